@@ -15,7 +15,6 @@
 package client
 
 import (
-	"encoding/json"
 	"github.com/logrange/logrange/pkg/forwarder"
 	"github.com/logrange/logrange/pkg/scanner"
 	"github.com/logrange/logrange/pkg/storage"
@@ -34,17 +33,22 @@ type (
 	}
 )
 
+// LoadCfgFromFile reads the config from the JSON or YAML file path (see
+// utils.UnmarshalCfg). The forwarder config is re-read from the same file.
 func LoadCfgFromFile(path string) (*Config, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	cfg := &Config{}
-	err = json.Unmarshal(data, cfg)
+	err = utils.UnmarshalCfg(path, data, cfg)
 	if err != nil {
 		return nil, err
 	}
 	if cfg.Forwarder != nil {
+		if err = cfg.Forwarder.Migrate(); err != nil {
+			return nil, err
+		}
 		cfg.Forwarder.ReloadFn = func() (*forwarder.Config, error) {
 			cfg, err := LoadCfgFromFile(path)
 			if err != nil {
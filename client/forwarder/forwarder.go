@@ -21,8 +21,12 @@ import (
 	"github.com/logrange/logrange/api"
 	"github.com/logrange/logrange/pkg/forwarder"
 	"github.com/logrange/logrange/pkg/storage"
+	"time"
 )
 
+// cShutdownTimeout is the time the forwarder has to send the buffered events on shutdown
+const cShutdownTimeout = 30 * time.Second
+
 func Run(ctx context.Context, cfg *forwarder.Config, cl api.Client, storg storage.Storage) error {
 	logger := log4g.GetLogger("forwarder")
 
@@ -31,11 +35,18 @@ func Run(ctx context.Context, cfg *forwarder.Config, cl api.Client, storg storag
 		return fmt.Errorf("failed to create forwarder, err=%v", err)
 	}
 
-	if err := fwd.Run(ctx); err != nil {
+	// the forwarder is not stopped by ctx, but shut down gracefully, so the
+	// buffered events are sent
+	if err := fwd.Run(context.Background()); err != nil {
 		return fmt.Errorf("failed to run forwarder, err=%v", err)
 	}
 
 	<-ctx.Done()
+	sctx, cancel := context.WithTimeout(context.Background(), cShutdownTimeout)
+	if err := fwd.Shutdown(sctx); err != nil {
+		logger.Warn("Failed to shut down gracefully, err=", err)
+	}
+	cancel()
 	_ = fwd.Close()
 
 	logger.Info("Shutdown.")
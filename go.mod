@@ -14,7 +14,9 @@ require (
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826
 	github.com/peterh/liner v1.1.0
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.1.0
 	github.com/stretchr/testify v1.3.0
 	gopkg.in/urfave/cli.v2 v2.0.0-20180128182452-d3ae77c26ac8
 	k8s.io/apimachinery v0.0.0-20190809020650-423f5d784010 // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
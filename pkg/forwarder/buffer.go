@@ -0,0 +1,216 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/api"
+	"sync"
+)
+
+type (
+	// bufEntry is a record kept in the buffer
+	bufEntry struct {
+		// orig contains the record as it was read (not transformed)
+		orig *api.LogEvent
+		// ev contains the record, which is sent to the sink
+		ev *api.LogEvent
+		// pos contains the position, which follows the record. It is set for
+		// the last record of the read batch only
+		pos string
+	}
+
+	// buffer is the bounded queue of the records read by the worker, which are
+	// not sent to the sink yet. When the buffer is full, the new records are
+	// handled according to the onFull policy (see WorkerConfig.OnFull).
+	buffer struct {
+		size   int
+		onFull string
+
+		lock    sync.Mutex
+		entries []bufEntry
+		dropped uint64
+		// putCh and takeCh are notified when the records are put to, or taken
+		// from the buffer
+		putCh  chan struct{}
+		takeCh chan struct{}
+	}
+)
+
+const (
+	// OnFullBlock is the WorkerConfig.OnFull policy, when the worker stops reading
+	// the records until the buffer has room for them
+	OnFullBlock = "block"
+	// OnFullDropOldest is the WorkerConfig.OnFull policy, when the oldest records
+	// of the buffer are dropped to make room for the new ones
+	OnFullDropOldest = "drop_oldest"
+	// OnFullDropNewest is the WorkerConfig.OnFull policy, when the new records are
+	// dropped, if the buffer has no room for them
+	OnFullDropNewest = "drop_newest"
+)
+
+func newBuffer(size int, onFull string) *buffer {
+	if onFull == "" {
+		onFull = OnFullBlock
+	}
+	b := new(buffer)
+	b.size = size
+	b.onFull = onFull
+	b.entries = make([]bufEntry, 0, size)
+	b.putCh = make(chan struct{}, 1)
+	b.takeCh = make(chan struct{}, 1)
+	return b
+}
+
+// put adds the records read to the buffer. The orig contains the records as they
+// were read, and the events contains the records to be sent, pos is the position
+// after the records. The OnFullBlock policy waits until the buffer has room
+// for every record, false is returned if ctx is closed or stopCh is closed while
+// waiting. The drop policies never wait.
+func (b *buffer) put(ctx context.Context, stopCh <-chan struct{}, orig, events []*api.LogEvent, pos string) bool {
+	if len(events) == 0 {
+		b.putPos(pos)
+		notify(b.putCh)
+		return true
+	}
+	for i, e := range events {
+		be := bufEntry{orig: orig[i], ev: e}
+		if i == len(events)-1 {
+			be.pos = pos
+		}
+		for !b.putEntry(be) {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-stopCh:
+				return false
+			case <-b.takeCh:
+			}
+		}
+		notify(b.putCh)
+	}
+	return true
+}
+
+// putPos is called when no records of a read batch are sent, the position
+// pos is reached when the buffered records are sent
+func (b *buffer) putPos(pos string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n := len(b.entries); n > 0 {
+		b.entries[n-1].pos = pos
+		return
+	}
+	// the entry with no records, it doesn't take the room
+	b.entries = append(b.entries, bufEntry{pos: pos})
+}
+
+// putEntry adds be to the buffer according to the onFull policy. It returns
+// false if the buffer is full and the policy is OnFullBlock.
+func (b *buffer) putEntry(be bufEntry) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, be)
+		return true
+	}
+
+	switch b.onFull {
+	case OnFullDropOldest:
+		head := b.entries[0]
+		b.entries[0] = bufEntry{}
+		b.entries = append(b.entries[1:], be)
+		// the records before the next one are gone, so its position is
+		// reached when the next one is sent
+		if head.pos != "" && b.entries[0].pos == "" {
+			b.entries[0].pos = head.pos
+		}
+	case OnFullDropNewest:
+		// the position of the dropped record is reached when the last
+		// buffered one is sent
+		if be.pos != "" {
+			b.entries[len(b.entries)-1].pos = be.pos
+		}
+	default:
+		return false
+	}
+	b.dropped++
+	return true
+}
+
+// take removes up to max records from the buffer and returns them with the
+// position, which is reached when they are sent (empty if the records don't
+// complete a read batch). It waits until the buffer has at least one record,
+// ok is false if ctx is closed or stopCh is closed while waiting.
+func (b *buffer) take(ctx context.Context, stopCh <-chan struct{}, max int) (orig, events []*api.LogEvent, pos string, ok bool) {
+	for {
+		b.lock.Lock()
+		n := len(b.entries)
+		if n > 0 {
+			break
+		}
+		b.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, "", false
+		case <-stopCh:
+			return nil, nil, "", false
+		case <-b.putCh:
+		}
+	}
+
+	n := len(b.entries)
+	if n > max {
+		n = max
+	}
+	orig = make([]*api.LogEvent, 0, n)
+	events = make([]*api.LogEvent, 0, n)
+	for _, be := range b.entries[:n] {
+		if be.ev != nil {
+			orig = append(orig, be.orig)
+			events = append(events, be.ev)
+		}
+		if be.pos != "" {
+			pos = be.pos
+		}
+	}
+	// the entries are moved, so the buffer doesn't grow
+	copy(b.entries, b.entries[n:])
+	for i := len(b.entries) - n; i < len(b.entries); i++ {
+		b.entries[i] = bufEntry{}
+	}
+	b.entries = b.entries[:len(b.entries)-n]
+	b.lock.Unlock()
+
+	notify(b.takeCh)
+	return orig, events, pos, true
+}
+
+// getDropped returns the number of records dropped because the buffer was full
+func (b *buffer) getDropped() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+// notify signals the channel ch without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
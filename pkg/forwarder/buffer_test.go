@@ -0,0 +1,203 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stalledSink doesn't accept the events until it is released
+type stalledSink struct {
+	testSink
+	calls   int32
+	release chan struct{}
+}
+
+func (ss *stalledSink) OnEvent(events []*api.LogEvent) error {
+	atomic.AddInt32(&ss.calls, 1)
+	<-ss.release
+	return ss.testSink.OnEvent(events)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	start := time.Now()
+	for !cond() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for ", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (tc *testClient) lastPos() string {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if len(tc.poss) == 0 {
+		return ""
+	}
+	return tc.poss[len(tc.poss)-1]
+}
+
+func (b *buffer) len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.entries)
+}
+
+func TestBufferCheck(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.BufferSize = 10
+	for _, p := range []string{"", OnFullBlock, OnFullDropOldest, OnFullDropNewest} {
+		wc.OnFull = p
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for OnFull=", p)
+		}
+	}
+
+	for _, p := range []string{"drop", "Block"} {
+		wc.OnFull = p
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for OnFull=", p)
+		}
+	}
+
+	wc.OnFull = ""
+	wc.BufferSize = -1
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for negative BufferSize")
+	}
+}
+
+func TestBufferPositions(t *testing.T) {
+	ctx := context.Background()
+	evs := newTestEvents(6)
+
+	b := newBuffer(4, OnFullDropOldest)
+	b.put(ctx, nil, evs[:3], evs[:3], "3")
+	b.put(ctx, nil, evs[3:], evs[3:], "6")
+	_, res, pos, ok := b.take(ctx, nil, 3)
+	if !ok || len(res) != 3 || res[0] != evs[2] || pos != "3" {
+		t.Fatal("expected 3 events from msg2 with pos 3, but ", res, ", pos=", pos)
+	}
+	if _, res, pos, _ = b.take(ctx, nil, 3); len(res) != 1 || res[0] != evs[5] || pos != "6" {
+		t.Fatal("expected msg5 with pos 6, but ", res, ", pos=", pos)
+	}
+
+	b = newBuffer(4, OnFullDropNewest)
+	b.put(ctx, nil, evs[:3], evs[:3], "3")
+	b.put(ctx, nil, evs[3:], evs[3:], "6")
+	if _, res, pos, _ = b.take(ctx, nil, 10); len(res) != 4 || res[3] != evs[3] || pos != "6" {
+		t.Fatal("expected 4 events till msg3 with pos 6, but ", res, ", pos=", pos)
+	}
+	if b.getDropped() != 2 {
+		t.Fatal("expected 2 dropped, but ", b.getDropped())
+	}
+}
+
+func testBufferPolicy(t *testing.T, onFull string) (*worker, *stalledSink, *testClient, func()) {
+	tc := &testClient{events: newTestEvents(100), limit: 5}
+	ss := &stalledSink{release: make(chan struct{})}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.BufferSize = 10
+	wc.OnFull = onFull
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, ss)
+	waitFor(t, "the sink is called", func() bool { return atomic.LoadInt32(&ss.calls) == 1 })
+	return w, ss, tc, func() {
+		cancel()
+		wait()
+	}
+}
+
+func TestBufferBlock(t *testing.T) {
+	w, ss, tc, stop := testBufferPolicy(t, OnFullBlock)
+	defer stop()
+
+	waitFor(t, "the buffer is full", func() bool { return w.buf.len() == 10 })
+	time.Sleep(50 * time.Millisecond)
+	read, _ := strconv.Atoi(tc.lastPos())
+	if read >= 100 || w.buf.len() != 10 {
+		t.Fatal("the reading must be blocked, but ", read, " events read, buffered ", w.buf.len())
+	}
+
+	close(ss.release)
+	waitCount(t, &ss.testSink, 100)
+	for i, e := range ss.events {
+		if e.Message != fmt.Sprintf("msg%d\n", i) {
+			t.Fatal("expected msg", i, ", but ", e.Message)
+		}
+	}
+	waitFor(t, "the position is moved", func() bool { return w.getDesc().getPosition() == "100" })
+	if w.getDropped() != 0 {
+		t.Fatal("no events must be dropped, but ", w.getDropped())
+	}
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	w, ss, tc, stop := testBufferPolicy(t, OnFullDropOldest)
+	defer stop()
+
+	waitFor(t, "all the events are read", func() bool { return tc.lastPos() == "100" })
+	close(ss.release)
+	waitFor(t, "the position is moved", func() bool { return w.getDesc().getPosition() == "100" })
+
+	n := ss.count()
+	if uint64(n)+w.getDropped() != 100 || n < 10 {
+		t.Fatal("expected 100 events sent or dropped, but sent ", n, ", dropped ", w.getDropped())
+	}
+	// the first batch could be taken by the sink before the buffer is full,
+	// and the newest events are buffered
+	for i, e := range ss.events[n-10:] {
+		if e.Message != fmt.Sprintf("msg%d\n", 90+i) {
+			t.Fatal("expected msg", 90+i, ", but ", e.Message)
+		}
+	}
+	if n > 10 && ss.events[0].Message != "msg0\n" {
+		t.Fatal("expected msg0, but ", ss.events[0].Message)
+	}
+}
+
+func TestBufferDropNewest(t *testing.T) {
+	w, ss, tc, stop := testBufferPolicy(t, OnFullDropNewest)
+	defer stop()
+
+	waitFor(t, "all the events are read", func() bool { return tc.lastPos() == "100" })
+	close(ss.release)
+	waitFor(t, "the position is moved", func() bool { return w.getDesc().getPosition() == "100" })
+
+	n := ss.count()
+	if uint64(n)+w.getDropped() != 100 || n < 10 {
+		t.Fatal("expected 100 events sent or dropped, but sent ", n, ", dropped ", w.getDropped())
+	}
+	// the oldest events are sent
+	for i, e := range ss.events {
+		if e.Message != fmt.Sprintf("msg%d\n", i) {
+			t.Fatal("expected msg", i, ", but ", e.Message)
+		}
+	}
+
+	var ws WorkerStatus
+	w.fillStatus(&ws)
+	if ws.Dropped != w.getDropped() {
+		t.Fatal("expected Dropped=", w.getDropped(), ", but ", ws.Dropped)
+	}
+}
@@ -15,14 +15,18 @@
 package forwarder
 
 import (
+	"context"
 	"fmt"
+	"github.com/jrivets/log4g"
 	"github.com/logrange/logrange/pkg/forwarder/sink"
-	"github.com/logrange/logrange/pkg/lql"
+	"github.com/logrange/logrange/pkg/tindex"
 	"github.com/logrange/logrange/pkg/utils"
+	"github.com/logrange/logrange/pkg/utils/kvstring"
 	"github.com/mohae/deepcopy"
 	"reflect"
-	"regexp/syntax"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type (
@@ -34,7 +38,14 @@ type (
 		// The value could be empty - app partitions
 		From string
 		// Filter contains an expression for filtering records (true means record is taken).
-		// The value could be empty - all records match
+		// The value could be empty (or contain spaces only) - all records match, the
+		// filtering is skipped then. The value is an lql WHERE condition, which
+		// could refer the record fields and tags, e.g. `msg contains "error" AND
+		// fields:level = "warn"`, it is evaluated by the pipe. Only when the whole
+		// value is a string literal, e.g. 'timeout|refused', it is a regular
+		// expression (RE2 syntax), which is matched against the record message,
+		// it is evaluated by the worker then. The single quoted literal is taken
+		// as is, and the double quoted one could contain escape sequences.
 		Filter string
 	}
 
@@ -45,62 +56,278 @@ type (
 		Name string
 		// Pipe describes the source, where records will be taken
 		Pipe *PipeConfig
-		// Sink describes the destination, where records will be written
+		// Sink describes the destination, where records will be written. It is kept
+		// for the compatibility, and it is considered as the first one of Sinks
 		Sink *sink.Config
+		// Sinks describes several destinations, every record is written to all
+		// of them. The position is moved when all the sinks accepted the records.
+		Sinks []*sink.Config
+		// Retry describes how the retryable sink errors are retried (see sink.IsRetryable).
+		// The value could be nil - NewDefaultRetryConfig() is used then
+		Retry *RetryConfig
+		// RateLimit limits the rate the events are sent to the sink with. The value
+		// could be nil - no limits
+		RateLimit *RateLimitConfig
+		// Enabled defines whether the worker is started. A disabled worker is still
+		// checked and keeps its position. The value could be nil - the worker is enabled
+		Enabled *bool
+		// DeliveryMode defines when the worker position is committed, DeliveryAtLeastOnce
+		// if empty. See DeliveryAtLeastOnce and DeliveryAtMostOnce
+		DeliveryMode string
+		// Transform contains the text/template, which is applied to every record before
+		// it is sent to the sink. The template result replaces the record message. The
+		// template data contains the record Timestamp, Time, Message, Tags and Fields
+		// (the last two are maps), e.g. `{{.Tags.app}}: {{.Message}}`. The value could
+		// be empty - the records are sent as is
+		Transform string
+		// Extract contains the regexp with the named groups, which is matched against
+		// the record message. The groups values are available in the Transform
+		// template as the Caps map, e.g. `(?P<level>[A-Z]+): ` and `{{.Caps.level}}`.
+		// The Caps map is empty for the records, which messages don't match. If the
+		// value is empty, the named groups of the Pipe Filter regexp (if the Filter
+		// is a string literal) are used. The value requires Transform.
+		Extract string
+		// Format defines how the records are encoded before they are sent to the sink
+		// (after the Transform is applied), it could be FormatRaw, FormatJSON or
+		// FormatLogfmt. The JSON and logfmt records contain the record timestamp,
+		// source tags, fields and message. The value could be empty - FormatRaw then
+		Format string
+		// IncludeTags defines whether the record source tags are sent to the sink.
+		// The tags are added to the record fields, and the FormatRaw messages are
+		// prefixed by the tags line in square brackets, like `[app=a] msg`
+		IncludeTags bool
+		// TagsPrefix is added to the tag names, when IncludeTags is set, so the tags
+		// don't clash with the record fields, e.g. "tag_". The value could be empty
+		TagsPrefix string
+		// DeadLetter describes the destination, where the records, which could not be
+		// sent when the retries are over, are written with the error in the
+		// DeadLetterErrorField field. The records are not sent to the DeadLetter
+		// sink transformed. The value could be nil - the worker retries the records
+		// until they are sent then (or drops them in the DeliveryAtMostOnce mode)
+		DeadLetter *sink.Config
+		// BufferSize contains the maximum number of records, which are read, but not
+		// sent to the sink yet. The records are read while the sink is busy until
+		// the buffer is full. The value could be 0 - no buffer, the worker reads
+		// the next records when the previous ones are sent then
+		BufferSize int
+		// OnFull defines what happens with the read records, when the buffer is full,
+		// it could be OnFullBlock, OnFullDropOldest or OnFullDropNewest. The value
+		// could be empty - OnFullBlock then
+		OnFull string
+		// Concurrency contains the number of the writers, which send the buffered
+		// records to the sinks in parallel, it requires BufferSize > 0. Every writer
+		// sends up to BufferSize/Concurrency records at once, and the position is
+		// moved when all the records before it are sent. The writers share the
+		// sinks, so the sinks, which send the records one by one (file, syslog),
+		// are not faster. The value could be 0 - 1 writer then
+		Concurrency int
+		// PreserveOrder defines whether the records of one source are sent in the
+		// order they are read, when Concurrency > 1. The records are split between
+		// the writers by their sources then, so the records of one source are
+		// sent by the same writer
+		PreserveOrder bool
+		// MaxLineBytes contains the maximum size of a record message in bytes. The
+		// limit is applied after the Transform, but before the record is encoded
+		// by the Format. The value could be 0 - no limit
+		MaxLineBytes int
+		// OnOversize defines what happens with the records, which messages exceed
+		// MaxLineBytes, it could be OnOversizeTruncate, OnOversizeDrop or
+		// OnOversizeSplit. The value could be empty - OnOversizeTruncate then
+		OnOversize string
+		// StartFrom defines where a new worker, which has no saved position, starts
+		// reading its source from. It could be StartFromBeginning, StartFromTail (only
+		// the records written after the worker start are forwarded), or the RFC3339
+		// timestamp, e.g. "2019-08-01T00:00:00Z". The records with the timestamps
+		// before it are not forwarded then, even after the worker is restarted. The
+		// value could be empty - StartFromBeginning then
+		StartFrom string
+	}
+
+	// RateLimitConfig struct contains the worker rate limits. When a limit is reached,
+	// the worker waits, no events are dropped.
+	RateLimitConfig struct {
+		// RecordsPerSec contains the maximum number of records sent per second, 0 - no limit
+		RecordsPerSec int
+		// BytesPerSec contains the maximum number of the records messages bytes sent
+		// per second, 0 - no limit
+		BytesPerSec int
+	}
+
+	// RetryConfig struct contains settings for retrying the sink writes. The same events
+	// are sent to the sink again after the backoff, if the sink returns a retryable
+	// error. When the attempts are over, or the error is not retryable, the worker
+	// reads the events again after a pause.
+	RetryConfig struct {
+		// MaxAttempts contains the maximum number of attempts to send the same events,
+		// including the first one
+		MaxAttempts int
+		// InitialBackoffMs contains the pause before the first retry in milliseconds
+		InitialBackoffMs int
+		// MaxBackoffMs contains the maximum pause between retries in milliseconds
+		MaxBackoffMs int
+		// Multiplier defines how the pause grows with every retry
+		Multiplier float64
+	}
+
+	// ClusterConfig struct contains the settings of the forwarder node, which runs
+	// in a cluster of forwarders with the same workers. The records of every journal
+	// (source) are forwarded by the nodes owning it only (see JournalRouter), so the
+	// nodes don't forward the same records.
+	ClusterConfig struct {
+		// NodeID contains the identity of the node, it must be one of Nodes
+		NodeID string
+		// Nodes contains the identities of all the nodes of the cluster
+		Nodes []string
+		// ReplicationFactor contains the number of nodes every journal is forwarded
+		// by, 1 by default. The values > 1 make the journals records to be forwarded
+		// several times, but they are forwarded while one of the owners is running.
+		ReplicationFactor int
+		// VirtualNodes contains the number of the hash ring points of every node,
+		// 256 by default. More points distribute the journals more evenly.
+		VirtualNodes int
 	}
 
 	// Config struct contains the comprehensive forwarder configuration. It describes
 	// workers, and some common parameters
 	Config struct {
+		// Version contains the config schema version. The configs of older versions
+		// are upgraded by Migrate, the value could be 0 for the configs written before
+		// the versioning, they are considered as ConfigVersion1.
+		Version int
 		// Workers slice contains configuration for all workers
 		Workers []*WorkerConfig
 		// StateStoreIntervalSec the number of seconds between saving state calls
 		StateStoreIntervalSec int
 		// SyncWorkersIntervalSec the number of second between re-checking configurations (files)
 		SyncWorkersIntervalSec int
+		// TickerJitterPct defines the percentage (0..50) the StateStoreIntervalSec and
+		// SyncWorkersIntervalSec are randomly spread by, every interval is chosen in
+		// [interval - interval*TickerJitterPct/100, interval + interval*TickerJitterPct/100].
+		// It desynchronizes the forwarders started at the same time, so they don't
+		// load the config source and the storage at the same moments. No jitter if 0.
+		TickerJitterPct int
+		// Cluster contains the cluster settings of the forwarder node, nil if the
+		// forwarder forwards all the journals
+		Cluster *ClusterConfig
 		// ReloadFn the function which is called for re-load the config (Read from a file, for instance)
 		ReloadFn func() (*Config, error) `json:"-"`
 	}
 )
 
+const (
+	// DeliveryAtLeastOnce is the WorkerConfig.DeliveryMode, when the position is
+	// committed after the sink accepted the events. The events could be sent twice
+	// (after a crash, or a sink error), but they are not lost.
+	DeliveryAtLeastOnce = "at_least_once"
+	// DeliveryAtMostOnce is the WorkerConfig.DeliveryMode, when the position is
+	// persisted before the events are sent to the sink. The events are sent once,
+	// the events are lost, if the sink fails to accept them, or the forwarder
+	// crashes while sending.
+	DeliveryAtMostOnce = "at_most_once"
+
+	// ConfigVersion1 is the Config.Version of the first config schema, which
+	// doesn't have the workers retries, rate limits, delivery modes, formats etc.
+	ConfigVersion1 = 1
+	// ConfigVersion is the Config.Version of the current config schema
+	ConfigVersion = 2
+
+	// cMaxTickerJitterPct is the maximum Config.TickerJitterPct value
+	cMaxTickerJitterPct = 50
+
+	// StartFromBeginning is the WorkerConfig.StartFrom, when a new worker forwards
+	// all the records of its source
+	StartFromBeginning = "beginning"
+	// StartFromTail is the WorkerConfig.StartFrom, when a new worker forwards only
+	// the records written after it is started
+	StartFromTail = "tail"
+
+	// DeadLetterErrorField is the field, which contains the sink error of the
+	// records written to the WorkerConfig.DeadLetter sink
+	DeadLetterErrorField = "forwarder_error"
+)
+
 //===================== config =====================
 
 // NewDefaultConfig creates a new instance of Config with default values
 func NewDefaultConfig() *Config {
 	return &Config{
+		Version:                ConfigVersion,
 		Workers:                []*WorkerConfig{},
 		StateStoreIntervalSec:  10,
 		SyncWorkersIntervalSec: 20,
 	}
 }
 
-// Apply allows to overwrite existing values by the other config provided
+// NewDefaultRetryConfig creates a new instance of RetryConfig with default values
+func NewDefaultRetryConfig() *RetryConfig {
+	return &RetryConfig{
+		MaxAttempts:      5,
+		InitialBackoffMs: 100,
+		MaxBackoffMs:     5000,
+		Multiplier:       2,
+	}
+}
+
+// Apply allows to overwrite existing values by the other config provided. The workers
+// are reconciled by their names: the unchanged workers configs are kept as is, the
+// modified and added ones are copied from other, and the ones which are not in other
+// are removed.
 func (c *Config) Apply(other *Config) {
 	if other == nil {
 		return
 	}
+	if other.Version != 0 {
+		c.Version = other.Version
+	}
 	if other.StateStoreIntervalSec != 0 {
 		c.StateStoreIntervalSec = other.StateStoreIntervalSec
 	}
 	if other.SyncWorkersIntervalSec != 0 {
 		c.SyncWorkersIntervalSec = other.SyncWorkersIntervalSec
 	}
+	c.TickerJitterPct = other.TickerJitterPct
+	c.Cluster = other.Cluster
 	if other.Workers != nil {
-		c.Workers = deepcopy.Copy(other.Workers).([]*WorkerConfig)
+		c.Workers = mergeWorkers(c.Workers, other.Workers)
 	}
 	if other.ReloadFn != nil {
 		c.ReloadFn = other.ReloadFn
 	}
 }
 
+// Validate performs Check and validates the workers against the index ts, if it
+// is not nil (see WorkerConfig.Validate). The disabled workers are validated too.
+func (c *Config) Validate(ctx context.Context, ts tindex.Service) error {
+	if err := c.Check(); err != nil {
+		return err
+	}
+	for _, w := range c.Workers {
+		if err := w.Validate(ctx, ts); err != nil {
+			return fmt.Errorf("invalid Worker=%v: %v", w, err)
+		}
+	}
+	return nil
+}
+
 // Check performs a parameter checks and returns an error if they are not acceptable
 func (c *Config) Check() error {
+	if c.Version < 0 || c.Version > ConfigVersion {
+		return fmt.Errorf("invalid Version=%v, must be in [0..%d]", c.Version, ConfigVersion)
+	}
 	if c.StateStoreIntervalSec <= 0 {
 		return fmt.Errorf("invalid StateStoreIntervalSec=%v, must be > 0sec", c.StateStoreIntervalSec)
 	}
 	if c.SyncWorkersIntervalSec <= 0 {
 		return fmt.Errorf("invalid SyncWorkersIntervalSec=%v, must be > 0sec", c.SyncWorkersIntervalSec)
 	}
+	if c.TickerJitterPct < 0 || c.TickerJitterPct > cMaxTickerJitterPct {
+		return fmt.Errorf("invalid TickerJitterPct=%v, must be in [0..%d]", c.TickerJitterPct, cMaxTickerJitterPct)
+	}
+	if c.Cluster != nil {
+		if err := c.Cluster.Check(); err != nil {
+			return fmt.Errorf("invalid Cluster=%v: %v", c.Cluster, err)
+		}
+	}
 
 	wNames := make(map[string]bool)
 	for _, w := range c.Workers {
@@ -117,25 +344,170 @@ func (c *Config) Check() error {
 	return nil
 }
 
+// Migrate upgrades the config of an older Version to the ConfigVersion. The new
+// fields, which are not set, are filled by their default values, so the config
+// behaves the same way. An error is returned if the config Version is newer than
+// ConfigVersion.
+func (c *Config) Migrate() error {
+	if c.Version > ConfigVersion {
+		return fmt.Errorf("the config Version=%d is not supported, the newest supported version is %d", c.Version, ConfigVersion)
+	}
+	if c.Version < 0 {
+		return fmt.Errorf("invalid Version=%v, must be in [0..%d]", c.Version, ConfigVersion)
+	}
+	if c.Version == 0 {
+		c.Version = ConfigVersion1
+	}
+
+	if c.Version == ConfigVersion1 {
+		dc := NewDefaultConfig()
+		if c.StateStoreIntervalSec == 0 {
+			c.StateStoreIntervalSec = dc.StateStoreIntervalSec
+		}
+		if c.SyncWorkersIntervalSec == 0 {
+			c.SyncWorkersIntervalSec = dc.SyncWorkersIntervalSec
+		}
+		for _, w := range c.Workers {
+			if w == nil {
+				continue
+			}
+			if w.Retry == nil {
+				w.Retry = NewDefaultRetryConfig()
+			}
+			if w.DeliveryMode == "" {
+				w.DeliveryMode = DeliveryAtLeastOnce
+			}
+			if w.Format == "" {
+				w.Format = FormatRaw
+			}
+		}
+		c.Version = ConfigVersion
+	}
+	return nil
+}
+
+// mergeWorkers returns the workers list in the order of nws. The workers from ows,
+// which have the same config in nws, are kept, others are copied from nws.
+func mergeWorkers(ows, nws []*WorkerConfig) []*WorkerConfig {
+	old := make(map[string]*WorkerConfig, len(ows))
+	for _, w := range ows {
+		old[w.Name] = w
+	}
+
+	res := make([]*WorkerConfig, 0, len(nws))
+	for _, nw := range nws {
+		if ow, ok := old[nw.Name]; ok && reflect.DeepEqual(ow, nw) {
+			res = append(res, ow)
+			continue
+		}
+		res = append(res, deepcopy.Copy(nw).(*WorkerConfig))
+	}
+	return res
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the string fields of the workers
+// configuration by the environment variables values (see utils.ExpandEnv)
+func (c *Config) ExpandEnv() error {
+	if c.Cluster != nil {
+		if err := c.Cluster.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Cluster=%v: %v", c.Cluster, err)
+		}
+	}
+	for _, w := range c.Workers {
+		if err := w.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Worker=%v: %v", w, err)
+		}
+	}
+	return nil
+}
+
 // Reload refresh and can update the Config c instance values
 func (c *Config) Reload() (bool, error) {
-	var (
-		err error
-		nc  *Config
-	)
-	if c.ReloadFn != nil {
-		nc, err = c.ReloadFn()
-		if err == nil {
-			if !c.Equals(nc) {
-				err = nc.Check()
-				if err == nil {
-					c.Apply(nc)
-					return true, nil
-				}
-			}
+	return c.ReloadWith(nil)
+}
+
+// ReloadWith reads the new config by ReloadFn, and if it differs from c, calls
+// prepare for the candidate config, which is a copy of c with the new config
+// applied. The new config is applied to c only if prepare returns no error, so
+// c keeps the old values, if the candidate could not be run. prepare could be nil.
+func (c *Config) ReloadWith(prepare func(cand *Config) error) (bool, error) {
+	if c.ReloadFn == nil {
+		return false, nil
+	}
+	nc, err := c.ReloadFn()
+	if err == nil {
+		err = nc.ExpandEnv()
+	}
+	if err != nil || c.Equals(nc) {
+		return false, err
+	}
+
+	diff, err := c.Diff(nc)
+	if err != nil {
+		return false, err
+	}
+	if prepare != nil {
+		cand := deepcopy.Copy(c).(*Config)
+		cand.Apply(nc)
+		if err = prepare(cand); err != nil {
+			return false, fmt.Errorf("the new config is rejected; %v", err)
 		}
 	}
-	return false, err
+
+	logger := log4g.GetLogger("forwarder.config")
+	for _, d := range diff {
+		logger.Info("Reload: ", d)
+	}
+	c.Apply(nc)
+	return true, nil
+}
+
+// Diff checks the other config and returns the human readable list of changes, which
+// are made if other is applied to c: the common parameters changed, the workers added,
+// removed or modified. The workers are matched by their names, and the modified
+// workers are reported field by field. It allows to validate a config without
+// running it.
+func (c *Config) Diff(other *Config) ([]string, error) {
+	if other == nil {
+		return nil, fmt.Errorf("the config to compare with must be non-nil")
+	}
+	if err := other.Check(); err != nil {
+		return nil, err
+	}
+
+	var res []string
+	if c.StateStoreIntervalSec != other.StateStoreIntervalSec {
+		res = append(res, fmt.Sprintf("StateStoreIntervalSec: %d -> %d", c.StateStoreIntervalSec, other.StateStoreIntervalSec))
+	}
+	if c.SyncWorkersIntervalSec != other.SyncWorkersIntervalSec {
+		res = append(res, fmt.Sprintf("SyncWorkersIntervalSec: %d -> %d", c.SyncWorkersIntervalSec, other.SyncWorkersIntervalSec))
+	}
+	if c.TickerJitterPct != other.TickerJitterPct {
+		res = append(res, fmt.Sprintf("TickerJitterPct: %d -> %d", c.TickerJitterPct, other.TickerJitterPct))
+	}
+	if !reflect.DeepEqual(c.Cluster, other.Cluster) {
+		res = append(res, fmt.Sprintf("Cluster: %v -> %v", c.Cluster, other.Cluster))
+	}
+
+	old := make(map[string]*WorkerConfig, len(c.Workers))
+	for _, w := range c.Workers {
+		old[w.Name] = w
+	}
+	for _, nw := range other.Workers {
+		ow, ok := old[nw.Name]
+		if !ok {
+			res = append(res, fmt.Sprintf("added worker %s: %v", nw.Name, nw))
+			continue
+		}
+		delete(old, nw.Name)
+		res = append(res, ow.diff(nw)...)
+	}
+	for _, w := range c.Workers {
+		if _, ok := old[w.Name]; ok {
+			res = append(res, fmt.Sprintf("removed worker %s", w.Name))
+		}
+	}
+	return res, nil
 }
 
 // Equals returns true if the Config c has same field values as other
@@ -146,6 +518,8 @@ func (c *Config) Equals(other *Config) bool {
 
 	return c.StateStoreIntervalSec == other.StateStoreIntervalSec &&
 		c.SyncWorkersIntervalSec == other.SyncWorkersIntervalSec &&
+		c.TickerJitterPct == other.TickerJitterPct &&
+		reflect.DeepEqual(c.Cluster, other.Cluster) &&
 		reflect.DeepEqual(c.Workers, other.Workers)
 }
 
@@ -163,27 +537,382 @@ func (wc *WorkerConfig) Check() error {
 	if wc.Pipe == nil {
 		return fmt.Errorf("invalid Pipe=%v, must be non-nil", wc.Pipe)
 	}
-	if wc.Sink == nil {
-		return fmt.Errorf("invalid Sink=%v, must be non-nil", wc.Sink)
+	if wc.Sink == nil && len(wc.Sinks) == 0 {
+		return fmt.Errorf("invalid Sink=%v and Sinks=%v, at least one sink must be set", wc.Sink, wc.Sinks)
 	}
 
 	err := wc.Pipe.Check()
 	if err != nil {
 		return fmt.Errorf("invalid Pipe=%v: %v", wc.Pipe, err)
 	}
-	err = wc.Sink.Check()
-	if err != nil {
-		return fmt.Errorf("invalid Sink=%v: %v", wc.Sink, err)
+	if wc.Sink != nil {
+		if err = wc.Sink.Check(); err != nil {
+			return fmt.Errorf("invalid Sink=%v: %v", wc.Sink, err)
+		}
+	}
+	for i, s := range wc.Sinks {
+		if s == nil {
+			return fmt.Errorf("invalid Sinks[%d]=%v, must be non-nil", i, s)
+		}
+		if err = s.Check(); err != nil {
+			return fmt.Errorf("invalid Sinks[%d]=%v: %v", i, s, err)
+		}
+	}
+	if wc.Retry != nil {
+		if err = wc.Retry.Check(); err != nil {
+			return fmt.Errorf("invalid Retry=%v: %v", wc.Retry, err)
+		}
+	}
+	if wc.RateLimit != nil {
+		if err = wc.RateLimit.Check(); err != nil {
+			return fmt.Errorf("invalid RateLimit=%v: %v", wc.RateLimit, err)
+		}
+	}
+	switch wc.DeliveryMode {
+	case "", DeliveryAtLeastOnce, DeliveryAtMostOnce:
+	default:
+		return fmt.Errorf("invalid DeliveryMode=%v, must be %v or %v", wc.DeliveryMode,
+			DeliveryAtLeastOnce, DeliveryAtMostOnce)
+	}
+	if wc.Transform != "" {
+		if _, err = compileTransform(wc.Transform); err != nil {
+			return fmt.Errorf("invalid Transform=%v: %v", wc.Transform, err)
+		}
+	}
+	if wc.Extract != "" {
+		re, err := regexp.Compile(wc.Extract)
+		if err != nil {
+			return fmt.Errorf("invalid Extract=%v: %v", wc.Extract, err)
+		}
+		if !hasNamedGroups(re) {
+			return fmt.Errorf("invalid Extract=%v, must contain the named groups, e.g. (?P<level>[A-Z]+)", wc.Extract)
+		}
+		if wc.Transform == "" {
+			return fmt.Errorf("invalid Extract=%v, the Transform must be non-empty to use it", wc.Extract)
+		}
+	}
+	switch wc.Format {
+	case "", FormatRaw, FormatJSON, FormatLogfmt:
+	default:
+		return fmt.Errorf("invalid Format=%v, must be %v, %v or %v", wc.Format,
+			FormatRaw, FormatJSON, FormatLogfmt)
+	}
+	if strings.ContainsAny(wc.TagsPrefix, kvstring.KeyValueSeparator+kvstring.FieldsSeparator+"\"{} ") {
+		return fmt.Errorf("invalid TagsPrefix=%v, must not contain spaces, quotes, curly braces, %q or %q", wc.TagsPrefix,
+			kvstring.KeyValueSeparator, kvstring.FieldsSeparator)
+	}
+	if wc.DeadLetter != nil {
+		if err = wc.DeadLetter.Check(); err != nil {
+			return fmt.Errorf("invalid DeadLetter=%v: %v", wc.DeadLetter, err)
+		}
+	}
+	if wc.BufferSize < 0 {
+		return fmt.Errorf("invalid BufferSize=%v, must be >= 0", wc.BufferSize)
+	}
+	switch wc.OnFull {
+	case "", OnFullBlock, OnFullDropOldest, OnFullDropNewest:
+	default:
+		return fmt.Errorf("invalid OnFull=%v, must be %v, %v or %v", wc.OnFull,
+			OnFullBlock, OnFullDropOldest, OnFullDropNewest)
+	}
+	if wc.Concurrency < 0 {
+		return fmt.Errorf("invalid Concurrency=%v, must be >= 1, or 0 for 1 writer", wc.Concurrency)
+	}
+	if wc.Concurrency > 1 && wc.BufferSize == 0 {
+		return fmt.Errorf("invalid Concurrency=%v, BufferSize must be set for more than 1 writer", wc.Concurrency)
+	}
+	if wc.MaxLineBytes < 0 {
+		return fmt.Errorf("invalid MaxLineBytes=%v, must be > 0, or 0 for no limit", wc.MaxLineBytes)
+	}
+	switch wc.OnOversize {
+	case "", OnOversizeTruncate, OnOversizeDrop, OnOversizeSplit:
+	default:
+		return fmt.Errorf("invalid OnOversize=%v, must be %v, %v or %v", wc.OnOversize,
+			OnOversizeTruncate, OnOversizeDrop, OnOversizeSplit)
+	}
+	switch wc.StartFrom {
+	case "", StartFromBeginning, StartFromTail:
+	default:
+		if _, err = time.Parse(time.RFC3339, wc.StartFrom); err != nil {
+			return fmt.Errorf("invalid StartFrom=%v, must be %v, %v or RFC3339 timestamp", wc.StartFrom,
+				StartFromBeginning, StartFromTail)
+		}
+	}
+
+	return nil
+}
+
+// Validate performs Check and validates the wc Pipe against the index ts, if
+// it is not nil (see PipeConfig.Validate)
+func (wc *WorkerConfig) Validate(ctx context.Context, ts tindex.Service) error {
+	if err := wc.Check(); err != nil {
+		return err
 	}
+	if err := wc.Pipe.Validate(ctx, ts); err != nil {
+		return fmt.Errorf("invalid Pipe=%v: %v", wc.Pipe, err)
+	}
+	return nil
+}
 
+// ExpandEnv replaces the ${VAR} placeholders in the string fields of wc, its
+// Pipe and Sink by the environment variables values
+func (wc *WorkerConfig) ExpandEnv() (err error) {
+	if wc.Name, err = utils.ExpandEnv(wc.Name); err != nil {
+		return fmt.Errorf("invalid Name=%v: %v", wc.Name, err)
+	}
+	if wc.Pipe != nil {
+		if err = wc.Pipe.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Pipe=%v: %v", wc.Pipe, err)
+		}
+	}
+	if wc.Sink != nil {
+		if err = wc.Sink.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Sink=%v: %v", wc.Sink, err)
+		}
+	}
+	for i, s := range wc.Sinks {
+		if s == nil {
+			continue
+		}
+		if err = s.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Sinks[%d]=%v: %v", i, s, err)
+		}
+	}
+	if wc.DeadLetter != nil {
+		if err = wc.DeadLetter.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid DeadLetter=%v: %v", wc.DeadLetter, err)
+		}
+	}
 	return nil
 }
 
+// diff returns the list of wc fields which have different values in other
+func (wc *WorkerConfig) diff(other *WorkerConfig) []string {
+	var res []string
+	ov, nv := reflect.ValueOf(wc).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		of, nf := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(of, nf) {
+			res = append(res, fmt.Sprintf("modified worker %s: %s %s -> %s", wc.Name,
+				ov.Type().Field(i).Name, utils.ToJsonStr(of), utils.ToJsonStr(nf)))
+		}
+	}
+	return res
+}
+
+// getRetry returns the Retry config or the default one, if it is not set
+func (wc *WorkerConfig) getRetry() *RetryConfig {
+	if wc.Retry == nil {
+		return NewDefaultRetryConfig()
+	}
+	return wc.Retry
+}
+
+// getConcurrency returns the number of the writers, which send the buffered records
+func (wc *WorkerConfig) getConcurrency() int {
+	if wc.Concurrency < 1 {
+		return 1
+	}
+	return wc.Concurrency
+}
+
+// getSinks returns the Sink (if set) followed by the Sinks
+func (wc *WorkerConfig) getSinks() []*sink.Config {
+	if wc.Sink == nil {
+		return wc.Sinks
+	}
+	return append([]*sink.Config{wc.Sink}, wc.Sinks...)
+}
+
+// getStartPos returns the position, which the worker with no saved position
+// starts from
+func (wc *WorkerConfig) getStartPos() string {
+	if wc.StartFrom == StartFromTail {
+		return "tail"
+	}
+	return ""
+}
+
+// getStartTime returns the StartFrom timestamp, ok is false if StartFrom is
+// not a timestamp
+func (wc *WorkerConfig) getStartTime() (tm time.Time, ok bool) {
+	switch wc.StartFrom {
+	case "", StartFromBeginning, StartFromTail:
+		return tm, false
+	}
+	tm, err := time.Parse(time.RFC3339, wc.StartFrom)
+	return tm, err == nil
+}
+
+// isAtMostOnce returns whether the worker DeliveryMode is DeliveryAtMostOnce
+func (wc *WorkerConfig) isAtMostOnce() bool {
+	return wc.DeliveryMode == DeliveryAtMostOnce
+}
+
+// isEnabled returns whether the worker should be started
+func (wc *WorkerConfig) isEnabled() bool {
+	return wc.Enabled == nil || *wc.Enabled
+}
+
+// equalsIgnoreEnabled returns whether wc and other are the same except the
+// Enabled field
+func (wc *WorkerConfig) equalsIgnoreEnabled(other *WorkerConfig) bool {
+	w1, w2 := *wc, *other
+	w1.Enabled, w2.Enabled = nil, nil
+	return reflect.DeepEqual(&w1, &w2)
+}
+
+// equalsIgnoreSinks returns whether wc and other are the same except the Sink,
+// Sinks and DeadLetter fields, so the worker could continue with the other
+// sinks (see Forwarder.replaceSinks)
+func (wc *WorkerConfig) equalsIgnoreSinks(other *WorkerConfig) bool {
+	w1, w2 := *wc, *other
+	w1.Sink, w2.Sink = nil, nil
+	w1.Sinks, w2.Sinks = nil, nil
+	w1.DeadLetter, w2.DeadLetter = nil, nil
+	return reflect.DeepEqual(&w1, &w2)
+}
+
+// getExtractRegexp returns the regexp, which named groups are available in the
+// Transform template (see Extract), or nil if there is no such regexp
+func (wc *WorkerConfig) getExtractRegexp() *regexp.Regexp {
+	if wc.Extract != "" {
+		// the config is checked, so the regexp is valid
+		re, _ := regexp.Compile(wc.Extract)
+		return re
+	}
+	if re := wc.Pipe.getMsgRegexp(); re != nil && hasNamedGroups(re) {
+		return re
+	}
+	return nil
+}
+
+// hasNamedGroups returns whether the regexp re has at least one named group
+func hasNamedGroups(re *regexp.Regexp) bool {
+	for _, n := range re.SubexpNames() {
+		if n != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // String is fmt.Stringer implementation
 func (wc *WorkerConfig) String() string {
 	return utils.ToJsonStr(wc)
 }
 
+//===================== retryConfig =====================
+
+// Check performs an internal check for RetryConfig fields
+func (rc *RetryConfig) Check() error {
+	if rc.MaxAttempts <= 0 {
+		return fmt.Errorf("invalid MaxAttempts=%v, must be > 0", rc.MaxAttempts)
+	}
+	if rc.InitialBackoffMs <= 0 {
+		return fmt.Errorf("invalid InitialBackoffMs=%v, must be > 0ms", rc.InitialBackoffMs)
+	}
+	if rc.MaxBackoffMs < rc.InitialBackoffMs {
+		return fmt.Errorf("invalid MaxBackoffMs=%v, must be >= InitialBackoffMs", rc.MaxBackoffMs)
+	}
+	if rc.Multiplier < 1 {
+		return fmt.Errorf("invalid Multiplier=%v, must be >= 1", rc.Multiplier)
+	}
+	return nil
+}
+
+// nextBackoff returns the pause which follows the pause bo
+func (rc *RetryConfig) nextBackoff(bo time.Duration) time.Duration {
+	bo = time.Duration(float64(bo) * rc.Multiplier)
+	if max := time.Duration(rc.MaxBackoffMs) * time.Millisecond; bo > max {
+		bo = max
+	}
+	return bo
+}
+
+// String is fmt.Stringer implementation
+func (rc *RetryConfig) String() string {
+	return utils.ToJsonStr(rc)
+}
+
+//===================== clusterConfig =====================
+
+// Check performs an internal check for ClusterConfig fields
+func (cc *ClusterConfig) Check() error {
+	if len(cc.Nodes) == 0 {
+		return fmt.Errorf("invalid Nodes=%v, must be non-empty", cc.Nodes)
+	}
+	nodes := make(map[string]bool, len(cc.Nodes))
+	for _, n := range cc.Nodes {
+		if strings.TrimSpace(n) == "" || nodes[n] {
+			return fmt.Errorf("invalid Nodes=%v, must be non-empty and unique", cc.Nodes)
+		}
+		nodes[n] = true
+	}
+	if !nodes[cc.NodeID] {
+		return fmt.Errorf("invalid NodeID=%v, must be one of Nodes=%v", cc.NodeID, cc.Nodes)
+	}
+	if cc.ReplicationFactor < 0 || cc.ReplicationFactor > len(cc.Nodes) {
+		return fmt.Errorf("invalid ReplicationFactor=%v, must be in [0..%d]", cc.ReplicationFactor, len(cc.Nodes))
+	}
+	if cc.VirtualNodes < 0 {
+		return fmt.Errorf("invalid VirtualNodes=%v, must be >= 0", cc.VirtualNodes)
+	}
+	return nil
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the NodeID and Nodes by the
+// environment variables values, so the node could take its identity from the
+// environment, e.g. "${HOSTNAME}"
+func (cc *ClusterConfig) ExpandEnv() (err error) {
+	if cc.NodeID, err = utils.ExpandEnv(cc.NodeID); err != nil {
+		return fmt.Errorf("invalid NodeID=%v: %v", cc.NodeID, err)
+	}
+	for i, n := range cc.Nodes {
+		if cc.Nodes[i], err = utils.ExpandEnv(n); err != nil {
+			return fmt.Errorf("invalid Nodes[%d]=%v: %v", i, n, err)
+		}
+	}
+	return nil
+}
+
+func (cc *ClusterConfig) getReplicationFactor() int {
+	if cc.ReplicationFactor == 0 {
+		return 1
+	}
+	return cc.ReplicationFactor
+}
+
+func (cc *ClusterConfig) getVirtualNodes() int {
+	if cc.VirtualNodes == 0 {
+		return cDefaultVirtualNodes
+	}
+	return cc.VirtualNodes
+}
+
+// String is fmt.Stringer implementation
+func (cc *ClusterConfig) String() string {
+	return utils.ToJsonStr(cc)
+}
+
+//===================== rateLimitConfig =====================
+
+// Check performs an internal check for RateLimitConfig fields
+func (rl *RateLimitConfig) Check() error {
+	if rl.RecordsPerSec < 0 {
+		return fmt.Errorf("invalid RecordsPerSec=%v, must be >= 0", rl.RecordsPerSec)
+	}
+	if rl.BytesPerSec < 0 {
+		return fmt.Errorf("invalid BytesPerSec=%v, must be >= 0", rl.BytesPerSec)
+	}
+	return nil
+}
+
+// String is fmt.Stringer implementation
+func (rl *RateLimitConfig) String() string {
+	return utils.ToJsonStr(rl)
+}
+
 //===================== streamConfig =====================
 
 func (sc *PipeConfig) Check() error {
@@ -192,21 +921,72 @@ func (sc *PipeConfig) Check() error {
 			"when Name is not empty")
 	}
 	if sc.Name == "" {
-		if _, err := lql.ParseSource(sc.From); err != nil {
+		if _, err := preds.source(sc.From); err != nil {
 			return fmt.Errorf("invalid From=%s: %v", sc.From, err)
 		}
-		if _, err := lql.ParseExpr(sc.Filter); err != nil {
+		if _, err := preds.filter(sc.Filter); err != nil {
 			return fmt.Errorf("invalid Filter=%s: %v", sc.Filter, err)
 		}
-		if sc.Filter != "" {
-			if _, err := syntax.Parse(sc.Filter, syntax.Perl); err != nil {
-				return fmt.Errorf("invalid Filter=%s: %v", sc.Filter, err)
-			}
-		}
 	}
 	return nil
 }
 
+// Validate performs Check and, if ts is not nil, checks that the From condition
+// matches at least one journal of the index ts, so the misspelled conditions are
+// found before the pipe is created. The pipes referred by Name are not checked
+// against the index.
+func (sc *PipeConfig) Validate(ctx context.Context, ts tindex.Service) error {
+	if err := sc.Check(); err != nil {
+		return err
+	}
+	if ts == nil || sc.Name != "" {
+		return nil
+	}
+
+	src, _ := preds.source(sc.From)
+	n, err := ts.CountJournals(ctx, src)
+	if err != nil {
+		return fmt.Errorf("could not count journals for From=%s: %v", sc.From, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("invalid From=%s: matches 0 journals", sc.From)
+	}
+	return nil
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the sc fields by the environment variables values
+func (sc *PipeConfig) ExpandEnv() (err error) {
+	if sc.Name, err = utils.ExpandEnv(sc.Name); err != nil {
+		return fmt.Errorf("invalid Name=%v: %v", sc.Name, err)
+	}
+	if sc.From, err = utils.ExpandEnv(sc.From); err != nil {
+		return fmt.Errorf("invalid From=%v: %v", sc.From, err)
+	}
+	if sc.Filter, err = utils.ExpandEnv(sc.Filter); err != nil {
+		return fmt.Errorf("invalid Filter=%v: %v", sc.Filter, err)
+	}
+	return nil
+}
+
+// getFilter returns the filter condition which is sent to the pipe. The empty
+// string is returned if no filtering is needed, or if the records are filtered
+// by the message regexp (see getMsgRegexp).
+func (sc *PipeConfig) getFilter() string {
+	if sc.getMsgRegexp() != nil {
+		return ""
+	}
+	return strings.TrimSpace(sc.Filter)
+}
+
+// getMsgRegexp returns the regexp, which the records messages must match, if
+// the Filter is a string literal, or nil otherwise
+func (sc *PipeConfig) getMsgRegexp() *regexp.Regexp {
+	if sc.Name != "" {
+		return nil
+	}
+	return preds.msgRegexp(sc.Filter)
+}
+
 // String is fmt.Stringer implementation
 func (sc *PipeConfig) String() string {
 	return utils.ToJsonStr(sc)
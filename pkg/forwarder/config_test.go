@@ -0,0 +1,313 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/logrange/logrange/pkg/forwarder/sink"
+	"github.com/logrange/logrange/pkg/lql"
+	"github.com/logrange/logrange/pkg/tindex"
+	"github.com/logrange/logrange/pkg/utils"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipeConfigCheckFilter(t *testing.T) {
+	for _, flt := range []string{
+		"",
+		"msg contains \"abc\"",
+		// not a valid regexp, but valid filter
+		"msg contains \"(\"",
+		"msg like \"*a?c*\"",
+		// the like pattern is a shell pattern, it is not a valid Perl regexp
+		"msg like \"a**\"",
+	} {
+		pc := &PipeConfig{Filter: flt}
+		if err := pc.Check(); err != nil {
+			t.Fatal("the filter ", flt, " must be valid, but err=", err)
+		}
+		if _, err := lql.BuildWhereExpFunc(flt); err != nil {
+			t.Fatal("the filter ", flt, " must be valid for the pipe, but err=", err)
+		}
+	}
+
+	for _, flt := range []string{
+		"msg = ",
+		// the like pattern is checked when the filter is built
+		"msg like \"[a\"",
+		// a valid Perl regexp, but not a valid shell pattern
+		"msg like \"[]a]\"",
+		"abc contains \"a\"",
+	} {
+		pc := &PipeConfig{Filter: flt}
+		if err := pc.Check(); err == nil {
+			t.Fatal("the filter ", flt, " must be invalid")
+		}
+		if _, err := lql.BuildWhereExpFunc(flt); err == nil {
+			t.Fatal("the filter ", flt, " must be invalid for the pipe")
+		}
+	}
+}
+
+func TestPipeConfigCheckSyntaxError(t *testing.T) {
+	pc := &PipeConfig{From: "name = = foo"}
+	err := pc.Check()
+	if err == nil || !strings.Contains(err.Error(), `unexpected "=" at column 8`) {
+		t.Fatal("the error must point to the invalid token, but err=", err)
+	}
+
+	pc = &PipeConfig{Filter: "msg contains abc and"}
+	err = pc.Check()
+	if err == nil || !strings.Contains(err.Error(), "unexpected end of condition at column 21") {
+		t.Fatal("the error must point to the end of filter, but err=", err)
+	}
+}
+
+func TestConfigExpandEnv(t *testing.T) {
+	os.Setenv("LR_TEST_FWD_ADDR", "127.0.0.1:5514")
+	defer os.Unsetenv("LR_TEST_FWD_ADDR")
+	os.Unsetenv("LR_TEST_FWD_MISSING")
+
+	cfg := NewDefaultConfig()
+	cfg.Workers = []*WorkerConfig{{
+		Name: "w1",
+		Pipe: &PipeConfig{Filter: "msg contains \"$${LR_TEST_FWD_ADDR}\""},
+		Sink: &sink.Config{Type: sink.SnkTypeSyslog, Params: sink.Params{
+			"RemoteAddr":    "${LR_TEST_FWD_ADDR}",
+			"MessageSchema": map[string]interface{}{"Hostname": "h-${LR_TEST_FWD_ADDR}"},
+		}},
+	}}
+
+	if err := cfg.ExpandEnv(); err != nil {
+		t.Fatal("ExpandEnv() err=", err)
+	}
+
+	w := cfg.Workers[0]
+	if w.Pipe.Filter != "msg contains \"${LR_TEST_FWD_ADDR}\"" || w.Sink.Params["RemoteAddr"] != "127.0.0.1:5514" ||
+		w.Sink.Params["MessageSchema"].(map[string]interface{})["Hostname"] != "h-127.0.0.1:5514" {
+		t.Fatal("wrong expansion ", w)
+	}
+
+	w.Sink.Params["TlsCAFile"] = "${LR_TEST_FWD_MISSING}"
+	if err := cfg.ExpandEnv(); err == nil {
+		t.Fatal("ExpandEnv() must fail for the missing variable")
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	newWorker := func(name, pipe string) *WorkerConfig {
+		return &WorkerConfig{Name: name, Pipe: &PipeConfig{Name: pipe}, Sink: &sink.Config{Type: sink.SnkTypeStdout}}
+	}
+
+	c1 := NewDefaultConfig()
+	c1.Workers = []*WorkerConfig{newWorker("w1", "p1"), newWorker("w2", "p2")}
+	c2 := NewDefaultConfig()
+	c2.Workers = []*WorkerConfig{newWorker("w1", "p1"), newWorker("w2", "p2")}
+
+	diff, err := c1.Diff(c2)
+	if err != nil || len(diff) != 0 {
+		t.Fatal("no diff expected, but diff=", diff, ", err=", err)
+	}
+
+	c2.StateStoreIntervalSec++
+	c2.Workers = []*WorkerConfig{newWorker("w3", "p3"), newWorker("w2", "p22")}
+	c2.Workers[1].Retry = NewDefaultRetryConfig()
+	diff, err = c1.Diff(c2)
+	if err != nil {
+		t.Fatal("Diff() err=", err)
+	}
+
+	exp := []string{"StateStoreIntervalSec", "added worker w3", "modified worker w2: Pipe", "modified worker w2: Retry", "removed worker w1"}
+	if len(diff) != len(exp) {
+		t.Fatal("expected ", exp, ", but diff=", diff)
+	}
+	for i, e := range exp {
+		if !strings.HasPrefix(diff[i], e) {
+			t.Fatal("expected ", e, ", but diff=", diff[i])
+		}
+	}
+
+	c2.Workers[0].Name = ""
+	if _, err = c1.Diff(c2); err == nil {
+		t.Fatal("Diff() must check the config")
+	}
+}
+
+func TestConfigMigrate(t *testing.T) {
+	v1 := `{
+		"StateStoreIntervalSec": 5,
+		"Workers": [{"Name": "w1", "Pipe": {"Name": "p1"}, "Sink": {"Type": "stdout"}}]
+	}`
+	cfg := &Config{}
+	if err := json.Unmarshal([]byte(v1), cfg); err != nil {
+		t.Fatal("Unmarshal() err=", err)
+	}
+	if err := cfg.Migrate(); err != nil {
+		t.Fatal("Migrate() err=", err)
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+
+	if cfg.Version != ConfigVersion || cfg.StateStoreIntervalSec != 5 || cfg.SyncWorkersIntervalSec != NewDefaultConfig().SyncWorkersIntervalSec {
+		t.Fatal("unexpected migrated config ", cfg)
+	}
+	w := cfg.Workers[0]
+	if !reflect.DeepEqual(w.Retry, NewDefaultRetryConfig()) || w.DeliveryMode != DeliveryAtLeastOnce || w.Format != FormatRaw ||
+		w.RateLimit != nil || !w.isEnabled() || w.Pipe.Name != "p1" || w.Sink.Type != sink.SnkTypeStdout {
+		t.Fatal("unexpected migrated worker ", w)
+	}
+
+	// the current version is not changed
+	cfg.Workers[0].Retry = nil
+	if err := cfg.Migrate(); err != nil || cfg.Workers[0].Retry != nil {
+		t.Fatal("the current version must not be migrated, err=", err)
+	}
+
+	cfg.Version = ConfigVersion + 1
+	if err := cfg.Migrate(); err == nil {
+		t.Fatal("Migrate() must fail for the newer version")
+	}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("Check() must fail for the newer version")
+	}
+}
+
+// testIndex implements tindex.Service CountJournals, which returns cnt or err
+type testIndex struct {
+	tindex.Service
+	cnt int
+	err error
+}
+
+func (ti *testIndex) CountJournals(ctx context.Context, srcCond *lql.Source) (int, error) {
+	return ti.cnt, ti.err
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Workers = []*WorkerConfig{{Name: "w1", Pipe: &PipeConfig{}, Sink: &sink.Config{Type: sink.SnkTypeStdout}}}
+	ctx := context.Background()
+
+	// no index, the syntax is checked only
+	if err := cfg.Validate(ctx, nil); err != nil {
+		t.Fatal("Validate() err=", err)
+	}
+	if err := cfg.Validate(ctx, &testIndex{cnt: 3}); err != nil {
+		t.Fatal("Validate() err=", err)
+	}
+
+	err := cfg.Validate(ctx, &testIndex{})
+	if err == nil || !strings.Contains(err.Error(), "matches 0 journals") {
+		t.Fatal("Validate() must fail, when no journals match, but err=", err)
+	}
+	if err = cfg.Validate(ctx, &testIndex{err: fmt.Errorf("test error")}); err == nil {
+		t.Fatal("Validate() must fail, when the journals could not be counted")
+	}
+
+	// the pipes referred by name are not checked against the index
+	cfg.Workers[0].Pipe.Name = "p1"
+	if err = cfg.Validate(ctx, &testIndex{}); err != nil {
+		t.Fatal("Validate() err=", err)
+	}
+
+	cfg.Workers[0].Sink.Type = "unknown"
+	if err = cfg.Validate(ctx, &testIndex{cnt: 3}); err == nil {
+		t.Fatal("Validate() must check the config")
+	}
+}
+
+const testJsonCfg = `{
+  "Version": 2,
+  "Workers": [{
+    "Name": "w1",
+    "Pipe": {"From": "app=a", "Filter": "'error'"},
+    "Sinks": [{
+      "Type": "http",
+      "Params": {"URL": "https://example.com/logs", "BatchSize": 100, "Headers": {"X-Env": "prod"}},
+      "TLS": {"InsecureSkipVerify": true},
+      "Auth": {"BearerToken": "${TOKEN}"}
+    }],
+    "Retry": {"MaxAttempts": 3, "InitialBackoffMs": 100, "MaxBackoffMs": 1000, "Multiplier": 1.5},
+    "BufferSize": 1000
+  }],
+  "StateStoreIntervalSec": 20,
+  "SyncWorkersIntervalSec": 5
+}`
+
+const testYamlCfg = `
+# the same config as testJsonCfg
+Version: 2
+Workers:
+  - Name: w1
+    Pipe:
+      From: app=a
+      Filter: "'error'"
+    Sinks:
+      - Type: http
+        Params:
+          URL: https://example.com/logs
+          BatchSize: 100
+          Headers:
+            X-Env: prod
+        TLS:
+          InsecureSkipVerify: true
+        Auth:
+          BearerToken: ${TOKEN}
+    Retry:
+      MaxAttempts: 3
+      InitialBackoffMs: 100
+      MaxBackoffMs: 1000
+      Multiplier: 1.5
+    BufferSize: 1000
+StateStoreIntervalSec: 20
+SyncWorkersIntervalSec: 5
+`
+
+func TestConfigYaml(t *testing.T) {
+	jc, yc := &Config{}, &Config{}
+	if err := utils.UnmarshalCfg("forward.json", []byte(testJsonCfg), jc); err != nil {
+		t.Fatal("could not read JSON, err=", err)
+	}
+	if err := utils.UnmarshalCfg("forward.yaml", []byte(testYamlCfg), yc); err != nil {
+		t.Fatal("could not read YAML, err=", err)
+	}
+	if !reflect.DeepEqual(jc, yc) {
+		t.Fatal("the configs must be equal, but json=", jc, ", yaml=", yc)
+	}
+	if err := yc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+
+	// the format is found by the content, if the extension is unknown
+	c := &Config{}
+	if err := utils.UnmarshalCfg("forward.conf", []byte(testYamlCfg), c); err != nil || !reflect.DeepEqual(c, jc) {
+		t.Fatal("the YAML content must be found, err=", err)
+	}
+	c = &Config{}
+	if err := utils.UnmarshalCfg("forward", []byte(testJsonCfg), c); err != nil || !reflect.DeepEqual(c, jc) {
+		t.Fatal("the JSON content must be found, err=", err)
+	}
+
+	// the config is written and read back
+	c = &Config{}
+	if err := utils.UnmarshalCfg("forward.yml", []byte(utils.ToYamlStr(jc)), c); err != nil || !reflect.DeepEqual(c, jc) {
+		t.Fatal("the config must be read back, err=", err, ", yaml=", utils.ToYamlStr(jc))
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/model/tag"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type (
+	// jsonRecord is the record encoded by the FormatJSON
+	jsonRecord struct {
+		Timestamp string            `json:"timestamp"`
+		Tags      map[string]string `json:"tags,omitempty"`
+		Fields    map[string]string `json:"fields,omitempty"`
+		Message   string            `json:"message"`
+	}
+
+	// encoder encodes the records messages according to the WorkerConfig.Format,
+	// and adds the source tags to the records, if WorkerConfig.IncludeTags is set
+	encoder struct {
+		format      string
+		includeTags bool
+		tagsPrefix  string
+		sb          strings.Builder
+		// tags contains the parsed tags lines, the records of a batch usually
+		// have a few sources only
+		tags map[string]map[string]string
+		// lines contains the tags lines with TagsPrefix added to the tag names
+		lines map[string]string
+	}
+)
+
+const (
+	// FormatRaw is the WorkerConfig.Format, when the records messages are sent as is
+	FormatRaw = "raw"
+	// FormatJSON is the WorkerConfig.Format, when every record is sent as the JSON
+	// object like {"timestamp":"2019-01-01T00:00:00Z","tags":{"app":"a"},"fields":{},"message":"msg"}
+	FormatJSON = "json"
+	// FormatLogfmt is the WorkerConfig.Format, when every record is sent as the
+	// logfmt line like `ts=2019-01-01T00:00:00Z app=a msg=msg`
+	FormatLogfmt = "logfmt"
+
+	// cLogfmtTsKey and cLogfmtMsgKey are the keys of the record timestamp and
+	// message in FormatLogfmt
+	cLogfmtTsKey  = "ts"
+	cLogfmtMsgKey = "msg"
+)
+
+// newEncoder returns the encoder for the worker config wc, or nil if the
+// records are sent as is
+func newEncoder(wc *WorkerConfig) *encoder {
+	format := wc.Format
+	if format == "" {
+		format = FormatRaw
+	}
+	if format == FormatRaw && !wc.IncludeTags {
+		return nil
+	}
+	return &encoder{format: format, includeTags: wc.IncludeTags, tagsPrefix: wc.TagsPrefix}
+}
+
+// apply returns the copies of the events with the messages encoded. The trailing
+// new line of a message is kept after the encoded record. If the tags are
+// included, they are added to the events fields, and the FormatRaw messages
+// are prefixed by the tags line in square brackets, like `[app=a] msg`.
+func (enc *encoder) apply(events []*api.LogEvent) []*api.LogEvent {
+	enc.tags = make(map[string]map[string]string)
+	enc.lines = make(map[string]string)
+	res := make([]*api.LogEvent, len(events))
+	for i, e := range events {
+		ee := *e
+		tl := ""
+		if enc.includeTags {
+			if tl = enc.getTagsLine(e.Tags); tl != "" {
+				ee.Fields = addFields(ee.Fields, tl)
+			}
+		}
+
+		if enc.format == FormatRaw {
+			if tl != "" {
+				ee.Message = "[" + tl + "] " + ee.Message
+			}
+			res[i] = &ee
+			continue
+		}
+
+		msg := strings.TrimSuffix(ee.Message, "\n")
+		enc.sb.Reset()
+		if enc.format == FormatJSON {
+			enc.writeJSON(&ee, msg)
+		} else {
+			enc.writeLogfmt(&ee, msg)
+		}
+		if len(msg) < len(ee.Message) {
+			enc.sb.WriteByte('\n')
+		}
+		ee.Message = enc.sb.String()
+		res[i] = &ee
+	}
+	return res
+}
+
+// getTagsLine returns the tags line tl with the tagsPrefix added to the tag names
+func (enc *encoder) getTagsLine(tl string) string {
+	res, ok := enc.lines[tl]
+	if !ok {
+		tm := enc.getTags(tl)
+		pm := make(map[string]string, len(tm))
+		for k, v := range tm {
+			pm[enc.tagsPrefix+k] = v
+		}
+		ts := tag.MapToSet(pm)
+		res = string(ts.Line())
+		enc.lines[tl] = res
+	}
+	return res
+}
+
+func (enc *encoder) writeJSON(e *api.LogEvent, msg string) {
+	jr := jsonRecord{
+		Timestamp: formatTimestamp(e.Timestamp),
+		Tags:      enc.getTags(e.Tags),
+		Fields:    toMap(e.Fields),
+		Message:   msg,
+	}
+	// the strings and string maps are always encoded
+	buf, _ := json.Marshal(&jr)
+	enc.sb.Write(buf)
+}
+
+func (enc *encoder) writeLogfmt(e *api.LogEvent, msg string) {
+	enc.writeLogfmtPair(cLogfmtTsKey, formatTimestamp(e.Timestamp))
+	enc.writeLogfmtMap(enc.getTags(e.Tags))
+	enc.writeLogfmtMap(toMap(e.Fields))
+	enc.writeLogfmtPair(cLogfmtMsgKey, msg)
+}
+
+// writeLogfmtMap writes the key-value pairs of m sorted by keys
+func (enc *encoder) writeLogfmtMap(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		enc.writeLogfmtPair(k, m[k])
+	}
+}
+
+func (enc *encoder) writeLogfmtPair(k, v string) {
+	if enc.sb.Len() > 0 {
+		enc.sb.WriteByte(' ')
+	}
+	enc.sb.WriteString(k)
+	enc.sb.WriteByte('=')
+	if logfmtNeedsQuote(v) {
+		v = strconv.Quote(v)
+	}
+	enc.sb.WriteString(v)
+}
+
+func (enc *encoder) getTags(tl string) map[string]string {
+	m, ok := enc.tags[tl]
+	if !ok {
+		m = toMap(tl)
+		enc.tags[tl] = m
+	}
+	return m
+}
+
+// logfmtNeedsQuote returns whether the logfmt value v must be quoted
+func logfmtNeedsQuote(v string) bool {
+	if v == "" {
+		return true
+	}
+	for _, r := range v {
+		if r == '=' || r == '"' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTimestamp returns the record timestamp (in nanoseconds) in RFC3339 format
+func formatTimestamp(ts int64) string {
+	return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,140 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logrange/logrange/api"
+	"testing"
+)
+
+func TestFormatCheck(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	for _, f := range []string{"", FormatRaw, FormatJSON, FormatLogfmt} {
+		wc.Format = f
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for Format=", f)
+		}
+	}
+
+	for _, f := range []string{"JSON", "xml", " raw"} {
+		wc.Format = f
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for Format=", f)
+		}
+	}
+}
+
+func TestFormatEncode(t *testing.T) {
+	evs := []*api.LogEvent{
+		{Timestamp: 3600*1e9 + 5, Message: "msg \"1\"\n", Tags: "app=a,env=prod", Fields: "lvl=info"},
+		{Timestamp: 3601 * 1e9, Message: "msg2", Tags: "app=b"},
+	}
+
+	if newEncoder(&WorkerConfig{}) != nil || newEncoder(&WorkerConfig{Format: FormatRaw}) != nil {
+		t.Fatal("no encoder expected for the raw format")
+	}
+
+	res := newEncoder(&WorkerConfig{Format: FormatJSON}).apply(evs)
+	if res[0].Message != `{"timestamp":"1970-01-01T01:00:00.000000005Z","tags":{"app":"a","env":"prod"},"fields":{"lvl":"info"},"message":"msg \"1\""}`+"\n" ||
+		res[1].Message != `{"timestamp":"1970-01-01T01:00:01Z","tags":{"app":"b"},"message":"msg2"}` {
+		t.Fatal("unexpected JSON records ", res[0].Message, ", ", res[1].Message)
+	}
+	var jr jsonRecord
+	if err := json.Unmarshal([]byte(res[0].Message), &jr); err != nil || jr.Message != `msg "1"` || jr.Tags["env"] != "prod" {
+		t.Fatal("the JSON record must be decoded, but jr=", jr, ", err=", err)
+	}
+
+	res = newEncoder(&WorkerConfig{Format: FormatLogfmt}).apply(evs)
+	if res[0].Message != `ts=1970-01-01T01:00:00.000000005Z app=a env=prod lvl=info msg="msg \"1\""`+"\n" ||
+		res[1].Message != `ts=1970-01-01T01:00:01Z app=b msg=msg2` {
+		t.Fatal("unexpected logfmt records ", res[0].Message, ", ", res[1].Message)
+	}
+
+	if evs[0].Message != "msg \"1\"\n" || res[0].Tags != evs[0].Tags || res[0].Timestamp != evs[0].Timestamp {
+		t.Fatal("the events must be copied")
+	}
+}
+
+func TestIncludeTagsCheck(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.IncludeTags = true
+	for _, p := range []string{"", "tag_", "tag."} {
+		wc.TagsPrefix = p
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for TagsPrefix=", p)
+		}
+	}
+
+	for _, p := range []string{"tag=", "a,b", "tag ", `"tag"`} {
+		wc.TagsPrefix = p
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for TagsPrefix=", p)
+		}
+	}
+}
+
+func TestIncludeTags(t *testing.T) {
+	evs := []*api.LogEvent{
+		{Timestamp: 3600 * 1e9, Message: "msg1\n", Tags: "app=a,env=prod", Fields: "lvl=info"},
+		{Timestamp: 3601 * 1e9, Message: "msg2", Tags: `app="b c"`},
+		{Timestamp: 3602 * 1e9, Message: "msg3"},
+	}
+
+	// the text records
+	res := newEncoder(&WorkerConfig{IncludeTags: true}).apply(evs)
+	if res[0].Message != "[app=a,env=prod] msg1\n" || res[1].Message != "[app=b c] msg2" || res[2].Message != "msg3" {
+		t.Fatal("unexpected text records ", res[0].Message, ", ", res[1].Message, ", ", res[2].Message)
+	}
+	if res[0].Fields != "lvl=info,app=a,env=prod" || res[2].Fields != "" {
+		t.Fatal("the tags must be added to the fields, but ", res[0].Fields, ", ", res[2].Fields)
+	}
+
+	// the structured records
+	res = newEncoder(&WorkerConfig{Format: FormatJSON, IncludeTags: true, TagsPrefix: "tag_"}).apply(evs)
+	var jr jsonRecord
+	if err := json.Unmarshal([]byte(res[0].Message), &jr); err != nil {
+		t.Fatal("the JSON record must be decoded, err=", err)
+	}
+	if len(jr.Fields) != 3 || jr.Fields["lvl"] != "info" || jr.Fields["tag_app"] != "a" || jr.Fields["tag_env"] != "prod" {
+		t.Fatal("the tags must be added to the fields with the prefix, but ", jr.Fields)
+	}
+	if err := json.Unmarshal([]byte(res[1].Message), &jr); err != nil || jr.Fields["tag_app"] != "b c" {
+		t.Fatal("the tags must be added to the fields, but ", jr.Fields, ", err=", err)
+	}
+	if evs[0].Fields != "lvl=info" || evs[0].Message != "msg1\n" {
+		t.Fatal("the events must be copied")
+	}
+}
+
+func TestFormatWorker(t *testing.T) {
+	tc := &testClient{events: []*api.LogEvent{{Message: "msg1\n", Tags: "app=a"}, {Message: "msg2\n", Tags: "app=b"}}}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.Transform = "{{.Tags.app}}: {{.Message}}"
+	wc.Format = FormatLogfmt
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, wait := runTestWorker(ctx, wc, tc, ts)
+	waitCount(t, ts, 2)
+	cancel()
+	wait()
+
+	if ts.events[0].Message != "ts=1970-01-01T00:00:00Z app=a msg=\"a: msg1\"\n" ||
+		ts.events[1].Message != "ts=1970-01-01T00:00:00Z app=b msg=\"b: msg2\"\n" {
+		t.Fatal("the events must be transformed and encoded, but got ", ts.events[0].Message, ", ", ts.events[1].Message)
+	}
+}
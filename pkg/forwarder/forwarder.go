@@ -27,6 +27,8 @@ import (
 	"github.com/mohae/deepcopy"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -41,14 +43,97 @@ type (
 
 	descs map[string]*desc
 
+	// WorkerStatus struct contains the worker state returned by Forwarder.Status
+	WorkerStatus struct {
+		Name string
+		// State is one of WorkerStateRunning, WorkerStateStopping, WorkerStateStopped
+		// or WorkerStateDisabled
+		State string
+		// Position contains the position of the last record forwarded
+		Position string
+		// Forwarded contains the number of records accepted by the sink since the worker start,
+		// the records split by WorkerConfig.OnOversize are counted by chunks. The
+		// counters of the status (Forwarded, Throttled, Dropped and Oversized) are
+		// not affected by Forwarder.ResetStats, see SinceReset
+		Forwarded uint64
+		// LastRecordTime contains the timestamp of the last record accepted by the sink
+		LastRecordTime time.Time
+		// Lag contains the time passed since LastRecordTime, 0 if no records forwarded yet
+		Lag time.Duration
+		// LastFlushTime contains the time when the sink accepted the records last time
+		LastFlushTime time.Time
+		// LastError contains the last error happened (query, sink, etc.), empty if no errors
+		LastError string
+		// LastErrorTime contains the time when the LastError happened
+		LastErrorTime time.Time
+		// Backoff contains the pause duration, if the worker waits after an error, or 0
+		Backoff time.Duration
+		// Throttled contains the total time the worker waited because of the rate limits
+		Throttled time.Duration
+		// Dropped contains the number of records dropped because the worker buffer
+		// was full (see WorkerConfig.OnFull)
+		Dropped uint64
+		// Oversized contains the number of records, which messages exceeded the
+		// WorkerConfig.MaxLineBytes (see WorkerConfig.OnOversize)
+		Oversized uint64
+		// TailLag contains the time between the oldest record, which is not forwarded
+		// yet, and the newest record of the worker source, 0 if all the records are
+		// forwarded. The lag is checked periodically, so the value could be outdated
+		// for up to 30 seconds
+		TailLag time.Duration
+		// SinceReset contains the counters values since ResetTime
+		SinceReset WorkerCounters
+		// ResetTime contains the time when the worker stats were reset last time
+		// (see Forwarder.ResetStats), or the worker start time
+		ResetTime time.Time
+	}
+
+	// WorkerCounters struct contains the worker counters values, see WorkerStatus
+	// for the fields description
+	WorkerCounters struct {
+		Forwarded uint64
+		Throttled time.Duration
+		Dropped   uint64
+		Oversized uint64
+	}
+
 	workers map[string]*worker
 
+	// Forwarder runs the workers, which send the events to the sinks. The workers
+	// positions are persisted every StateStoreIntervalSec and when the Forwarder
+	// is stopped, so the workers continue from them after restart. The delivery
+	// is at-least-once: the position is moved when the sink accepted the events,
+	// so the events sent after the last persisted position are sent again after
+	// a crash. The batching sinks (kafka, http) accept the events before they are
+	// sent, the events in the batch could be lost after a crash.
 	Forwarder struct {
 		cfg *Config
 
 		descs   atomic.Value
 		workers atomic.Value
 		waitWg  sync.WaitGroup
+		// wrkWg is used to wait until all the workers are stopped
+		wrkWg sync.WaitGroup
+		// syncStopCh is closed when the sync workers loop is over
+		syncStopCh chan struct{}
+		// stateLock serializes the state persisting
+		stateLock sync.Mutex
+		// cancel stops the forwarder, and stopSync stops the sync workers loop
+		// only, so no new workers are started (see Shutdown)
+		cancel   context.CancelFunc
+		stopSync context.CancelFunc
+		// stateIntervalCh notifies the persist state loop about the new StateStoreIntervalSec
+		stateIntervalCh chan int
+		// jitterPct contains the Config.TickerJitterPct, it is updated when the
+		// config is reloaded
+		jitterPct int32
+		// router contains the *JournalRouter for the Config.Cluster, it is nil
+		// if the forwarder is not clustered. It is updated when the config is
+		// reloaded, so the running workers use the new one from the next records.
+		router atomic.Value
+		// clock provides the time for the forwarder and the workers, it could
+		// be replaced in tests
+		clock utils.Clock
 
 		client  api.Client
 		storage storage.Storage
@@ -60,18 +145,34 @@ const (
 	storageKeyName = "forwarder.json"
 )
 
+const (
+	WorkerStateRunning  = "running"
+	WorkerStateStopping = "stopping"
+	WorkerStateStopped  = "stopped"
+	WorkerStateDisabled = "disabled"
+)
+
 //===================== forwarder =====================
 
 func NewForwarder(cfg *Config, cli api.Client, storage storage.Storage) (*Forwarder, error) {
-	if err := cfg.Check(); err != nil {
-		return nil, fmt.Errorf("invalid config; %v", err)
-	}
-
 	f := new(Forwarder)
 	f.cfg = deepcopy.Copy(cfg).(*Config)
+	if err := f.cfg.ExpandEnv(); err != nil {
+		return nil, fmt.Errorf("invalid config; %v", err)
+	}
+	if err := f.cfg.Check(); err != nil {
+		return nil, fmt.Errorf("invalid config; %v", err)
+	}
 
 	f.workers.Store(make(workers))
 	f.descs.Store(make(descs))
+	f.stateIntervalCh = make(chan int, 1)
+	f.jitterPct = int32(f.cfg.TickerJitterPct)
+	if err := f.setRouter(f.cfg.Cluster); err != nil {
+		return nil, fmt.Errorf("invalid config; %v", err)
+	}
+	f.syncStopCh = make(chan struct{})
+	f.clock = utils.RealClock
 
 	f.client = cli
 	f.storage = storage
@@ -82,20 +183,138 @@ func NewForwarder(cfg *Config, cli api.Client, storage storage.Storage) (*Forwar
 
 func (f *Forwarder) Run(ctx context.Context) error {
 	f.logger.Info("Running, config=", f.cfg)
+	ctx, f.cancel = context.WithCancel(ctx)
+	sctx, stopSync := context.WithCancel(ctx)
+	f.stopSync = stopSync
 	if err := f.init(ctx); err != nil {
+		f.cancel()
 		return err
 	}
-	f.runSyncWorkers(ctx)
-	f.runPersistState(ctx)
+	// the config is changed by the sync workers loop, so the intervals are read before
+	syncInterval, stateInterval := f.cfg.SyncWorkersIntervalSec, f.cfg.StateStoreIntervalSec
+	f.runSyncWorkers(ctx, sctx, syncInterval)
+	f.runPersistState(ctx, stateInterval)
 	return nil
 }
 
+// Shutdown stops the forwarder gracefully. The workers stop reading new events,
+// send the events already read, close the sinks (the batching sinks send the
+// buffered events then), and the workers positions are persisted. Shutdown
+// returns when all the workers are stopped, or when ctx is done. In the last
+// case the workers are interrupted, and the ctx error is returned. Shutdown
+// must be called after Run, Close could be used to wait until the forwarder
+// goroutines are over.
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.logger.Info("Shutting down...")
+	defer f.cancel()
+
+	// no workers are started after the sync loop is over
+	f.stopSync()
+	select {
+	case <-f.syncStopCh:
+	case <-ctx.Done():
+		f.logger.Warn("Shutdown is interrupted, err=", ctx.Err())
+		return ctx.Err()
+	}
+
+	for _, w := range f.workers.Load().(workers) {
+		w.stopGracefully()
+	}
+	drained := make(chan struct{})
+	go func() {
+		f.wrkWg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		f.logger.Warn("Shutdown is interrupted, not all the workers are stopped, err=", ctx.Err())
+		return ctx.Err()
+	}
+
+	err := f.persistState()
+	f.logger.Info("Shut down, err=", err)
+	return err
+}
+
 func (f *Forwarder) sync(ctx context.Context) {
 	nd := f.toDescs(f.cfg)
 	if nd != nil {
 		md := f.mergeDescs(f.getDescs(), nd)
-		f.syncWorkers(ctx, md)
+		// the descs are set before the workers are started, so the workers
+		// positions could be persisted (see workerConfig.commit)
 		f.setDescs(md)
+		f.syncWorkers(ctx, md, nil)
+	}
+}
+
+// reload reloads the config in two phases: the sinks of the new and modified
+// workers are created for the candidate config first, and the config is
+// applied and the workers are synced with the sinks created, only if all of
+// them are created. Otherwise, the created sinks are closed, and the old
+// config keeps running. It returns true, if the new config is applied.
+func (f *Forwarder) reload(ctx context.Context) (bool, error) {
+	var (
+		md  descs
+		wcs map[string]*workerConfig
+	)
+	ok, err := f.cfg.ReloadWith(func(cand *Config) error {
+		var err error
+		md, wcs, err = f.prepareWorkers(ctx, cand)
+		return err
+	})
+	if ok {
+		if rerr := f.setRouter(f.cfg.Cluster); rerr != nil {
+			f.logger.Error("Could not create the journal router for Cluster=", f.cfg.Cluster, ", err=", rerr)
+		}
+	}
+	if ok && md != nil {
+		f.setDescs(md)
+		f.syncWorkers(ctx, md, wcs)
+	}
+	return ok, err
+}
+
+// prepareWorkers returns the descs for cfg and the worker configs, with the
+// sinks created, for the workers, which are started or which sinks are replaced
+// when the descs are synced. If any of the sinks could not be created, the ones
+// created are closed, and the error listing the failed workers is returned.
+func (f *Forwarder) prepareWorkers(ctx context.Context, cfg *Config) (descs, map[string]*workerConfig, error) {
+	nd := f.toDescs(cfg)
+	if nd == nil {
+		return nil, nil, nil
+	}
+	md := f.mergeDescs(f.getDescs(), nd)
+	oldWks := f.workers.Load().(workers)
+
+	wcs := make(map[string]*workerConfig)
+	var errs []string
+	for name, d := range md {
+		w, ok := oldWks[name]
+		if !d.Worker.isEnabled() || (ok && w.hasDesc(d) && !w.isStopped()) {
+			continue
+		}
+		wcfg, err := f.newWorkerConfig(d)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Worker=%s: %v", name, err))
+			continue
+		}
+		wcs[name] = wcfg
+	}
+
+	if len(errs) > 0 {
+		f.closeWorkerConfigs(wcs)
+		sort.Strings(errs)
+		return nil, nil, fmt.Errorf("could not start %d worker(s); %s", len(errs), strings.Join(errs, "; "))
+	}
+	return md, wcs, nil
+}
+
+// closeWorkerConfigs closes the sinks of the worker configs wcs, which are not used
+func (f *Forwarder) closeWorkerConfigs(wcs map[string]*workerConfig) {
+	for _, wcfg := range wcs {
+		closeSinks(wcfg.sink, wcfg.deadLetter, wcfg.logger)
 	}
 }
 
@@ -108,6 +327,44 @@ func (f *Forwarder) Close() error {
 	return nil
 }
 
+// Status returns the workers states sorted by the workers names. The disabled
+// workers are reported too.
+func (f *Forwarder) Status() []WorkerStatus {
+	ds := f.getDescs()
+	wks := f.workers.Load().(workers)
+
+	res := make([]WorkerStatus, 0, len(ds))
+	for name, d := range ds {
+		ws := WorkerStatus{Name: name, Position: d.getPosition(), State: WorkerStateStopped}
+		if w, ok := wks[name]; ok {
+			w.fillStatus(&ws)
+		} else if !d.Worker.isEnabled() {
+			ws.State = WorkerStateDisabled
+		}
+		res = append(res, ws)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// ResetStats resets the SinceReset counters of all the running workers
+func (f *Forwarder) ResetStats() {
+	for _, w := range f.workers.Load().(workers) {
+		w.resetStats()
+	}
+}
+
+// ResetWorkerStats resets the SinceReset counters of the running worker name.
+// An error is returned if the worker is not running.
+func (f *Forwarder) ResetWorkerStats(name string) error {
+	w, ok := f.workers.Load().(workers)[name]
+	if !ok {
+		return fmt.Errorf("the worker %s is not running", name)
+	}
+	w.resetStats()
+	return nil
+}
+
 func (f *Forwarder) init(ctx context.Context) error {
 	err := f.loadState()
 	if err == nil {
@@ -140,41 +397,108 @@ func (f *Forwarder) toDescs(cfg *Config) descs {
 
 //===================== forwarder.jobs =====================
 
-func (f *Forwarder) runSyncWorkers(ctx context.Context) {
-	f.logger.Info("Running sync workers every ", f.cfg.SyncWorkersIntervalSec, " seconds...")
-	ticker := time.NewTicker(time.Second *
-		time.Duration(f.cfg.SyncWorkersIntervalSec))
+// runSyncWorkers runs the sync workers loop until sctx is done, the workers
+// are run with ctx
+func (f *Forwarder) runSyncWorkers(ctx, sctx context.Context, interval int) {
+	f.logger.Info("Running sync workers every ", interval, " seconds...")
+	ticker := newJitterTicker(f.clock, time.Second*time.Duration(interval), f.getJitterPct)
 
 	f.waitWg.Add(1)
 	go func() {
-		for utils.Wait(ctx, ticker) {
-			newFlag, err := f.cfg.Reload()
+		for ticker.wait(sctx) {
+			newFlag, err := f.reload(ctx)
 			if err != nil {
 				f.logger.Warn("Failed config reloading, using old one, err=", err)
 			}
 			if newFlag {
 				f.logger.Info("Found new config=", f.cfg)
+				atomic.StoreInt32(&f.jitterPct, int32(f.cfg.TickerJitterPct))
+				f.notifyStateInterval(f.cfg.StateStoreIntervalSec)
+				if f.cfg.SyncWorkersIntervalSec != interval {
+					interval = f.cfg.SyncWorkersIntervalSec
+					f.logger.Info("Sync workers every ", interval, " seconds now")
+					ticker.Stop()
+					ticker = newJitterTicker(f.clock, time.Second*time.Duration(interval), f.getJitterPct)
+				}
+			}
+			if !newFlag {
+				f.sync(ctx)
 			}
-			f.sync(ctx)
 		}
+		ticker.Stop()
+		close(f.syncStopCh)
 		f.logger.Warn("Sync workers stopped.")
 		f.waitWg.Done()
 	}()
 }
 
-func (f *Forwarder) runPersistState(ctx context.Context) {
-	f.logger.Info("Running persist state every ", f.cfg.StateStoreIntervalSec, " seconds...")
-	ticker := time.NewTicker(time.Second *
-		time.Duration(f.cfg.StateStoreIntervalSec))
+// setRouter sets the journal router for the cluster cc, which could be nil
+func (f *Forwarder) setRouter(cc *ClusterConfig) error {
+	var jr *JournalRouter
+	if cc != nil {
+		var err error
+		if jr, err = NewJournalRouter(cc); err != nil {
+			return err
+		}
+	}
+	f.router.Store(jr)
+	return nil
+}
+
+// ownsJournal returns whether the records of the journal with the tags line
+// are forwarded by the node
+func (f *Forwarder) ownsJournal(tags string) bool {
+	jr := f.router.Load().(*JournalRouter)
+	return jr == nil || jr.Owns(tags)
+}
+
+func (f *Forwarder) getJitterPct() int {
+	return int(atomic.LoadInt32(&f.jitterPct))
+}
+
+// notifyStateInterval sends the StateStoreIntervalSec value to the persist state loop.
+// Only the last value is kept, if the loop didn't receive the previous one yet.
+func (f *Forwarder) notifyStateInterval(interval int) {
+	select {
+	case <-f.stateIntervalCh:
+	default:
+	}
+	f.stateIntervalCh <- interval
+}
+
+func (f *Forwarder) runPersistState(ctx context.Context, interval int) {
+	f.logger.Info("Running persist state every ", interval, " seconds...")
+	ticker := newJitterTicker(f.clock, time.Second*time.Duration(interval), f.getJitterPct)
 
 	f.waitWg.Add(1)
 	go func() {
-		for utils.Wait(ctx, ticker) {
-			if err := f.persistState(); err != nil {
-				f.logger.Error("Unable to persist state, cause=", err)
+	L:
+		for {
+			select {
+			case <-ctx.Done():
+				break L
+			case iv := <-f.stateIntervalCh:
+				if iv != interval {
+					interval = iv
+					f.logger.Info("Persist state every ", interval, " seconds now")
+					ticker.Stop()
+					ticker = newJitterTicker(f.clock, time.Second*time.Duration(interval), f.getJitterPct)
+				}
+			case <-ticker.C:
+				if err := f.persistState(); err != nil {
+					f.logger.Error("Unable to persist state, cause=", err)
+				}
 			}
 		}
-		_ = f.persistState()
+		ticker.Stop()
+
+		// no workers are started after the sync loop is over, the last
+		// positions are persisted when all the workers are stopped
+		<-f.syncStopCh
+		f.wrkWg.Wait()
+		if err := f.persistState(); err != nil {
+			f.logger.Error("Unable to persist state, cause=", err)
+		}
 		f.logger.Warn("Persist state stopped.")
 		f.waitWg.Done()
 	}()
@@ -182,19 +506,33 @@ func (f *Forwarder) runPersistState(ctx context.Context) {
 
 //===================== forwarder.workers =====================
 
-func (f *Forwarder) syncWorkers(ctx context.Context, ds descs) {
+// syncWorkers starts, stops and updates the workers for ds. The worker configs
+// of wcs are used for the workers started or updated, if they are there, the
+// ones which are not used are closed. wcs could be nil.
+func (f *Forwarder) syncWorkers(ctx context.Context, ds descs, wcs map[string]*workerConfig) {
 	newWks := make(workers)
 	oldWks := f.workers.Load().(workers)
 
 	f.logger.Info("Syncing workers: new#=", len(ds), ", old#=", len(oldWks))
 	for name, d := range ds {
 		w, ok := oldWks[name]
-		if ok && d != w.desc {
+		if ok && !w.hasDesc(d) {
+			if f.replaceSinks(ctx, w, d, wcs) { //replace the sinks only
+				newWks[name] = w
+				continue
+			}
 			w.stopGracefully() //stop replaced
 		}
+		if !d.Worker.isEnabled() { //stop disabled
+			if ok && !w.isStopped() {
+				w.stopGracefully()
+				newWks[name] = w
+			}
+			continue
+		}
 		var err error
 		if !ok || w.isStopped() { //start new
-			if w, err = f.runWorker(ctx, d); err != nil {
+			if w, err = f.runWorker(ctx, d, wcs); err != nil {
 				f.logger.Error("Failed to run worker, desc=", d, ", err=", err)
 				continue
 			}
@@ -210,32 +548,87 @@ func (f *Forwarder) syncWorkers(ctx context.Context, ds descs) {
 		}
 	}
 	f.workers.Store(newWks)
+	f.closeWorkerConfigs(wcs)
 	f.logger.Info("Sync workers is done.")
 }
 
-func (f *Forwarder) newWorkerConfig(d *desc) (*workerConfig, error) {
-	snk, err := sink.NewSink(d.Worker.Sink)
+// replaceSinks replaces the sinks of the running worker w, if only the sinks
+// configuration is changed in d. It returns false, if the worker must be
+// restarted for d.
+func (f *Forwarder) replaceSinks(ctx context.Context, w *worker, d *desc, wcs map[string]*workerConfig) bool {
+	if !d.Worker.isEnabled() || !w.isRunning(ctx) || !w.getDesc().Worker.equalsIgnoreSinks(d.Worker) {
+		return false
+	}
+	wcfg, err := f.takeWorkerConfig(d, wcs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Sink=%v: %v", d.Worker.Sink, err)
+		f.logger.Error("Failed to create sinks, the worker will be restarted, desc=", d, ", err=", err)
+		return false
+	}
+	w.replaceSinks(wcfg)
+	return true
+}
+
+func (f *Forwarder) newWorkerConfig(d *desc) (*workerConfig, error) {
+	scs := d.Worker.getSinks()
+	snks := make([]sink.Sink, 0, len(scs))
+	for _, sc := range scs {
+		snk, err := sink.NewSink(sc)
+		if err != nil {
+			for _, s := range snks {
+				_ = s.Close()
+			}
+			return nil, fmt.Errorf("failed to create Sink=%v: %v", sc, err)
+		}
+		snks = append(snks, snk)
+	}
+
+	snk := snks[0]
+	if len(snks) > 1 {
+		snk = newMultiSink(snks)
+	}
+
+	var dl sink.Sink
+	if d.Worker.DeadLetter != nil {
+		var err error
+		if dl, err = sink.NewSink(d.Worker.DeadLetter); err != nil {
+			_ = snk.Close()
+			return nil, fmt.Errorf("failed to create DeadLetter=%v: %v", d.Worker.DeadLetter, err)
+		}
 	}
 	return &workerConfig{
-		desc:   d,
-		sink:   snk,
-		rpcc:   f.client,
-		logger: f.logger.WithId(fmt.Sprintf("[%v]", d.Worker.Name)).(log4g.Logger),
+		desc:       d,
+		sink:       snk,
+		deadLetter: dl,
+		commit:     f.persistState,
+		owns:       f.ownsJournal,
+		rpcc:       f.client,
+		clock:      f.clock,
+		logger:     f.logger.WithId(fmt.Sprintf("[%v]", d.Worker.Name)).(log4g.Logger),
 	}, nil
 }
 
-func (f *Forwarder) runWorker(ctx context.Context, d *desc) (*worker, error) {
-	wcfg, err := f.newWorkerConfig(d)
+// takeWorkerConfig returns the worker config for d from wcs, and removes it
+// from there, or creates the new one, if wcs doesn't have it
+func (f *Forwarder) takeWorkerConfig(d *desc, wcs map[string]*workerConfig) (*workerConfig, error) {
+	if wcfg, ok := wcs[d.Worker.Name]; ok && wcfg.desc == d {
+		delete(wcs, d.Worker.Name)
+		return wcfg, nil
+	}
+	return f.newWorkerConfig(d)
+}
+
+func (f *Forwarder) runWorker(ctx context.Context, d *desc, wcs map[string]*workerConfig) (*worker, error) {
+	wcfg, err := f.takeWorkerConfig(d, wcs)
 	if err != nil {
 		return nil, err
 	}
 
 	w := newWorker(wcfg)
 	f.waitWg.Add(1)
+	f.wrkWg.Add(1)
 	go func(w *worker) {
 		_ = w.run(ctx)
+		f.wrkWg.Done()
 		f.waitWg.Done()
 	}(w)
 
@@ -262,6 +655,11 @@ func (f *Forwarder) mergeDescs(old, new descs) descs {
 			continue
 		}
 		f.logger.Debug("Merge: repl (from=", od, ", to=", nd, ")")
+		if od.Worker.equalsIgnoreEnabled(nd.Worker) || od.Worker.equalsIgnoreSinks(nd.Worker) {
+			// the worker is enabled or disabled, or its sinks are changed only,
+			// continue from the same position
+			nd.setPosition(od.getPosition())
+		}
 		res[name] = nd
 		r++
 	}
@@ -296,6 +694,9 @@ func (f *Forwarder) loadState() error {
 }
 
 func (f *Forwarder) persistState() error {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+
 	f.logger.Info("Persisting state to storage=", f.storage)
 	d := f.getDescs()
 
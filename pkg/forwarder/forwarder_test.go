@@ -0,0 +1,1136 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jrivets/log4g"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/forwarder/sink"
+	"github.com/logrange/logrange/pkg/model"
+	"github.com/logrange/logrange/pkg/model/field"
+	"github.com/logrange/logrange/pkg/storage"
+	"github.com/logrange/logrange/pkg/utils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient implements the api.Client methods used by workers. The Query
+// returns the events starting from the position, which is the event index.
+type testClient struct {
+	api.Client
+
+	lock   sync.Mutex
+	events []*api.LogEvent
+	pipes  []api.Pipe
+	// poss contains the positions queried
+	poss []string
+	// limit contains the maximum number of events returned by one query, if not 0
+	limit int
+}
+
+// testSink collects the events received
+type testSink struct {
+	lock   sync.Mutex
+	events []*api.LogEvent
+}
+
+func (tc *testClient) EnsurePipe(ctx context.Context, p api.Pipe, res *api.PipeCreateResult) error {
+	tc.lock.Lock()
+	tc.pipes = append(tc.pipes, p)
+	tc.lock.Unlock()
+	res.Pipe = p
+	res.Pipe.Destination = p.Name
+	return nil
+}
+
+func (tc *testClient) Query(ctx context.Context, req *api.QueryRequest, res *api.QueryResult) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	tc.poss = append(tc.poss, req.Pos)
+	pos, _ := strconv.Atoi(req.Pos)
+	if req.Pos == "tail" {
+		pos = len(tc.events)
+	}
+	if pos += req.Offset; pos < 0 {
+		pos = 0
+	}
+	end := pos + req.Limit
+	if tc.limit > 0 && tc.limit < req.Limit {
+		end = pos + tc.limit
+	}
+	if end > len(tc.events) {
+		end = len(tc.events)
+	}
+	if pos < end {
+		res.Events = tc.events[pos:end]
+	}
+	res.NextQueryRequest = *req
+	res.NextQueryRequest.Pos = strconv.Itoa(end)
+	return nil
+}
+
+func (ts *testSink) OnEvent(events []*api.LogEvent) error {
+	ts.lock.Lock()
+	ts.events = append(ts.events, events...)
+	ts.lock.Unlock()
+	return nil
+}
+
+func (ts *testSink) Close() error {
+	return nil
+}
+
+func (ts *testSink) count() int {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return len(ts.events)
+}
+
+func newTestEvents(n int) []*api.LogEvent {
+	return newTestEventsFrom(0, n)
+}
+
+func newTestEventsFrom(from, n int) []*api.LogEvent {
+	res := make([]*api.LogEvent, n)
+	for i := range res {
+		res[i] = &api.LogEvent{Timestamp: int64(from + i), Message: fmt.Sprintf("msg%d\n", from+i)}
+	}
+	return res
+}
+
+func (tc *testClient) positions() []string {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return append([]string(nil), tc.poss...)
+}
+
+func (tc *testClient) addEvents(evs []*api.LogEvent) {
+	tc.lock.Lock()
+	tc.events = append(tc.events, evs...)
+	tc.lock.Unlock()
+}
+
+// runTestWorker runs the worker for wc with the sink ts, and returns the worker and
+// the function, which waits until the worker is stopped
+func runTestWorker(ctx context.Context, wc *WorkerConfig, tc *testClient, ts sink.Sink) (*worker, func()) {
+	d := &desc{Worker: wc}
+	d.setPosition("")
+	w := newWorker(&workerConfig{desc: d, sink: ts, rpcc: tc, logger: log4g.GetLogger("forwarder").WithId("[" + wc.Name + "]").(log4g.Logger)})
+	done := make(chan struct{})
+	go func() {
+		_ = w.run(ctx)
+		close(done)
+	}()
+	return w, func() { <-done }
+}
+
+func waitCount(t *testing.T, ts *testSink, n int) {
+	start := time.Now()
+	for ts.count() < n {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected ", n, " events, but sink has ", ts.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestWorkerConfig(name, pipe string) *WorkerConfig {
+	return &WorkerConfig{Name: name, Pipe: &PipeConfig{Name: pipe}, Sink: &sink.Config{Type: sink.SnkTypeStdout}}
+}
+
+func TestReloadKeepsUnchangedWorkers(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1"), newTestWorkerConfig("w2", "p2")}
+	f, err := NewForwarder(cfg, &testClient{}, storage.NewDefaultStorage())
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		f.Close()
+	}()
+
+	if err = f.init(ctx); err != nil {
+		t.Fatal("init() err=", err)
+	}
+	wks := f.workers.Load().(workers)
+	w1, w2 := wks["w1"], wks["w2"]
+	w1.getDesc().setPosition("pos1")
+
+	nc := NewDefaultConfig()
+	nc.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1"), newTestWorkerConfig("w2", "p22"), newTestWorkerConfig("w3", "p3")}
+	wc1 := f.cfg.Workers[0]
+	f.cfg.Apply(nc)
+	if f.cfg.Workers[0] != wc1 || len(f.cfg.Workers) != 3 || f.cfg.Workers[1].Pipe.Name != "p22" {
+		t.Fatal("the unchanged worker config must be kept, but workers=", f.cfg.Workers)
+	}
+	f.sync(ctx)
+
+	wks = f.workers.Load().(workers)
+	if wks["w1"] != w1 || w1.isStopped() || w1.getDesc().getPosition() != "pos1" {
+		t.Fatal("the unchanged worker must keep running with its state")
+	}
+	// the modified worker is restarted with the new config, when the old one is stopped
+	if atomic.LoadInt32(&w2.state) == wsRunning || f.getDescs()["w2"].Worker.Pipe.Name != "p22" || wks["w3"] == nil {
+		t.Fatal("the modified worker must be stopped and the new one started, workers=", wks)
+	}
+
+	nc.Workers = nc.Workers[:1]
+	f.cfg.Apply(nc)
+	f.sync(ctx)
+	if len(f.getDescs()) != 1 || f.workers.Load().(workers)["w1"] != w1 {
+		t.Fatal("only w1 must be kept, but descs=", f.getDescs())
+	}
+}
+
+func TestEmptyFilter(t *testing.T) {
+	tc := &testClient{events: newTestEvents(2500)}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "")
+	wc.Pipe.Filter = "  "
+	if err := wc.Check(); err != nil {
+		t.Fatal("the empty filter must be valid, err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, wait := runTestWorker(ctx, wc, tc, ts)
+	waitCount(t, ts, 2500)
+	cancel()
+	wait()
+
+	if len(tc.pipes) != 1 || tc.pipes[0].FilterCond != "" {
+		t.Fatal("the pipe must be created with no filter, but pipes=", tc.pipes)
+	}
+	if ts.count() != 2500 {
+		t.Fatal("all events must be forwarded, but ", ts.count())
+	}
+
+	if f, err := preds.filter(" "); err != nil || !f(nil) {
+		t.Fatal("the empty filter must match all, err=", err)
+	}
+}
+
+func TestMsgRegexpFilter(t *testing.T) {
+	tc := &testClient{events: newTestEvents(100), limit: 30}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "")
+	wc.Pipe.Filter = ` 'msg[0-9]?7\n' `
+	if err := wc.Check(); err != nil {
+		t.Fatal("the regexp filter must be valid, err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, ts)
+	waitPosition(t, w.getDesc(), "100")
+	cancel()
+	wait()
+
+	if len(tc.pipes) != 1 || tc.pipes[0].FilterCond != "" {
+		t.Fatal("the regexp must not be sent to the pipe, but pipes=", tc.pipes)
+	}
+	if ts.count() != 10 {
+		t.Fatal("expected 10 events forwarded, but ", ts.events)
+	}
+	for i, e := range ts.events {
+		if e.Message != fmt.Sprintf("msg%d\n", i*10+7) {
+			t.Fatal("expected msg", i*10+7, ", but ", e.Message)
+		}
+	}
+
+	wc.Pipe.Filter = `'msg(['`
+	if err := wc.Check(); err == nil {
+		t.Fatal("the invalid regexp must be reported")
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	le := &model.LogEvent{Msg: []byte("level=warn"), Fields: field.Parse("level=error")}
+
+	// the lql condition refers the fields, and it is sent to the pipe
+	pc := &PipeConfig{Filter: `fields:level = "error"`}
+	if err := pc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	f, _ := preds.filter(pc.Filter)
+	if !f(le) || pc.getMsgRegexp() != nil || pc.getFilter() != pc.Filter {
+		t.Fatal("the field predicate must be evaluated by the pipe")
+	}
+
+	// the string literal is matched against the message only
+	for _, flt := range []string{`'level=warn'`, `"level=warn"`, `"level=w\x61rn"`} {
+		pc = &PipeConfig{Filter: flt}
+		if err := pc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for ", flt)
+		}
+		f, _ = preds.filter(pc.Filter)
+		if !f(le) || pc.getMsgRegexp() == nil || pc.getFilter() != "" {
+			t.Fatal("the message regexp must be evaluated by the worker for ", flt)
+		}
+	}
+	pc = &PipeConfig{Filter: `'level=error'`}
+	if f, _ = preds.filter(pc.Filter); f(le) {
+		t.Fatal("the fields must not be matched by the regexp")
+	}
+
+	// the pipe referred by name is not filtered by the worker
+	pc = &PipeConfig{Name: "p1"}
+	if pc.getMsgRegexp() != nil {
+		t.Fatal("no regexp expected for the named pipe")
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	tc := &testClient{events: newTestEvents(100)}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.MaxLineBytes = 5
+	wc.OnOversize = OnOversizeTruncate
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, ts)
+	defer func() {
+		cancel()
+		wait()
+	}()
+	waitPosition(t, w.getDesc(), "100")
+
+	f := &Forwarder{}
+	f.workers.Store(workers{"w1": w})
+	var ws WorkerStatus
+	w.fillStatus(&ws)
+	start := ws.ResetTime
+	if ws.Forwarded != 100 || ws.Oversized != 90 || ws.SinceReset.Forwarded != 100 || ws.SinceReset.Oversized != 90 {
+		t.Fatal("all the counters must be counted since the start, but ", ws)
+	}
+
+	f.ResetStats()
+	ws = WorkerStatus{}
+	w.fillStatus(&ws)
+	if ws.Forwarded != 100 || ws.Oversized != 90 || ws.SinceReset != (WorkerCounters{}) || !ws.ResetTime.After(start) {
+		t.Fatal("the lifetime counters must be kept, and the window ones reset, but ", ws)
+	}
+
+	tc.addEvents(newTestEventsFrom(100, 50))
+	waitPosition(t, w.getDesc(), "150")
+	ws = WorkerStatus{}
+	w.fillStatus(&ws)
+	if ws.Forwarded != 150 || ws.Oversized != 140 || ws.SinceReset.Forwarded != 50 || ws.SinceReset.Oversized != 50 {
+		t.Fatal("expected 50 records since the reset, but ", ws)
+	}
+
+	if err := f.ResetWorkerStats("w1"); err != nil {
+		t.Fatal("ResetWorkerStats() err=", err)
+	}
+	ws = WorkerStatus{}
+	w.fillStatus(&ws)
+	if ws.Forwarded != 150 || ws.SinceReset.Forwarded != 0 {
+		t.Fatal("the window counters must be reset, but ", ws)
+	}
+	if err := f.ResetWorkerStats("w2"); err == nil {
+		t.Fatal("ResetWorkerStats() must fail for unknown worker")
+	}
+}
+
+func TestStartFrom(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	for _, sf := range []string{"", StartFromBeginning, StartFromTail, "2019-08-01T00:00:00Z", "2019-08-01T00:00:00+03:00"} {
+		wc.StartFrom = sf
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for StartFrom=", sf)
+		}
+	}
+	for _, sf := range []string{"head", "Tail", "2019-08-01", "1564617600"} {
+		wc.StartFrom = sf
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for StartFrom=", sf)
+		}
+	}
+
+	defer func(d time.Duration) { idleInterval = d }(idleInterval)
+	idleInterval = 10 * time.Millisecond
+	runFresh := func(startFrom string) (*testClient, *testSink, *worker, func()) {
+		tc := &testClient{events: newTestEvents(10)}
+		ts := &testSink{}
+		wc := newTestWorkerConfig("w1", "p1")
+		wc.StartFrom = startFrom
+		ctx, cancel := context.WithCancel(context.Background())
+		w, wait := runTestWorker(ctx, wc, tc, ts)
+		return tc, ts, w, func() {
+			cancel()
+			wait()
+		}
+	}
+
+	// all the records are forwarded
+	for _, sf := range []string{"", StartFromBeginning} {
+		_, ts, w, stop := runFresh(sf)
+		waitPosition(t, w.getDesc(), "10")
+		stop()
+		if ts.count() != 10 || ts.events[0].Message != "msg0\n" {
+			t.Fatal("expected all the records forwarded for StartFrom=", sf, ", but ", ts.events)
+		}
+	}
+
+	// only the new records are forwarded
+	tc, ts, w, stop := runFresh(StartFromTail)
+	waitQueries(t, tc, 2)
+	tc.addEvents(newTestEventsFrom(10, 5))
+	waitPosition(t, w.getDesc(), "15")
+	stop()
+	if poss := tc.positions(); poss[0] != "tail" || poss[1] != "10" || ts.count() != 5 || ts.events[0].Message != "msg10\n" {
+		t.Fatal("expected the new records forwarded only, but ", ts.events, ", positions ", poss)
+	}
+
+	// the saved position is used regardless of StartFrom
+	wc = newTestWorkerConfig("w1", "p1")
+	wc.StartFrom = StartFromTail
+	d := &desc{Worker: wc}
+	d.setPosition("3")
+	w = newWorker(&workerConfig{desc: d, logger: log4g.GetLogger("forwarder")})
+	if qr, _ := w.prepareQuery("p1"); qr.Pos != "3" || qr.Query != "SELECT FROM p1" {
+		t.Fatal("expected the saved position, but ", qr)
+	}
+
+	// the records before the timestamp are filtered out
+	wc.StartFrom = "2019-08-01T00:00:00Z"
+	d.setPosition("")
+	if qr, _ := w.prepareQuery("p1"); qr.Pos != "" || qr.Query != "SELECT FROM p1 WHERE ts >= 1564617600000000000" {
+		t.Fatal("expected the timestamp condition, but ", qr)
+	}
+}
+
+func TestWorkerClock(t *testing.T) {
+	fc := utils.NewFakeClock(time.Unix(1000, 0))
+	tc := &testClient{}
+	ts := &testSink{}
+	d := &desc{Worker: newTestWorkerConfig("w1", "p1")}
+	d.setPosition("")
+	w := newWorker(&workerConfig{desc: d, sink: ts, rpcc: tc, clock: fc, logger: log4g.GetLogger("forwarder")})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = w.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the worker sleeps, because there are no events, the tail lag ticker runs as well
+	waitQueries(t, tc, 1)
+	start := time.Now()
+	for fc.Timers() < 2 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the worker must wait for the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tc.addEvents(newTestEvents(10))
+	fc.Advance(idleInterval)
+	waitCount(t, ts, 10)
+
+	var ws WorkerStatus
+	w.fillStatus(&ws)
+	if !ws.ResetTime.Equal(time.Unix(1000, 0)) || !ws.LastFlushTime.Equal(fc.Now()) ||
+		ws.Lag != fc.Now().Sub(time.Unix(0, 9)) {
+		t.Fatal("the times must be given by the clock, but ", ws)
+	}
+}
+
+// testStorage counts the writes
+type testStorage struct {
+	storage.Storage
+	writes int32
+}
+
+func (ts *testStorage) WriteData(key string, val []byte) error {
+	atomic.AddInt32(&ts.writes, 1)
+	return ts.Storage.WriteData(key, val)
+}
+
+func TestReloadIntervals(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.SyncWorkersIntervalSec = 1
+	cfg.StateStoreIntervalSec = 1000
+	cfg.ReloadFn = func() (*Config, error) {
+		nc := NewDefaultConfig()
+		nc.SyncWorkersIntervalSec = 1
+		nc.StateStoreIntervalSec = 1
+		return nc, nil
+	}
+
+	ts := &testStorage{Storage: storage.NewDefaultStorage()}
+	f, err := NewForwarder(cfg, &testClient{}, ts)
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		f.Close()
+	}()
+
+	if err = f.Run(ctx); err != nil {
+		t.Fatal("Run() err=", err)
+	}
+
+	// the config is reloaded in 1 sec, and the state is persisted in 1 sec after that
+	start := time.Now()
+	for atomic.LoadInt32(&ts.writes) == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the state must be persisted with the new interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	// the syslog sink could not connect to the closed port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen() err=", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cfg := NewDefaultConfig()
+	cfg.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1"), newTestWorkerConfig("w2", "p2")}
+	var nc *Config
+	cfg.ReloadFn = func() (*Config, error) {
+		return nc, nil
+	}
+	f, err := NewForwarder(cfg, &testClient{}, storage.NewDefaultStorage())
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		f.Close()
+	}()
+
+	if err = f.init(ctx); err != nil {
+		t.Fatal("init() err=", err)
+	}
+	wks := f.workers.Load().(workers)
+
+	nc = NewDefaultConfig()
+	nc.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1"), newTestWorkerConfig("w2", "p22"), newTestWorkerConfig("w3", "p3")}
+	nc.Workers[2].Sink = &sink.Config{Type: sink.SnkTypeSyslog, Params: sink.Params{"Protocol": "tcp", "RemoteAddr": addr}}
+	ok, err := f.reload(ctx)
+	if ok || err == nil || !strings.Contains(err.Error(), "Worker=w3") || strings.Contains(err.Error(), "Worker=w2") {
+		t.Fatal("the reload must be rejected because of w3, but ok=", ok, ", err=", err)
+	}
+	if len(f.cfg.Workers) != 2 || f.cfg.Workers[1].Pipe.Name != "p2" || f.getDescs()["w2"].Worker.Pipe.Name != "p2" {
+		t.Fatal("the old config must be kept, but workers=", f.cfg.Workers)
+	}
+	wks2 := f.workers.Load().(workers)
+	if len(wks2) != 2 || wks2["w1"] != wks["w1"] || wks2["w2"] != wks["w2"] || wks["w2"].isStopped() {
+		t.Fatal("the old workers must keep running, but workers=", wks2)
+	}
+
+	// the fixed config is applied
+	nc.Workers[2] = newTestWorkerConfig("w3", "p3")
+	if ok, err = f.reload(ctx); !ok || err != nil {
+		t.Fatal("the reload must succeed, but ok=", ok, ", err=", err)
+	}
+	wks2 = f.workers.Load().(workers)
+	if len(f.cfg.Workers) != 3 || wks2["w3"] == nil || wks2["w1"] != wks["w1"] || atomic.LoadInt32(&wks["w2"].state) == wsRunning {
+		t.Fatal("w3 must be started and w2 must be stopped for the restart, but workers=", wks2)
+	}
+}
+
+func waitQueries(t *testing.T, tc *testClient, n int) {
+	start := time.Now()
+	for len(tc.positions()) < n {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected ", n, " queries, but there are ", tc.positions())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitPosition(t *testing.T, d *desc, pos string) {
+	start := time.Now()
+	for d.getPosition() != pos {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected position ", pos, ", but it is ", d.getPosition())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEnableDisableWorker(t *testing.T) {
+	disabled, enabled := false, true
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.Enabled = &disabled
+	wc.Sink.Type = "unknown"
+	if err := wc.Check(); err == nil {
+		t.Fatal("the disabled worker must be checked")
+	}
+
+	tc := &testClient{events: newTestEvents(100)}
+	cfg := NewDefaultConfig()
+	cfg.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1")}
+	f, err := NewForwarder(cfg, tc, storage.NewDefaultStorage())
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		f.Close()
+	}()
+
+	if err = f.init(ctx); err != nil {
+		t.Fatal("init() err=", err)
+	}
+	w := f.workers.Load().(workers)["w1"]
+	waitPosition(t, w.getDesc(), "100")
+
+	// disable
+	nc := NewDefaultConfig()
+	nc.Workers = []*WorkerConfig{newTestWorkerConfig("w1", "p1")}
+	nc.Workers[0].Enabled = &disabled
+	f.cfg.Apply(nc)
+	f.sync(ctx)
+	if atomic.LoadInt32(&w.state) == wsRunning {
+		t.Fatal("the disabled worker must be stopped")
+	}
+	for !w.isStopped() {
+		time.Sleep(time.Millisecond)
+	}
+	f.sync(ctx)
+	if len(f.workers.Load().(workers)) != 0 {
+		t.Fatal("no workers must run, but workers=", f.workers.Load())
+	}
+	if d := f.getDescs()["w1"]; d == nil || d.getPosition() != "100" {
+		t.Fatal("the disabled worker must keep its position, but desc=", d)
+	}
+
+	// enable
+	tc.lock.Lock()
+	tc.events = append(tc.events, newTestEventsFrom(100, 50)...)
+	tc.poss = nil
+	tc.lock.Unlock()
+	nc.Workers[0].Enabled = &enabled
+	f.cfg.Apply(nc)
+	f.sync(ctx)
+	w = f.workers.Load().(workers)["w1"]
+	if w == nil || w.isStopped() {
+		t.Fatal("the enabled worker must be started")
+	}
+	waitPosition(t, w.getDesc(), "150")
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if tc.poss[0] != "100" {
+		t.Fatal("the enabled worker must continue from its position, but it started from ", tc.poss[0])
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarderResumeTest")
+	if err != nil {
+		t.Fatal("could not create temp dir, err=", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := storage.NewStorage(&storage.Config{Type: storage.TypeFile, Location: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatal("NewStorage() err=", err)
+	}
+	out := filepath.Join(dir, "out.log")
+	cfg := NewDefaultConfig()
+	cfg.StateStoreIntervalSec = 1
+	cfg.Workers = []*WorkerConfig{{Name: "w1", Pipe: &PipeConfig{Name: "p1"},
+		Sink: &sink.Config{Type: sink.SnkTypeFile, Params: sink.Params{"Path": out}}}}
+	tc := &testClient{events: newTestEvents(100)}
+
+	runForwarder := func(pos string) {
+		f, err := NewForwarder(cfg, tc, st)
+		if err != nil {
+			t.Fatal("NewForwarder() err=", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err = f.Run(ctx); err != nil {
+			t.Fatal("Run() err=", err)
+		}
+		waitPosition(t, f.getDescs()["w1"], pos)
+		cancel()
+		f.Close()
+	}
+
+	// the position is persisted on shutdown
+	runForwarder("100")
+	state, err := st.ReadData(storageKeyName)
+	if err != nil || !strings.Contains(string(state), `"Position":"100"`) {
+		t.Fatal("the position must be persisted, but state=", string(state), ", err=", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "state", storageKeyName+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("the temporary state file must be removed, err=", err)
+	}
+
+	// the forwarder crashes after forwarding 50 events more, so the state is not persisted
+	tc.addEvents(newTestEventsFrom(100, 50))
+	runForwarder("150")
+	if err = st.WriteData(storageKeyName, state); err != nil {
+		t.Fatal("WriteData() err=", err)
+	}
+
+	// the forwarder continues from the persisted position
+	tc.addEvents(newTestEventsFrom(150, 50))
+	runForwarder("200")
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal("could not read ", out, ", err=", err)
+	}
+	cnt := make(map[string]int)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for _, l := range lines {
+		cnt[l]++
+	}
+	for i := 0; i < 200; i++ {
+		if cnt[fmt.Sprintf("msg%d", i)] == 0 {
+			t.Fatal("msg", i, " is not forwarded")
+		}
+	}
+	// only the events forwarded after the persisted position are sent again
+	if len(lines) != 250 || cnt["msg149"] != 2 || cnt["msg150"] != 1 {
+		t.Fatal("expected 50 events sent twice, but forwarded ", len(lines), " events")
+	}
+}
+
+// testNetError is a retryable sink error
+type testNetError struct{}
+
+func (testNetError) Error() string   { return "test network error" }
+func (testNetError) Timeout() bool   { return true }
+func (testNetError) Temporary() bool { return true }
+
+// flakySink fails the OnEvent call number failOn (starting from 1) once
+type flakySink struct {
+	testSink
+	calls  int
+	failOn int
+}
+
+func (fs *flakySink) OnEvent(events []*api.LogEvent) error {
+	fs.lock.Lock()
+	fs.calls++
+	fail := fs.calls == fs.failOn
+	fs.lock.Unlock()
+	if fail {
+		return testNetError{}
+	}
+	return fs.testSink.OnEvent(events)
+}
+
+func TestDeliveryMode(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.DeliveryMode = "exactly_once"
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for unknown DeliveryMode")
+	}
+
+	for _, mode := range []string{"", DeliveryAtLeastOnce, DeliveryAtMostOnce} {
+		wc := newTestWorkerConfig("w1", "p1")
+		wc.DeliveryMode = mode
+		wc.Retry = &RetryConfig{MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 1, Multiplier: 1}
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err)
+		}
+
+		tc := &testClient{events: newTestEvents(30), limit: 10}
+		fs := &flakySink{failOn: 2}
+		// the number of events sent, when the position is committed
+		var commits []int
+		d := &desc{Worker: wc}
+		d.setPosition("")
+		w := newWorker(&workerConfig{desc: d, sink: fs, rpcc: tc, logger: log4g.GetLogger("forwarder").WithId("[w1]").(log4g.Logger),
+			commit: func() error {
+				commits = append(commits, fs.count())
+				return nil
+			}})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			_ = w.run(ctx)
+			close(done)
+		}()
+		waitPosition(t, d, "30")
+		cancel()
+		<-done
+
+		if mode == DeliveryAtMostOnce {
+			// the position is committed before the events are sent, the failed ones are lost
+			if fs.count() != 20 || fs.events[9].Message != "msg9\n" || fs.events[10].Message != "msg20\n" {
+				t.Fatal("expected 20 events with the failed ones lost, but got ", fs.count())
+			}
+			if !reflect.DeepEqual(commits, []int{0, 10, 10}) {
+				t.Fatal("the position must be committed before every batch, but commits=", commits)
+			}
+		} else {
+			// the position is moved after the events are sent, the failed ones are sent again
+			if fs.count() != 30 || fs.events[10].Message != "msg10\n" {
+				t.Fatal("expected all the 30 events, but got ", fs.count())
+			}
+			if len(commits) != 0 {
+				t.Fatal("the position must not be committed, but commits=", commits)
+			}
+		}
+	}
+}
+
+// failingSink fails all the OnEvent calls with err
+type failingSink struct {
+	testSink
+	err error
+}
+
+func (fs *failingSink) OnEvent(events []*api.LogEvent) error {
+	return fs.err
+}
+
+func TestStatus(t *testing.T) {
+	f, err := NewForwarder(NewDefaultConfig(), &testClient{}, storage.NewDefaultStorage())
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	disabled := false
+	wc0 := newTestWorkerConfig("w0", "p0")
+	wc0.Enabled = &disabled
+	wc1 := newTestWorkerConfig("w1", "p1")
+	wc2 := newTestWorkerConfig("w2", "p2")
+	wc2.Retry = &RetryConfig{MaxAttempts: 100, InitialBackoffMs: 60000, MaxBackoffMs: 60000, Multiplier: 1}
+
+	tc := &testClient{events: newTestEventsFrom(1, 10)}
+	ts := &testSink{}
+	fs := &failingSink{err: testNetError{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	w1, wait1 := runTestWorker(ctx, wc1, tc, ts)
+	w2, wait2 := runTestWorker(ctx, wc2, tc, fs)
+	defer func() {
+		cancel()
+		wait1()
+		wait2()
+	}()
+
+	f.setDescs(descs{"w0": &desc{Worker: wc0}, "w1": w1.getDesc(), "w2": w2.getDesc()})
+	f.workers.Store(workers{"w1": w1, "w2": w2})
+	waitCount(t, ts, 10)
+
+	start := time.Now()
+	for {
+		st := f.Status()
+		if len(st) != 3 || st[0].Name != "w0" || st[1].Name != "w1" || st[2].Name != "w2" {
+			t.Fatal("unexpected status ", st)
+		}
+		if st[2].Backoff > 0 {
+			if st[0].State != WorkerStateDisabled || st[1].State != WorkerStateRunning || st[2].State != WorkerStateRunning {
+				t.Fatal("unexpected states ", st)
+			}
+			if st[1].Forwarded != 10 || st[1].Position != "10" || st[1].LastRecordTime != time.Unix(0, 10) ||
+				st[1].Lag <= 0 || st[1].LastFlushTime.IsZero() || st[1].LastError != "" {
+				t.Fatal("unexpected w1 status ", st[1])
+			}
+			// the failing sink error surfaces in the status
+			if st[2].LastError != "test network error" || st[2].LastErrorTime.IsZero() || st[2].Forwarded != 0 || st[2].Position != "" {
+				t.Fatal("unexpected w2 status ", st[2])
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the w2 worker must be in backoff, but status=", st[2])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// poisonSink fails the OnEvent calls, which contain the poison message
+type poisonSink struct {
+	testSink
+	poison string
+}
+
+func (ps *poisonSink) OnEvent(events []*api.LogEvent) error {
+	for _, e := range events {
+		if e.Message == ps.poison {
+			return fmt.Errorf("poison record")
+		}
+	}
+	return ps.testSink.OnEvent(events)
+}
+
+func TestDeadLetter(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.DeadLetter = &sink.Config{Type: "unknown"}
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for the invalid DeadLetter")
+	}
+	wc.DeadLetter = &sink.Config{Type: sink.SnkTypeStdout}
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() must succeed, but err=", err)
+	}
+
+	tc := &testClient{}
+	evs := newTestEvents(10)
+	evs[3].Fields = "f1=v1"
+	tc.addEvents(evs)
+
+	ps := &poisonSink{poison: "msg3\n"}
+	dls := &testSink{}
+	d := &desc{Worker: wc}
+	d.setPosition("")
+	w := newWorker(&workerConfig{desc: d, sink: ps, deadLetter: dls, rpcc: tc,
+		logger: log4g.GetLogger("forwarder").WithId("[w1]").(log4g.Logger)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = w.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the poison record doesn't stall the worker
+	waitPosition(t, d, "10")
+	if ps.count() != 9 || dls.count() != 1 {
+		t.Fatal("expected 9 events sent and 1 in the dead letter, but ", ps.count(), " and ", dls.count())
+	}
+
+	dls.lock.Lock()
+	de := dls.events[0]
+	dls.lock.Unlock()
+	if de.Message != "msg3\n" || de.Fields != `f1=v1,`+DeadLetterErrorField+`="poison record"` {
+		t.Fatal("unexpected dead letter event ", de)
+	}
+	if evs[3].Fields != "f1=v1" {
+		t.Fatal("the original event must not be changed, but ", evs[3])
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var lock sync.Mutex
+	var received []*api.LogEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evs []*api.LogEvent
+		if err := json.NewDecoder(r.Body).Decode(&evs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		received = append(received, evs...)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := NewDefaultConfig()
+	cfg.StateStoreIntervalSec = 1000
+	cfg.Workers = []*WorkerConfig{{Name: "w1", Pipe: &PipeConfig{Name: "p1"},
+		Sink: &sink.Config{Type: sink.SnkTypeHttp, Params: sink.Params{"URL": srv.URL, "BatchSize": 1000}}}}
+	tc := &testClient{events: newTestEvents(100)}
+	st := &testStorage{Storage: storage.NewDefaultStorage()}
+	f, err := NewForwarder(cfg, tc, st)
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+	if err = f.Run(context.Background()); err != nil {
+		t.Fatal("Run() err=", err)
+	}
+	// the position is moved, when the events are sent by the batching sink
+	waitPosition(t, f.getDescs()["w1"], "100")
+	lock.Lock()
+	n := len(received)
+	lock.Unlock()
+	if n != 100 {
+		t.Fatal("the events must be sent before the position is moved, but ", n, " received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = f.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown() err=", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Shutdown() must not wait for the workers queries, but took ", time.Since(start))
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal("Close() err=", err)
+	}
+
+	lock.Lock()
+	n = len(received)
+	lock.Unlock()
+	if n != 100 {
+		t.Fatal("the events must be sent once, but ", n, " received")
+	}
+	state, err := st.ReadData(storageKeyName)
+	if err != nil || !strings.Contains(string(state), `"Position":"100"`) {
+		t.Fatal("the position must be persisted, but state=", string(state), ", err=", err)
+	}
+}
+
+func TestReplaceSinks(t *testing.T) {
+	var lock sync.Mutex
+	var received []*api.LogEvent
+	tokens := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evs []*api.LogEvent
+		if err := json.NewDecoder(r.Body).Decode(&evs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// the worker is slowed down, so the sinks are replaced while it runs
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		received = append(received, evs...)
+		tokens[r.Header.Get("Authorization")] += len(evs)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	newConfig := func(token string) *Config {
+		cfg := NewDefaultConfig()
+		cfg.Workers = []*WorkerConfig{{Name: "w1", Pipe: &PipeConfig{Name: "p1"},
+			Sink: &sink.Config{Type: sink.SnkTypeHttp, Params: sink.Params{"URL": srv.URL, "BatchSize": 1},
+				Auth: &sink.AuthConfig{BearerToken: token}}}}
+		return cfg
+	}
+	dir, err := ioutil.TempDir("", "forwarderReplaceSinksTest")
+	if err != nil {
+		t.Fatal("could not create temp dir, err=", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the state of the other tests is not loaded
+	st, err := storage.NewStorage(&storage.Config{Type: storage.TypeFile, Location: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatal("NewStorage() err=", err)
+	}
+	tc := &testClient{events: newTestEvents(200), limit: 1}
+	f, err := NewForwarder(newConfig("t1"), tc, st)
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		f.Close()
+	}()
+
+	if err = f.init(ctx); err != nil {
+		t.Fatal("init() err=", err)
+	}
+	w := f.workers.Load().(workers)["w1"]
+	waitFor(t, "some events are sent", func() bool {
+		pos, _ := strconv.Atoi(w.getDesc().getPosition())
+		return pos >= 20
+	})
+
+	// rotate the token
+	f.cfg.Apply(newConfig("t2"))
+	f.sync(ctx)
+	if f.workers.Load().(workers)["w1"] != w || w.isStopped() {
+		t.Fatal("the worker must keep running")
+	}
+	d := f.getDescs()["w1"]
+	if d.Worker.Sink.Auth.BearerToken != "t2" || !w.hasDesc(d) {
+		t.Fatal("the worker must run for the new desc=", d)
+	}
+	f.sync(ctx)
+	if f.workers.Load().(workers)["w1"] != w {
+		t.Fatal("the worker must not be restarted by the next sync")
+	}
+	waitPosition(t, d, "200")
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 200 || tokens["Bearer t1"] < 20 || tokens["Bearer t2"] == 0 {
+		t.Fatal("expected 200 events sent with both tokens, but ", len(received), ", tokens=", tokens)
+	}
+	for i, e := range received {
+		if e.Message != fmt.Sprintf("msg%d\n", i) {
+			t.Fatal("the events must be sent once in order, but ", i, "th is ", e.Message)
+		}
+	}
+
+	// the pipe is changed, so the worker is restarted
+	nc := newConfig("t2")
+	nc.Workers[0].Pipe.Name = "p2"
+	f.cfg.Apply(nc)
+	f.sync(ctx)
+	if atomic.LoadInt32(&w.state) == wsRunning || f.getDescs()["w1"].getPosition() != "" {
+		t.Fatal("the worker must be restarted from the beginning")
+	}
+}
+
+func TestTailLag(t *testing.T) {
+	defer func(d time.Duration) { tailLagInterval = d }(tailLagInterval)
+	tailLagInterval = 10 * time.Millisecond
+
+	evs := newTestEvents(100)
+	for i, e := range evs {
+		e.Timestamp = int64(i) * int64(time.Second)
+	}
+	tc := &testClient{events: evs}
+	ss := &stalledSink{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, newTestWorkerConfig("w1", "p1"), tc, ss)
+	defer func() {
+		cancel()
+		wait()
+	}()
+
+	tailLag := func() time.Duration {
+		var ws WorkerStatus
+		w.fillStatus(&ws)
+		return ws.TailLag
+	}
+	// the sink doesn't accept the records, so the worker is behind the source
+	waitFor(t, "the lag is reported", func() bool { return tailLag() == 99*time.Second })
+
+	close(ss.release)
+	waitPosition(t, w.getDesc(), "100")
+	waitFor(t, "the lag is gone", func() bool { return tailLag() == 0 })
+}
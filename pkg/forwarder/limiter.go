@@ -0,0 +1,64 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/pkg/utils"
+	"time"
+)
+
+// limiter is the token bucket, which allows to take rate tokens per second. The
+// bucket capacity is rate, so up to 1 second of the rate could be taken at once.
+// More tokens could be taken, than the bucket has, then the caller waits until
+// the debt is payed off.
+type limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	clock  utils.Clock
+}
+
+// newLimiter returns the limiter for the rate provided, or nil if rate is 0 (no limit)
+func newLimiter(clock utils.Clock, rate int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{rate: float64(rate), tokens: float64(rate), last: clock.Now(), clock: clock}
+}
+
+// take takes n tokens waiting until they are available. It returns the time
+// spent in waiting. The nil limiter never waits.
+func (l *limiter) take(ctx context.Context, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	utils.SleepClock(ctx, l.clock, wait)
+	return l.clock.Now().Sub(now)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/pkg/utils"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var l *limiter
+	if l.take(context.Background(), 1000000) != 0 || newLimiter(utils.RealClock, 0) != nil {
+		t.Fatal("nil limiter must not wait")
+	}
+
+	// 1000 tokens are in the bucket, other 1000 are given in 1 second
+	l = newLimiter(utils.RealClock, 1000)
+	start := time.Now()
+	waited := time.Duration(0)
+	for i := 0; i < 20; i++ {
+		waited += l.take(context.Background(), 100)
+	}
+	el := time.Since(start)
+	if el < 900*time.Millisecond || el > 2*time.Second || waited < 900*time.Millisecond {
+		t.Fatal("expected about 1 sec, but elapsed=", el, ", waited=", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	l.take(ctx, 100000)
+	if time.Since(start) > time.Second {
+		t.Fatal("the closed context must interrupt the wait")
+	}
+}
+
+func TestWorkerRateLimit(t *testing.T) {
+	tc := &testClient{events: newTestEvents(1500)}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.RateLimit = &RateLimitConfig{RecordsPerSec: 1000}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	w, wait := runTestWorker(ctx, wc, tc, ts)
+	waitCount(t, ts, 1500)
+	el := time.Since(start)
+	cancel()
+	wait()
+
+	// 1000 records are sent at once, and 500 in 0.5 sec
+	if el < 400*time.Millisecond || w.getThrottled() < 400*time.Millisecond {
+		t.Fatal("the rate must be limited, but elapsed=", el, ", throttled=", w.getThrottled())
+	}
+}
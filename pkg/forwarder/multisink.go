@@ -0,0 +1,164 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/forwarder/sink"
+	"strings"
+	"sync"
+)
+
+type (
+	// multiSink writes the events to several sinks. The OnEvent succeeds when
+	// all the sinks accepted the events. If some sinks failed, and OnEvent is
+	// called again with the same events (the worker retries the batch, or
+	// sends its records one by one to the dead letter sink), the events are
+	// sent to the failed sinks only. OnEvent could be called concurrently by
+	// the writers (see WorkerConfig.Concurrency) for different events.
+	multiSink struct {
+		sinks []sink.Sink
+
+		lock sync.Mutex
+		// acked contains the events, which some sinks failed to accept, and
+		// whether the sinks accepted them by the sinks indexes
+		acked map[*api.LogEvent][]bool
+	}
+
+	// multiSinkError contains the errors of the sinks by their indexes, nil
+	// for the sinks succeeded
+	multiSinkError struct {
+		errs []error
+	}
+)
+
+func newMultiSink(sinks []sink.Sink) *multiSink {
+	return &multiSink{sinks: sinks, acked: make(map[*api.LogEvent][]bool)}
+}
+
+// OnEvent sends the events to all the sinks, every sink gets the events it
+// has not accepted yet. The error returned is retryable if all the sinks
+// errors are retryable.
+func (ms *multiSink) OnEvent(events []*api.LogEvent) error {
+	var me *multiSinkError
+	for i, s := range ms.sinks {
+		evs := ms.pending(i, events)
+		if len(evs) == 0 {
+			continue
+		}
+		if err := s.OnEvent(evs); err != nil {
+			me = me.add(i, err, len(ms.sinks))
+		}
+	}
+
+	if me == nil {
+		ms.forget(events)
+		return nil
+	}
+
+	ms.lock.Lock()
+	for _, e := range events {
+		acks, ok := ms.acked[e]
+		if !ok {
+			acks = make([]bool, len(ms.sinks))
+			ms.acked[e] = acks
+		}
+		for i, err := range me.errs {
+			if err == nil {
+				acks[i] = true
+			}
+		}
+	}
+	ms.lock.Unlock()
+	return me
+}
+
+func (ms *multiSink) Close() error {
+	var me *multiSinkError
+	for i, s := range ms.sinks {
+		if err := s.Close(); err != nil {
+			me = me.add(i, err, len(ms.sinks))
+		}
+	}
+	if me != nil {
+		return me
+	}
+	return nil
+}
+
+// pending returns the events, which are not accepted by the sink i yet
+func (ms *multiSink) pending(i int, events []*api.LogEvent) []*api.LogEvent {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if len(ms.acked) == 0 {
+		return events
+	}
+	res := events[:0:0]
+	for _, e := range events {
+		if acks, ok := ms.acked[e]; !ok || !acks[i] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// forget removes the events from the acked, it is called when the events are
+// accepted by all the sinks, or the worker doesn't retry them anymore
+func (ms *multiSink) forget(events []*api.LogEvent) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if len(ms.acked) == 0 {
+		return
+	}
+	for _, e := range events {
+		delete(ms.acked, e)
+	}
+}
+
+//===================== multiSinkError =====================
+
+// add sets the error of the sink i, the multiSinkError for n sinks is created if me is nil
+func (me *multiSinkError) add(i int, err error, n int) *multiSinkError {
+	if me == nil {
+		me = &multiSinkError{errs: make([]error, n)}
+	}
+	me.errs[i] = err
+	return me
+}
+
+func (me *multiSinkError) Error() string {
+	var sb strings.Builder
+	for i, err := range me.errs {
+		if err == nil {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(fmt.Sprintf("sink[%d]: %v", i, err))
+	}
+	return sb.String()
+}
+
+// Retryable returns true if all the errors are retryable
+func (me *multiSinkError) Retryable() bool {
+	for _, err := range me.errs {
+		if err != nil && !sink.IsRetryable(err) {
+			return false
+		}
+	}
+	return true
+}
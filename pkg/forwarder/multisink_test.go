@@ -0,0 +1,260 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/jrivets/log4g"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/forwarder/sink"
+	"github.com/logrange/logrange/pkg/utils"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMultiSinkCheck(t *testing.T) {
+	wc := &WorkerConfig{Name: "w1", Pipe: &PipeConfig{Name: "p1"}}
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail when no sinks are set")
+	}
+
+	wc.Sinks = []*sink.Config{{Type: sink.SnkTypeStdout}, {Type: "unknown"}}
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for the invalid Sinks[1]")
+	}
+
+	wc.Sinks[1].Type = sink.SnkTypeStdout
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() must succeed, but err=", err)
+	}
+	if len(wc.getSinks()) != 2 {
+		t.Fatal("expected 2 sinks, but got ", wc.getSinks())
+	}
+
+	// the single Sink is still supported, and goes first
+	wc.Sink = &sink.Config{Type: sink.SnkTypeStdout}
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() must succeed, but err=", err)
+	}
+	if ss := wc.getSinks(); len(ss) != 3 || ss[0] != wc.Sink {
+		t.Fatal("unexpected sinks ", ss)
+	}
+}
+
+func TestMultiSinkRetry(t *testing.T) {
+	ts1 := &testSink{}
+	ts2 := &flakySink{failOn: 1}
+	ms := newMultiSink([]sink.Sink{ts1, ts2})
+
+	evs := newTestEvents(5)
+	err := ms.OnEvent(evs)
+	if err == nil || !sink.IsRetryable(err) {
+		t.Fatal("expected retryable error, but err=", err)
+	}
+	if ts1.count() != 5 || ts2.count() != 0 {
+		t.Fatal("unexpected counts ", ts1.count(), ts2.count())
+	}
+
+	// the retry goes to the failed sink only
+	if err := ms.OnEvent(evs); err != nil {
+		t.Fatal("OnEvent() must succeed, but err=", err)
+	}
+	if ts1.count() != 5 || ts2.count() != 5 || len(ms.acked) != 0 {
+		t.Fatal("unexpected counts ", ts1.count(), ts2.count(), ", or the acks kept ", ms.acked)
+	}
+
+	// new events go to all the sinks
+	if err := ms.OnEvent(newTestEventsFrom(5, 5)); err != nil {
+		t.Fatal("OnEvent() must succeed, but err=", err)
+	}
+	if ts1.count() != 10 || ts2.count() != 10 {
+		t.Fatal("unexpected counts ", ts1.count(), ts2.count())
+	}
+}
+
+func TestMultiSinkError(t *testing.T) {
+	ms := newMultiSink([]sink.Sink{&failingSink{err: testNetError{}}, &testSink{}, &failingSink{err: fmt.Errorf("fatal")}})
+	err := ms.OnEvent(newTestEvents(1))
+	if err == nil || sink.IsRetryable(err) {
+		t.Fatal("expected not retryable error, but err=", err)
+	}
+	if err.Error() != "sink[0]: test network error; sink[2]: fatal" {
+		t.Fatal("unexpected error ", err)
+	}
+}
+
+func TestMultiSinkWorker(t *testing.T) {
+	tc := &testClient{}
+	tc.addEvents(newTestEvents(10))
+
+	ts1 := &testSink{}
+	ts2 := &flakySink{failOn: 1}
+	wc := newTestWorkerConfig("w1", "p1")
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, newMultiSink([]sink.Sink{ts1, ts2}))
+	defer func() {
+		cancel()
+		wait()
+	}()
+
+	// the position is moved only when both sinks accepted the events, and
+	// the sink succeeded first doesn't get the events twice
+	waitPosition(t, w.getDesc(), "10")
+	if ts1.count() != 10 || ts2.count() != 10 {
+		t.Fatal("unexpected counts ", ts1.count(), ts2.count())
+	}
+	time.Sleep(10 * time.Millisecond)
+	if pos, _ := strconv.Atoi(w.getDesc().getPosition()); pos != 10 || ts1.count() != 10 {
+		t.Fatal("unexpected position ", pos, " or count ", ts1.count())
+	}
+}
+
+// periodicSink fails every period-th OnEvent call
+type periodicSink struct {
+	testSink
+	calls  int
+	period int
+}
+
+func (ps *periodicSink) OnEvent(events []*api.LogEvent) error {
+	ps.lock.Lock()
+	ps.calls++
+	fail := ps.calls%ps.period == 0
+	ps.lock.Unlock()
+	if fail {
+		return testNetError{}
+	}
+	return ps.testSink.OnEvent(events)
+}
+
+func TestMultiSinkConcurrency(t *testing.T) {
+	tc := &testClient{events: newTestEvents(400), limit: 10}
+	ps1, ps2 := &periodicSink{period: 3}, &periodicSink{period: 5}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.BufferSize = 40
+	wc.Concurrency = 4
+	wc.Retry = &RetryConfig{MaxAttempts: 100, InitialBackoffMs: 1, MaxBackoffMs: 1, Multiplier: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, newMultiSink([]sink.Sink{ps1, ps2}))
+	waitPosition(t, w.getDesc(), "400")
+	cancel()
+	wait()
+
+	// the retries of the concurrent writers go to the failed sinks only
+	for i, ps := range []*periodicSink{ps1, ps2} {
+		seen := make(map[string]bool)
+		for _, e := range ps.events {
+			if seen[e.Message] {
+				t.Fatal("the sink ", i, " got ", e.Message, " twice")
+			}
+			seen[e.Message] = true
+		}
+		if len(seen) != 400 {
+			t.Fatal("expected 400 events in the sink ", i, ", but ", len(seen))
+		}
+	}
+}
+
+// copyingClient returns the copies of the events, like the real client, which
+// decodes every query result
+type copyingClient struct {
+	*testClient
+}
+
+func (cc copyingClient) Query(ctx context.Context, req *api.QueryRequest, res *api.QueryResult) error {
+	err := cc.testClient.Query(ctx, req, res)
+	evs := make([]*api.LogEvent, len(res.Events))
+	for i, e := range res.Events {
+		ce := *e
+		evs[i] = &ce
+	}
+	res.Events = evs
+	return err
+}
+
+func TestMultiSinkWorkerRetry(t *testing.T) {
+	fc := utils.NewFakeClock(time.Unix(1000, 0))
+	tc := &testClient{events: newTestEvents(10)}
+	ts1, ts2 := &testSink{}, &flakySink{failOn: 1}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.Retry = &RetryConfig{MaxAttempts: 1, InitialBackoffMs: 1, MaxBackoffMs: 1, Multiplier: 1}
+	d := &desc{Worker: wc}
+	d.setPosition("")
+	w := newWorker(&workerConfig{desc: d, sink: newMultiSink([]sink.Sink{ts1, ts2}), rpcc: copyingClient{tc},
+		clock: fc, logger: log4g.GetLogger("forwarder")})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = w.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the worker backs off after the failed attempt, the tail lag ticker runs as well
+	start := time.Now()
+	for fc.Timers() < 2 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the worker must back off")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fc.Advance(5 * time.Second)
+	waitPosition(t, d, "10")
+
+	// the events are not read again, so the retry goes to the failed sink only
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if ts1.count() != 10 || ts2.count() != 10 || tc.poss[0] != "" || (len(tc.poss) > 1 && tc.poss[1] != "10") {
+		t.Fatal("expected 10 events in every sink read once, but ", ts1.count(), ", ", ts2.count(), ", queries=", tc.poss)
+	}
+}
+
+func TestMultiSinkDeadLetter(t *testing.T) {
+	tc := &testClient{}
+	tc.addEvents(newTestEvents(10))
+
+	ts := &testSink{}
+	ps := &poisonSink{poison: "msg3\n"}
+	dls := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.DeadLetter = &sink.Config{Type: sink.SnkTypeStdout}
+	d := &desc{Worker: wc}
+	d.setPosition("")
+	w := newWorker(&workerConfig{desc: d, sink: newMultiSink([]sink.Sink{ts, ps}), deadLetter: dls, rpcc: tc,
+		logger: log4g.GetLogger("forwarder").WithId("[w1]").(log4g.Logger)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = w.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the records are sent one by one to the failed sink only, so the sink
+	// accepted the batch doesn't get the records twice
+	waitPosition(t, d, "10")
+	if ts.count() != 10 || ps.count() != 9 || dls.count() != 1 {
+		t.Fatal("expected 10, 9 and 1 events, but ", ts.count(), ", ", ps.count(), " and ", dls.count())
+	}
+}
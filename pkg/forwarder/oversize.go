@@ -0,0 +1,153 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"github.com/logrange/logrange/api"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+type (
+	// lineGuard limits the records messages size according to the
+	// WorkerConfig.MaxLineBytes and OnOversize
+	lineGuard struct {
+		maxBytes   int
+		onOversize string
+		// oversized contains the number of the oversized records found
+		oversized uint64
+	}
+)
+
+const (
+	// OnOversizeTruncate is the WorkerConfig.OnOversize policy, when the oversized
+	// messages are truncated, and the TruncatedMarker is appended to them
+	OnOversizeTruncate = "truncate"
+	// OnOversizeDrop is the WorkerConfig.OnOversize policy, when the oversized
+	// records are not sent
+	OnOversizeDrop = "drop"
+	// OnOversizeSplit is the WorkerConfig.OnOversize policy, when the oversized
+	// messages are split to several records with the same timestamp, tags and fields
+	OnOversizeSplit = "split"
+
+	// TruncatedMarker is appended to the truncated messages
+	TruncatedMarker = "...[truncated]"
+)
+
+// newLineGuard returns the lineGuard for the worker config wc, or nil if the
+// messages size is not limited
+func newLineGuard(wc *WorkerConfig) *lineGuard {
+	if wc.MaxLineBytes <= 0 {
+		return nil
+	}
+	onOversize := wc.OnOversize
+	if onOversize == "" {
+		onOversize = OnOversizeTruncate
+	}
+	return &lineGuard{maxBytes: wc.MaxLineBytes, onOversize: onOversize}
+}
+
+// apply returns the records, which messages are not longer than maxBytes. The
+// orig contains the records as they were read, the result orig contains the
+// read record for every record returned. The trailing new line of a message is
+// counted, and it is kept in the truncated and split messages.
+func (lg *lineGuard) apply(orig, events []*api.LogEvent) ([]*api.LogEvent, []*api.LogEvent) {
+	resOrig, res := orig[:0:0], events[:0:0]
+	for i, e := range events {
+		if len(e.Message) <= lg.maxBytes {
+			resOrig = append(resOrig, orig[i])
+			res = append(res, e)
+			continue
+		}
+
+		atomic.AddUint64(&lg.oversized, 1)
+		switch lg.onOversize {
+		case OnOversizeDrop:
+		case OnOversizeSplit:
+			for _, chunk := range splitMessage(e.Message, lg.maxBytes) {
+				ee := *e
+				ee.Message = chunk
+				resOrig = append(resOrig, orig[i])
+				res = append(res, &ee)
+			}
+		default:
+			ee := *e
+			ee.Message = truncateMessage(e.Message, lg.maxBytes)
+			resOrig = append(resOrig, orig[i])
+			res = append(res, &ee)
+		}
+	}
+	return resOrig, res
+}
+
+// getOversized returns the number of the oversized records found
+func (lg *lineGuard) getOversized() uint64 {
+	return atomic.LoadUint64(&lg.oversized)
+}
+
+// truncateMessage cuts msg to max bytes, including the TruncatedMarker and
+// the trailing new line, if msg has it
+func truncateMessage(msg string, max int) string {
+	body, nl := cutNewLine(msg)
+	n := max - len(nl) - len(TruncatedMarker)
+	if n <= 0 {
+		// no room for the marker
+		return msg[:runeBoundary(msg, max)]
+	}
+	return body[:runeBoundary(body, n)] + TruncatedMarker + nl
+}
+
+// splitMessage splits msg to the chunks of up to max bytes. Every chunk ends
+// with the new line, if msg has it.
+func splitMessage(msg string, max int) []string {
+	body, nl := cutNewLine(msg)
+	n := max - len(nl)
+	if n <= 0 {
+		// the new line doesn't fit
+		n, nl = max, ""
+	}
+
+	var res []string
+	for len(body) > 0 {
+		end := runeBoundary(body, n)
+		if end == 0 {
+			// the rune is longer than max
+			_, end = utf8.DecodeRuneInString(body)
+		}
+		res = append(res, body[:end]+nl)
+		body = body[end:]
+	}
+	return res
+}
+
+func cutNewLine(msg string) (string, string) {
+	if strings.HasSuffix(msg, "\n") {
+		return msg[:len(msg)-1], "\n"
+	}
+	return msg, ""
+}
+
+// runeBoundary returns the greatest position up to n, which doesn't split a
+// rune of s
+func runeBoundary(s string, n int) int {
+	if n >= len(s) {
+		return len(s)
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
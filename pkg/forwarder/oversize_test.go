@@ -0,0 +1,161 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/api"
+	"strings"
+	"testing"
+)
+
+func TestOversizeCheck(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.MaxLineBytes = 100
+	for _, p := range []string{"", OnOversizeTruncate, OnOversizeDrop, OnOversizeSplit} {
+		wc.OnOversize = p
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for OnOversize=", p)
+		}
+	}
+
+	for _, p := range []string{"cut", "Drop"} {
+		wc.OnOversize = p
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for OnOversize=", p)
+		}
+	}
+
+	wc.OnOversize = ""
+	wc.MaxLineBytes = -1
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for negative MaxLineBytes")
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	if m := truncateMessage(strings.Repeat("a", 30)+"\n", 20); m != "aaaaa"+TruncatedMarker+"\n" {
+		t.Fatal("unexpected truncated message ", m)
+	}
+	if m := truncateMessage(strings.Repeat("a", 30), 20); m != "aaaaaa"+TruncatedMarker {
+		t.Fatal("unexpected truncated message ", m)
+	}
+	// the runes are not split
+	if m := truncateMessage("aaaaa"+strings.Repeat("б", 10), 20); len(m) != 19 || m != "aaaaa"+TruncatedMarker {
+		t.Fatal("unexpected truncated message ", m)
+	}
+	if m := truncateMessage(strings.Repeat("a", 30), 10); m != strings.Repeat("a", 10) {
+		t.Fatal("the message must be cut with no marker, but ", m)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	res := splitMessage("aaabbbcc\n", 4)
+	if len(res) != 3 || res[0] != "aaa\n" || res[1] != "bbb\n" || res[2] != "cc\n" {
+		t.Fatal("unexpected chunks ", res)
+	}
+	res = splitMessage("aбвгд", 4)
+	if len(res) != 3 || res[0] != "aб" || res[1] != "вг" || res[2] != "д" {
+		t.Fatal("unexpected chunks ", res)
+	}
+}
+
+func testOversizeWorker(t *testing.T, onOversize string, bufferSize int) *testSink {
+	huge := strings.Repeat("x", 10000) + "\n"
+	tc := &testClient{events: []*api.LogEvent{
+		{Timestamp: 1, Message: "msg1\n", Tags: "app=a"},
+		{Timestamp: 2, Message: huge, Tags: "app=b", Fields: "f=1"},
+		{Timestamp: 3, Message: "msg3\n", Tags: "app=a"},
+	}}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.MaxLineBytes = 1000
+	wc.OnOversize = onOversize
+	wc.BufferSize = bufferSize
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, ts)
+	waitPosition(t, w.getDesc(), "3")
+	cancel()
+	wait()
+
+	var ws WorkerStatus
+	w.fillStatus(&ws)
+	if ws.Oversized != 1 || ws.Forwarded != uint64(len(ts.events)) {
+		t.Fatal("expected 1 oversized and ", len(ts.events), " forwarded, but status=", ws)
+	}
+	for _, e := range ts.events {
+		if len(e.Message) > wc.MaxLineBytes {
+			t.Fatal("the message of ", len(e.Message), " bytes is sent")
+		}
+	}
+	if ts.events[0].Message != "msg1\n" || ts.events[len(ts.events)-1].Message != "msg3\n" {
+		t.Fatal("the records must be sent as is, but ", ts.events)
+	}
+	return ts
+}
+
+func TestOversizeTruncate(t *testing.T) {
+	ts := testOversizeWorker(t, OnOversizeTruncate, 0)
+	if len(ts.events) != 3 || len(ts.events[1].Message) != 1000 ||
+		!strings.HasSuffix(ts.events[1].Message, TruncatedMarker+"\n") || ts.events[1].Tags != "app=b" {
+		t.Fatal("the record must be truncated, but ", ts.events[1])
+	}
+}
+
+func TestOversizeDrop(t *testing.T) {
+	for _, bs := range []int{0, 10} {
+		ts := testOversizeWorker(t, OnOversizeDrop, bs)
+		if len(ts.events) != 2 {
+			t.Fatal("the record must be dropped, but ", ts.events)
+		}
+	}
+
+	// all the records of a batch are dropped
+	for _, bs := range []int{0, 10} {
+		tc := &testClient{events: []*api.LogEvent{{Message: strings.Repeat("x", 100)}}}
+		ts := &testSink{}
+		wc := newTestWorkerConfig("w1", "p1")
+		wc.MaxLineBytes = 10
+		wc.OnOversize = OnOversizeDrop
+		wc.BufferSize = bs
+
+		ctx, cancel := context.WithCancel(context.Background())
+		w, wait := runTestWorker(ctx, wc, tc, ts)
+		waitPosition(t, w.getDesc(), "1")
+		cancel()
+		wait()
+		if ts.count() != 0 {
+			t.Fatal("no records must be sent, but ", ts.events)
+		}
+	}
+}
+
+func TestOversizeSplit(t *testing.T) {
+	ts := testOversizeWorker(t, OnOversizeSplit, 10)
+	if len(ts.events) != 13 {
+		t.Fatal("the record must be split to 11 records, but ", len(ts.events)-2)
+	}
+	var sb strings.Builder
+	for _, e := range ts.events[1:12] {
+		if e.Tags != "app=b" || e.Fields != "f=1" || e.Timestamp != 2 || !strings.HasSuffix(e.Message, "\n") {
+			t.Fatal("the chunks must keep the record tags, fields and timestamp, but ", e)
+		}
+		sb.WriteString(strings.TrimSuffix(e.Message, "\n"))
+	}
+	if sb.String() != strings.Repeat("x", 10000) {
+		t.Fatal("the chunks must contain the whole message")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"github.com/logrange/logrange/pkg/container"
+	"github.com/logrange/logrange/pkg/lql"
+	"github.com/logrange/logrange/pkg/model"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// predCache memoizes the compiled pipe conditions (the From sources and the
+	// Filter functions) by the conditions strings. The configs are checked on
+	// every reload, and many workers could have the same conditions, so the
+	// conditions are not parsed again. A changed condition is a new key, the
+	// old one is pulled out of the cache when it is full.
+	predCache struct {
+		lock sync.Mutex
+		lru  *container.Lru
+	}
+
+	predKey struct {
+		filter bool
+		cond   string
+	}
+
+	// predVal contains the compiled condition or the error, the invalid
+	// conditions are cached as well
+	predVal struct {
+		src *lql.Source
+		wef lql.WhereExpFunc
+		// re is the message regexp, if the Filter is a string literal
+		re  *regexp.Regexp
+		err error
+	}
+)
+
+const cPredCacheSize = 256
+
+// preds is the cache used by PipeConfig
+var preds = newPredCache(cPredCacheSize)
+
+func newPredCache(maxSize int) *predCache {
+	return &predCache{lru: container.NewLru(int64(maxSize), 0, nil)}
+}
+
+// source returns the parsed From condition (see lql.ParseSource). The result
+// is shared, it must not be modified.
+func (pc *predCache) source(from string) (*lql.Source, error) {
+	pv := pc.get(predKey{cond: from}, func() *predVal {
+		src, err := lql.ParseSource(from)
+		return &predVal{src: src, err: err}
+	})
+	return pv.src, pv.err
+}
+
+// filter returns the compiled Filter condition. It is built the same way the
+// pipe does it when the events are selected, so a filter passed the check could
+// not fail at runtime. The empty filter matches all records, it is not parsed.
+func (pc *predCache) filter(filter string) (lql.WhereExpFunc, error) {
+	filter = strings.TrimSpace(filter)
+	pv := pc.getFilter(filter)
+	return pv.wef, pv.err
+}
+
+// msgRegexp returns the message regexp, if the filter is a string literal
+// (see msgPattern), or nil otherwise
+func (pc *predCache) msgRegexp(filter string) *regexp.Regexp {
+	return pc.getFilter(strings.TrimSpace(filter)).re
+}
+
+func (pc *predCache) getFilter(filter string) *predVal {
+	return pc.get(predKey{filter: true, cond: filter}, func() *predVal {
+		ptrn, ok := msgPattern(filter)
+		if !ok {
+			wef, err := lql.BuildWhereExpFunc(filter)
+			return &predVal{wef: wef, err: err}
+		}
+
+		re, err := regexp.Compile(ptrn)
+		if err != nil {
+			return &predVal{err: err}
+		}
+		wef := func(le *model.LogEvent) bool {
+			return re.MatchString(le.Msg.AsWeakString())
+		}
+		return &predVal{wef: wef, re: re}
+	})
+}
+
+// get returns the cached value for the key k, or the value built by f. The
+// lock is not held while f is called, so the same condition could be compiled
+// twice concurrently, what is harmless.
+func (pc *predCache) get(k predKey, f func() *predVal) *predVal {
+	pc.lock.Lock()
+	lv := pc.lru.Get(k)
+	if lv != nil {
+		pv := lv.Val().(*predVal)
+		pc.lock.Unlock()
+		return pv
+	}
+	pc.lock.Unlock()
+
+	pv := f()
+	pc.lock.Lock()
+	pc.lru.Put(k, pv, 1)
+	pc.lock.Unlock()
+	return pv
+}
+
+// msgPattern returns the regexp pattern, if the filter is a single string
+// literal. The single quoted literal is taken as is, and the double quoted one
+// could contain the escape sequences (see strconv.Unquote).
+func msgPattern(filter string) (string, bool) {
+	if len(filter) < 2 {
+		return "", false
+	}
+	switch {
+	case filter[0] == '\'' && filter[len(filter)-1] == '\'':
+		ptrn := filter[1 : len(filter)-1]
+		return ptrn, !strings.Contains(ptrn, "'")
+	case filter[0] == '"':
+		ptrn, err := strconv.Unquote(filter)
+		return ptrn, err == nil
+	}
+	return "", false
+}
+
+func (pc *predCache) len() int {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.lru.Len()
+}
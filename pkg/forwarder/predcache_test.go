@@ -0,0 +1,85 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPredCache(t *testing.T) {
+	pc := newPredCache(2)
+	s1, err1 := pc.source("a=b")
+	s2, err2 := pc.source("a=b")
+	if s1 != s2 || err1 != err2 {
+		t.Fatal("the cached source must be returned, but ", s1, s2, err1, err2)
+	}
+
+	// the same string is a different key for the source and the filter
+	if _, err := pc.filter("a=b"); err == nil {
+		t.Fatal("a=b is not a valid filter")
+	}
+	if pc.len() != 2 {
+		t.Fatal("expected 2 entries, but ", pc.len())
+	}
+
+	// the filters are trimmed
+	if f, err := pc.filter("  "); err != nil || !f(nil) {
+		t.Fatal("the empty filter must match all, err=", err)
+	}
+	if pc.len() != 2 {
+		t.Fatal("the least recently used entry must be removed, but ", pc.len())
+	}
+	if _, err := pc.filter(""); err != nil || pc.len() != 2 {
+		t.Fatal("the trimmed filter must be found, err=", err, ", len=", pc.len())
+	}
+}
+
+func newBenchPipeConfigs(n int) []*PipeConfig {
+	res := make([]*PipeConfig, n)
+	for i := range res {
+		res[i] = &PipeConfig{From: fmt.Sprintf("app=app%d AND env LIKE 'prod*'", i%10),
+			Filter: fmt.Sprintf("msg contains 'error%d'", i%10)}
+	}
+	return res
+}
+
+func benchmarkPipeConfigCheck(b *testing.B, warm bool) {
+	pcs := newBenchPipeConfigs(100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !warm {
+			b.StopTimer()
+			preds = newPredCache(cPredCacheSize)
+			b.StartTimer()
+		}
+		for _, pc := range pcs {
+			_ = pc.Check()
+		}
+	}
+}
+
+// BenchmarkPipeConfigCheckCold checks the configs of 100 workers with 10
+// different conditions, when nothing is cached (the first config load)
+func BenchmarkPipeConfigCheckCold(b *testing.B) {
+	benchmarkPipeConfigCheck(b, false)
+}
+
+// BenchmarkPipeConfigCheckWarm checks the same configs, when the conditions
+// were compiled before (the config reload)
+func BenchmarkPipeConfigCheckWarm(b *testing.B) {
+	benchmarkPipeConfigCheck(b, true)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// JournalRouter distributes the journals between the forwarder nodes of a
+// cluster by consistent hashing. Every node is placed on the hash ring by
+// ClusterConfig.VirtualNodes points, and a journal is owned by the first
+// ReplicationFactor different nodes found clockwise from the journal hash.
+// When a node joins or leaves the cluster, only the journals of the ring
+// segments it takes or gives up change their owners.
+type JournalRouter struct {
+	node string
+	rf   int
+	// hashes contains the ring points sorted, the point hashes[i] belongs
+	// to the node nodes[i]
+	hashes []uint64
+	nodes  []string
+	// nodesCnt contains the number of different nodes on the ring
+	nodesCnt int
+}
+
+const (
+	cDefaultVirtualNodes = 256
+)
+
+// NewJournalRouter returns the router for the node cc.NodeID of the cluster cc
+func NewJournalRouter(cc *ClusterConfig) (*JournalRouter, error) {
+	if err := cc.Check(); err != nil {
+		return nil, err
+	}
+
+	vn := cc.getVirtualNodes()
+	jr := &JournalRouter{node: cc.NodeID, rf: cc.getReplicationFactor(), nodesCnt: len(cc.Nodes)}
+	pts := make([]ringPoint, 0, vn*len(cc.Nodes))
+	for _, n := range cc.Nodes {
+		for i := 0; i < vn; i++ {
+			pts = append(pts, ringPoint{hash: ringHash(n + "#" + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i].hash == pts[j].hash {
+			return pts[i].node < pts[j].node
+		}
+		return pts[i].hash < pts[j].hash
+	})
+
+	jr.hashes = make([]uint64, len(pts))
+	jr.nodes = make([]string, len(pts))
+	for i, p := range pts {
+		jr.hashes[i], jr.nodes[i] = p.hash, p.node
+	}
+	return jr, nil
+}
+
+// Owners returns the nodes, which own the journal, the first one is the primary owner
+func (jr *JournalRouter) Owners(journal string) []string {
+	res := make([]string, 0, jr.rf)
+	h := ringHash(journal)
+	i := sort.Search(len(jr.hashes), func(i int) bool { return jr.hashes[i] >= h })
+	for n := 0; n < len(jr.hashes) && len(res) < jr.rf; n++ {
+		node := jr.nodes[(i+n)%len(jr.hashes)]
+		if !containsStr(res, node) {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// Owns returns whether the journal is owned by the node of the router
+func (jr *JournalRouter) Owns(journal string) bool {
+	return containsStr(jr.Owners(journal), jr.node)
+}
+
+// Owned returns the journals, which are owned by the node of the router
+func (jr *JournalRouter) Owned(journals []string) []string {
+	res := make([]string, 0, len(journals)*jr.rf/jr.nodesCnt+1)
+	for _, j := range journals {
+		if jr.Owns(j) {
+			res = append(res, j)
+		}
+	}
+	return res
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// ringHash returns the FNV-1a hash of s, which bits are mixed by the
+// SplitMix64 finalizer, so the close strings are spread over the ring
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func containsStr(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
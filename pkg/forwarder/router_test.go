@@ -0,0 +1,188 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"fmt"
+	"github.com/jrivets/log4g"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/storage"
+	"testing"
+)
+
+func newTestJournals(n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = fmt.Sprintf("app=app%d,host=h%d", i%97, i)
+	}
+	return res
+}
+
+func newTestRouter(t *testing.T, node string, rf int, nodes ...string) *JournalRouter {
+	jr, err := NewJournalRouter(&ClusterConfig{NodeID: node, Nodes: nodes, ReplicationFactor: rf})
+	if err != nil {
+		t.Fatal("NewJournalRouter() err=", err)
+	}
+	return jr
+}
+
+// primaryOwners returns the primary owner of every journal
+func primaryOwners(jr *JournalRouter, journals []string) map[string]string {
+	res := make(map[string]string, len(journals))
+	for _, j := range journals {
+		res[j] = jr.Owners(j)[0]
+	}
+	return res
+}
+
+func TestClusterConfigCheck(t *testing.T) {
+	for _, cc := range []*ClusterConfig{
+		{NodeID: "n1"},
+		{NodeID: "n3", Nodes: []string{"n1", "n2"}},
+		{NodeID: "n1", Nodes: []string{"n1", "n1"}},
+		{NodeID: "n1", Nodes: []string{"n1", " "}},
+		{NodeID: "n1", Nodes: []string{"n1", "n2"}, ReplicationFactor: 3},
+		{NodeID: "n1", Nodes: []string{"n1", "n2"}, VirtualNodes: -1},
+	} {
+		if err := cc.Check(); err == nil {
+			t.Fatal("Check() must fail for ", cc)
+		}
+	}
+
+	cfg := NewDefaultConfig()
+	cfg.Cluster = &ClusterConfig{NodeID: "n1", Nodes: []string{"n1"}, ReplicationFactor: 2}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("Config.Check() must check the Cluster")
+	}
+	cfg.Cluster.ReplicationFactor = 1
+	if err := cfg.Check(); err != nil {
+		t.Fatal("Config.Check() err=", err)
+	}
+}
+
+func TestJournalRouterDistribution(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5"}
+	js := newTestJournals(50000)
+	exp := len(js) / len(nodes)
+
+	total := 0
+	for _, n := range nodes {
+		owned := newTestRouter(t, n, 1, nodes...).Owned(js)
+		if d := len(owned) - exp; d > exp/5 || d < -exp/5 {
+			t.Fatal("the node ", n, " owns ", len(owned), " journals, but expected about ", exp)
+		}
+		total += len(owned)
+	}
+	if total != len(js) {
+		t.Fatal("every journal must be owned by one node, but total=", total)
+	}
+
+	// every journal is owned by 2 different nodes
+	jr := newTestRouter(t, "n1", 2, nodes...)
+	total = 0
+	for _, n := range nodes {
+		total += len(newTestRouter(t, n, 2, nodes...).Owned(js))
+	}
+	if total != 2*len(js) {
+		t.Fatal("every journal must be owned by 2 nodes, but total=", total)
+	}
+	for _, j := range js[:100] {
+		if ows := jr.Owners(j); len(ows) != 2 || ows[0] == ows[1] {
+			t.Fatal("expected 2 different owners, but ", ows)
+		}
+	}
+}
+
+func TestJournalRouterChurn(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5"}
+	js := newTestJournals(20000)
+	before := primaryOwners(newTestRouter(t, "n1", 1, nodes...), js)
+
+	// the joined node takes about 1/6 of the journals from the others only
+	after := primaryOwners(newTestRouter(t, "n1", 1, append(nodes, "n6")...), js)
+	moved := 0
+	for j, o := range before {
+		if after[j] != o {
+			if after[j] != "n6" {
+				t.Fatal("the journal ", j, " is moved from ", o, " to ", after[j], ", but not to the new node")
+			}
+			moved++
+		}
+	}
+	if exp := len(js) / 6; moved < exp*4/5 || moved > exp*6/5 {
+		t.Fatal("expected about ", exp, " journals moved, but ", moved)
+	}
+
+	// the journals of the node left are moved only
+	after = primaryOwners(newTestRouter(t, "n1", 1, "n1", "n2", "n4", "n5"), js)
+	moved = 0
+	for j, o := range before {
+		if o != "n3" && after[j] != o {
+			t.Fatal("the journal ", j, " of ", o, " must not be moved, but it is owned by ", after[j])
+		}
+		if o == "n3" {
+			moved++
+		}
+	}
+	if exp := len(js) / 5; moved < exp*4/5 || moved > exp*6/5 {
+		t.Fatal("expected about ", exp, " journals of the node left, but ", moved)
+	}
+}
+
+func TestWorkerJournalRouting(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3"}
+	evs := make([]*api.LogEvent, 300)
+	for i := range evs {
+		evs[i] = &api.LogEvent{Tags: fmt.Sprintf("app=a%d", i%30), Message: fmt.Sprintf("msg%d", i)}
+	}
+
+	sent := make(map[string]string)
+	for _, n := range nodes {
+		jr := newTestRouter(t, n, 1, nodes...)
+		w := newWorker(&workerConfig{desc: &desc{Worker: newTestWorkerConfig("w1", "p1")}, owns: jr.Owns,
+			logger: log4g.GetLogger("forwarder")})
+		_, res := w.process(evs)
+		if len(res) == 0 || len(res) == len(evs) {
+			t.Fatal("the node ", n, " must forward a part of the events, but ", len(res))
+		}
+		for _, e := range res {
+			if o, ok := sent[e.Message]; ok {
+				t.Fatal("the event ", e, " is forwarded by ", o, " and ", n)
+			}
+			sent[e.Message] = n
+		}
+	}
+	if len(sent) != len(evs) {
+		t.Fatal("all the events must be forwarded, but ", len(sent))
+	}
+
+	cfg := NewDefaultConfig()
+	f, err := NewForwarder(cfg, &testClient{}, storage.NewDefaultStorage())
+	if err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+	if !f.ownsJournal("app=a1") {
+		t.Fatal("all the journals must be owned without Cluster")
+	}
+	cfg.Cluster = &ClusterConfig{NodeID: "n1", Nodes: nodes}
+	if f, err = NewForwarder(cfg, &testClient{}, storage.NewDefaultStorage()); err != nil {
+		t.Fatal("NewForwarder() err=", err)
+	}
+	for _, e := range evs {
+		if f.ownsJournal(e.Tags) != (sent[e.Message] == "n1") {
+			t.Fatal("the forwarder must own the journals of n1 only, but ", e.Tags)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"fmt"
+	"github.com/jrivets/log4g"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/lql"
+	"github.com/logrange/logrange/pkg/model"
+	"github.com/logrange/logrange/pkg/model/field"
+	"github.com/logrange/logrange/pkg/model/tag"
+	"github.com/logrange/range/pkg/utils/bytes"
+)
+
+// Simulate returns the records of the sample, which the worker wc would send to
+// its sinks, as they would be sent. The records are selected by the Pipe From
+// and Filter conditions the same way the pipe does it, and they are prepared
+// by the worker (transformed, encoded etc.) after that. Nothing is sent, so
+// it allows to check the worker config against the known records before it
+// is deployed. The sample records must contain the source Tags. The workers,
+// which refer the pipes by Name, could not be simulated, because the pipe
+// conditions are not known.
+func Simulate(wc *WorkerConfig, sample []*api.LogEvent) ([]*api.LogEvent, error) {
+	if err := wc.Check(); err != nil {
+		return nil, fmt.Errorf("invalid worker config; %v", err)
+	}
+	if wc.Pipe.Name != "" {
+		return nil, fmt.Errorf("the worker with Pipe.Name=%s could not be simulated, the pipe conditions are not known", wc.Pipe.Name)
+	}
+
+	// the conditions are checked already
+	src, _ := preds.source(wc.Pipe.From)
+	tef, err := lql.BuildTagsExpFuncBySource(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid From=%s: %v", wc.Pipe.From, err)
+	}
+	var wef lql.WhereExpFunc
+	if filter := wc.Pipe.getFilter(); filter != "" {
+		if wef, err = preds.filter(filter); err != nil {
+			return nil, fmt.Errorf("invalid Filter=%s: %v", filter, err)
+		}
+	}
+
+	read := make([]*api.LogEvent, 0, len(sample))
+	var me model.LogEvent
+	for i, e := range sample {
+		tags, err := tag.Parse(e.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Tags=%s of the record %d: %v", e.Tags, i, err)
+		}
+		if !tef(tags) {
+			continue
+		}
+		if wef != nil {
+			me.Timestamp = e.Timestamp
+			me.Msg = bytes.StringToByteArray(e.Message)
+			me.Fields = field.Parse(e.Fields)
+			if !wef(&me) {
+				continue
+			}
+		}
+		read = append(read, e)
+	}
+
+	w := newWorker(&workerConfig{desc: &desc{Worker: wc}, logger: log4g.GetLogger("forwarder.simulate")})
+	_, events := w.process(read)
+	return events, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"github.com/logrange/logrange/api"
+	"testing"
+)
+
+func newSimulateSample() []*api.LogEvent {
+	return []*api.LogEvent{
+		{Timestamp: 1, Tags: "app=a", Fields: "level=info", Message: "started"},
+		{Timestamp: 2, Tags: "app=b", Fields: "level=error", Message: "connection refused"},
+		{Timestamp: 3, Tags: "app=a", Fields: "level=error", Message: "read timeout"},
+		{Timestamp: 4, Tags: "app=b", Fields: "level=info", Message: "stopped"},
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	wc := &WorkerConfig{Name: "w1", Pipe: &PipeConfig{Filter: "'timeout|refused'"}}
+	wc.Sink = newTestWorkerConfig("w1", "p1").Sink
+	wc.Transform = "{{.Tags.app}}: {{.Message}}"
+	sample := newSimulateSample()
+
+	res, err := Simulate(wc, sample)
+	if err != nil {
+		t.Fatal("Simulate() err=", err)
+	}
+	if len(res) != 2 || res[0].Message != "b: connection refused" || res[1].Message != "a: read timeout" {
+		t.Fatal("expected 2 transformed records, but ", res)
+	}
+	if sample[1].Message != "connection refused" {
+		t.Fatal("the sample must not be changed, but ", sample[1])
+	}
+
+	// the records are dropped by the line guard
+	wc.MaxLineBytes = 15
+	wc.OnOversize = OnOversizeDrop
+	if res, err = Simulate(wc, sample); err != nil || len(res) != 1 || res[0].Message != "a: read timeout" {
+		t.Fatal("expected 1 record, but ", res, ", err=", err)
+	}
+
+	// no records pass
+	wc.Pipe.Filter = "'panic'"
+	if res, err = Simulate(wc, sample); err != nil || len(res) != 0 {
+		t.Fatal("expected no records, but ", res, ", err=", err)
+	}
+
+	wc.Pipe.Filter = "'('"
+	if _, err = Simulate(wc, sample); err == nil {
+		t.Fatal("Simulate() must fail for the invalid config")
+	}
+
+	if _, err = Simulate(newTestWorkerConfig("w1", "p1"), sample); err == nil {
+		t.Fatal("Simulate() must fail for the named pipe")
+	}
+}
+
+func TestSimulateConditions(t *testing.T) {
+	wc := &WorkerConfig{Name: "w1", Pipe: &PipeConfig{From: "app=a", Filter: `fields:level = "error"`}}
+	wc.Sink = newTestWorkerConfig("w1", "p1").Sink
+
+	res, err := Simulate(wc, newSimulateSample())
+	if err != nil {
+		t.Fatal("Simulate() err=", err)
+	}
+	if len(res) != 1 || res[0].Timestamp != 3 {
+		t.Fatal("expected the record 3 only, but ", res)
+	}
+
+	wc.Pipe.Filter = ""
+	if res, err = Simulate(wc, newSimulateSample()); err != nil || len(res) != 2 {
+		t.Fatal("expected 2 records of app=a, but ", res, ", err=", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"sync"
+	"time"
+)
+
+type (
+	// batcher sends the events by batches of up to the size. The events of
+	// the concurrent add calls could be sent in one batch: the events wait
+	// for the other events up to the flush interval, then the batch is sent
+	// partially. No events are kept in the batcher, when add returns, so the
+	// events accepted by add are sent, and the failed ones could be sent again.
+	batcher struct {
+		send func(events []*api.LogEvent) error
+		size int
+		wait time.Duration
+
+		lock   sync.Mutex
+		cur    *batch
+		closed bool
+	}
+
+	// batch contains the events collected, done is closed when the batch is sent
+	batch struct {
+		events []*api.LogEvent
+		timer  *time.Timer
+		done   chan struct{}
+		err    error
+	}
+)
+
+// newBatcher returns the batcher, which sends the batches of up to size events
+// by send. If flushInterval is 0, the events of an add call are sent by the call
+// right away, they don't wait for the events of the other calls.
+func newBatcher(size int, flushInterval time.Duration, send func(events []*api.LogEvent) error) *batcher {
+	return &batcher{send: send, size: size, wait: flushInterval}
+}
+
+// add sends the events, it returns when the batches containing the events are
+// sent. If the batch could not be sent, the error is returned to all the calls,
+// which events are in the batch, so the events could be added again.
+func (b *batcher) add(events []*api.LogEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return fmt.Errorf("already closed.")
+	}
+	if b.wait <= 0 {
+		b.lock.Unlock()
+		return b.sendBySize(events)
+	}
+
+	bt := b.cur
+	if bt == nil {
+		bt = &batch{done: make(chan struct{})}
+		bt.timer = time.AfterFunc(b.wait, func() { b.flush(bt) })
+		b.cur = bt
+	}
+	bt.events = append(bt.events, events...)
+	if len(bt.events) < b.size {
+		b.lock.Unlock()
+		<-bt.done
+		return bt.err
+	}
+
+	b.cur = nil
+	b.lock.Unlock()
+	b.sendBatch(bt)
+	return bt.err
+}
+
+// close sends the events, which wait for the batch. The add calls, which
+// are not returned yet, get the result of the sending, so the events are not
+// lost, if the batch could not be sent.
+func (b *batcher) close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	bt := b.cur
+	b.cur = nil
+	b.lock.Unlock()
+
+	if bt == nil {
+		return nil
+	}
+	b.sendBatch(bt)
+	return bt.err
+}
+
+// flush sends the batch bt, if it is not sent yet
+func (b *batcher) flush(bt *batch) {
+	b.lock.Lock()
+	if b.cur != bt {
+		b.lock.Unlock()
+		return
+	}
+	b.cur = nil
+	b.lock.Unlock()
+	b.sendBatch(bt)
+}
+
+func (b *batcher) sendBatch(bt *batch) {
+	bt.timer.Stop()
+	bt.err = b.sendBySize(bt.events)
+	close(bt.done)
+}
+
+// sendBySize sends the events by the batches of up to the size
+func (b *batcher) sendBySize(events []*api.LogEvent) error {
+	for len(events) > 0 {
+		n := len(events)
+		if n > b.size {
+			n = b.size
+		}
+		if err := b.send(events[:n]); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// len returns the number of the events, which wait for the batch
+func (b *batcher) len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.cur == nil {
+		return 0
+	}
+	return len(b.cur.events)
+}
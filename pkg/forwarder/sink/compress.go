@@ -0,0 +1,97 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressor creates a writer which compresses the data written to w. The
+// data is flushed to w when the writer is closed.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	comprLock sync.Mutex
+	comprs    = map[string]Compressor{
+		CompressionGzip: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	}
+)
+
+// RegisterCompressor sets the Compressor for the compression name provided,
+// nil removes it. The "gzip" compressor is registered by default, the "zstd"
+// one must be registered before the configs of the sinks using it are checked,
+// the configs with a compression, which has no Compressor, are invalid.
+func RegisterCompressor(name string, c Compressor) {
+	comprLock.Lock()
+	if c == nil {
+		delete(comprs, name)
+	} else {
+		comprs[name] = c
+	}
+	comprLock.Unlock()
+}
+
+func getCompressor(name string) Compressor {
+	comprLock.Lock()
+	defer comprLock.Unlock()
+	return comprs[name]
+}
+
+func isCompressed(compression string) bool {
+	return compression != "" && compression != CompressionNone
+}
+
+// checkCompression returns an error, if the compression is unknown, or its
+// Compressor is not registered
+func checkCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone:
+		return nil
+	case CompressionGzip, CompressionZstd:
+		if getCompressor(compression) == nil {
+			return fmt.Errorf("no compressor registered for Compression=%v, see RegisterCompressor", compression)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid Compression=%v, must be one of %v, %v, %v", compression,
+		CompressionNone, CompressionGzip, CompressionZstd)
+}
+
+// compress returns data compressed by c
+func compress(c Compressor, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/logrange/logrange/api"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testZstdPrefix is written by the fake zstd compressor before the data
+const testZstdPrefix = "ZSTD:"
+
+type testPrefixWriter struct {
+	w io.Writer
+}
+
+func (pw *testPrefixWriter) Write(p []byte) (int, error) {
+	return pw.w.Write(p)
+}
+
+func (pw *testPrefixWriter) Close() error {
+	return nil
+}
+
+func testZstdCompressor(w io.Writer) (io.WriteCloser, error) {
+	if _, err := io.WriteString(w, testZstdPrefix); err != nil {
+		return nil, err
+	}
+	return &testPrefixWriter{w: w}, nil
+}
+
+// newTestEncodingServer decodes the batches received by the Content-Encoding
+// header and collects them
+func newTestEncodingServer(t *testing.T) (*httptest.Server, func() ([]string, [][]*api.LogEvent)) {
+	var lock sync.Mutex
+	var encs []string
+	var batches [][]*api.LogEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error("could not read the request body, err=", err)
+			return
+		}
+
+		enc := r.Header.Get("Content-Encoding")
+		switch enc {
+		case CompressionGzip:
+			gr, err := gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, err = ioutil.ReadAll(gr)
+			}
+			if err != nil {
+				t.Error("could not decompress the gzip body, err=", err)
+				return
+			}
+		case CompressionZstd:
+			if !bytes.HasPrefix(body, []byte(testZstdPrefix)) {
+				t.Error("the body is not compressed by the zstd compressor, body=", string(body))
+				return
+			}
+			body = body[len(testZstdPrefix):]
+		}
+
+		var evs []*api.LogEvent
+		if err = json.Unmarshal(body, &evs); err != nil {
+			t.Error("could not decode the request body, err=", err)
+		}
+		lock.Lock()
+		encs = append(encs, enc)
+		batches = append(batches, evs)
+		lock.Unlock()
+	}))
+	return srv, func() ([]string, [][]*api.LogEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		return encs, batches
+	}
+}
+
+func TestConfigCheckCompression(t *testing.T) {
+	for _, c := range []*Config{
+		{Type: SnkTypeHttp, Params: Params{"URL": "http://localhost"}, Compression: "lz4"},
+		{Type: SnkTypeHttp, Params: Params{"URL": "http://localhost"}, Compression: "GZIP"},
+		{Type: SnkTypeFile, Params: Params{"Path": "a.log"}, Compression: CompressionGzip},
+		{Type: SnkTypeStdout, Compression: CompressionZstd},
+		// the zstd compressor is not registered
+		{Type: SnkTypeHttp, Params: Params{"URL": "http://localhost"}, Compression: CompressionZstd},
+	} {
+		if err := c.Check(); err == nil {
+			t.Fatal("Check() must fail for ", c)
+		}
+	}
+
+	RegisterCompressor(CompressionZstd, testZstdCompressor)
+	defer RegisterCompressor(CompressionZstd, nil)
+	RegisterKafkaProducer(func(cfg *KafkaProducerConfig) (KafkaProducer, error) {
+		return &testProducer{}, nil
+	})
+	defer RegisterKafkaProducer(nil)
+	for _, c := range []*Config{
+		{Type: SnkTypeHttp, Params: Params{"URL": "http://localhost"}, Compression: CompressionGzip},
+		{Type: SnkTypeHttp, Params: Params{"URL": "http://localhost"}, Compression: CompressionZstd},
+		{Type: SnkTypeKafka, Params: Params{"Brokers": []string{"b1:9092"}, "Topic": "logs"}, Compression: CompressionZstd},
+		{Type: SnkTypeFile, Params: Params{"Path": "a.log"}, Compression: CompressionNone},
+		{Type: SnkTypeStdout},
+	} {
+		if err := c.Check(); err != nil {
+			t.Fatal("Check() must succeed for ", c, ", but err=", err)
+		}
+	}
+}
+
+func TestHttpSinkCompression(t *testing.T) {
+	srv, get := newTestEncodingServer(t)
+	defer srv.Close()
+
+	for _, cmpr := range []string{"", CompressionNone, CompressionGzip} {
+		s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 3}, Compression: cmpr})
+		if err != nil {
+			t.Fatal("NewSink() err=", err)
+		}
+		if err = s.OnEvent(newTestHttpEvents(0, 3)); err != nil {
+			t.Fatal("OnEvent() err=", err)
+		}
+		s.Close()
+	}
+
+	encs, bs := get()
+	if !reflect.DeepEqual(encs, []string{"", "", CompressionGzip}) {
+		t.Fatal("unexpected Content-Encoding headers ", encs)
+	}
+	for _, b := range bs {
+		if !reflect.DeepEqual(b, newTestHttpEvents(0, 3)) {
+			t.Fatal("the batch must be decompressed to the original one, but ", b)
+		}
+	}
+}
+
+func TestHttpSinkZstdCompression(t *testing.T) {
+	srv, get := newTestEncodingServer(t)
+	defer srv.Close()
+
+	cfg := &Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 2}, Compression: CompressionZstd}
+	if _, err := NewSink(cfg); err == nil {
+		t.Fatal("NewSink() must fail, the zstd compressor is not registered")
+	}
+
+	RegisterCompressor(CompressionZstd, testZstdCompressor)
+	defer RegisterCompressor(CompressionZstd, nil)
+	s, err := NewSink(cfg)
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	defer s.Close()
+	if err = s.OnEvent(newTestHttpEvents(5, 2)); err != nil {
+		t.Fatal("OnEvent() err=", err)
+	}
+
+	encs, bs := get()
+	if len(bs) != 1 || encs[0] != CompressionZstd || !reflect.DeepEqual(bs[0], newTestHttpEvents(5, 2)) {
+		t.Fatal("unexpected encodings=", encs, ", batches=", bs)
+	}
+}
+
+func TestKafkaSinkCompression(t *testing.T) {
+	var pc *KafkaProducerConfig
+	RegisterKafkaProducer(func(cfg *KafkaProducerConfig) (KafkaProducer, error) {
+		pc = cfg
+		return &testProducer{}, nil
+	})
+	defer RegisterKafkaProducer(nil)
+	RegisterCompressor(CompressionZstd, testZstdCompressor)
+	defer RegisterCompressor(CompressionZstd, nil)
+
+	for cmpr, exp := range map[string]string{"": CompressionNone, CompressionGzip: CompressionGzip, CompressionZstd: CompressionZstd} {
+		s, err := NewSink(&Config{Type: SnkTypeKafka, Params: Params{"Brokers": []string{"b1:9092"}, "Topic": "logs"},
+			Compression: cmpr})
+		if err != nil {
+			t.Fatal("NewSink() err=", err)
+		}
+		s.Close()
+		if pc.Compression != exp {
+			t.Fatal("the producer must be created with Compression=", exp, ", but cfg=", pc)
+		}
+	}
+}
+
+func TestCompressGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("the log line\n"), 100)
+	cd, err := compress(getCompressor(CompressionGzip), data)
+	if err != nil || len(cd) >= len(data) {
+		t.Fatal("the data must be compressed, err=", err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(cd))
+	if err != nil {
+		t.Fatal("gzip.NewReader() err=", err)
+	}
+	if res, err := ioutil.ReadAll(gr); err != nil || !bytes.Equal(res, data) {
+		t.Fatal("the data must be decompressed to the original one, err=", err)
+	}
+}
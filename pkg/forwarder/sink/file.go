@@ -0,0 +1,291 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/model"
+	"github.com/mitchellh/mapstructure"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	fileSinkConfig struct {
+		// Path contains the file path template. The template could contain
+		// {vars:<tag name>} constructions (see model.NewFormatParser), so the
+		// events of different sources could be written into different files
+		Path string
+		// Format contains the record format (see model.NewFormatParser), the
+		// message is written as is, if the Format is empty
+		Format string
+		// MaxSize contains the file size in bytes, the file is rotated when
+		// it reaches the size. 0 - no rotation by size
+		MaxSize int64
+		// MaxAgeSec contains the time in seconds, the file is rotated when it
+		// has been written longer than the time. 0 - no rotation by time
+		MaxAgeSec int
+		// MaxBackups contains the number of the rotated files kept, the older
+		// ones are removed. 0 - all the rotated files are kept
+		MaxBackups int
+	}
+
+	fileSink struct {
+		cfg  *fileSinkConfig
+		path *model.FormatParser
+		frmt *model.FormatParser
+		// lock serializes the writes, the sink could be used by several writers
+		lock  sync.Mutex
+		files map[string]*rotFile
+	}
+
+	// rotFile is the file written by fileSink
+	rotFile struct {
+		name    string
+		f       *os.File
+		w       *bufio.Writer
+		size    int64
+		created time.Time
+	}
+)
+
+// cBackupTsFormat is the format of the rotated files suffix, it is sorted by time
+const cBackupTsFormat = "20060102-150405.000000000"
+
+//===================== fileSink =====================
+
+func newFileSink(cfg *fileSinkConfig) (*fileSink, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+
+	fs := &fileSink{cfg: cfg, files: make(map[string]*rotFile)}
+	fs.path, _ = model.NewFormatParser(cfg.Path)
+	if cfg.Format != "" {
+		fs.frmt, _ = model.NewFormatParser(cfg.Format)
+	}
+	return fs, nil
+}
+
+// OnEvent writes the events into the files defined by the Path template
+func (fs *fileSink) OnEvent(events []*api.LogEvent) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var me model.LogEvent
+	for _, e := range events {
+		copyEv(e, &me)
+		msg := e.Message
+		if fs.frmt != nil {
+			msg = fs.frmt.FormatStr(&me, e.Tags)
+		}
+
+		rf, err := fs.getFile(fs.path.FormatStr(&me, e.Tags), len(msg))
+		if err != nil {
+			return err
+		}
+		if err = rf.write(msg); err != nil {
+			return err
+		}
+	}
+	return fs.flush()
+}
+
+func (fs *fileSink) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var err error
+	for name, rf := range fs.files {
+		if err1 := rf.close(); err == nil {
+			err = err1
+		}
+		delete(fs.files, name)
+	}
+	return err
+}
+
+// getFile returns the file name opened for writing n bytes more. The file
+// is rotated, if needed.
+func (fs *fileSink) getFile(name string, n int) (*rotFile, error) {
+	rf, ok := fs.files[name]
+	if ok && fs.needRotate(rf, n) {
+		delete(fs.files, name)
+		if err := fs.rotate(rf); err != nil {
+			return nil, err
+		}
+		ok = false
+	}
+
+	if !ok {
+		var err error
+		if rf, err = openRotFile(name); err != nil {
+			return nil, err
+		}
+		fs.files[name] = rf
+	}
+	return rf, nil
+}
+
+func (fs *fileSink) needRotate(rf *rotFile, n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if fs.cfg.MaxSize > 0 && rf.size+int64(n) > fs.cfg.MaxSize {
+		return true
+	}
+	return fs.cfg.MaxAgeSec > 0 && time.Since(rf.created) > time.Duration(fs.cfg.MaxAgeSec)*time.Second
+}
+
+// rotate closes rf, renames it to the backup and removes the old backups
+func (fs *fileSink) rotate(rf *rotFile) error {
+	if err := rf.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rf.name, rf.name+"."+time.Now().Format(cBackupTsFormat)); err != nil {
+		return fmt.Errorf("could not rotate file %s: %v", rf.name, err)
+	}
+	return fs.removeOldBackups(rf.name)
+}
+
+// removeOldBackups removes the backups of the file name above the MaxBackups
+func (fs *fileSink) removeOldBackups(name string) error {
+	if fs.cfg.MaxBackups <= 0 {
+		return nil
+	}
+
+	bkps, err := getBackups(name)
+	if err != nil {
+		return err
+	}
+	for len(bkps) > fs.cfg.MaxBackups {
+		if err = os.Remove(bkps[0]); err != nil {
+			return fmt.Errorf("could not remove backup %s: %v", bkps[0], err)
+		}
+		bkps = bkps[1:]
+	}
+	return nil
+}
+
+func (fs *fileSink) flush() error {
+	for _, rf := range fs.files {
+		if err := rf.w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBackups returns the rotated files of the file name, the oldest first
+func getBackups(name string) ([]string, error) {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		sfx := strings.TrimPrefix(fi.Name(), base+".")
+		if fi.IsDir() || len(sfx) != len(cBackupTsFormat) || sfx == fi.Name() {
+			continue
+		}
+		if _, err := time.Parse(cBackupTsFormat, sfx); err == nil {
+			res = append(res, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+//===================== rotFile =====================
+
+func openRotFile(name string) (*rotFile, error) {
+	if dir := filepath.Dir(name); dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("could not create dir for file %s: %v", name, err)
+		}
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotFile{name: name, f: f, w: bufio.NewWriter(f), size: fi.Size(), created: time.Now()}, nil
+}
+
+func (rf *rotFile) write(s string) error {
+	n, err := rf.w.WriteString(s)
+	rf.size += int64(n)
+	return err
+}
+
+func (rf *rotFile) close() error {
+	err := rf.w.Flush()
+	if err1 := rf.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+//===================== fileSinkConfig =====================
+
+func newFileSinkConfig(params Params) (*fileSinkConfig, error) {
+	cfg := &fileSinkConfig{}
+	if err := mapstructure.Decode(params, cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode Params=%v; %v", params, err)
+	}
+	return cfg, nil
+}
+
+func (fc *fileSinkConfig) Check() error {
+	if strings.TrimSpace(fc.Path) == "" {
+		return fmt.Errorf("invalid Path=%v, must be non-empty", fc.Path)
+	}
+	if _, err := model.NewFormatParser(fc.Path); err != nil {
+		return fmt.Errorf("invalid Path=%v; %v", fc.Path, err)
+	}
+	if fc.Format != "" {
+		if _, err := model.NewFormatParser(fc.Format); err != nil {
+			return fmt.Errorf("invalid Format=%v; %v", fc.Format, err)
+		}
+	}
+	if fc.MaxSize < 0 {
+		return fmt.Errorf("invalid MaxSize=%v, must be >= 0", fc.MaxSize)
+	}
+	if fc.MaxAgeSec < 0 {
+		return fmt.Errorf("invalid MaxAgeSec=%v, must be >= 0", fc.MaxAgeSec)
+	}
+	if fc.MaxBackups < 0 {
+		return fmt.Errorf("invalid MaxBackups=%v, must be >= 0", fc.MaxBackups)
+	}
+	return nil
+}
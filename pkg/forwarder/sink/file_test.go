@@ -0,0 +1,110 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"github.com/logrange/logrange/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFileSink(t *testing.T, params Params) (*fileSink, string) {
+	dir, err := ioutil.TempDir("", "fileSinkTest")
+	if err != nil {
+		t.Fatal("could not create temp dir, err=", err)
+	}
+	params["Path"] = filepath.Join(dir, params["Path"].(string))
+
+	cfg := &Config{Type: SnkTypeFile, Params: params}
+	if err = cfg.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	s, err := NewSink(cfg)
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	return s.(*fileSink), dir
+}
+
+func readTestFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal("could not read ", name, ", err=", err)
+	}
+	return string(data)
+}
+
+func TestFileSinkConfigCheck(t *testing.T) {
+	for _, p := range []Params{{}, {"Path": " "}, {"Path": "{vars"}, {"Path": "a.log", "Format": "{unknown}"},
+		{"Path": "a.log", "MaxSize": -1}, {"Path": "a.log", "MaxAgeSec": -1}, {"Path": "a.log", "MaxBackups": -1}} {
+		if err := (&Config{Type: SnkTypeFile, Params: p}).Check(); err == nil {
+			t.Fatal("Check() must fail for Params=", p)
+		}
+	}
+	if err := (&Config{Type: SnkTypeFile, Params: Params{"Path": "{vars:app}.log", "MaxSize": 10}}).Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+}
+
+func TestFileSinkPathTemplate(t *testing.T) {
+	fs, dir := newTestFileSink(t, Params{"Path": "{vars:app}/out.log"})
+	defer os.RemoveAll(dir)
+
+	err := fs.OnEvent([]*api.LogEvent{{Tags: "app=a", Message: "a1\n"}, {Tags: "app=b", Message: "b1\n"}, {Tags: "app=a", Message: "a2\n"}})
+	if err != nil {
+		t.Fatal("OnEvent() err=", err)
+	}
+	if s := readTestFile(t, filepath.Join(dir, "a", "out.log")); s != "a1\na2\n" {
+		t.Fatal("expected a1, a2, but got ", s)
+	}
+	if s := readTestFile(t, filepath.Join(dir, "b", "out.log")); s != "b1\n" {
+		t.Fatal("expected b1, but got ", s)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal("Close() err=", err)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	fs, dir := newTestFileSink(t, Params{"Path": "out.log", "MaxSize": 10, "MaxBackups": 2})
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	fn := filepath.Join(dir, "out.log")
+	for _, m := range []string{"msg1\n", "msg2\n", "msg3\n", "msg4\n", "msg5\n", "msg6\n", "msg7\n"} {
+		if err := fs.OnEvent([]*api.LogEvent{{Message: m}}); err != nil {
+			t.Fatal("OnEvent() err=", err)
+		}
+	}
+
+	if s := readTestFile(t, fn); s != "msg7\n" {
+		t.Fatal("expected msg7 in the current file, but got ", s)
+	}
+	bkps, err := getBackups(fn)
+	if err != nil {
+		t.Fatal("getBackups() err=", err)
+	}
+	if len(bkps) != 2 {
+		t.Fatal("expected 2 backups, but got ", bkps)
+	}
+	if s := readTestFile(t, bkps[0]); s != "msg3\nmsg4\n" {
+		t.Fatal("expected msg3, msg4 in the oldest backup, but got ", s)
+	}
+	if s := readTestFile(t, bkps[1]); s != "msg5\nmsg6\n" {
+		t.Fatal("expected msg5, msg6 in the newest backup, but got ", s)
+	}
+}
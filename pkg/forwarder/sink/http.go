@@ -0,0 +1,221 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type (
+	httpSinkConfig struct {
+		// URL contains the endpoint address, the records are sent to
+		URL string
+		// Method contains the HTTP method, POST by default
+		Method string
+		// Headers contains the additional request headers
+		Headers map[string]string
+		// BatchSize contains the number of records sent in one request
+		BatchSize int
+		// FlushIntervalMs contains the time the records of an OnEvent call
+		// could wait for the records of the concurrent calls (see the worker
+		// Concurrency) to fill the batch. If it is 0, the records are sent
+		// right away. OnEvent returns when its records are sent anyway.
+		FlushIntervalMs int
+		// TimeoutMs contains the request timeout
+		TimeoutMs int
+	}
+
+	// httpSink sends the records as a JSON array of api.LogEvent. The body
+	// is compressed, if the compressor is set, and the Content-Encoding
+	// header contains the compression then.
+	httpSink struct {
+		cfg   *httpSinkConfig
+		auth  *AuthConfig
+		cli   *http.Client
+		b     *batcher
+		cmpr  Compressor
+		cname string
+	}
+
+	// httpStatusError is returned when the endpoint responds with an error
+	// status. The 5xx errors are retryable.
+	httpStatusError struct {
+		code int
+		msg  string
+	}
+)
+
+const (
+	cHttpDefaultBatchSize = 100
+	cHttpDefaultTimeoutMs = 10000
+)
+
+//===================== httpSink =====================
+
+func newHttpSink(cfg *httpSinkConfig, tc *TLSConfig, auth *AuthConfig, compression string) (*httpSink, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	if err := checkCompression(compression); err != nil {
+		return nil, err
+	}
+
+	hs := &httpSink{cfg: cfg, auth: auth}
+	if isCompressed(compression) {
+		if hs.cmpr = getCompressor(compression); hs.cmpr == nil {
+			return nil, fmt.Errorf("no compressor registered for Compression=%v", compression)
+		}
+		hs.cname = compression
+	}
+	hs.cli = &http.Client{Timeout: time.Duration(cfg.getTimeoutMs()) * time.Millisecond}
+	if tc != nil {
+		tlsCfg, err := tc.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		hs.cli.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg}
+	}
+	hs.b = newBatcher(cfg.getBatchSize(), time.Duration(cfg.FlushIntervalMs)*time.Millisecond, hs.send)
+	return hs, nil
+}
+
+// OnEvent sends the events by the batches of up to BatchSize, it returns when
+// the events are sent. If the batch could not be sent, the error is returned,
+// so the events could be sent again.
+func (hs *httpSink) OnEvent(events []*api.LogEvent) error {
+	return hs.b.add(events)
+}
+
+// Close sends the events, which wait for the batch
+func (hs *httpSink) Close() error {
+	return hs.b.close()
+}
+
+func (hs *httpSink) send(events []*api.LogEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	if hs.cmpr != nil {
+		if body, err = compress(hs.cmpr, body); err != nil {
+			return fmt.Errorf("could not compress the batch with Compression=%v: %v", hs.cname, err)
+		}
+	}
+
+	req, err := http.NewRequest(hs.cfg.getMethod(), hs.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hs.cmpr != nil {
+		req.Header.Set("Content-Encoding", hs.cname)
+	}
+	for k, v := range hs.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if hs.auth != nil {
+		hs.auth.setAuth(req)
+	}
+
+	resp, err := hs.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return &httpStatusError{code: resp.StatusCode, msg: string(msg)}
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+//===================== httpStatusError =====================
+
+func (he *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d: %s", he.code, he.msg)
+}
+
+func (he *httpStatusError) Retryable() bool {
+	return he.code >= 500
+}
+
+//===================== httpSinkConfig =====================
+
+func newHttpSinkConfig(params Params) (*httpSinkConfig, error) {
+	cfg := &httpSinkConfig{}
+	if err := mapstructure.Decode(params, cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode Params=%v; %v", params, err)
+	}
+	return cfg, nil
+}
+
+func (hc *httpSinkConfig) Check() error {
+	u, err := url.Parse(hc.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL=%v; %v", hc.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL=%v, must be http(s)://<host>[/path]", hc.URL)
+	}
+	switch strings.ToUpper(hc.Method) {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("invalid Method=%v, must be one of %v, %v, %v", hc.Method,
+			http.MethodPost, http.MethodPut, http.MethodPatch)
+	}
+	if hc.BatchSize < 0 {
+		return fmt.Errorf("invalid BatchSize=%v, must be >= 0", hc.BatchSize)
+	}
+	if hc.FlushIntervalMs < 0 {
+		return fmt.Errorf("invalid FlushIntervalMs=%v, must be >= 0", hc.FlushIntervalMs)
+	}
+	if hc.TimeoutMs < 0 {
+		return fmt.Errorf("invalid TimeoutMs=%v, must be >= 0", hc.TimeoutMs)
+	}
+	return nil
+}
+
+func (hc *httpSinkConfig) getMethod() string {
+	if hc.Method == "" {
+		return http.MethodPost
+	}
+	return strings.ToUpper(hc.Method)
+}
+
+func (hc *httpSinkConfig) getBatchSize() int {
+	if hc.BatchSize == 0 {
+		return cHttpDefaultBatchSize
+	}
+	return hc.BatchSize
+}
+
+func (hc *httpSinkConfig) getTimeoutMs() int {
+	if hc.TimeoutMs == 0 {
+		return cHttpDefaultTimeoutMs
+	}
+	return hc.TimeoutMs
+}
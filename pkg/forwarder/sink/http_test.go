@@ -0,0 +1,215 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHttpServer collects the batches received and responds with the statuses
+// set, or with 200, when no statuses left
+type testHttpServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	batches  [][]*api.LogEvent
+	statuses []int
+}
+
+func newTestHttpServer(t *testing.T) *testHttpServer {
+	ts := &testHttpServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "abc" {
+			t.Error("unexpected request method=", r.Method, ", headers=", r.Header)
+		}
+
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+		if len(ts.statuses) > 0 {
+			w.WriteHeader(ts.statuses[0])
+			ts.statuses = ts.statuses[1:]
+			return
+		}
+
+		var evs []*api.LogEvent
+		if err := json.NewDecoder(r.Body).Decode(&evs); err != nil {
+			t.Error("could not decode the request body, err=", err)
+		}
+		ts.batches = append(ts.batches, evs)
+	}))
+	return ts
+}
+
+func (ts *testHttpServer) setStatuses(sts ...int) {
+	ts.lock.Lock()
+	ts.statuses = sts
+	ts.lock.Unlock()
+}
+
+func (ts *testHttpServer) getBatches() [][]*api.LogEvent {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.batches
+}
+
+func newTestHttpEvents(from, n int) []*api.LogEvent {
+	res := make([]*api.LogEvent, n)
+	for i := range res {
+		res[i] = &api.LogEvent{Timestamp: int64(from + i), Message: fmt.Sprintf("msg%d", from+i)}
+	}
+	return res
+}
+
+func TestHttpSinkConfigCheck(t *testing.T) {
+	for _, p := range []Params{{}, {"URL": "localhost:8080"}, {"URL": "ftp://localhost"}, {"URL": "http://localhost", "Method": "GET"},
+		{"URL": "http://localhost", "BatchSize": -1}, {"URL": "http://localhost", "FlushIntervalMs": -1}} {
+		if err := (&Config{Type: SnkTypeHttp, Params: p}).Check(); err == nil {
+			t.Fatal("Check() must fail for Params=", p)
+		}
+	}
+	if err := (&Config{Type: SnkTypeHttp, Params: Params{"URL": "https://localhost/logs", "Method": "put"}}).Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+}
+
+func TestHttpSinkBatching(t *testing.T) {
+	srv := newTestHttpServer(t)
+	defer srv.Close()
+
+	s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL + "/logs", "Method": "PUT",
+		"Headers": map[string]string{"X-Token": "abc"}, "BatchSize": 3}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+
+	// the events are sent, when OnEvent returns
+	if err = s.OnEvent(newTestHttpEvents(0, 2)); err != nil || len(srv.getBatches()) != 1 {
+		t.Fatal("the events must be sent, err=", err)
+	}
+	if err = s.OnEvent(newTestHttpEvents(2, 4)); err != nil || len(srv.getBatches()) != 3 {
+		t.Fatal("the events must be sent by BatchSize, err=", err)
+	}
+	if bs := srv.getBatches(); len(bs[1]) != 3 || bs[1][0].Message != "msg2" || len(bs[2]) != 1 || bs[2][0].Timestamp != 5 {
+		t.Fatal("unexpected batches ", bs)
+	}
+
+	// the 5xx are retryable, the events are sent again by the forwarder
+	srv.setStatuses(http.StatusServiceUnavailable)
+	evs := newTestHttpEvents(6, 3)
+	if err = s.OnEvent(evs); err == nil || !IsRetryable(err) {
+		t.Fatal("OnEvent() must return retryable error, but err=", err)
+	}
+	if err = s.OnEvent(evs); err != nil {
+		t.Fatal("OnEvent() err=", err)
+	}
+	if bs := srv.getBatches(); len(bs) != 4 || len(bs[3]) != 3 || bs[3][0].Message != "msg6" {
+		t.Fatal("the failed events must be sent once, but batches=", bs)
+	}
+
+	// the 4xx are not retryable
+	srv.setStatuses(http.StatusBadRequest)
+	if err = s.OnEvent(newTestHttpEvents(9, 3)); err == nil || IsRetryable(err) {
+		t.Fatal("OnEvent() must return non-retryable error, but err=", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal("Close() err=", err)
+	}
+	if err = s.OnEvent(newTestHttpEvents(12, 1)); err == nil {
+		t.Fatal("OnEvent() must fail for the closed sink")
+	}
+}
+
+func TestHttpSinkConcurrentBatching(t *testing.T) {
+	srv := newTestHttpServer(t)
+	defer srv.Close()
+
+	s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "Headers": map[string]string{"X-Token": "abc"},
+		"Method": "PUT", "BatchSize": 4, "FlushIntervalMs": 60000}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	defer s.Close()
+
+	// the events of the concurrent calls are sent by one batch
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.OnEvent(newTestHttpEvents(i*2, 2)); err != nil {
+				t.Error("OnEvent() err=", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if bs := srv.getBatches(); len(bs) != 1 || len(bs[0]) != 4 {
+		t.Fatal("the events must be sent by one batch, but batches=", bs)
+	}
+}
+
+func TestHttpSinkCloseFailure(t *testing.T) {
+	srv := newTestHttpServer(t)
+	defer srv.Close()
+
+	s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "Headers": map[string]string{"X-Token": "abc"},
+		"Method": "PUT", "BatchSize": 100, "FlushIntervalMs": 60000}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- s.OnEvent(newTestHttpEvents(0, 3))
+	}()
+	for s.(*httpSink).b.len() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the events waiting for the batch are not accepted, if the batch
+	// could not be sent on close, so the worker doesn't move the position
+	srv.setStatuses(http.StatusServiceUnavailable)
+	if err = s.Close(); err == nil {
+		t.Fatal("Close() must fail")
+	}
+	if err = <-errCh; err == nil || !IsRetryable(err) {
+		t.Fatal("OnEvent() must return the error of the batch sent on close, but err=", err)
+	}
+	if bs := srv.getBatches(); len(bs) != 0 {
+		t.Fatal("no batches expected, but ", bs)
+	}
+}
+
+func TestHttpSinkNetworkError(t *testing.T) {
+	srv := newTestHttpServer(t)
+	srv.Close()
+
+	s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 1}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	defer s.Close()
+
+	if err = s.OnEvent(newTestHttpEvents(0, 1)); err == nil || !IsRetryable(err) {
+		t.Fatal("OnEvent() must return retryable error, but err=", err)
+	}
+}
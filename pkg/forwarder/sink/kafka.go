@@ -0,0 +1,249 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/model"
+	"github.com/mitchellh/mapstructure"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// KafkaMessage is a record sent to Kafka
+	KafkaMessage struct {
+		Topic string
+		Value []byte
+	}
+
+	// KafkaProducer interface is an abstraction of the Kafka client used by the
+	// kafka sink. The client is provided by the factory registered via
+	// RegisterKafkaProducer
+	KafkaProducer interface {
+		// Send sends the messages and returns when they are acknowledged
+		// according to the acks level the producer was created with
+		Send(msgs []*KafkaMessage) error
+		// Close is part of io.Closer
+		Close() error
+	}
+
+	// KafkaProducerConfig struct contains the settings of the KafkaProducer
+	KafkaProducerConfig struct {
+		Brokers []string
+		// Acks contains the acks level, one of KafkaAcksNone, KafkaAcksLeader, KafkaAcksAll
+		Acks string
+		// TLS contains the TLS settings, nil means no TLS
+		TLS *tls.Config
+		// Auth contains the SASL credentials, could be nil
+		Auth *AuthConfig
+		// Compression contains the codec the producer compresses the message
+		// batches with, one of CompressionNone, CompressionGzip, CompressionZstd
+		Compression string
+	}
+
+	// KafkaProducerFactory creates a KafkaProducer by the config provided
+	KafkaProducerFactory func(cfg *KafkaProducerConfig) (KafkaProducer, error)
+
+	kafkaSinkConfig struct {
+		// Brokers contains the list of the Kafka brokers addresses
+		Brokers []string
+		// Topic contains the topic template. The template could contain
+		// {vars:<tag name>} constructions (see model.NewFormatParser)
+		Topic string
+		// Format contains the record format (see model.NewFormatParser), the
+		// message is sent as is, if the Format is empty
+		Format string
+		// Acks contains the acks level, KafkaAcksLeader by default
+		Acks string
+		// BatchSize contains the number of records sent in one batch
+		BatchSize int
+		// FlushIntervalMs contains the time the records of an OnEvent call
+		// could wait for the records of the concurrent calls (see the worker
+		// Concurrency) to fill the batch. If it is 0, the records are sent
+		// right away. OnEvent returns when its records are sent anyway.
+		FlushIntervalMs int
+	}
+
+	kafkaSink struct {
+		cfg   *kafkaSinkConfig
+		prod  KafkaProducer
+		topic *model.FormatParser
+		frmt  *model.FormatParser
+		b     *batcher
+	}
+)
+
+const (
+	KafkaAcksNone   = "none"
+	KafkaAcksLeader = "leader"
+	KafkaAcksAll    = "all"
+
+	cKafkaDefaultBatchSize = 100
+)
+
+var (
+	kafkaProdLock    sync.Mutex
+	kafkaProdFactory KafkaProducerFactory
+)
+
+// RegisterKafkaProducer sets the factory used by the kafka sink to create
+// the Kafka client. There is no Kafka client built in, so the application,
+// which uses the kafka sink, must register the factory before the forwarder
+// config is checked, the "kafka" sink config is invalid until then.
+func RegisterKafkaProducer(f KafkaProducerFactory) {
+	kafkaProdLock.Lock()
+	kafkaProdFactory = f
+	kafkaProdLock.Unlock()
+}
+
+func getKafkaProducerFactory() KafkaProducerFactory {
+	kafkaProdLock.Lock()
+	defer kafkaProdLock.Unlock()
+	return kafkaProdFactory
+}
+
+//===================== kafkaSink =====================
+
+func newKafkaSink(cfg *kafkaSinkConfig, tc *TLSConfig, auth *AuthConfig, compression string) (*kafkaSink, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	if err := checkCompression(compression); err != nil {
+		return nil, err
+	}
+	if compression == "" {
+		compression = CompressionNone
+	}
+
+	pf := getKafkaProducerFactory()
+	if pf == nil {
+		return nil, fmt.Errorf("no Kafka producer registered")
+	}
+
+	pc := &KafkaProducerConfig{Brokers: cfg.Brokers, Acks: cfg.getAcks(), Auth: auth, Compression: compression}
+	if tc != nil {
+		var err error
+		if pc.TLS, err = tc.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	prod, err := pf(pc)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Kafka producer for Brokers=%v: %v", cfg.Brokers, err)
+	}
+
+	ks := &kafkaSink{cfg: cfg, prod: prod}
+	ks.topic, _ = model.NewFormatParser(cfg.Topic)
+	if cfg.Format != "" {
+		ks.frmt, _ = model.NewFormatParser(cfg.Format)
+	}
+	ks.b = newBatcher(cfg.getBatchSize(), time.Duration(cfg.FlushIntervalMs)*time.Millisecond, ks.send)
+	return ks, nil
+}
+
+// OnEvent sends the events by the batches of up to BatchSize, it returns when
+// the events are sent. If the batch could not be sent, the error is returned,
+// so the events could be sent again.
+func (ks *kafkaSink) OnEvent(events []*api.LogEvent) error {
+	return ks.b.add(events)
+}
+
+// Close sends the events, which wait for the batch, and closes the producer
+func (ks *kafkaSink) Close() error {
+	err := ks.b.close()
+	if err1 := ks.prod.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (ks *kafkaSink) send(events []*api.LogEvent) error {
+	msgs := make([]*KafkaMessage, len(events))
+	var me model.LogEvent
+	for i, e := range events {
+		copyEv(e, &me)
+		km := &KafkaMessage{Topic: ks.topic.FormatStr(&me, e.Tags), Value: []byte(e.Message)}
+		if ks.frmt != nil {
+			km.Value = []byte(ks.frmt.FormatStr(&me, e.Tags))
+		}
+		msgs[i] = km
+	}
+	return ks.prod.Send(msgs)
+}
+
+//===================== kafkaSinkConfig =====================
+
+func newKafkaSinkConfig(params Params) (*kafkaSinkConfig, error) {
+	cfg := &kafkaSinkConfig{}
+	if err := mapstructure.Decode(params, cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode Params=%v; %v", params, err)
+	}
+	return cfg, nil
+}
+
+func (kc *kafkaSinkConfig) Check() error {
+	if len(kc.Brokers) == 0 {
+		return fmt.Errorf("invalid Brokers=%v, must be non-empty", kc.Brokers)
+	}
+	for _, b := range kc.Brokers {
+		if strings.TrimSpace(b) == "" {
+			return fmt.Errorf("invalid Brokers=%v, must not contain empty addresses", kc.Brokers)
+		}
+	}
+	if strings.TrimSpace(kc.Topic) == "" {
+		return fmt.Errorf("invalid Topic=%v, must be non-empty", kc.Topic)
+	}
+	if _, err := model.NewFormatParser(kc.Topic); err != nil {
+		return fmt.Errorf("invalid Topic=%v; %v", kc.Topic, err)
+	}
+	if kc.Format != "" {
+		if _, err := model.NewFormatParser(kc.Format); err != nil {
+			return fmt.Errorf("invalid Format=%v; %v", kc.Format, err)
+		}
+	}
+	switch kc.Acks {
+	case "", KafkaAcksNone, KafkaAcksLeader, KafkaAcksAll:
+	default:
+		return fmt.Errorf("invalid Acks=%v, must be one of %v, %v, %v", kc.Acks, KafkaAcksNone, KafkaAcksLeader, KafkaAcksAll)
+	}
+	if kc.BatchSize < 0 {
+		return fmt.Errorf("invalid BatchSize=%v, must be >= 0", kc.BatchSize)
+	}
+	if kc.FlushIntervalMs < 0 {
+		return fmt.Errorf("invalid FlushIntervalMs=%v, must be >= 0", kc.FlushIntervalMs)
+	}
+	if getKafkaProducerFactory() == nil {
+		return fmt.Errorf("no Kafka producer registered, see RegisterKafkaProducer")
+	}
+	return nil
+}
+
+func (kc *kafkaSinkConfig) getAcks() string {
+	if kc.Acks == "" {
+		return KafkaAcksLeader
+	}
+	return kc.Acks
+}
+
+func (kc *kafkaSinkConfig) getBatchSize() int {
+	if kc.BatchSize == 0 {
+		return cKafkaDefaultBatchSize
+	}
+	return kc.BatchSize
+}
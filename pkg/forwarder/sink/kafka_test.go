@@ -0,0 +1,175 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"sync"
+	"testing"
+)
+
+// testProducer is the mock KafkaProducer, which collects the batches sent
+type testProducer struct {
+	cfg *KafkaProducerConfig
+
+	lock    sync.Mutex
+	batches [][]*KafkaMessage
+	err     error
+	closed  bool
+}
+
+func (tp *testProducer) Send(msgs []*KafkaMessage) error {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.err != nil {
+		return tp.err
+	}
+	tp.batches = append(tp.batches, msgs)
+	return nil
+}
+
+func (tp *testProducer) Close() error {
+	tp.lock.Lock()
+	tp.closed = true
+	tp.lock.Unlock()
+	return nil
+}
+
+func (tp *testProducer) setErr(err error) {
+	tp.lock.Lock()
+	tp.err = err
+	tp.lock.Unlock()
+}
+
+func (tp *testProducer) getBatches() [][]*KafkaMessage {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.batches
+}
+
+func newTestKafkaSink(t *testing.T, params Params) (*kafkaSink, *testProducer) {
+	tp := &testProducer{}
+	RegisterKafkaProducer(func(cfg *KafkaProducerConfig) (KafkaProducer, error) {
+		tp.cfg = cfg
+		return tp, nil
+	})
+	defer RegisterKafkaProducer(nil)
+
+	cfg := &Config{Type: SnkTypeKafka, Params: params}
+	if err := cfg.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	s, err := NewSink(cfg)
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	return s.(*kafkaSink), tp
+}
+
+func newTestKafkaEvents(app string, n int) []*api.LogEvent {
+	res := make([]*api.LogEvent, n)
+	for i := range res {
+		res[i] = &api.LogEvent{Tags: "app=" + app, Message: fmt.Sprintf("%s%d", app, i)}
+	}
+	return res
+}
+
+func TestKafkaSinkConfigCheck(t *testing.T) {
+	for _, p := range []Params{{}, {"Topic": "logs"}, {"Brokers": []string{"b1:9092"}}, {"Brokers": []string{" "}, "Topic": "logs"},
+		{"Brokers": []string{"b1:9092"}, "Topic": "{vars"}, {"Brokers": []string{"b1:9092"}, "Topic": "logs", "Acks": "some"},
+		{"Brokers": []string{"b1:9092"}, "Topic": "logs", "BatchSize": -1}} {
+		if err := (&Config{Type: SnkTypeKafka, Params: p}).Check(); err == nil {
+			t.Fatal("Check() must fail for Params=", p)
+		}
+	}
+
+	// the config is not valid until the producer is registered
+	cfg := &Config{Type: SnkTypeKafka, Params: Params{"Brokers": []string{"b1:9092"}, "Topic": "logs"}}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("Check() must fail, when no producer is registered")
+	}
+	if _, err := NewSink(cfg); err == nil {
+		t.Fatal("NewSink() must fail, when no producer is registered")
+	}
+
+	RegisterKafkaProducer(func(cfg *KafkaProducerConfig) (KafkaProducer, error) {
+		return &testProducer{}, nil
+	})
+	defer RegisterKafkaProducer(nil)
+	if err := cfg.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+}
+
+func TestKafkaSinkBatching(t *testing.T) {
+	ks, tp := newTestKafkaSink(t, Params{"Brokers": []string{"b1:9092", "b2:9092"}, "Topic": "logs-{vars:app}",
+		"Acks": KafkaAcksAll, "BatchSize": 5})
+	if len(tp.cfg.Brokers) != 2 || tp.cfg.Acks != KafkaAcksAll || tp.cfg.TLS != nil || tp.cfg.Auth != nil {
+		t.Fatal("the producer must be created for the config brokers and acks, but cfg=", tp.cfg)
+	}
+
+	if err := ks.OnEvent(newTestKafkaEvents("a", 3)); err != nil || len(tp.getBatches()) != 1 {
+		t.Fatal("the events must be sent, err=", err)
+	}
+	if err := ks.OnEvent(newTestKafkaEvents("b", 7)); err != nil || len(tp.getBatches()) != 3 {
+		t.Fatal("the events must be sent by BatchSize, err=", err)
+	}
+	bs := tp.getBatches()
+	if len(bs[0]) != 3 || bs[0][0].Topic != "logs-a" || string(bs[0][0].Value) != "a0" || len(bs[1]) != 5 ||
+		len(bs[2]) != 2 || bs[2][1].Topic != "logs-b" || string(bs[2][1].Value) != "b6" {
+		t.Fatal("unexpected batches ", bs)
+	}
+
+	// the events are not kept, if the batch could not be sent
+	tp.setErr(fmt.Errorf("test error"))
+	if err := ks.OnEvent(newTestKafkaEvents("c", 3)); err == nil || ks.b.len() != 0 {
+		t.Fatal("OnEvent() must fail, and the failed events must not be kept, err=", err)
+	}
+	tp.setErr(nil)
+
+	if err := ks.Close(); err != nil || !tp.closed {
+		t.Fatal("Close() must close the producer, err=", err)
+	}
+	if err := ks.OnEvent(newTestKafkaEvents("e", 1)); err == nil {
+		t.Fatal("OnEvent() must fail for the closed sink")
+	}
+}
+
+func TestKafkaSinkFlushInterval(t *testing.T) {
+	ks, tp := newTestKafkaSink(t, Params{"Brokers": []string{"b1:9092"}, "Topic": "logs", "BatchSize": 100, "FlushIntervalMs": 10})
+	defer ks.Close()
+
+	// the events of the concurrent calls wait for each other up to the flush
+	// interval, and the calls return when the batch is sent
+	var wg sync.WaitGroup
+	for _, app := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(app string) {
+			defer wg.Done()
+			if err := ks.OnEvent(newTestKafkaEvents(app, 3)); err != nil {
+				t.Error("OnEvent() err=", err)
+			}
+		}(app)
+	}
+	wg.Wait()
+	n := 0
+	for _, b := range tp.getBatches() {
+		n += len(b)
+	}
+	if n != 6 {
+		t.Fatal("all the events must be sent, when OnEvent returns, but batches=", tp.getBatches())
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/logrange/logrange/pkg/utils"
+	"io/ioutil"
+	"net/http"
+)
+
+type (
+	// TLSConfig struct contains the TLS settings of the network sinks
+	TLSConfig struct {
+		// CAFile contains the PEM encoded CA certificates file, which are used to
+		// verify the server certificate. The system CAs are used, if empty
+		CAFile string
+		// CertFile and KeyFile contain the PEM encoded client certificate and its
+		// key. Both must be set, or both must be empty
+		CertFile string
+		KeyFile  string
+		// InsecureSkipVerify disables the server certificate verification
+		InsecureSkipVerify bool
+	}
+
+	// AuthConfig struct contains the credentials the network sinks use. Either
+	// the bearer token, or the username and password could be set.
+	AuthConfig struct {
+		BearerToken string
+		Username    string
+		Password    string
+	}
+)
+
+//===================== TLSConfig =====================
+
+// Check performs an internal check of the TLSConfig fields, the files are read
+// and parsed.
+func (tc *TLSConfig) Check() error {
+	_, err := tc.tlsConfig()
+	return err
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the files names by the
+// environment variables values
+func (tc *TLSConfig) ExpandEnv() (err error) {
+	if tc.CAFile, err = utils.ExpandEnv(tc.CAFile); err != nil {
+		return fmt.Errorf("invalid CAFile=%v: %v", tc.CAFile, err)
+	}
+	if tc.CertFile, err = utils.ExpandEnv(tc.CertFile); err != nil {
+		return fmt.Errorf("invalid CertFile=%v: %v", tc.CertFile, err)
+	}
+	if tc.KeyFile, err = utils.ExpandEnv(tc.KeyFile); err != nil {
+		return fmt.Errorf("invalid KeyFile=%v: %v", tc.KeyFile, err)
+	}
+	return nil
+}
+
+// tlsConfig returns the tls.Config built by tc
+func (tc *TLSConfig) tlsConfig() (*tls.Config, error) {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, fmt.Errorf("invalid CertFile=%v and KeyFile=%v, must be both set or both empty", tc.CertFile, tc.KeyFile)
+	}
+
+	res := &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify}
+	if tc.CAFile != "" {
+		data, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAFile=%v; %v", tc.CAFile, err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("invalid CAFile=%v, no PEM certificates found", tc.CAFile)
+		}
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CertFile=%v or KeyFile=%v; %v", tc.CertFile, tc.KeyFile, err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+//===================== AuthConfig =====================
+
+// Check performs an internal check of the AuthConfig fields
+func (ac *AuthConfig) Check() error {
+	if ac.BearerToken != "" && (ac.Username != "" || ac.Password != "") {
+		return fmt.Errorf("either BearerToken or Username and Password must be set, but not both")
+	}
+	if ac.Username == "" && ac.Password != "" {
+		return fmt.Errorf("invalid Username=%v, must be non-empty if Password is set", ac.Username)
+	}
+	return nil
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the credentials by the
+// environment variables values, so the secrets could be kept out of the config
+func (ac *AuthConfig) ExpandEnv() (err error) {
+	if ac.BearerToken, err = utils.ExpandEnv(ac.BearerToken); err != nil {
+		return fmt.Errorf("invalid BearerToken: %v", err)
+	}
+	if ac.Username, err = utils.ExpandEnv(ac.Username); err != nil {
+		return fmt.Errorf("invalid Username=%v: %v", ac.Username, err)
+	}
+	if ac.Password, err = utils.ExpandEnv(ac.Password); err != nil {
+		return fmt.Errorf("invalid Password: %v", err)
+	}
+	return nil
+}
+
+// setAuth sets the credentials to the request
+func (ac *AuthConfig) setAuth(req *http.Request) {
+	if ac.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.BearerToken)
+	} else if ac.Username != "" {
+		req.SetBasicAuth(ac.Username, ac.Password)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key into the dir, and
+// returns the files names
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("could not generate key, err=", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("could not create certificate, err=", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("could not marshal key, err=", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}))
+	return certFile, keyFile
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) {
+	if err := ioutil.WriteFile(name, data, 0640); err != nil {
+		t.Fatal("could not write ", name, ", err=", err)
+	}
+}
+
+func TestTLSConfigCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsConfigTest")
+	if err != nil {
+		t.Fatal("could not create temp dir, err=", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	badFile := filepath.Join(dir, "bad.pem")
+	writeTestFile(t, badFile, []byte("not a pem"))
+
+	for _, tc := range []*TLSConfig{
+		{CertFile: certFile},
+		{KeyFile: keyFile},
+		{CAFile: filepath.Join(dir, "absent.pem")},
+		{CAFile: badFile},
+		{CertFile: certFile, KeyFile: badFile},
+		{CertFile: keyFile, KeyFile: keyFile},
+	} {
+		if err := tc.Check(); err == nil {
+			t.Fatal("Check() must fail for ", tc)
+		}
+	}
+
+	for _, tc := range []*TLSConfig{
+		{},
+		{InsecureSkipVerify: true},
+		{CAFile: certFile},
+		{CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+	} {
+		if err := tc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for ", tc)
+		}
+	}
+}
+
+func TestAuthConfigCheck(t *testing.T) {
+	for _, ac := range []*AuthConfig{
+		{BearerToken: "abc", Username: "user"},
+		{BearerToken: "abc", Password: "pwd"},
+		{Password: "pwd"},
+	} {
+		if err := ac.Check(); err == nil {
+			t.Fatal("Check() must fail for ", ac)
+		}
+	}
+
+	for _, ac := range []*AuthConfig{{}, {BearerToken: "abc"}, {Username: "user"}, {Username: "user", Password: "pwd"}} {
+		if err := ac.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for ", ac)
+		}
+	}
+}
+
+func TestConfigCheckNet(t *testing.T) {
+	for _, c := range []*Config{
+		{Type: SnkTypeStdout, TLS: &TLSConfig{}},
+		{Type: SnkTypeFile, Params: Params{"Path": "a.log"}, Auth: &AuthConfig{}},
+		{Type: SnkTypeHttp, Params: Params{"URL": "https://localhost"}, TLS: &TLSConfig{CertFile: "cert.pem"}},
+		{Type: SnkTypeHttp, Params: Params{"URL": "https://localhost"}, Auth: &AuthConfig{Password: "pwd"}},
+	} {
+		if err := c.Check(); err == nil {
+			t.Fatal("Check() must fail for ", c)
+		}
+	}
+
+	var pc *KafkaProducerConfig
+	RegisterKafkaProducer(func(cfg *KafkaProducerConfig) (KafkaProducer, error) {
+		pc = cfg
+		return &testProducer{}, nil
+	})
+	defer RegisterKafkaProducer(nil)
+	c := &Config{Type: SnkTypeKafka, Params: Params{"Brokers": []string{"b1:9093"}, "Topic": "logs"},
+		TLS: &TLSConfig{InsecureSkipVerify: true}, Auth: &AuthConfig{Username: "user", Password: "pwd"}}
+	if err := c.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+
+	s, err := NewSink(c)
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	defer s.Close()
+	if pc.TLS == nil || !pc.TLS.InsecureSkipVerify || pc.Auth != c.Auth {
+		t.Fatal("the producer must be created with TLS and Auth, but cfg=", pc)
+	}
+}
+
+func TestHttpSinkTLSAndAuth(t *testing.T) {
+	var user, pwd, token string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pwd, _ = r.BasicAuth()
+		token = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "httpSinkTLSTest")
+	if err != nil {
+		t.Fatal("could not create temp dir, err=", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	// the server certificate is not trusted without the CA
+	s, err := NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 1}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	if err = s.OnEvent(newTestHttpEvents(0, 1)); err == nil {
+		t.Fatal("OnEvent() must fail for the unknown server certificate")
+	}
+	s.Close()
+
+	s, err = NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 1},
+		TLS: &TLSConfig{CAFile: caFile}, Auth: &AuthConfig{Username: "user", Password: "pwd"}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	if err = s.OnEvent(newTestHttpEvents(0, 1)); err != nil || user != "user" || pwd != "pwd" {
+		t.Fatal("OnEvent() must succeed with the basic auth, err=", err, ", user=", user)
+	}
+	s.Close()
+
+	s, err = NewSink(&Config{Type: SnkTypeHttp, Params: Params{"URL": srv.URL, "BatchSize": 1},
+		TLS: &TLSConfig{InsecureSkipVerify: true}, Auth: &AuthConfig{BearerToken: "abc"}})
+	if err != nil {
+		t.Fatal("NewSink() err=", err)
+	}
+	if err = s.OnEvent(newTestHttpEvents(0, 1)); err != nil || token != "Bearer abc" {
+		t.Fatal("OnEvent() must succeed with the bearer token, err=", err, ", token=", token)
+	}
+	s.Close()
+}
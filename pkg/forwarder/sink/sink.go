@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"github.com/logrange/logrange/api"
 	"github.com/logrange/logrange/pkg/utils"
+	"net"
 )
 
 type (
@@ -31,11 +32,23 @@ type (
 		Type string
 		// Params contains params for the specified type
 		Params Params
+		// TLS contains the TLS settings of the network sinks ("http" and "kafka"),
+		// could be nil
+		TLS *TLSConfig
+		// Auth contains the credentials of the network sinks ("http" and "kafka"),
+		// could be nil
+		Auth *AuthConfig
+		// Compression contains the compression of the payloads sent by the
+		// network sinks, one of CompressionNone (default), CompressionGzip or
+		// CompressionZstd
+		Compression string
 	}
 
 	// Sink interface is an abstraction for a sink implementation
 	Sink interface {
-		// OnEvent is called when new portion of events should be sent to the sink
+		// OnEvent is called when new portion of events should be sent to the sink. The
+		// error returned could be retryable (see IsRetryable), so the same events will
+		// be sent again.
 		OnEvent(events []*api.LogEvent) error
 		// Close is part of io.Closer
 		Close() error
@@ -45,9 +58,14 @@ type (
 const (
 	SnkTypeStdout = "stdout"
 	SnkTypeSyslog = "syslog"
+	SnkTypeFile   = "file"
+	SnkTypeKafka  = "kafka"
+	SnkTypeHttp   = "http"
 )
 
-// NewSink creates a new Sink instance by cfg provided. "stdout" and "syslog" is only supported so far
+// NewSink creates a new Sink instance by cfg provided. "stdout", "syslog", "file", "kafka" and
+// "http" are only supported so far. The "kafka" sink requires the Kafka producer registered
+// (see RegisterKafkaProducer), its config doesn't pass Check() otherwise
 func NewSink(cfg *Config) (Sink, error) {
 	switch cfg.Type {
 	case SnkTypeStdout:
@@ -58,15 +76,52 @@ func NewSink(cfg *Config) (Sink, error) {
 			return newSyslogSink(scfg)
 		}
 		return nil, err
+	case SnkTypeFile:
+		fcfg, err := newFileSinkConfig(cfg.Params)
+		if err == nil {
+			return newFileSink(fcfg)
+		}
+		return nil, err
+	case SnkTypeKafka:
+		kcfg, err := newKafkaSinkConfig(cfg.Params)
+		if err == nil {
+			return newKafkaSink(kcfg, cfg.TLS, cfg.Auth, cfg.Compression)
+		}
+		return nil, err
+	case SnkTypeHttp:
+		hcfg, err := newHttpSinkConfig(cfg.Params)
+		if err == nil {
+			return newHttpSink(hcfg, cfg.TLS, cfg.Auth, cfg.Compression)
+		}
+		return nil, err
 	}
 
 	return nil, fmt.Errorf("unknown Type=%v", cfg.Type)
 }
 
+// IsRetryable returns whether the error returned by Sink.OnEvent is transient, so the
+// events could be sent again soon. The network errors (net.Error) are retryable,
+// the syslog sink, for instance, re-connects on the next write. Other errors are
+// retryable if they have the Retryable() method returning true, like the 5xx
+// responses of the http sink.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case interface{ Retryable() bool }:
+		return e.Retryable()
+	}
+	return false
+}
+
 //===================== config =====================
 
 // Check peforms an internal check of c fields
 func (c *Config) Check() error {
+	if err := c.checkNet(); err != nil {
+		return err
+	}
+
 	switch c.Type {
 	case SnkTypeStdout:
 		return nil
@@ -76,11 +131,110 @@ func (c *Config) Check() error {
 			return cfg.Check()
 		}
 		return err
+	case SnkTypeFile:
+		cfg, err := newFileSinkConfig(c.Params)
+		if err == nil {
+			return cfg.Check()
+		}
+		return err
+	case SnkTypeKafka:
+		cfg, err := newKafkaSinkConfig(c.Params)
+		if err == nil {
+			return cfg.Check()
+		}
+		return err
+	case SnkTypeHttp:
+		cfg, err := newHttpSinkConfig(c.Params)
+		if err == nil {
+			return cfg.Check()
+		}
+		return err
 	}
 
 	return fmt.Errorf("unknown Type=%v", c.Type)
 }
 
+// checkNet checks TLS, Auth and Compression, which are allowed for the network
+// sinks only
+func (c *Config) checkNet() error {
+	if err := checkCompression(c.Compression); err != nil {
+		return err
+	}
+	if isCompressed(c.Compression) && !c.isNet() {
+		return fmt.Errorf("Compression=%v is not supported by Type=%v", c.Compression, c.Type)
+	}
+	if c.TLS == nil && c.Auth == nil {
+		return nil
+	}
+	if !c.isNet() {
+		return fmt.Errorf("TLS and Auth are not supported by Type=%v", c.Type)
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Check(); err != nil {
+			return fmt.Errorf("invalid TLS; %v", err)
+		}
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Check(); err != nil {
+			return fmt.Errorf("invalid Auth; %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) isNet() bool {
+	return c.Type == SnkTypeHttp || c.Type == SnkTypeKafka
+}
+
+// ExpandEnv replaces the ${VAR} placeholders in the Type, the string values
+// of Params (including the nested ones), TLS, Auth and Compression by the
+// environment variables values
+func (c *Config) ExpandEnv() (err error) {
+	if c.Type, err = utils.ExpandEnv(c.Type); err != nil {
+		return fmt.Errorf("invalid Type=%v: %v", c.Type, err)
+	}
+	if c.Compression, err = utils.ExpandEnv(c.Compression); err != nil {
+		return fmt.Errorf("invalid Compression=%v: %v", c.Compression, err)
+	}
+	for k, v := range c.Params {
+		if c.Params[k], err = expandEnvValue(v); err != nil {
+			return fmt.Errorf("invalid Params[%s]: %v", k, err)
+		}
+	}
+	if c.TLS != nil {
+		if err = c.TLS.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid TLS; %v", err)
+		}
+	}
+	if c.Auth != nil {
+		if err = c.Auth.ExpandEnv(); err != nil {
+			return fmt.Errorf("invalid Auth; %v", err)
+		}
+	}
+	return nil
+}
+
+func expandEnvValue(v interface{}) (interface{}, error) {
+	var err error
+	switch val := v.(type) {
+	case string:
+		return utils.ExpandEnv(val)
+	case map[string]interface{}:
+		for k, v := range val {
+			if val[k], err = expandEnvValue(v); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, v := range val {
+			if val[i], err = expandEnvValue(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
 // String is fmt.Stringer implementation
 func (c *Config) String() string {
 	return utils.ToJsonStr(c)
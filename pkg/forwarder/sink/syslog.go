@@ -23,6 +23,7 @@ import (
 	"github.com/logrange/logrange/pkg/utils"
 	"github.com/logrange/range/pkg/utils/bytes"
 	"github.com/mitchellh/mapstructure"
+	"sync"
 	"time"
 )
 
@@ -53,6 +54,8 @@ type (
 	syslogSink struct {
 		slog *syslog.Logger
 		schm *syslogMessageSchema
+		// lock serializes the writes, the sink could be used by several writers
+		lock sync.Mutex
 	}
 )
 
@@ -60,20 +63,24 @@ type (
 
 func newSyslogSink(cfg *syslogSinkConfig) (*syslogSink, error) {
 	ms, err := cfg.GetSyslogMsgSchema()
-	if err == nil {
-		slog, err := syslog.NewLogger(&cfg.Config)
-		if err == nil {
-			return &syslogSink{
-				slog: slog,
-				schm: ms,
-			}, nil
-		}
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	slog, err := syslog.NewLogger(&cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{
+		slog: slog,
+		schm: ms,
+	}, nil
 }
 
 // OnEvent sends the events via syslog to the destination
 func (ss *syslogSink) OnEvent(events []*api.LogEvent) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
 	var (
 		me model.LogEvent
 		sm syslog.Message
@@ -91,6 +98,9 @@ func (ss *syslogSink) OnEvent(events []*api.LogEvent) error {
 }
 
 func (ss *syslogSink) Close() error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
 	if ss.slog != nil {
 		return ss.slog.Close()
 	}
@@ -0,0 +1,89 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/pkg/utils"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type (
+	// jitterTicker delivers the ticks like time.Ticker does, but every interval
+	// between the ticks is randomly spread by the percentage returned by pct
+	// (see jitter). The ticks are dropped, if the receiver is slow.
+	jitterTicker struct {
+		C      <-chan time.Time
+		stopCh chan struct{}
+	}
+)
+
+var (
+	// rnd is seeded by the start time, so the forwarders started at the
+	// same moment have different intervals
+	rndLock sync.Mutex
+	rnd     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func newJitterTicker(clock utils.Clock, d time.Duration, pct func() int) *jitterTicker {
+	c := make(chan time.Time, 1)
+	jt := &jitterTicker{C: c, stopCh: make(chan struct{})}
+	go func() {
+		t := clock.NewTimer(jitter(d, pct()))
+		defer t.Stop()
+		for {
+			select {
+			case <-jt.stopCh:
+				return
+			case tm := <-t.C():
+				select {
+				case c <- tm:
+				default:
+				}
+				t.Reset(jitter(d, pct()))
+			}
+		}
+	}()
+	return jt
+}
+
+// wait waits for the next tick. It returns false if ctx is closed.
+func (jt *jitterTicker) wait(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-jt.C:
+		return true
+	}
+}
+
+// Stop turns off the ticker, no more ticks are sent after that
+func (jt *jitterTicker) Stop() {
+	close(jt.stopCh)
+}
+
+// jitter returns the random duration in [d - d*pct/100, d + d*pct/100]
+func jitter(d time.Duration, pct int) time.Duration {
+	spread := int64(d) * int64(pct) / 100
+	if spread <= 0 {
+		return d
+	}
+	rndLock.Lock()
+	n := rnd.Int63n(2*spread + 1)
+	rndLock.Unlock()
+	return d + time.Duration(n-spread)
+}
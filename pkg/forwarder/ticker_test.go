@@ -0,0 +1,117 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/pkg/utils"
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Fatal("no jitter expected, but ", d)
+	}
+
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := jitter(10*time.Second, 20)
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Fatal("the interval ", d, " is out of the jitter band")
+		}
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	// the intervals are spread over the band
+	if min > 9*time.Second || max < 11*time.Second {
+		t.Fatal("the intervals must vary, but min=", min, ", max=", max)
+	}
+}
+
+func TestJitterTicker(t *testing.T) {
+	jt := newJitterTicker(utils.RealClock, 20*time.Millisecond, func() int { return 50 })
+	defer jt.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if !jt.wait(ctx) {
+			t.Fatal("no ticks received")
+		}
+	}
+	// 10 intervals, every one is at least 10ms
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatal("the ticks are too frequent, 10 ticks in ", d)
+	}
+
+	cancel()
+	if jt.wait(ctx) {
+		t.Fatal("wait must return false for the closed context")
+	}
+}
+
+func TestJitterTickerClock(t *testing.T) {
+	fc := utils.NewFakeClock(time.Unix(1000, 0))
+	jt := newJitterTicker(fc, time.Minute, func() int { return 0 })
+	defer jt.Stop()
+
+	// the timer is created by the ticker goroutine
+	start := time.Now()
+	for fc.Timers() == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the ticker must start the timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fc.Advance(time.Minute)
+	if !jt.wait(ctx) {
+		t.Fatal("the tick is expected in 1 minute")
+	}
+}
+
+func TestConfigTickerJitter(t *testing.T) {
+	cfg := NewDefaultConfig()
+	for _, pct := range []int{0, 10, cMaxTickerJitterPct} {
+		cfg.TickerJitterPct = pct
+		if err := cfg.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for TickerJitterPct=", pct)
+		}
+	}
+	for _, pct := range []int{-1, cMaxTickerJitterPct + 1} {
+		cfg.TickerJitterPct = pct
+		if err := cfg.Check(); err == nil {
+			t.Fatal("Check() must fail for TickerJitterPct=", pct)
+		}
+	}
+
+	cfg.TickerJitterPct = 10
+	nc := NewDefaultConfig()
+	if cfg.Equals(nc) {
+		t.Fatal("the configs with different TickerJitterPct must not be equal")
+	}
+	cfg.Apply(nc)
+	if cfg.TickerJitterPct != 0 {
+		t.Fatal("the jitter must be turned off, but ", cfg.TickerJitterPct)
+	}
+}
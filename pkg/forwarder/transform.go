@@ -0,0 +1,141 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"github.com/logrange/logrange/api"
+	"github.com/logrange/logrange/pkg/utils/kvstring"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type (
+	// transformData is the record data available in the WorkerConfig.Transform
+	// template, e.g. `{{.Tags.app}} {{.Time.Format "15:04:05"}} {{.Message}}`
+	transformData struct {
+		// Timestamp contains the record timestamp in nanoseconds
+		Timestamp int64
+		// Time contains the record timestamp
+		Time time.Time
+		// Message contains the record message
+		Message string
+		// Tags contains the record source tags
+		Tags map[string]string
+		// Fields contains the record fields
+		Fields map[string]string
+		// Caps contains the values of the WorkerConfig.Extract named groups,
+		// it is empty, if the message doesn't match the regexp
+		Caps map[string]string
+	}
+
+	// transformer applies the WorkerConfig.Transform template to the records
+	transformer struct {
+		tmpl *template.Template
+		// re extracts the Caps values from the messages, could be nil
+		re *regexp.Regexp
+		sb strings.Builder
+		// tags contains the parsed tags lines, the records of a batch usually
+		// have a few sources only
+		tags map[string]map[string]string
+	}
+)
+
+// compileTransform returns the template for the WorkerConfig.Transform value. The
+// missing tags and fields are replaced by empty strings.
+func compileTransform(transform string) (*template.Template, error) {
+	return template.New("transform").Option("missingkey=zero").Parse(transform)
+}
+
+// newTransformer returns the transformer for the template, or nil if the template
+// is empty. The named groups of re (could be nil) are available in the template.
+func newTransformer(transform string, re *regexp.Regexp) (*transformer, error) {
+	if transform == "" {
+		return nil, nil
+	}
+	tmpl, err := compileTransform(transform)
+	if err != nil {
+		return nil, err
+	}
+	return &transformer{tmpl: tmpl, re: re}, nil
+}
+
+// apply returns the copies of the events with the messages transformed. The
+// events, which could not be transformed are returned as is, and the first
+// error happened is returned.
+func (t *transformer) apply(events []*api.LogEvent) ([]*api.LogEvent, error) {
+	var res error
+	t.tags = make(map[string]map[string]string)
+	tes := make([]*api.LogEvent, len(events))
+	for i, e := range events {
+		te := *e
+		td := transformData{
+			Timestamp: e.Timestamp,
+			Time:      time.Unix(0, e.Timestamp),
+			Message:   e.Message,
+			Tags:      t.getTags(e.Tags),
+			Fields:    toMap(e.Fields),
+			Caps:      t.extract(e.Message),
+		}
+
+		t.sb.Reset()
+		if err := t.tmpl.Execute(&t.sb, &td); err == nil {
+			te.Message = t.sb.String()
+		} else if res == nil {
+			res = err
+		}
+		tes[i] = &te
+	}
+	return tes, res
+}
+
+// extract returns the values of the named groups of the regexp for msg, or
+// the empty map, if there is no regexp or msg doesn't match it
+func (t *transformer) extract(msg string) map[string]string {
+	res := map[string]string{}
+	if t.re == nil {
+		return res
+	}
+	m := t.re.FindStringSubmatch(msg)
+	if m == nil {
+		return res
+	}
+	for i, n := range t.re.SubexpNames() {
+		if n != "" {
+			res[n] = m[i]
+		}
+	}
+	return res
+}
+
+func (t *transformer) getTags(tl string) map[string]string {
+	m, ok := t.tags[tl]
+	if !ok {
+		m = toMap(tl)
+		t.tags[tl] = m
+	}
+	return m
+}
+
+// toMap returns the key-value pairs of the tags or fields line, or the empty map
+// if the line could not be parsed
+func toMap(kvs string) map[string]string {
+	m, err := kvstring.ToMap(kvs)
+	if err != nil || m == nil {
+		return map[string]string{}
+	}
+	return m
+}
@@ -0,0 +1,130 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/api"
+	"testing"
+)
+
+func TestTransformCheck(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	for _, tr := range []string{"{{.Message", "{{.Message}", "{{if .Tags.app}}a", "{{unknownFunc .Message}}"} {
+		wc.Transform = tr
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for Transform=", tr)
+		}
+	}
+
+	wc.Transform = "{{.Tags.app}}: {{.Message}}"
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+}
+
+func TestTransformTags(t *testing.T) {
+	tr, err := newTransformer(`[{{.Tags.app}}|{{.Tags.absent}}] {{.Fields.lvl}} {{.Time.UTC.Format "15:04:05"}} {{.Message}}`, nil)
+	if err != nil {
+		t.Fatal("newTransformer() err=", err)
+	}
+
+	evs := []*api.LogEvent{
+		{Timestamp: 3600 * 1e9, Message: "msg1", Tags: "app=a,env=prod", Fields: "lvl=info"},
+		{Timestamp: 3601 * 1e9, Message: "msg2", Tags: "app=b"},
+	}
+	res, err := tr.apply(evs)
+	if err != nil {
+		t.Fatal("apply() err=", err)
+	}
+	if res[0].Message != "[a|] info 01:00:00 msg1" || res[1].Message != "[b|]  01:00:01 msg2" {
+		t.Fatal("unexpected transformation ", res[0].Message, ", ", res[1].Message)
+	}
+	if evs[0].Message != "msg1" || res[0].Tags != evs[0].Tags || res[0].Timestamp != evs[0].Timestamp {
+		t.Fatal("the events must be copied")
+	}
+
+	if tr, _ = newTransformer("", nil); tr != nil {
+		t.Fatal("no transformer expected for the empty template")
+	}
+}
+
+func TestTransformWorker(t *testing.T) {
+	tc := &testClient{events: []*api.LogEvent{{Message: "msg1\n", Tags: "app=a"}, {Message: "msg2\n", Tags: "app=b"}}}
+	ts := &testSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.Transform = "{{.Tags.app}}: {{.Message}}"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, wait := runTestWorker(ctx, wc, tc, ts)
+	waitCount(t, ts, 2)
+	cancel()
+	wait()
+
+	if ts.events[0].Message != "a: msg1\n" || ts.events[1].Message != "b: msg2\n" {
+		t.Fatal("the events must be transformed, but got ", ts.events[0].Message, ", ", ts.events[1].Message)
+	}
+}
+
+func TestTransformExtract(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.Extract = `^(?P<ts>\S+) \[(?P<level>[A-Z]+)\] `
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for Extract without Transform")
+	}
+	wc.Transform = `{{.Caps.level}}|{{.Caps.ts}}|{{.Message}}`
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	for _, ext := range []string{"(?P<level", "[A-Z]+"} {
+		wc.Extract = ext
+		if err := wc.Check(); err == nil {
+			t.Fatal("Check() must fail for Extract=", ext)
+		}
+	}
+
+	wc.Extract = `^(?P<ts>\S+) \[(?P<level>[A-Z]+)\] `
+	tr, _ := newTransformer(wc.Transform, wc.getExtractRegexp())
+	res, err := tr.apply([]*api.LogEvent{
+		{Message: "2019-08-01T10:00:00Z [ERROR] disk is full"},
+		{Message: "no timestamp"},
+	})
+	if err != nil {
+		t.Fatal("apply() err=", err)
+	}
+	if res[0].Message != "ERROR|2019-08-01T10:00:00Z|2019-08-01T10:00:00Z [ERROR] disk is full" || res[1].Message != "||no timestamp" {
+		t.Fatal("unexpected transformation ", res[0].Message, ", ", res[1].Message)
+	}
+}
+
+func TestTransformExtractFilter(t *testing.T) {
+	tc := &testClient{events: []*api.LogEvent{{Message: "read timeout after 5s"}, {Message: "connection refused"}, {Message: "write timeout after 10s"}}}
+	ts := &testSink{}
+	wc := &WorkerConfig{Name: "w1", Pipe: &PipeConfig{Filter: `'(?P<op>\w+) timeout after (?P<dur>\w+)'`}, Sink: newTestWorkerConfig("w1", "p1").Sink}
+	wc.Transform = "{{.Caps.op}}={{.Caps.dur}}"
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, wait := runTestWorker(ctx, wc, tc, ts)
+	waitCount(t, ts, 2)
+	cancel()
+	wait()
+
+	if len(ts.events) != 2 || ts.events[0].Message != "read=5s" || ts.events[1].Message != "write=10s" {
+		t.Fatal("the filter groups must be extracted, but got ", ts.events)
+	}
+}
@@ -21,26 +21,91 @@ import (
 	"github.com/logrange/logrange/api"
 	"github.com/logrange/logrange/pkg/forwarder/sink"
 	"github.com/logrange/logrange/pkg/utils"
+	"github.com/logrange/logrange/pkg/utils/kvstring"
+	"regexp"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type (
 	workerConfig struct {
-		desc   *desc
-		sink   sink.Sink
-		rpcc   api.Client
+		desc *desc
+		sink sink.Sink
+		// deadLetter is the sink for the events, which could not be sent, could be nil
+		deadLetter sink.Sink
+		// commit persists the workers positions, it is used in the
+		// DeliveryAtMostOnce mode before the events are sent
+		commit func() error
+		// owns returns whether the records of the journal are forwarded by
+		// the node (see JournalRouter), all the records are forwarded, if nil
+		owns func(tags string) bool
+		rpcc api.Client
+		// clock is the system clock, if nil
+		clock  utils.Clock
 		logger log4g.Logger
 	}
 
 	worker struct {
-		desc *desc
+		// desc contains the *desc, the worker runs for. It is replaced when
+		// the worker sinks are replaced (see replaceSinks)
+		desc atomic.Value
 		rpcc api.Client
+		// sink and deadLetter are used by the goroutine, which sends the events
 		sink sink.Sink
+		// deadLetter receives the events, which could not be sent to sink, could be nil
+		deadLetter sink.Sink
+		// swapLock guards the swap and the desc replacement
+		swapLock sync.Mutex
+		// swap contains the sinks and the desc, which replace the current ones,
+		// when the next events are sent, could be nil
+		swap   *workerConfig
+		commit func() error
+		// owns filters the events by their journals, could be nil
+		owns func(tags string) bool
+		// msgRe filters the events by the message, if the pipe filter is a
+		// regexp (see PipeConfig.Filter), could be nil
+		msgRe *regexp.Regexp
+		// trans transforms the events before they are sent, could be nil
+		trans *transformer
+		// enc encodes the events before they are sent, could be nil
+		enc *encoder
+		// lg limits the events messages size, could be nil
+		lg *lineGuard
+
+		// recLim and bytesLim limit the rate of the events sent to the sink
+		recLim   *limiter
+		bytesLim *limiter
+		// throttled contains the total time (in nanoseconds) the worker waited because of the rate limits
+		throttled int64
+		// buf keeps the records read, until they are sent, could be nil - the
+		// records are sent as soon as they are read then
+		buf *buffer
 
-		state  int32
+		state int32
+		// stopCh is closed when the worker is asked to stop, so it doesn't sleep anymore
+		stopCh chan struct{}
+		stats  workerStats
+		clock  utils.Clock
 		logger log4g.Logger
 	}
+
+	// workerStats contains the worker counters reported by Forwarder.Status
+	workerStats struct {
+		lock      sync.Mutex
+		forwarded uint64
+		lastRecTs int64
+		lastFlush time.Time
+		lastErr   error
+		lastErrTs time.Time
+		backoff   time.Duration
+		// tailLag contains the last lag measured (see checkTailLag)
+		tailLag time.Duration
+		// base contains the counters values, when the stats were reset
+		base      WorkerCounters
+		resetTime time.Time
+	}
 )
 
 const (
@@ -49,16 +114,44 @@ const (
 	wsStopped
 )
 
+var (
+	// tailLagInterval defines how often the worker lag behind the source tail is checked
+	tailLagInterval = 30 * time.Second
+	// idleInterval defines how long the worker sleeps, when there are no new events
+	idleInterval = 5 * time.Second
+)
+
 //===================== worker =====================
 
 func newWorker(wc *workerConfig) *worker {
 	w := new(worker)
-	w.desc = wc.desc
+	w.desc.Store(wc.desc)
 	w.rpcc = wc.rpcc
 	w.sink = wc.sink
+	w.deadLetter = wc.deadLetter
+	w.commit = wc.commit
+	w.owns = wc.owns
 	w.logger = wc.logger
 	w.state = wsRunning
-	w.logger.Info("New for desc=", w.desc)
+	w.stopCh = make(chan struct{})
+	w.clock = wc.clock
+	if w.clock == nil {
+		w.clock = utils.RealClock
+	}
+	w.stats.resetTime = w.clock.Now()
+	w.msgRe = w.getDesc().Worker.Pipe.getMsgRegexp()
+	// the config is checked, so the template is valid
+	w.trans, _ = newTransformer(w.getDesc().Worker.Transform, w.getDesc().Worker.getExtractRegexp())
+	w.enc = newEncoder(w.getDesc().Worker)
+	w.lg = newLineGuard(w.getDesc().Worker)
+	if rl := w.getDesc().Worker.RateLimit; rl != nil {
+		w.recLim = newLimiter(w.clock, rl.RecordsPerSec)
+		w.bytesLim = newLimiter(w.clock, rl.BytesPerSec)
+	}
+	if bs := w.getDesc().Worker.BufferSize; bs > 0 {
+		w.buf = newBuffer(bs, w.getDesc().Worker.OnFull)
+	}
+	w.logger.Info("New for desc=", w.getDesc())
 	return w
 }
 
@@ -74,69 +167,606 @@ func (w *worker) run(ctx context.Context) error {
 
 	totalCnt := uint64(0)
 	sleepDur := 5 * time.Second
-	nextStat := time.Now()
+	nextStat := w.clock.Now()
 
 	limit := qr.Limit
+	if rl := w.getDesc().Worker.RateLimit; rl != nil && rl.RecordsPerSec > 0 && rl.RecordsPerSec < limit {
+		// no more than 1 second of the rate in one batch
+		limit = rl.RecordsPerSec
+	}
 	timeout := qr.WaitTimeout
+
+	// the query waiting for new events is interrupted, when the worker is asked to stop
+	qctx, qcancel := context.WithCancel(ctx)
+	defer qcancel()
+	go func() {
+		select {
+		case <-w.stopCh:
+			qcancel()
+		case <-qctx.Done():
+		}
+	}()
+
+	// the buffered records are sent by the sender, and the records are read
+	// by the loop below
+	var sendWg sync.WaitGroup
+	sendWg.Add(1)
+	go func(query string) {
+		defer sendWg.Done()
+		w.watchTailLag(qctx, query)
+	}(qr.Query)
+	if w.buf != nil {
+		sendWg.Add(1)
+		go func() {
+			defer sendWg.Done()
+			w.sendBuffered(qctx, limit)
+		}()
+	}
+
 	for ctx.Err() == nil &&
 		atomic.LoadInt32(&w.state) != wsStopping {
 		qr.Limit = limit
 		qr.WaitTimeout = timeout
 
-		if time.Now().After(nextStat) {
-			w.logger.Info("Stats (every 10 sec): forwarded ", totalCnt, " events (total), position=", qr.Pos)
-			nextStat = time.Now().Add(10 * time.Second)
+		if w.clock.Now().After(nextStat) {
+			w.logger.Info("Stats (every 10 sec): forwarded ", totalCnt, " events (total), throttled ",
+				w.getThrottled(), " (total), dropped ", w.getDropped(), " events (total), oversized ", w.getOversized(),
+				" events (total), position=", qr.Pos)
+			nextStat = w.clock.Now().Add(10 * time.Second)
 		}
 
 		res := &api.QueryResult{}
-		err = w.rpcc.Query(ctx, qr, res)
-		if err != nil || res.Err != nil {
+		err = w.rpcc.Query(qctx, qr, res)
+		if err == nil {
+			err = res.Err
+		}
+		if err != nil && !w.isRunning(ctx) {
+			break
+		}
+		if err != nil {
 			w.logger.Error("Failed to execute query=", qr, ", will retry in 5 sec, err=", err, " res=", res)
-			utils.Sleep(ctx, sleepDur)
+			w.onError(err)
+			w.backoff(ctx, sleepDur)
 			continue
 		}
 
 		if len(res.Events) == 0 {
-			w.logger.Info("No new events, sleep 5 sec...")
-			utils.Sleep(ctx, sleepDur)
+			// the "tail" position is resolved, so the events written while
+			// the worker sleeps are not skipped
+			if res.NextQueryRequest.Pos != "" {
+				qr.Pos = res.NextQueryRequest.Pos
+			}
+			w.logger.Info("No new events, sleep ", idleInterval, "...")
+			w.sleep(ctx, idleInterval)
 			continue
 		}
 
-		err = w.sink.OnEvent(res.Events)
-		if err != nil {
-			w.logger.Warn("Failed to sink events, will retry in 5 sec, err=", err)
-			utils.Sleep(ctx, sleepDur)
+		atMostOnce := w.getDesc().Worker.isAtMostOnce()
+		if atMostOnce {
+			if err = w.commitPosition(res.NextQueryRequest.Pos); err != nil {
+				w.logger.Error("Failed to commit position, will retry in 5 sec, err=", err)
+				w.onError(err)
+				w.backoff(ctx, sleepDur)
+				continue
+			}
+		}
+
+		orig, events := w.process(res.Events)
+		if w.buf != nil {
+			if !w.buf.put(ctx, w.stopCh, orig, events, res.NextQueryRequest.Pos) {
+				break
+			}
+			qr = &res.NextQueryRequest
+			totalCnt += uint64(len(res.Events))
 			continue
 		}
 
+		// the events are retried as they were read, not queried again, so the
+		// multi sink skips the sinks, which accepted them already
+		if !w.sendBatch(ctx, orig, events, func() {
+			w.applySwap()
+			w.throttle(ctx, events)
+		}) {
+			break
+		}
+
 		qr = &res.NextQueryRequest
-		w.desc.setPosition(qr.Pos)
+		w.setPosition(qr.Pos)
 		totalCnt += uint64(len(res.Events))
 	}
 
-	_ = w.sink.Close()
+	qcancel()
+	sendWg.Wait()
+	// the sinks, which are not used yet, are closed too
+	w.applySwap()
+	closeSinks(w.sink, w.deadLetter, w.logger)
 	atomic.StoreInt32(&w.state, wsStopped)
 	w.logger.Warn("Stopped; pos=", qr.Pos, ", err=", err)
 	return nil
 }
+
+// sendBuffered sends the buffered records to the sink by batches of up to limit
+// records, until ctx is closed or the worker is asked to stop. The position is
+// moved when the sink accepted the records. The records are retried until they
+// are sent (or dropped in the DeliveryAtMostOnce mode), while they are retried
+// the buffer is filled according to the WorkerConfig.OnFull policy.
+func (w *worker) sendBuffered(ctx context.Context, limit int) {
+	if n := w.getDesc().Worker.getConcurrency(); n > 1 {
+		w.sendParallel(ctx, limit, n)
+		return
+	}
+
+	for {
+		orig, events, pos, ok := w.buf.take(ctx, w.stopCh, limit)
+		if !ok {
+			return
+		}
+
+		// the sinks could be replaced, while the events are retried
+		if !w.sendBatch(ctx, orig, events, func() {
+			w.applySwap()
+			w.throttle(ctx, events)
+		}) {
+			return
+		}
+
+		// the position is committed when the records are read in the
+		// DeliveryAtMostOnce mode
+		if pos != "" && !w.getDesc().Worker.isAtMostOnce() {
+			w.setPosition(pos)
+		}
+	}
+}
+
+// sendBatch sends the events to the sink, the orig contains the events as
+// they were read. The events are retried until they are sent, or dropped
+// in the DeliveryAtMostOnce mode, prepare is called before every attempt, if
+// it is not nil. It returns false, if ctx is closed or the worker is asked to
+// stop, while the events are retried.
+func (w *worker) sendBatch(ctx context.Context, orig, events []*api.LogEvent, prepare func()) bool {
+	sleepDur := 5 * time.Second
+	defer w.forgetEvents(events)
+	// the events of a read batch could be dropped by the line guard
+	for len(events) > 0 {
+		if prepare != nil {
+			prepare()
+		}
+		err := w.sinkEvents(ctx, w.sink, events)
+		if err != nil && w.deadLetter != nil && w.isRunning(ctx) {
+			err = w.sinkDeadLetter(ctx, orig, events)
+		}
+		if err == nil {
+			w.onFlush(orig)
+			break
+		}
+		if w.getDesc().Worker.isAtMostOnce() {
+			w.logger.Warn("Failed to sink events, ", len(orig), " events are lost, err=", err)
+			break
+		}
+		w.logger.Warn("Failed to sink events, will retry in 5 sec, err=", err)
+		if !w.backoff(ctx, sleepDur) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceSinks makes the worker to send the next events to the sinks of wc,
+// the worker continues with the wc.desc from the same position. The sinks are
+// replaced by the goroutine, which sends the events, before the next events
+// are sent, so the events are sent to one sink or another, but not both.
+func (w *worker) replaceSinks(wc *workerConfig) {
+	w.swapLock.Lock()
+	old := w.swap
+	w.swap = wc
+	w.swapLock.Unlock()
+
+	if old != nil {
+		closeSinks(old.sink, old.deadLetter, w.logger)
+	}
+	w.logger.Info("The sinks will be replaced, desc=", wc.desc)
+}
+
+// applySwap replaces the sinks and the desc by the ones provided by replaceSinks,
+// if any. It must be called by the goroutine, which sends the events only.
+func (w *worker) applySwap() {
+	w.swapLock.Lock()
+	wc := w.swap
+	w.swap = nil
+	if wc != nil {
+		wc.desc.setPosition(w.getDesc().getPosition())
+		w.desc.Store(wc.desc)
+	}
+	w.swapLock.Unlock()
+
+	if wc == nil {
+		return
+	}
+	closeSinks(w.sink, w.deadLetter, w.logger)
+	w.sink = wc.sink
+	w.deadLetter = wc.deadLetter
+	w.logger.Info("The sinks are replaced, position=", wc.desc.getPosition())
+}
+
+// hasSwap returns whether the sinks are going to be replaced (see replaceSinks)
+func (w *worker) hasSwap() bool {
+	w.swapLock.Lock()
+	defer w.swapLock.Unlock()
+	return w.swap != nil
+}
+
+// hasDesc returns whether the worker runs for d, or d replaces the worker desc
+func (w *worker) hasDesc(d *desc) bool {
+	w.swapLock.Lock()
+	defer w.swapLock.Unlock()
+	return w.getDesc() == d || (w.swap != nil && w.swap.desc == d)
+}
+
+func (w *worker) getDesc() *desc {
+	return w.desc.Load().(*desc)
+}
+
+// setPosition sets the position of the worker desc, the desc could not be
+// replaced meanwhile
+func (w *worker) setPosition(pos string) {
+	w.swapLock.Lock()
+	w.getDesc().setPosition(pos)
+	w.swapLock.Unlock()
+}
+
+// watchTailLag checks the worker lag every tailLagInterval until ctx is closed
+func (w *worker) watchTailLag(ctx context.Context, query string) {
+	ticker := w.clock.NewTicker(tailLagInterval)
+	defer ticker.Stop()
+	for utils.WaitTick(ctx, ticker) {
+		lag, err := w.checkTailLag(ctx, query)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.logger.Warn("Failed to check the lag, err=", err)
+			}
+			continue
+		}
+		w.stats.lock.Lock()
+		w.stats.tailLag = lag
+		w.stats.lock.Unlock()
+	}
+}
+
+// checkTailLag returns the time between the record at the worker position (the
+// oldest one, which is not forwarded yet) and the last record of the worker
+// source. The lag is 0, if all the records are forwarded.
+func (w *worker) checkTailLag(ctx context.Context, query string) (time.Duration, error) {
+	next, err := w.queryRecord(ctx, query, w.getDesc().getPosition(), 0)
+	if err != nil || next == nil {
+		return 0, err
+	}
+	last, err := w.queryRecord(ctx, query, "tail", -1)
+	if err != nil || last == nil {
+		return 0, err
+	}
+	if d := last.Timestamp - next.Timestamp; d > 0 {
+		return time.Duration(d), nil
+	}
+	return 0, nil
+}
+
+// queryRecord returns the record at the position pos with the offset, or nil
+// if there is no such record. The query doesn't wait for new records.
+func (w *worker) queryRecord(ctx context.Context, query, pos string, offset int) (*api.LogEvent, error) {
+	qr := &api.QueryRequest{Query: query, Pos: pos, Offset: offset, Limit: 1}
+	res := &api.QueryResult{}
+	err := w.rpcc.Query(ctx, qr, res)
+	if err == nil {
+		err = res.Err
+	}
+	if err != nil || len(res.Events) == 0 {
+		return nil, err
+	}
+	return res.Events[0], nil
+}
+
+// commitPosition sets the worker position to pos and persists it. The
+// position is restored, if it could not be persisted.
+func (w *worker) commitPosition(pos string) error {
+	old := w.getDesc().getPosition()
+	w.setPosition(pos)
+	if w.commit == nil {
+		return nil
+	}
+	err := w.commit()
+	if err != nil {
+		w.setPosition(old)
+	}
+	return err
+}
+
+// sinkEvents sends events to the sink s. The retryable errors are retried
+// according to the worker Retry config, the events are sent once in the
+// DeliveryAtMostOnce mode.
+func (w *worker) sinkEvents(ctx context.Context, s sink.Sink, events []*api.LogEvent) error {
+	rc := w.getDesc().Worker.getRetry()
+	bo := time.Duration(rc.InitialBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.OnEvent(events)
+		if err != nil {
+			w.onError(err)
+		}
+		if err == nil || attempt >= rc.MaxAttempts || !sink.IsRetryable(err) || w.getDesc().Worker.isAtMostOnce() {
+			return err
+		}
+
+		w.logger.Debug("Failed to sink events (attempt ", attempt, " of ", rc.MaxAttempts, "), will retry in ", bo, ", err=", err)
+		if !w.backoff(ctx, bo) {
+			return err
+		}
+		bo = rc.nextBackoff(bo)
+	}
+}
+
+// sinkDeadLetter is called when the events could not be sent to the sink. It
+// sends the events one by one to find the records, which cannot be sent, and
+// writes them to the dead letter sink with the error. The multi sink sends
+// the records to the sinks, which did not accept them, only. The orig contains the
+// events as they were read (not transformed). The error is returned, if the
+// dead letter sink fails.
+func (w *worker) sinkDeadLetter(ctx context.Context, orig, events []*api.LogEvent) error {
+	var dl []*api.LogEvent
+	for i, e := range events {
+		err := w.sink.OnEvent([]*api.LogEvent{e})
+		if err == nil {
+			continue
+		}
+		w.onError(err)
+		de := *orig[i]
+		de.Fields = addField(de.Fields, DeadLetterErrorField, err.Error())
+		dl = append(dl, &de)
+	}
+	if len(dl) == 0 {
+		return nil
+	}
+
+	w.logger.Warn(len(dl), " of ", len(events), " events could not be sent, writing them to the dead letter sink")
+	if err := w.sinkEvents(ctx, w.deadLetter, dl); err != nil {
+		return fmt.Errorf("failed to write %d events to the dead letter sink: %v", len(dl), err)
+	}
+	return nil
+}
+
+// forgetEvents is called when the events are not retried anymore. The multi
+// sink stops tracking the sinks, which accepted the events.
+func (w *worker) forgetEvents(events []*api.LogEvent) {
+	if ms, ok := w.sink.(*multiSink); ok {
+		ms.forget(events)
+	}
+}
+
+// process prepares the events read to be sent to the sink: they are filtered
+// by the journals the node owns and by the message regexp, transformed, checked by the line guard and encoded.
+// It returns the records as they were read (orig), and the records to be sent
+// (events), which correspond to each other.
+func (w *worker) process(read []*api.LogEvent) (orig, events []*api.LogEvent) {
+	orig, events = read, read
+	if w.owns != nil || w.msgRe != nil {
+		orig = w.filterEvents(orig)
+		events = orig
+	}
+	if w.trans != nil {
+		var terr error
+		if events, terr = w.trans.apply(events); terr != nil {
+			w.logger.Warn("Failed to transform events, the records are sent as is, err=", terr)
+		}
+	}
+	if w.lg != nil {
+		orig, events = w.lg.apply(orig, events)
+	}
+	if w.enc != nil {
+		events = w.enc.apply(events)
+	}
+	return orig, events
+}
+
+// filterEvents returns the events of the journals the node owns, which
+// messages match the msgRe
+func (w *worker) filterEvents(events []*api.LogEvent) []*api.LogEvent {
+	res := events[:0:0]
+	for _, e := range events {
+		if w.owns != nil && !w.owns(e.Tags) {
+			continue
+		}
+		if w.msgRe == nil || w.msgRe.MatchString(e.Message) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// throttle waits until events could be sent according to the rate limits
+func (w *worker) throttle(ctx context.Context, events []*api.LogEvent) {
+	d := w.recLim.take(ctx, len(events))
+	if w.bytesLim != nil {
+		n := 0
+		for _, e := range events {
+			n += len(e.Message)
+		}
+		d += w.bytesLim.take(ctx, n)
+	}
+
+	if d > 0 {
+		atomic.AddInt64(&w.throttled, int64(d))
+	}
+}
+
+// getDropped returns the number of records dropped because the buffer was full
+func (w *worker) getDropped() uint64 {
+	if w.buf == nil {
+		return 0
+	}
+	return w.buf.getDropped()
+}
+
+// getOversized returns the number of records, which messages exceeded the WorkerConfig.MaxLineBytes
+func (w *worker) getOversized() uint64 {
+	if w.lg == nil {
+		return 0
+	}
+	return w.lg.getOversized()
+}
+
+// getThrottled returns the total time the worker waited because of the rate limits
+func (w *worker) getThrottled() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.throttled))
+}
+
+// backoff sleeps for the duration d after an error, the duration is reported
+// by the worker status while the worker sleeps
+func (w *worker) backoff(ctx context.Context, d time.Duration) bool {
+	w.stats.lock.Lock()
+	w.stats.backoff = d
+	w.stats.lock.Unlock()
+
+	res := w.sleep(ctx, d)
+
+	w.stats.lock.Lock()
+	w.stats.backoff = 0
+	w.stats.lock.Unlock()
+	return res
+}
+
+func (w *worker) onError(err error) {
+	w.stats.lock.Lock()
+	w.stats.lastErr = err
+	w.stats.lastErrTs = w.clock.Now()
+	w.stats.lock.Unlock()
+}
+
+// onFlush updates the stats when the events are accepted by the sink
+func (w *worker) onFlush(events []*api.LogEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.stats.lock.Lock()
+	w.stats.forwarded += uint64(len(events))
+	w.stats.lastRecTs = events[len(events)-1].Timestamp
+	w.stats.lastFlush = w.clock.Now()
+	w.stats.lock.Unlock()
+}
+
+// counters returns the worker counters values since the worker start
+func (w *worker) counters() WorkerCounters {
+	w.stats.lock.Lock()
+	fwd := w.stats.forwarded
+	w.stats.lock.Unlock()
+	return WorkerCounters{
+		Forwarded: fwd,
+		Throttled: w.getThrottled(),
+		Dropped:   w.getDropped(),
+		Oversized: w.getOversized(),
+	}
+}
+
+// sub returns the difference between the counters c and the base, which are
+// 0 if the base is greater
+func (c WorkerCounters) sub(base WorkerCounters) WorkerCounters {
+	var res WorkerCounters
+	if c.Forwarded > base.Forwarded {
+		res.Forwarded = c.Forwarded - base.Forwarded
+	}
+	if c.Throttled > base.Throttled {
+		res.Throttled = c.Throttled - base.Throttled
+	}
+	if c.Dropped > base.Dropped {
+		res.Dropped = c.Dropped - base.Dropped
+	}
+	if c.Oversized > base.Oversized {
+		res.Oversized = c.Oversized - base.Oversized
+	}
+	return res
+}
+
+// resetStats makes the current counters values the base for the counters
+// since the reset (see WorkerStatus.SinceReset)
+func (w *worker) resetStats() {
+	c := w.counters()
+	w.stats.lock.Lock()
+	w.stats.base = c
+	w.stats.resetTime = w.clock.Now()
+	w.stats.lock.Unlock()
+}
+
+// fillStatus fills the ws fields by the worker state
+func (w *worker) fillStatus(ws *WorkerStatus) {
+	switch atomic.LoadInt32(&w.state) {
+	case wsRunning:
+		ws.State = WorkerStateRunning
+	case wsStopping:
+		ws.State = WorkerStateStopping
+	default:
+		ws.State = WorkerStateStopped
+	}
+	c := w.counters()
+	ws.Forwarded = c.Forwarded
+	ws.Throttled = c.Throttled
+	ws.Dropped = c.Dropped
+	ws.Oversized = c.Oversized
+
+	w.stats.lock.Lock()
+	defer w.stats.lock.Unlock()
+	// the counters could be read before the reset
+	ws.SinceReset = c.sub(w.stats.base)
+	ws.ResetTime = w.stats.resetTime
+	if w.stats.lastRecTs != 0 {
+		ws.LastRecordTime = time.Unix(0, w.stats.lastRecTs)
+		ws.Lag = w.clock.Now().Sub(ws.LastRecordTime)
+	}
+	ws.LastFlushTime = w.stats.lastFlush
+	if w.stats.lastErr != nil {
+		ws.LastError = w.stats.lastErr.Error()
+		ws.LastErrorTime = w.stats.lastErrTs
+	}
+	ws.Backoff = w.stats.backoff
+	ws.TailLag = w.stats.tailLag
+}
+
+// sleep waits for the duration d. It returns false if the context is closed,
+// or the worker is stopping.
+func (w *worker) sleep(ctx context.Context, d time.Duration) bool {
+	t := w.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-w.stopCh:
+		return false
+	case <-t.C():
+		return true
+	}
+}
+
 func (w *worker) stopGracefully() {
 	if atomic.CompareAndSwapInt32(&w.state, wsRunning, wsStopping) {
 		w.logger.Info("Stopping...")
+		close(w.stopCh)
 	}
 }
+
+// isRunning returns whether the worker is not asked to stop
+func (w *worker) isRunning(ctx context.Context) bool {
+	return ctx.Err() == nil && atomic.LoadInt32(&w.state) == wsRunning
+}
+
 func (w *worker) isStopped() bool {
 	return atomic.LoadInt32(&w.state) == wsStopped
 }
 
 func (w *worker) getPipe(ctx context.Context) (api.Pipe, error) {
-	if w.desc.Worker.Pipe.Name != "" {
-		return api.Pipe{Destination: w.desc.Worker.Pipe.Name}, nil
+	if w.getDesc().Worker.Pipe.Name != "" {
+		return api.Pipe{Destination: w.getDesc().Worker.Pipe.Name}, nil
 	}
 
 	st := api.Pipe{
-		Name:       w.desc.Worker.Name,
-		TagsCond:   w.desc.Worker.Pipe.From,
-		FilterCond: w.desc.Worker.Pipe.Filter,
+		Name:       w.getDesc().Worker.Name,
+		TagsCond:   w.getDesc().Worker.Pipe.From,
+		FilterCond: w.getDesc().Worker.Pipe.getFilter(),
 	}
 
 	res := &api.PipeCreateResult{}
@@ -149,11 +779,43 @@ func (w *worker) getPipe(ctx context.Context) (api.Pipe, error) {
 }
 
 func (w *worker) prepareQuery(dest string) (*api.QueryRequest, error) {
+	wc := w.getDesc().Worker
 	qr := &api.QueryRequest{
 		Query:       fmt.Sprintf("SELECT FROM %v", dest),
-		Pos:         w.desc.getPosition(),
+		Pos:         w.getDesc().getPosition(),
 		Limit:       1000,
 		WaitTimeout: 10,
 	}
+	if qr.Pos == "" {
+		qr.Pos = wc.getStartPos()
+	}
+	if tm, ok := wc.getStartTime(); ok {
+		qr.Query += fmt.Sprintf(" WHERE ts >= %d", tm.UnixNano())
+	}
 	return qr, nil
 }
+
+// addField adds the field k with value v to the fields line flds
+func addField(flds, k, v string) string {
+	return addFields(flds, k+kvstring.KeyValueSeparator+strconv.Quote(v))
+}
+
+// addFields adds the fields line kvs to the fields line flds
+func addFields(flds, kvs string) string {
+	if flds == "" {
+		return kvs
+	}
+	return flds + kvstring.FieldsSeparator + kvs
+}
+
+// closeSinks closes the sink s and the dead letter sink dl, if it is not nil
+func closeSinks(s, dl sink.Sink, logger log4g.Logger) {
+	if err := s.Close(); err != nil {
+		logger.Error("Failed to close sink, the buffered events could be lost, err=", err)
+	}
+	if dl != nil {
+		if err := dl.Close(); err != nil {
+			logger.Error("Failed to close dead letter sink, err=", err)
+		}
+	}
+}
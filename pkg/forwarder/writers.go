@@ -0,0 +1,199 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"github.com/logrange/logrange/api"
+	"hash/fnv"
+	"sync"
+)
+
+type (
+	// batchTracker keeps the batches taken from the buffer in the order they
+	// were taken, until they are sent. It allows to move the position, when
+	// all the batches before it are sent by the parallel writers.
+	batchTracker struct {
+		lock    sync.Mutex
+		batches []*trackedBatch
+	}
+
+	// trackedBatch is the batch taken from the buffer, pos is the position
+	// reached, when the batch is sent (could be empty), and parts contains the
+	// number of the batch parts, which are not sent yet
+	trackedBatch struct {
+		pos   string
+		parts int
+	}
+
+	// batchPart is the part of a batch, which is sent by one writer
+	batchPart struct {
+		orig   []*api.LogEvent
+		events []*api.LogEvent
+		tb     *trackedBatch
+	}
+)
+
+// sendParallel sends the buffered records to the sink by n writers. The batches
+// are taken from the buffer and throttled by the calling goroutine, and sent
+// by the writers. If WorkerConfig.PreserveOrder is set, every batch is split
+// by the records sources, and the records of one source are always sent by
+// the same writer. The sinks are replaced when the batches being sent are over.
+func (w *worker) sendParallel(ctx context.Context, limit, n int) {
+	preserveOrder := w.getDesc().Worker.PreserveOrder
+	// the buffered records are spread between the writers
+	if bl := w.buf.size / n; bl < limit {
+		limit = bl
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		bt   batchTracker
+		wg   sync.WaitGroup
+		busy sync.WaitGroup
+	)
+	chs := make([]chan batchPart, n)
+	for i := range chs {
+		if i > 0 && !preserveOrder {
+			// the writers share the batches
+			chs[i] = chs[0]
+			continue
+		}
+		chs[i] = make(chan batchPart)
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(ch chan batchPart) {
+			defer wg.Done()
+			for bp := range ch {
+				if w.sendBatch(ctx, bp.orig, bp.events, nil) {
+					bt.done(bp.tb, w.setSentPosition)
+				}
+				busy.Done()
+			}
+		}(chs[i])
+	}
+	w.logger.Info("Sending by ", n, " writers, batch limit=", limit, ", preserveOrder=", preserveOrder)
+
+	for {
+		orig, events, pos, ok := w.buf.take(ctx, w.stopCh, limit)
+		if !ok {
+			break
+		}
+
+		if w.hasSwap() {
+			busy.Wait()
+			w.applySwap()
+		}
+		w.throttle(ctx, events)
+
+		idxs, parts := splitBatch(orig, events, n, preserveOrder)
+		tb := bt.add(pos, len(parts))
+		busy.Add(len(parts))
+		for i, bp := range parts {
+			bp.tb = tb
+			chs[idxs[i]] <- bp
+		}
+	}
+
+	for i, ch := range chs {
+		if i == 0 || preserveOrder {
+			close(ch)
+		}
+	}
+	wg.Wait()
+}
+
+// setSentPosition moves the position, when the records before it are sent. The
+// position is committed when the records are read in the DeliveryAtMostOnce mode
+func (w *worker) setSentPosition(pos string) {
+	if !w.getDesc().Worker.isAtMostOnce() {
+		w.setPosition(pos)
+	}
+}
+
+// splitBatch returns the parts of the batch and the indexes of the writers,
+// which send them. If preserveOrder is set, the records are split by their
+// sources between n writers, otherwise the batch is sent as is by any writer.
+// The batch without records gives one part, so its position is tracked too.
+func splitBatch(orig, events []*api.LogEvent, n int, preserveOrder bool) ([]int, []batchPart) {
+	if !preserveOrder || len(events) == 0 {
+		return []int{0}, []batchPart{{orig: orig, events: events}}
+	}
+
+	parts := make(map[int]*batchPart)
+	var idxs []int
+	for i, e := range events {
+		h := fnv.New32a()
+		h.Write([]byte(orig[i].Tags))
+		idx := int(h.Sum32() % uint32(n))
+		bp, ok := parts[idx]
+		if !ok {
+			bp = new(batchPart)
+			parts[idx] = bp
+			idxs = append(idxs, idx)
+		}
+		bp.orig = append(bp.orig, orig[i])
+		bp.events = append(bp.events, e)
+	}
+
+	res := make([]batchPart, len(idxs))
+	for i, idx := range idxs {
+		res[i] = *parts[idx]
+	}
+	return idxs, res
+}
+
+//===================== batchTracker =====================
+
+// add registers the batch, which is sent by the parts number of writers
+func (bt *batchTracker) add(pos string, parts int) *trackedBatch {
+	tb := &trackedBatch{pos: pos, parts: parts}
+	bt.lock.Lock()
+	bt.batches = append(bt.batches, tb)
+	bt.lock.Unlock()
+	return tb
+}
+
+// done is called when the part of tb is sent. If all the batches before the
+// position are sent, setPos is called for the position. The positions are set
+// in the order of the batches.
+func (bt *batchTracker) done(tb *trackedBatch, setPos func(pos string)) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+
+	tb.parts--
+	pos := ""
+	n := 0
+	for _, b := range bt.batches {
+		if b.parts > 0 {
+			break
+		}
+		if b.pos != "" {
+			pos = b.pos
+		}
+		n++
+	}
+	copy(bt.batches, bt.batches[n:])
+	for i := len(bt.batches) - n; i < len(bt.batches); i++ {
+		bt.batches[i] = nil
+	}
+	bt.batches = bt.batches[:len(bt.batches)-n]
+	if pos != "" {
+		setPos(pos)
+	}
+}
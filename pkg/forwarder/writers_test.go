@@ -0,0 +1,180 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"github.com/logrange/logrange/api"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// slowSink spends 1 millisecond for every event, like a downstream with
+// the limited throughput of one connection
+type slowSink struct {
+	testSink
+}
+
+func (ss *slowSink) OnEvent(events []*api.LogEvent) error {
+	time.Sleep(time.Duration(len(events)) * time.Millisecond)
+	return ss.testSink.OnEvent(events)
+}
+
+func TestConfigConcurrency(t *testing.T) {
+	wc := newTestWorkerConfig("w1", "p1")
+	for _, c := range []int{0, 1} {
+		wc.Concurrency = c
+		if err := wc.Check(); err != nil {
+			t.Fatal("Check() err=", err, " for Concurrency=", c)
+		}
+	}
+	wc.Concurrency = 4
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for Concurrency without the buffer")
+	}
+	wc.BufferSize = 100
+	if err := wc.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	wc.Concurrency = -1
+	if err := wc.Check(); err == nil {
+		t.Fatal("Check() must fail for Concurrency=-1")
+	}
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	forward := func(concurrency int) time.Duration {
+		tc := &testClient{events: newTestEvents(400)}
+		ts := &slowSink{}
+		wc := newTestWorkerConfig("w1", "p1")
+		wc.BufferSize = 40
+		wc.Concurrency = concurrency
+
+		ctx, cancel := context.WithCancel(context.Background())
+		start := time.Now()
+		w, wait := runTestWorker(ctx, wc, tc, ts)
+		waitPosition(t, w.getDesc(), "400")
+		el := time.Since(start)
+		cancel()
+		wait()
+
+		if ts.count() != 400 {
+			t.Fatal("expected 400 events sent by ", concurrency, " writers, but ", ts.count())
+		}
+		return el
+	}
+
+	// the sink takes 400ms for all the records by 1 writer
+	el1, el4 := forward(1), forward(4)
+	if el4 > el1*2/3 {
+		t.Fatal("4 writers must be faster, but 1 writer took ", el1, ", and 4 writers took ", el4)
+	}
+}
+
+func TestWorkerPreserveOrder(t *testing.T) {
+	evs := newTestEvents(500)
+	for i, e := range evs {
+		e.Tags = fmt.Sprintf("src=%d", i%7)
+	}
+	tc := &testClient{events: evs, limit: 30}
+	ts := &slowSink{}
+	wc := newTestWorkerConfig("w1", "p1")
+	wc.BufferSize = 50
+	wc.Concurrency = 3
+	wc.PreserveOrder = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, wait := runTestWorker(ctx, wc, tc, ts)
+	waitPosition(t, w.getDesc(), "500")
+	cancel()
+	wait()
+
+	if ts.count() != 500 {
+		t.Fatal("expected 500 events, but ", ts.count())
+	}
+	last := make(map[string]int64)
+	for _, e := range ts.events {
+		if prev, ok := last[e.Tags]; ok && prev >= e.Timestamp {
+			t.Fatal("the records of ", e.Tags, " are reordered, ", e.Timestamp, " is after ", prev)
+		}
+		last[e.Tags] = e.Timestamp
+	}
+}
+
+func TestBatchTracker(t *testing.T) {
+	var (
+		bt   batchTracker
+		poss []string
+	)
+	setPos := func(pos string) {
+		poss = append(poss, pos)
+	}
+
+	tb1 := bt.add("1", 2)
+	tb2 := bt.add("", 1)
+	tb3 := bt.add("3", 1)
+
+	// the batches after the first one are sent
+	bt.done(tb3, setPos)
+	bt.done(tb2, setPos)
+	bt.done(tb1, setPos)
+	if len(poss) != 0 {
+		t.Fatal("the position must not be moved, before the first batch is sent, but ", poss)
+	}
+	bt.done(tb1, setPos)
+	if len(poss) != 1 || poss[0] != "3" || len(bt.batches) != 0 {
+		t.Fatal("expected the position 3, but ", poss, ", batches=", bt.batches)
+	}
+
+	tb4 := bt.add("4", 1)
+	bt.add("5", 1)
+	bt.done(tb4, setPos)
+	if len(poss) != 2 || poss[1] != "4" || len(bt.batches) != 1 {
+		t.Fatal("expected the position 4, but ", poss, ", batches=", bt.batches)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	evs := newTestEvents(20)
+	for i, e := range evs {
+		e.Tags = "src=" + strconv.Itoa(i%4)
+	}
+	idxs, parts := splitBatch(evs, evs, 3, false)
+	if len(parts) != 1 || idxs[0] != 0 || len(parts[0].events) != 20 {
+		t.Fatal("the batch must not be split, but ", parts)
+	}
+
+	idxs, parts = splitBatch(evs, evs, 3, true)
+	writers := make(map[string]int)
+	n := 0
+	for i, bp := range parts {
+		for _, e := range bp.orig {
+			if idx, ok := writers[e.Tags]; ok && idx != idxs[i] {
+				t.Fatal("the records of ", e.Tags, " are sent by the writers ", idx, " and ", idxs[i])
+			}
+			writers[e.Tags] = idxs[i]
+		}
+		n += len(bp.events)
+	}
+	if n != 20 {
+		t.Fatal("expected 20 records in the parts, but ", n)
+	}
+
+	if idxs, parts = splitBatch(nil, nil, 3, true); len(parts) != 1 || idxs[0] != 0 {
+		t.Fatal("the empty batch must give one part, but ", parts)
+	}
+}
@@ -23,5 +23,17 @@ The LQL supports the following constructions so far:
 	TRUNCATE  [({<tags>}|<tags expression)][MINSIZE <size>][MAXSIZE <size>][BEFORE <timestamp>][MAXDBSIZE <size>]
 	CREATE PIPE <pipe name> [FROM ({<tags>}|<tags expression)] [WHERE <fields expression>]
 	DELETE PIPE <pipe name>
+
+The tags expression consists of the tag conditions like `name=app1`, combined with AND, OR and
+parentheses. The condition operators are =, !=, <, >, <=, >=, =~i, LIKE, CONTAINS, PREFIX and
+SUFFIX, the comparisons are case-sensitive except =~i, which compares the values ignoring the
+case, e.g. `host =~i "prod"` matches the host values prod, Prod and PROD. A condition or a
+parenthesized expression could be negated by NOT, so all journals except the matched ones are
+selected, e.g.:
+	SELECT FROM NOT name=app1 AND (NOT env=test OR pod=web-1)
+Only one NOT is allowed per condition, `NOT NOT name=app1` is a syntax error. The missing tags
+have the empty value, so `NOT name=app1` and `name!=app1` match the journals without the name
+tag too. The values containing dots, like IP addresses, must be quoted: `ip="1.2.3.4"`, the
+unquoted 1.2.3.4 is read as the number 1.2 followed by .3, which is a syntax error.
 */
 package lql
@@ -30,7 +30,7 @@ var (
 		`|(?P<Keyword>(?i)SELECT|DESCRIBE|TRUNCATE|DELETE|DRYRUN|BEFORE|MAXSIZE|MINSIZE|MAXDBSIZE|FROM|RANGE|WHERE|PARTITIONS|PARTITION|PIPES|SHOW|CREATE|PIPE|POSITION|LIMIT|OFFSET|AND|OR|LIKE|CONTAINS|PREFIX|SUFFIX|NOT|\[|\]|\:)` +
 		`|(?P<Ident>[a-zA-Z_][a-z\./\-A-Z0-9_:]*)` +
 		`|(?P<String>"([^\\"]|\\.)*"|'[^']*')` +
-		`|(?P<Operator><>|!=|<=|>=|[-+*/%,.=<>()])` +
+		`|(?P<Operator><>|!=|<=|>=|=~i|[-+*/%,.=<>()])` +
 		`|(?P<Number>[-+]?\d*\.?\d+([eE][-+]?\d+|[mMkKgGtTbBpP][ib]{0,2})?)` +
 		`|(?P<Tags>\{.+\})`,
 	))
@@ -75,6 +75,8 @@ const (
 	CMP_HAS_PREFIX = "PREFIX"
 	CMP_HAS_SUFFIX = "SUFFIX"
 	CMP_LIKE       = "LIKE"
+	// CMP_EQUAL_FOLD is the case-insensitive equality, e.g. `host =~i "prod"`
+	CMP_EQUAL_FOLD = "=~i"
 )
 
 // fixed operands names
@@ -155,7 +157,7 @@ type (
 
 	Condition struct {
 		Ident *Identifier `  @@`
-		Op    string      ` (@("<"|">"|">="|"<="|"!="|"="|"CONTAINS"|"PREFIX"|"SUFFIX"|"LIKE"))`
+		Op    string      ` (@("<"|">"|">="|"<="|"!="|"="|"=~i"|"CONTAINS"|"PREFIX"|"SUFFIX"|"LIKE"))`
 		Value string      ` (@String|@Ident|@Number)`
 	}
 
@@ -248,6 +250,10 @@ func ParseExpr(where string) (*Expression, error) {
 	exp := &Expression{}
 	err := parserExpr.ParseString(where, exp)
 	if err != nil {
+		if verr := ValidateExpr(where); verr != nil {
+			// points to the invalid token
+			return nil, verr
+		}
 		return nil, err
 	}
 	return exp, err
@@ -261,6 +267,10 @@ func ParseSource(source string) (*Source, error) {
 	src := &Source{}
 	err := parserSource.ParseString(source, src)
 	if err != nil {
+		if verr := ValidateSource(source); verr != nil {
+			// points to the invalid token
+			return nil, verr
+		}
 		return nil, err
 	}
 	return src, err
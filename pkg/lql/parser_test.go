@@ -111,6 +111,28 @@ func TestParseTagsSource(t *testing.T) {
 	testParseSource(t, `{ asdfd="sf ,\\=df" , d=d }`, true, false)
 	testParseSource(t, `{asdfd="sf,\\=df",c="",b=12\34.1234.1324.1234,d=asdf}`, true, false)
 	testParseSource(t, `a = b and c like 'asdf*'`, false, false)
+	testParseSource(t, `NOT a = b`, false, false)
+	testParseSource(t, `a != b and not (c = d or e = f)`, false, false)
+	testParseSource(t, `NOT NOT a = b`, false, true)
+	testParseSource(t, `ip="1.2.3.4"`, false, false)
+	testParseSource(t, `ip=1.2.3.4`, false, true)
+}
+
+func TestParseSourceNegation(t *testing.T) {
+	src, err := ParseSource("NOT a=b AND c=d")
+	if err != nil {
+		t.Fatal("unexpected err=", err)
+	}
+	// the negation is applied to the first condition only
+	and := src.Expr.Or[0].And
+	if len(and) != 2 || !and[0].Not || and[1].Not {
+		t.Fatal("NOT must be applied to a=b only, but ", src)
+	}
+
+	src2, err := ParseSource(src.String())
+	if err != nil || src2.String() != src.String() {
+		t.Fatal("expected ", src, ", but got ", src2, ", err=", err)
+	}
 }
 
 func TestParseWhere(t *testing.T) {
@@ -122,6 +144,8 @@ func TestConditionString(t *testing.T) {
 	testCondParse(t, `a like '12"3'`)
 	testCondParse(t, `a=b`)
 	testCondParse(t, `a=bcd`)
+	testCondParse(t, `a=~i"Prod"`)
+	testCondParse(t, `a =~i prod`)
 }
 
 func TestParsingRange(t *testing.T) {
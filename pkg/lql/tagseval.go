@@ -162,7 +162,7 @@ func (teb *tagsExpFuncBuilder) buildTagCond(cn *Condition) (err error) {
 		return err
 	}
 
-	op := strings.ToUpper(cn.Op)
+	op := normCondOp(cn.Op)
 	switch op {
 	case "<":
 		teb.tef = func(tags tag.Set) bool {
@@ -188,15 +188,16 @@ func (teb *tagsExpFuncBuilder) buildTagCond(cn *Condition) (err error) {
 		teb.tef = func(tags tag.Set) bool {
 			return tvf(tags) == cn.Value
 		}
+	case CMP_EQUAL_FOLD:
+		teb.tef = func(tags tag.Set) bool {
+			return strings.EqualFold(tvf(tags), cn.Value)
+		}
 	case CMP_LIKE:
-		// test it first
-		_, err := path.Match(cn.Value, "abc")
-		if err != nil {
-			err = fmt.Errorf("Wrong 'like' expression for %s, err=%s", cn.Value, err.Error())
-		} else {
+		var lf likeFunc
+		lf, err = buildLikeFunc(cn.Value)
+		if err == nil {
 			teb.tef = func(tags tag.Set) bool {
-				res, _ := path.Match(cn.Value, tvf(tags))
-				return res
+				return lf(tvf(tags))
 			}
 		}
 	case CMP_CONTAINS:
@@ -217,6 +218,56 @@ func (teb *tagsExpFuncBuilder) buildTagCond(cn *Condition) (err error) {
 	return err
 }
 
+// normCondOp returns the condition operation in upper case, the =~i is
+// returned as is, its `i` suffix is lower case
+func normCondOp(op string) string {
+	if op == CMP_EQUAL_FOLD {
+		return op
+	}
+	return strings.ToUpper(op)
+}
+
+// likeFunc returns whether the value matches the LIKE pattern
+type likeFunc func(val string) bool
+
+// likeMeta contains the special characters of the LIKE patterns (see path.Match)
+const likeMeta = `*?[\`
+
+// buildLikeFunc returns the likeFunc for the pattern, which has the path.Match
+// syntax. The common patterns like `web-*`, `*.log` or the patterns without the
+// special characters are matched without path.Match
+func buildLikeFunc(pattern string) (likeFunc, error) {
+	// test it first
+	_, err := path.Match(pattern, "abc")
+	if err != nil {
+		return nil, fmt.Errorf("Wrong 'like' expression for %s, err=%s", pattern, err.Error())
+	}
+
+	ln := len(pattern)
+	switch {
+	case !strings.ContainsAny(pattern, likeMeta):
+		return func(val string) bool {
+			return val == pattern
+		}, nil
+	case ln > 1 && pattern[ln-1] == '*' && !strings.ContainsAny(pattern[:ln-1], likeMeta):
+		// the '*' doesn't match '/' (see path.Match)
+		pfx := pattern[:ln-1]
+		return func(val string) bool {
+			return strings.HasPrefix(val, pfx) && strings.IndexByte(val[len(pfx):], '/') < 0
+		}, nil
+	case ln > 1 && pattern[0] == '*' && !strings.ContainsAny(pattern[1:], likeMeta):
+		sfx := pattern[1:]
+		return func(val string) bool {
+			return strings.HasSuffix(val, sfx) && strings.IndexByte(val[:len(val)-len(sfx)], '/') < 0
+		}, nil
+	}
+
+	return func(val string) bool {
+		res, _ := path.Match(pattern, val)
+		return res
+	}, nil
+}
+
 type tagValueF func(tags tag.Set) string
 
 func buildTagIdent(id *Identifier) (tagValueF, error) {
@@ -16,6 +16,7 @@ package lql
 
 import (
 	"github.com/logrange/logrange/pkg/model/tag"
+	"path"
 	"testing"
 )
 
@@ -52,3 +53,81 @@ func TestTagsExpGeneral(t *testing.T) {
 	testTagsExpGeneral(t, "name=app13 or name=app14 or ttt=ddfe", tags, true)
 	testTagsExpGeneral(t, "c=''", tags, true)
 }
+
+func TestTagsExpNegation(t *testing.T) {
+	tags, _ := tag.Parse("name=app1,ip=1.2.3.4,ttt=ddfe")
+	noName, _ := tag.Parse("ip=1.2.3.4")
+	testTagsExpGeneral(t, "NOT name=app1", tags, false)
+	testTagsExpGeneral(t, "NOT name=app2", tags, true)
+	testTagsExpGeneral(t, "name!=app1", tags, false)
+	testTagsExpGeneral(t, "name!=app2", tags, true)
+	// the journals without the tag are not excluded
+	testTagsExpGeneral(t, "NOT name=app1", noName, true)
+	testTagsExpGeneral(t, "name!=app1", noName, true)
+
+	testTagsExpGeneral(t, "NOT name=app1 AND ip=\"1.2.3.4\"", tags, false)
+	testTagsExpGeneral(t, "NOT name=app2 AND ip=\"1.2.3.4\"", tags, true)
+	testTagsExpGeneral(t, "ip=\"1.2.3.4\" AND NOT name=app1", tags, false)
+	testTagsExpGeneral(t, "NOT name=app1 OR ip=\"1.2.3.4\"", tags, true)
+	testTagsExpGeneral(t, "NOT name=app1 OR ip=\"1.2.3.5\"", tags, false)
+	testTagsExpGeneral(t, "NOT (name=app1 AND ip=\"1.2.3.5\")", tags, true)
+	testTagsExpGeneral(t, "NOT (name=app1 OR ip=\"1.2.3.5\")", tags, false)
+	testTagsExpGeneral(t, "NOT (name=app2 OR name=app3) AND ttt!=abc", tags, true)
+}
+
+func TestTagsExpLike(t *testing.T) {
+	tags, _ := tag.Parse("pod=web-123,file=/var/log/syslog.log")
+	testTagsExpGeneral(t, `pod LIKE "web-*"`, tags, true)
+	testTagsExpGeneral(t, `pod LIKE "db-*"`, tags, false)
+	testTagsExpGeneral(t, `pod LIKE "*-123"`, tags, true)
+	testTagsExpGeneral(t, `pod LIKE "*-124"`, tags, false)
+	testTagsExpGeneral(t, `pod LIKE "w*-1*3"`, tags, true)
+	testTagsExpGeneral(t, `pod LIKE "w*-2*"`, tags, false)
+	testTagsExpGeneral(t, `pod LIKE "web-12?"`, tags, true)
+	testTagsExpGeneral(t, `pod LIKE "web-123"`, tags, true)
+	testTagsExpGeneral(t, `file LIKE "/var/log/*"`, tags, true)
+	testTagsExpGeneral(t, `file LIKE "/var/*"`, tags, false)
+	testTagsExpGeneral(t, `NOT pod LIKE "web-*" OR file LIKE "*.log"`, tags, false)
+
+	if _, err := BuildTagsExpFunc(`pod LIKE "web-["`); err == nil {
+		t.Fatal("the malformed pattern must be reported")
+	}
+}
+
+func TestTagsExpEqualFold(t *testing.T) {
+	tags, _ := tag.Parse("host=Prod-1,env=prod")
+	testTagsExpGeneral(t, `host="prod-1"`, tags, false)
+	testTagsExpGeneral(t, `host=~i"prod-1"`, tags, true)
+	testTagsExpGeneral(t, `host =~i "PROD-1"`, tags, true)
+	testTagsExpGeneral(t, `host =~i "prod-2"`, tags, false)
+	testTagsExpGeneral(t, `env =~i PROD AND NOT host =~i "prod-2"`, tags, true)
+}
+
+func TestBuildLikeFunc(t *testing.T) {
+	// the fast paths must match the same values as path.Match does
+	patterns := []string{"", "*", "web-*", "*-123", "*.log", "w*-1*3", "web-12?", "web-123", "/var/*", "*/syslog.log",
+		"web-[0-9]*", `web\-*`, "**"}
+	vals := []string{"", "web-", "web-123", "web-124", "db-123", "web-1/23", "/var/log", "/var/log/syslog.log", "a.log",
+		"a/b.log", "web-a"}
+	for _, p := range patterns {
+		lf, err := buildLikeFunc(p)
+		if err != nil {
+			t.Fatal("unexpected err=", err, " for pattern ", p)
+		}
+		for _, v := range vals {
+			exp, _ := path.Match(p, v)
+			if lf(v) != exp {
+				t.Fatal("expected ", exp, " for pattern ", p, " and value ", v)
+			}
+		}
+	}
+}
+
+func BenchmarkLikePrefix(b *testing.B) {
+	lf, _ := buildLikeFunc("web-*")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lf("web-1234567")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lql
+
+import (
+	"fmt"
+	"github.com/alecthomas/participle/lexer"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// SyntaxError describes the invalid token of a source or an expression
+	// condition, e.g. for `name = = foo` it is the second "=" at column 8, where
+	// a value is expected.
+	SyntaxError struct {
+		// Column contains the 1-based position of the token in the condition
+		Column int
+		// Token contains the unexpected token, it is empty if the condition
+		// ended unexpectedly
+		Token string
+		// Expected contains the descriptions of the tokens, which could be there.
+		// It is empty, if the Token is not a valid token at all
+		Expected []string
+	}
+
+	// validator checks the tokens of a condition against the source and
+	// expression grammars (see Source and Expression)
+	validator struct {
+		toks []lexer.Token
+		idx  int
+	}
+)
+
+var (
+	tkKeyword  = lqlLexer.Symbols()["Keyword"]
+	tkIdent    = lqlLexer.Symbols()["Ident"]
+	tkString   = lqlLexer.Symbols()["String"]
+	tkOperator = lqlLexer.Symbols()["Operator"]
+	tkNumber   = lqlLexer.Symbols()["Number"]
+	tkTags     = lqlLexer.Symbols()["Tags"]
+
+	condOps = []string{"<", ">", ">=", "<=", "!=", "=", CMP_EQUAL_FOLD, CMP_CONTAINS, CMP_HAS_PREFIX, CMP_HAS_SUFFIX, CMP_LIKE}
+)
+
+const (
+	expEnd   = "end of condition"
+	expIdent = "tag or field name"
+	expValue = "value (string, identifier or number)"
+	expOp    = "operator (<, >, >=, <=, !=, =, =~i, CONTAINS, PREFIX, SUFFIX or LIKE)"
+)
+
+// ValidateSource checks the source condition (see ParseSource), and returns
+// *SyntaxError, which points to the first invalid token, or nil if the
+// condition is valid
+func ValidateSource(source string) error {
+	v, err := newValidator(source)
+	if err != nil || len(v.toks) == 0 {
+		return err
+	}
+	if v.peek().Type == tkTags {
+		v.idx++
+	} else if err = v.expr(); err != nil {
+		return err
+	}
+	return v.end()
+}
+
+// ValidateExpr checks the expression condition (see ParseExpr), and returns
+// *SyntaxError, which points to the first invalid token, or nil if the
+// condition is valid
+func ValidateExpr(expr string) error {
+	v, err := newValidator(expr)
+	if err != nil || len(v.toks) == 0 {
+		return err
+	}
+	if err = v.expr(); err != nil {
+		return err
+	}
+	return v.end()
+}
+
+//===================== SyntaxError =====================
+
+func (se *SyntaxError) Error() string {
+	if len(se.Expected) == 0 {
+		return fmt.Sprintf("invalid character %q at column %d", se.Token, se.Column)
+	}
+	tok := expEnd
+	if se.Token != "" {
+		tok = strconv.Quote(se.Token)
+	}
+	return fmt.Sprintf("unexpected %s at column %d, expected %s", tok, se.Column, joinExpected(se.Expected))
+}
+
+func joinExpected(exp []string) string {
+	if len(exp) < 2 {
+		return strings.Join(exp, "")
+	}
+	return strings.Join(exp[:len(exp)-1], ", ") + " or " + exp[len(exp)-1]
+}
+
+//===================== validator =====================
+
+func newValidator(cond string) (*validator, error) {
+	lx, err := lqlLexer.Lex(strings.NewReader(cond))
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{}
+	for {
+		tok, err := lx.Next()
+		if err != nil {
+			// the lexer fails on the character, which doesn't start any token
+			se := &SyntaxError{}
+			if rl, ok := lx.(*regexpLexer); ok {
+				r, _ := utf8.DecodeRune(rl.b)
+				se.Column = rl.pos.Column
+				se.Token = string(r)
+			}
+			return nil, se
+		}
+		v.toks = append(v.toks, tok)
+		if tok.Type == lexer.EOF {
+			break
+		}
+	}
+	if len(v.toks) == 1 {
+		// EOF only
+		v.toks = nil
+	}
+	return v, nil
+}
+
+func (v *validator) peek() lexer.Token {
+	return v.toks[v.idx]
+}
+
+// isWord returns whether the current token is the keyword or the operator w
+func (v *validator) isWord(w string) bool {
+	t := v.peek()
+	if t.Type == tkKeyword {
+		return strings.EqualFold(t.Value, w)
+	}
+	return t.Type == tkOperator && t.Value == w
+}
+
+func (v *validator) fail(exp ...string) error {
+	t := v.peek()
+	se := &SyntaxError{Column: t.Pos.Column, Expected: exp}
+	if t.Type != lexer.EOF {
+		se.Token = t.Value
+	}
+	return se
+}
+
+func (v *validator) end() error {
+	if v.peek().Type != lexer.EOF {
+		return v.fail("AND", "OR", expEnd)
+	}
+	return nil
+}
+
+// expr checks `and { OR and }`
+func (v *validator) expr() error {
+	if err := v.and(); err != nil {
+		return err
+	}
+	for v.isWord("OR") {
+		v.idx++
+		if err := v.and(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// and checks `xcond { AND xcond }`
+func (v *validator) and() error {
+	if err := v.xcond(); err != nil {
+		return err
+	}
+	for v.isWord("AND") {
+		v.idx++
+		if err := v.xcond(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xcond checks `[NOT] (cond | "(" expr ")")`
+func (v *validator) xcond() error {
+	if v.isWord("NOT") {
+		v.idx++
+	}
+	if !v.isWord("(") {
+		return v.cond()
+	}
+
+	v.idx++
+	if err := v.expr(); err != nil {
+		return err
+	}
+	if !v.isWord(")") {
+		return v.fail("AND", "OR", `")"`)
+	}
+	v.idx++
+	return nil
+}
+
+// cond checks `ident op value`
+func (v *validator) cond() error {
+	if err := v.ident(); err != nil {
+		return err
+	}
+
+	found := false
+	for _, op := range condOps {
+		if v.isWord(op) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return v.fail(expOp)
+	}
+	v.idx++
+
+	switch v.peek().Type {
+	case tkString, tkIdent, tkNumber:
+		v.idx++
+		return nil
+	}
+	return v.fail(expValue)
+}
+
+// ident checks `(Ident | Keyword) [ "(" ident { "," ident } ")" ]`
+func (v *validator) ident() error {
+	switch v.peek().Type {
+	case tkIdent, tkKeyword:
+		v.idx++
+	default:
+		return v.fail(expIdent)
+	}
+	if !v.isWord("(") {
+		return nil
+	}
+
+	v.idx++
+	for {
+		if err := v.ident(); err != nil {
+			return err
+		}
+		if v.isWord(")") {
+			v.idx++
+			return nil
+		}
+		if !v.isWord(",") {
+			return v.fail(`","`, `")"`)
+		}
+		v.idx++
+	}
+}
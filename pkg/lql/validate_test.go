@@ -0,0 +1,71 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lql
+
+import (
+	"testing"
+)
+
+func TestValidateSourceOk(t *testing.T) {
+	for _, src := range []string{"", " ", "{a=b,c=d}", "a=b", "NOT a = b AND (c like 'd*' OR upper(e) != F)",
+		`name =~i "app" or not (ip prefix 1.2 and ttt contains "x")`, "lower(upper(a))=b", "from=1"} {
+		if err := ValidateSource(src); err != nil {
+			t.Fatal("the source ", src, " must be valid, but err=", err)
+		}
+	}
+}
+
+func TestValidateSourceErrors(t *testing.T) {
+	testValidateSource(t, "name = = foo", 8, "=", `unexpected "=" at column 8, expected value (string, identifier or number)`)
+	testValidateSource(t, "name foo", 6, "foo", `unexpected "foo" at column 6, expected operator (<, >, >=, <=, !=, =, =~i, CONTAINS, PREFIX, SUFFIX or LIKE)`)
+	testValidateSource(t, "name = foo bar", 12, "bar", `unexpected "bar" at column 12, expected AND, OR or end of condition`)
+	testValidateSource(t, "name = foo AND", 15, "", `unexpected end of condition at column 15, expected tag or field name`)
+	testValidateSource(t, "(a=b OR c=d", 12, "", `unexpected end of condition at column 12, expected AND, OR or ")"`)
+	testValidateSource(t, "upper(a b)=c", 9, "b", `unexpected "b" at column 9, expected "," or ")"`)
+	testValidateSource(t, "a=b AND c=d ;", 13, ";", `invalid character ";" at column 13`)
+	testValidateSource(t, "{a=b} AND c=d", 7, "AND", `unexpected "AND" at column 7, expected AND, OR or end of condition`)
+}
+
+func TestValidateExpr(t *testing.T) {
+	if err := ValidateExpr("msg contains abc and fields:f1 = 'x'"); err != nil {
+		t.Fatal("the expression must be valid, but err=", err)
+	}
+	se, ok := ValidateExpr("msg contains").(*SyntaxError)
+	if !ok || se.Column != 13 || se.Token != "" {
+		t.Fatal("expected the error at the end of the expression, but ", se)
+	}
+	// the tags are not allowed in the expressions
+	if se, ok = ValidateExpr("{a=b}").(*SyntaxError); !ok || se.Column != 1 {
+		t.Fatal("expected the error at column 1, but ", se)
+	}
+}
+
+func TestParseSourceSyntaxError(t *testing.T) {
+	_, err := ParseSource("name = = foo")
+	if se, ok := err.(*SyntaxError); !ok || se.Column != 8 {
+		t.Fatal("expected the syntax error at column 8, but err=", err)
+	}
+}
+
+func testValidateSource(t *testing.T, src string, col int, tok, msg string) {
+	err := ValidateSource(src)
+	se, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatal("expected SyntaxError for ", src, ", but err=", err)
+	}
+	if se.Column != col || se.Token != tok || se.Error() != msg {
+		t.Fatal("unexpected error for ", src, ": column=", se.Column, ", token=", se.Token, ", msg=", se.Error())
+	}
+}
@@ -225,7 +225,7 @@ func buildMsgLeStrFldF(id *Identifier) (strTransF, error) {
 }
 
 func (web *whereExpFuncBuilder) buildMsgCond(cn *Condition) (err error) {
-	op := strings.ToUpper(cn.Op)
+	op := normCondOp(cn.Op)
 	val := cn.Value
 	lsf, err := buildMsgLeStrFldF(cn.Ident)
 	if err != nil {
@@ -247,7 +247,7 @@ func (web *whereExpFuncBuilder) buildMsgCond(cn *Condition) (err error) {
 		}
 	case CMP_LIKE:
 		// test it first
-		_, err := path.Match(cn.Value, "abc")
+		_, err = path.Match(cn.Value, "abc")
 		if err != nil {
 			err = fmt.Errorf("wrong 'like' expression for %s, err=%s", cn.Value, err.Error())
 		} else {
@@ -265,7 +265,7 @@ func (web *whereExpFuncBuilder) buildMsgCond(cn *Condition) (err error) {
 func (web *whereExpFuncBuilder) buildFldCond(cn *Condition, fldName string) (err error) {
 	// the fldName is prefixed by `fields:`, so cut it
 	fldName = fldName[7:]
-	op := strings.ToUpper(cn.Op)
+	op := normCondOp(cn.Op)
 	val := cn.Value
 	lsf, err := buildMsgLeStrFldF(cn.Ident)
 	if err != nil {
@@ -287,7 +287,7 @@ func (web *whereExpFuncBuilder) buildFldCond(cn *Condition, fldName string) (err
 		}
 	case CMP_LIKE:
 		// test it first
-		_, err := path.Match(cn.Value, "abc")
+		_, err = path.Match(cn.Value, "abc")
 		if err != nil {
 			err = fmt.Errorf("uncompilable 'like' expression for \"%s\", expected a shell pattern (not regexp) err=%s", val, err.Error())
 		} else {
@@ -300,6 +300,10 @@ func (web *whereExpFuncBuilder) buildFldCond(cn *Condition, fldName string) (err
 		web.wef = func(le *model.LogEvent) bool {
 			return lsf(le.Fields.Value(fldName)) == val
 		}
+	case CMP_EQUAL_FOLD:
+		web.wef = func(le *model.LogEvent) bool {
+			return strings.EqualFold(lsf(le.Fields.Value(fldName)), val)
+		}
 	case "!=":
 		web.wef = func(le *model.LogEvent) bool {
 			return lsf(le.Fields.Value(fldName)) != val
@@ -62,6 +62,8 @@ func TestWhereExpGeneral(t *testing.T) {
 	testWhereExpGeneral(t, "fields:f1 = val1 and fields:f2=val2", le, true)
 	testWhereExpGeneral(t, "fields:f1 = VAL1 and fields:f2=val2", le, false)
 	testWhereExpGeneral(t, "upper(fields:f1) = VAL1 and fields:f2=val2", le, true)
+	testWhereExpGeneral(t, "fields:f1 =~i VAL1 and fields:f2=~i\"Val2\"", le, true)
+	testWhereExpGeneral(t, "fields:f1 =~i VAL2", le, false)
 	testWhereExpGeneral(t, "fields:f1 = val1 and fields:f2=val2 and fields:f3 = \"\"", le, true)
 	testWhereExpGeneral(t, "fields:f1 = val1 and fields:f2=val3", le, false)
 }
@@ -49,12 +49,15 @@ var (
 //
 // The value for any tag could be in escaped (double quoted by "). This case the value
 // can contain the following symbols '{', '}', ',', '\', '"' escaped by backslash
+//
+// The tag names must be unique, the lines like "a=1,a=2" are ambiguous, so an
+// error is returned for them.
 func ParseUnsafe(tags records.Record) (Set, error) {
 	if len(tags) == 0 {
 		return EmptySet, nil
 	}
 
-	m, err := kvstring.ToMap(bytes.ByteArrayToString(tags))
+	m, err := kvstring.ToMapStrict(bytes.ByteArrayToString(tags))
 	if err != nil {
 		return EmptySet, err
 	}
@@ -68,6 +71,18 @@ func Parse(tags string) (Set, error) {
 	return ParseUnsafe([]byte(tags))
 }
 
+// Normalize parses the tags line and returns its canonical form, which is used
+// by the index: the tags are sorted by names, the spaces and the curly braces are
+// removed and the values are quoted only when needed. The lines, which normalized
+// forms are equal, refer to the same journal, e.g. `{ b="2", a=1 }` and `a=1,b=2`
+func Normalize(tags string) (Line, error) {
+	s, err := Parse(tags)
+	if err != nil {
+		return EmptyLine, err
+	}
+	return s.Line(), nil
+}
+
 // MapToSet receives a map of values mp and returns the Set of tags, formed from there.
 func MapToSet(mp map[string]string) Set {
 	if len(mp) == 0 {
@@ -92,6 +107,16 @@ func (s *Set) Tag(tag string) string {
 	return s.tmap[tag]
 }
 
+// Keys returns the sorted list of the tag names
+func (s *Set) Keys() []string {
+	res := make([]string, 0, len(s.tmap))
+	for k := range s.tmap {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
 // IsEmpty returns true if the set is empty
 func (s *Set) IsEmpty() bool {
 	return len(s.tmap) == 0
@@ -107,6 +132,27 @@ func (s *Set) Equals(s1 Set) bool {
 	return s.line == s1.line
 }
 
+// Merge returns a new Set which contains the tags of s and other. If a tag
+// presents in the both sets, the value from other is used. s and other are
+// not changed.
+func (s *Set) Merge(other Set) Set {
+	if len(other.tmap) == 0 {
+		return *s
+	}
+	if len(s.tmap) == 0 {
+		return other
+	}
+
+	tm := make(tagMap, len(s.tmap)+len(other.tmap))
+	for k, v := range s.tmap {
+		tm[k] = v
+	}
+	for k, v := range other.tmap {
+		tm[k] = v
+	}
+	return Set{tm.line(), tm}
+}
+
 // String returns line of tags
 func (s *Set) String() string {
 	return string(s.line)
@@ -165,7 +211,7 @@ func (m tagMap) line() Line {
 		sb.WriteString(k)
 		sb.WriteString(kvstring.KeyValueSeparator)
 		v := m[k]
-		if len(v) == 0 || strings.IndexByte(v, kvstring.KeyValueSeparator[0]) >= 0 || strings.IndexByte(v, kvstring.FieldsSeparator[0]) >= 0 {
+		if needsQuote(v) {
 			v = strconv.Quote(v)
 		}
 		sb.WriteString(v)
@@ -173,3 +219,22 @@ func (m tagMap) line() Line {
 	}
 	return Line(sb.String())
 }
+
+// needsQuote returns whether the tag value v must be quoted in the tags line, so
+// the line is parsed to the same value again: the empty values, the values with
+// the separators, quotes, backslashes, curly braces, non-printable characters or
+// the leading and trailing spaces are quoted.
+func needsQuote(v string) bool {
+	if len(v) == 0 || v[0] == '`' || v != strings.TrimSpace(v) {
+		return true
+	}
+	if strings.ContainsAny(v, kvstring.KeyValueSeparator+kvstring.FieldsSeparator+"\"{}\\") {
+		return true
+	}
+	for _, r := range v {
+		if !strconv.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
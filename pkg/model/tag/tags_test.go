@@ -36,8 +36,8 @@ func TestTagLine(t *testing.T) {
 	testTagLine(t, "name=app", "name=app")
 	testTagLine(t, "{name=app}", "name=app")
 	testTagLine(t, "{ name=\"app\" }", "name=app")
-	testTagLine(t, "{ name=\"a\\\"p\\\"p\" }", "name=a\"p\"p")
-	testTagLine(t, "{ name=\"a\\\"pp\" }", "name=a\"pp")
+	testTagLine(t, "{ name=\"a\\\"p\\\"p\" }", "name=\"a\\\"p\\\"p\"")
+	testTagLine(t, "{ name=\"a\\\"pp\" }", "name=\"a\\\"pp\"")
 	testTagLine(t, "{ name=\"app\"}", "name=app")
 	testTagLine(t, "{ name=\"a==b\" }", "name=\"a==b\"")
 	testTagLine(t, "{ name=\"a,b\" }", "name=\"a,b\"")
@@ -86,6 +86,100 @@ func TestSubset(t *testing.T) {
 	}
 }
 
+func TestKeys(t *testing.T) {
+	s, _ := Parse(`c=3,a=1,b=2`)
+	if ks := s.Keys(); len(ks) != 3 || ks[0] != "a" || ks[1] != "b" || ks[2] != "c" {
+		t.Fatal("wrong keys ", ks)
+	}
+	if len(EmptySet.Keys()) != 0 {
+		t.Fatal("must be empty")
+	}
+}
+
+func TestParseDuplicateKeys(t *testing.T) {
+	for _, tags := range []string{"a=1,a=2", "a=1,a=1", "{b=2, a=1, a =2}", `a="x,a=2",a=3`} {
+		if _, err := Parse(tags); err == nil {
+			t.Fatal("the duplicate key must be reported for ", tags)
+		}
+	}
+	// the quoted value could contain the same key
+	if s, err := Parse(`a="a=1",b=2`); err != nil || s.Tag("a") != "a=1" {
+		t.Fatal("unexpected set=", s, ", err=", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for _, tc := range []struct {
+		base, other string
+		line        Line
+	}{
+		{"a=1", "b=2", "a=1,b=2"},
+		{"a=1,b=2", "b=3,c=4", "a=1,b=3,c=4"},
+		{"a=1,b=2", "a=3,b=4", "a=3,b=4"},
+		{"a=1", "", "a=1"},
+		{"", "a=1", "a=1"},
+		{"", "", ""},
+	} {
+		base, _ := Parse(tc.base)
+		other, _ := Parse(tc.other)
+		res := base.Merge(other)
+		if res.Line() != tc.line {
+			t.Fatal("expected ", tc.line, " for ", tc.base, " merged with ", tc.other, ", but ", res.Line())
+		}
+		// the merged sets are not changed
+		if base.tmap.line() != Line(tc.base) || other.tmap.line() != Line(tc.other) {
+			t.Fatal("the merged sets must not be changed, base=", base, ", other=", other)
+		}
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	for _, v := range []string{"", "app", "/var/log/a,b.log", "a=b", `a"b`, `a\b`, "{a}", " a", "a ", "`a`", "a\tb", "ключ", "1.2.3.4"} {
+		s, err := Parse("name=" + strconv.Quote(v) + ",b=1")
+		if err != nil || s.Tag("name") != v {
+			t.Fatal("unexpected set=", s, " for ", v, ", err=", err)
+		}
+		ln := s.Line()
+		s2, err := Parse(string(ln))
+		if err != nil || s2.Tag("name") != v || s2.Tag("b") != "1" || s2.Line() != ln {
+			t.Fatal("the line ", ln, " must be parsed to the same set for ", v, ", but set=", s2, ", err=", err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		tags string
+		line Line
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"a=1", "a=1"},
+		{" { a = 1 } ", "a=1"},
+		{"b=2,a=1", "a=1,b=2"},
+		{"b=2, a=1,c=3", "a=1,b=2,c=3"},
+		{`{ b="2", a=1 }`, "a=1,b=2"},
+		{`a="1=2",b=""`, `a="1=2",b=""`},
+		{`a="x,y"`, `a="x,y"`},
+		{`a="x \"y\""`, `a="x \"y\""`},
+	} {
+		ln, err := Normalize(tc.tags)
+		if err != nil || ln != tc.line {
+			t.Fatal("expected ", tc.line, " for ", tc.tags, ", but ", ln, ", err=", err)
+		}
+		// the normalized line is normalized
+		if ln2, err := Normalize(string(ln)); err != nil || ln2 != ln {
+			t.Fatal("expected ", ln, " for ", ln, ", but ", ln2, ", err=", err)
+		}
+	}
+
+	for _, tags := range []string{"a", "a=1,a=2", `a="1`} {
+		if _, err := Normalize(tags); err == nil {
+			t.Fatal("Normalize() must fail for ", tags)
+		}
+	}
+}
+
 func testTagLine(t *testing.T, tags string, line Line) {
 	tm, err := Parse(tags)
 	if err != nil {
@@ -129,10 +129,36 @@ func (fs *fileStorage) ReadData(key string) ([]byte, error) {
 	return data, err
 }
 
+// WriteData writes val into a temporary file, which replaces the key file then,
+// so the key file content is either the old or the new one after a crash.
 func (fs *fileStorage) WriteData(key string, val []byte) error {
-	err := ioutil.WriteFile(fs.filePath(key), val, 0640)
+	fn := fs.filePath(key)
+	tmp := fn + ".tmp"
+	err := writeFileSync(tmp, val)
 	if err == nil {
-		fs.logger.Debug("Wrote key=", key, ", value=", string(val))
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fs.logger.Debug("Wrote key=", key, ", value=", string(val))
+	return nil
+}
+
+// writeFileSync writes data to the file name and syncs it
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
 	}
 	return err
 }
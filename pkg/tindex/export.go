@@ -0,0 +1,218 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"encoding/json"
+	"github.com/logrange/logrange/pkg/model/tag"
+	errors2 "github.com/logrange/range/pkg/utils/errors"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// exportRec is the record of the index export
+type exportRec struct {
+	Tags string `json:"tags"`
+	Src  string `json:"src"`
+}
+
+// Export is the part of Service interface
+func (ims *inmemService) Export(w io.Writer) error {
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return ErrShutDown
+	}
+
+	tds := make([]*tagsDesc, 0, ims.tmap.len())
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		tds = append(tds, td)
+		return true
+	})
+	sortTagsDescs(tds)
+
+	enc := json.NewEncoder(w)
+	for _, td := range tds {
+		if err := enc.Encode(exportRec{Tags: string(td.tags.Line()), Src: td.Src}); err != nil {
+			return errors.Wrapf(err, "could not export the record %s", td)
+		}
+	}
+	return nil
+}
+
+// Snapshot is the part of Service interface
+func (ims *inmemService) Snapshot(w io.Writer) error {
+	ims.lock.RLock()
+	if ims.done {
+		ims.lock.RUnlock()
+		return ErrShutDown
+	}
+	// the records readers could be changed, so the sources are copied only
+	tmap := make(map[tag.Line]*tagsDesc, ims.tmap.len())
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		tmap[td.tags.Line()] = &tagsDesc{Src: td.Src}
+		return true
+	})
+	ims.lock.RUnlock()
+
+	data, err := marshalIdx(tmap, ims.Config.Format, ims.Config.Compression, ims.encKey)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return errors.Wrapf(err, "could not write the snapshot")
+	}
+	return nil
+}
+
+// Import is the part of Service interface. The MaxJournals and MaxTagValues limits
+// and the AllowedKeys and RequiredKeys are not applied to the imported records, but
+// the WarnJournalsThreshold is reported.
+func (ims *inmemService) Import(r io.Reader, mode int) error {
+	if mode != IMPORT_MERGE && mode != IMPORT_REPLACE {
+		return errors.Errorf("unknown import mode %d", mode)
+	}
+
+	tds, err := readExport(r)
+	if err != nil {
+		return err
+	}
+
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
+	if ims.done {
+		return ErrShutDown
+	}
+
+	if ims.Config.ReadOnly {
+		return errReadOnly
+	}
+
+	if mode == IMPORT_REPLACE {
+		return ims.importReplaceUnsafe(tds)
+	}
+	return ims.importMergeUnsafe(tds)
+}
+
+func (ims *inmemService) importReplaceUnsafe(tds []*tagsDesc) error {
+	var acquired *tagsDesc
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		if td.exclusive || td.readers > 0 {
+			acquired = td
+			return false
+		}
+		return true
+	})
+	if td := acquired; td != nil {
+		ims.logger.Warn("Import(): could not replace the index, the source is acquired, src=", td.Src, ", tags=", td.tags.Line())
+		return errors2.WrongState
+	}
+
+	tmap, smap, kvals, kidx := ims.tmap, ims.smap, ims.kvals, ims.kidx
+	ims.tmap = newLinesMap(len(tmap.buckets))
+	ims.smap = newSrcsMap(len(smap.buckets))
+	ims.kvals = nil
+	ims.kidx = nil
+	for _, td := range tds {
+		ims.addUnsafe(td)
+	}
+
+	old := make([]*tagsDesc, 0, tmap.len())
+	tmap.forEach(func(td *tagsDesc) bool {
+		old = append(old, td)
+		return true
+	})
+	if err := ims.onChangeUnsafe(tds, old); err != nil {
+		ims.tmap, ims.smap, ims.kvals, ims.kidx = tmap, smap, kvals, kidx
+		return err
+	}
+	ims.notifyReplaceUnsafe(tmap)
+	ims.checkThresholdUnsafe()
+	ims.logger.Info("Import(): the index is replaced, count=", len(tds))
+	return nil
+}
+
+func (ims *inmemService) importMergeUnsafe(tds []*tagsDesc) error {
+	added := make([]*tagsDesc, 0, len(tds))
+	for _, td := range tds {
+		ln := td.tags.Line()
+		if td2 := ims.tmap.get(ln); td2 != nil {
+			if td2.Src != td.Src {
+				return errors.Errorf("the tags %s are already in the index with the source %s, but %s is imported", ln, td2.Src, td.Src)
+			}
+			continue
+		}
+
+		if td2 := ims.smap.load(td.Src); td2 != nil {
+			return errors.Errorf("the source %s is already in the index for the tags %s, but %s is imported", td.Src, td2.tags.Line(), ln)
+		}
+		added = append(added, td)
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	for _, td := range added {
+		ims.addUnsafe(td)
+	}
+
+	if err := ims.onChangeUnsafe(added, nil); err != nil {
+		for _, td := range added {
+			ims.removeUnsafe(td)
+		}
+		return err
+	}
+	ims.notifyUnsafe(JE_CREATED, added...)
+	ims.checkThresholdUnsafe()
+	ims.logger.Info("Import(): the records are added to the index, count=", len(added))
+	return nil
+}
+
+// readExport reads the records written by Export. It checks that neither tags
+// nor sources are repeated.
+func readExport(r io.Reader) ([]*tagsDesc, error) {
+	var tds []*tagsDesc
+	tmap := make(map[tag.Line]bool)
+	smap := make(map[string]bool)
+	dec := json.NewDecoder(r)
+	for {
+		var rec exportRec
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the record %d", len(tds)+1)
+		}
+
+		tgs, err := tag.Parse(rec.Tags)
+		if err != nil {
+			return nil, wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", rec.Tags, err)
+		}
+
+		if tgs.IsEmpty() || rec.Src == "" {
+			return nil, errors.Errorf("the record %d must have non-empty tags and src", len(tds)+1)
+		}
+
+		if tmap[tgs.Line()] || smap[rec.Src] {
+			return nil, errors.Errorf("the record %d repeats tags %s or src %s", len(tds)+1, rec.Tags, rec.Src)
+		}
+		tmap[tgs.Line()] = true
+		smap[rec.Src] = true
+		tds = append(tds, &tagsDesc{tags: tgs, Src: rec.Src})
+	}
+	return tds, nil
+}
@@ -15,8 +15,14 @@
 package tindex
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"github.com/logrange/logrange/pkg/model/tag"
 	"github.com/logrange/logrange/pkg/utils"
+	"github.com/pkg/errors"
+	"strings"
+	"unicode"
 )
 
 func newSrc() string {
@@ -25,3 +31,22 @@ func newSrc() string {
 	// (see NextSimpleId() implementation for details)
 	return fmt.Sprintf("%X%02X", id, (id>>16)&0xFF)
 }
+
+// checkSrc returns an error, if src could not be the journal name
+func checkSrc(src string) error {
+	if src == "" || src == "." || src == ".." {
+		return errors.Errorf("the source id %q must be non-empty and could not be . or ..", src)
+	}
+	if strings.IndexFunc(src, func(r rune) bool { return r == '/' || r == '\\' || unicode.IsSpace(r) }) >= 0 {
+		return errors.Errorf("the source id %q must not contain the path separators or the white spaces", src)
+	}
+	return nil
+}
+
+// hashSrc returns the source id for the tags line ln, which is the same for
+// the same line everywhere (see InMemConfig.DeterministicSrc). The line is
+// expected to be normalized.
+func hashSrc(ln tag.Line) string {
+	h := sha256.Sum256([]byte(ln))
+	return fmt.Sprintf("%016X", binary.BigEndian.Uint64(h[:8]))
+}
@@ -0,0 +1,391 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/logrange/logrange/pkg/model/tag"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+)
+
+// The index file consists of the header followed by the payload. The header
+// has the following layout:
+//
+//	| magic (4 bytes) | version (1 byte) | CRC32 of the payload (4 bytes) |
+//
+// Files written before the header was introduced contain the payload only and
+// are still accepted. The payload is either the encoded index or the gzipped
+// one, what is detected by the gzip magic bytes. If the index is encrypted, the
+// payload is AES-GCM encrypted (and gzipped, if compressed) encoded index with
+// the following layout:
+//
+//	| magic (4 bytes) | version (1 byte) | nonce (12 bytes) | ciphertext |
+//
+// The index is encoded either as the JSON object, which maps the tags lines to
+// the records, or in the binary format, which is detected by its magic bytes:
+//
+//	| magic (4 bytes) | version (1 byte) | records number (uvarint) | records |
+//
+// where every record is the tags line and the source id, both are written as
+// the length (uvarint) followed by the string bytes.
+const (
+	cIdxHdrVersion = 1
+	cIdxHdrSize    = 9
+
+	cEncVersion = 1
+	cEncHdrSize = 5
+
+	cBinVersion = 1
+	cBinHdrSize = 5
+)
+
+const (
+	// FormatJSON is the InMemConfig.Format value to encode the index as JSON
+	FormatJSON = "json"
+	// FormatBinary is the InMemConfig.Format value to encode the index in the
+	// binary format, which is faster to encode and decode
+	FormatBinary = "binary"
+)
+
+const (
+	// CompressionNone is the InMemConfig.Compression value to store the index as is
+	CompressionNone = "none"
+	// CompressionGzip is the InMemConfig.Compression value to gzip the index
+	CompressionGzip = "gzip"
+)
+
+const (
+	cIdxFileName       = "tindex.dat"
+	cIdxBackupFileName = "tindex.bak"
+	cIdxTmpFileName    = "tindex.dat.tmp"
+
+	// cIdxShardsFileName is the shards manifest, it contains the number of the
+	// index shards, if the index is sharded. It is written after the shards, so
+	// the index is loaded either from the previous layout or from the new one,
+	// when InMemConfig.ShardCount is changed.
+	cIdxShardsFileName    = "tindex.shards"
+	cIdxShardsTmpFileName = "tindex.shards.tmp"
+)
+
+type (
+	// idxFileName contains the names of an index object, its backup and the
+	// temporary object, which is renamed to the index object when it is written
+	idxFileName struct {
+		name, bak, tmp string
+	}
+
+	// shardsManifest is the content of the shards manifest
+	shardsManifest struct {
+		ShardCount int
+	}
+)
+
+var (
+	cIdxMagic  = []byte("LRTI")
+	cEncMagic  = []byte("LRTE")
+	cBinMagic  = []byte("LRTB")
+	cGzipMagic = []byte{0x1f, 0x8b}
+
+	// errCorruptedIdx is returned when the index file content does not match its checksum
+	errCorruptedIdx = errors.New("the index file is corrupted")
+	// errNoKey is returned when the index file is encrypted, but the key is not provided
+	errNoKey = errors.New("the index file is encrypted, but no EncryptionKey is provided")
+)
+
+// encodeIdxFile returns payload prefixed by the index file header
+func encodeIdxFile(payload []byte) []byte {
+	res := make([]byte, cIdxHdrSize+len(payload))
+	copy(res, cIdxMagic)
+	res[4] = cIdxHdrVersion
+	binary.BigEndian.PutUint32(res[5:], crc32.ChecksumIEEE(payload))
+	copy(res[cIdxHdrSize:], payload)
+	return res
+}
+
+// decodeIdxFile checks the header of data and returns the payload. If the
+// checksum doesn't match, errCorruptedIdx is returned.
+func decodeIdxFile(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, cIdxMagic) {
+		// no header, the file was written by an older version
+		return data, nil
+	}
+
+	if len(data) < cIdxHdrSize {
+		return nil, errCorruptedIdx
+	}
+
+	if data[4] != cIdxHdrVersion {
+		return nil, errors.Errorf("unsupported index file version %d", data[4])
+	}
+
+	payload := data[cIdxHdrSize:]
+	if binary.BigEndian.Uint32(data[5:]) != crc32.ChecksumIEEE(payload) {
+		return nil, errCorruptedIdx
+	}
+	return payload, nil
+}
+
+// readIdxFile reads the index object name from st and returns its verified, decrypted
+// (if the key is provided) and uncompressed payload
+func readIdxFile(st Storage, name string, key []byte) ([]byte, error) {
+	data, err := st.Read(name)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := decodeIdxFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = decryptIdx(payload, key); err != nil {
+		return nil, err
+	}
+	return decompressIdx(payload)
+}
+
+// marshalIdx returns the index file content for tmap, which is encoded in the
+// format, compressed and encrypted (if the key is provided)
+func marshalIdx(tmap map[tag.Line]*tagsDesc, format, compression string, key []byte) ([]byte, error) {
+	data, err := encodeIdx(tmap, format)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not marshal tmap ")
+	}
+
+	data, err = compressIdx(data, compression)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not compress tmap ")
+	}
+
+	data, err = encryptIdx(data, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not encrypt tmap ")
+	}
+	return encodeIdxFile(data), nil
+}
+
+// encodeIdx returns tmap encoded in the format provided
+func encodeIdx(tmap map[tag.Line]*tagsDesc, format string) ([]byte, error) {
+	switch format {
+	case "", FormatJSON:
+		return json.Marshal(tmap)
+	case FormatBinary:
+		n := cBinHdrSize + binary.MaxVarintLen64
+		for ln, td := range tmap {
+			n += len(ln) + len(td.Src) + 2*binary.MaxVarintLen64
+		}
+		res := make([]byte, cBinHdrSize, n)
+		copy(res, cBinMagic)
+		res[4] = cBinVersion
+		res = appendUvarint(res, uint64(len(tmap)))
+		for ln, td := range tmap {
+			res = appendUvarint(res, uint64(len(ln)))
+			res = append(res, ln...)
+			res = appendUvarint(res, uint64(len(td.Src)))
+			res = append(res, td.Src...)
+		}
+		return res, nil
+	}
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// decodeIdx returns the index decoded from data and the format it was encoded in.
+// The format is detected by the data content. The records tags are not parsed.
+func decodeIdx(data []byte) (map[tag.Line]*tagsDesc, string, error) {
+	if !bytes.HasPrefix(data, cBinMagic) {
+		tmap := make(map[tag.Line]*tagsDesc)
+		if err := json.Unmarshal(data, &tmap); err != nil {
+			return nil, FormatJSON, err
+		}
+		return tmap, FormatJSON, nil
+	}
+
+	if len(data) < cBinHdrSize {
+		return nil, FormatBinary, errCorruptedIdx
+	}
+	if data[4] != cBinVersion {
+		return nil, FormatBinary, errors.Errorf("unsupported binary index version %d", data[4])
+	}
+	buf := data[cBinHdrSize:]
+	n, ok := readUvarint(&buf)
+	if !ok || n > uint64(len(buf)) {
+		return nil, FormatBinary, errCorruptedIdx
+	}
+	tmap := make(map[tag.Line]*tagsDesc, n)
+	for i := uint64(0); i < n; i++ {
+		ln, ok1 := readString(&buf)
+		src, ok2 := readString(&buf)
+		if !ok1 || !ok2 {
+			return nil, FormatBinary, errCorruptedIdx
+		}
+		tmap[tag.Line(ln)] = &tagsDesc{Src: src}
+	}
+	if len(buf) > 0 {
+		return nil, FormatBinary, errCorruptedIdx
+	}
+	return tmap, FormatBinary, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// readUvarint reads the uvarint from buf and moves buf after it
+func readUvarint(buf *[]byte) (uint64, bool) {
+	v, n := binary.Uvarint(*buf)
+	if n <= 0 {
+		return 0, false
+	}
+	*buf = (*buf)[n:]
+	return v, true
+}
+
+// readString reads the length prefixed string from buf and moves buf after it
+func readString(buf *[]byte) (string, bool) {
+	n, ok := readUvarint(buf)
+	if !ok || n > uint64(len(*buf)) {
+		return "", false
+	}
+	res := string((*buf)[:n])
+	*buf = (*buf)[n:]
+	return res, true
+}
+
+// compressIdx compresses payload using the compression method provided
+func compressIdx(payload []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Errorf("unknown compression %q", compression)
+}
+
+// decompressIdx returns the uncompressed payload, it detects whether the
+// payload is compressed or not by its content.
+func decompressIdx(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, cGzipMagic) {
+		return payload, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// idxFileNames returns the names of the index shard n objects, like "tindex-1.dat",
+// or the names of the single index objects, like "tindex.dat", if n is negative
+func idxFileNames(n int) idxFileName {
+	if n < 0 {
+		return idxFileName{cIdxFileName, cIdxBackupFileName, cIdxTmpFileName}
+	}
+	pfx := "tindex-" + strconv.Itoa(n)
+	return idxFileName{pfx + ".dat", pfx + ".bak", pfx + ".dat.tmp"}
+}
+
+// parseEncryptionKey returns the AES key for the hex-encoded InMemConfig.EncryptionKey,
+// or nil if the key is empty
+func parseEncryptionKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	res, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "the key must be hex-encoded")
+	}
+	if _, err = aes.NewCipher(res); err != nil {
+		return nil, errors.Errorf("the key must be 16, 24 or 32 bytes long, but it is %d bytes", len(res))
+	}
+	return res, nil
+}
+
+// encryptIdx encrypts the payload with key by AES-GCM, the payload is returned as
+// is, if the key is empty
+func encryptIdx(payload, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return payload, nil
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, cEncHdrSize+gcm.NonceSize(), cEncHdrSize+gcm.NonceSize()+len(payload)+gcm.Overhead())
+	copy(res, cEncMagic)
+	res[4] = cEncVersion
+	nonce := res[cEncHdrSize:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(res, nonce, payload, res[:cEncHdrSize]), nil
+}
+
+// decryptIdx decrypts the payload with key, if it is encrypted, otherwise
+// the payload is returned as is
+func decryptIdx(payload, key []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, cEncMagic) {
+		return payload, nil
+	}
+	if len(key) == 0 {
+		return nil, errNoKey
+	}
+	if len(payload) < cEncHdrSize || payload[4] != cEncVersion {
+		return nil, errors.Errorf("unsupported index encryption version")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < cEncHdrSize+gcm.NonceSize() {
+		return nil, errCorruptedIdx
+	}
+	nonce := payload[cEncHdrSize : cEncHdrSize+gcm.NonceSize()]
+	res, err := gcm.Open(nil, nonce, payload[cEncHdrSize+gcm.NonceSize():], payload[:cEncHdrSize])
+	if err != nil {
+		return nil, errors.Errorf("could not decrypt the index file, the EncryptionKey is wrong or the file is corrupted")
+	}
+	return res, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
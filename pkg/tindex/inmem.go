@@ -15,20 +15,23 @@
 package tindex
 
 import (
+	"container/heap"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jrivets/log4g"
 	"github.com/logrange/logrange/pkg/lql"
 	"github.com/logrange/logrange/pkg/model/tag"
+	"github.com/logrange/logrange/pkg/utils"
 	"github.com/logrange/range/pkg/records/journal"
 	"github.com/logrange/range/pkg/utils/bytes"
 	errors2 "github.com/logrange/range/pkg/utils/errors"
-	"github.com/logrange/range/pkg/utils/fileutil"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"os"
-	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -42,6 +45,10 @@ type (
 		Src string
 	}
 
+	// linesHeap is the max-heap of the tags lines, it keeps the smallest lines
+	// matched, while the index is scanned
+	linesHeap []string
+
 	// InMemConfig struct contains configuration for inmemService
 	InMemConfig struct {
 		// DoNotSave flag indicates that the data should not be persisted. Used for testing.
@@ -49,32 +56,221 @@ type (
 
 		// WorkingDir contains path to the folder for persisting the index data
 		WorkingDir string
+
+		// Compression defines how the index file is compressed, "none" (default) or "gzip".
+		// Files are loaded regardless of the setting, so it could be changed any time.
+		Compression string
+
+		// Format defines how the index is encoded, "json" (default) or "binary". The
+		// binary format is faster to encode and decode, what matters for the big indexes.
+		// Files are loaded regardless of the setting, and the index, which is loaded
+		// in the other format, is written in the Format on Init, so it could be changed
+		// any time.
+		Format string
+
+		// FlushIntervalMs defines the interval the index changes are persisted with. If the
+		// value is 0, the index is saved synchronously on every change.
+		FlushIntervalMs int
+
+		// WAL makes the index changes to be appended to the "tindex.wal" object synchronously,
+		// instead of writing the whole index on every change. The WAL is compacted into the
+		// index, when it has WALMaxRecords records, or by the flusher, if FlushIntervalMs is
+		// set, and by Compact. The WAL is replayed on top of the index regardless of the
+		// setting, so it could be changed any time. The Storage must implement Appender.
+		WAL bool
+
+		// WALMaxRecords defines the number of the WAL records, which makes the WAL to be
+		// compacted into the index, 1000 by default.
+		WALMaxRecords int
+
+		// Storage allows to persist the index data in a custom storage. If it is nil, the
+		// files in WorkingDir are used.
+		Storage Storage
+
+		// Clock provides the time for the flusher and the stats. If it is nil, the
+		// system clock is used. Used for testing.
+		Clock utils.Clock
+
+		// MaxJournals limits the number of records in the index. No limit if 0.
+		MaxJournals int
+
+		// WarnJournalsThreshold is the number of records in the index, which is reported
+		// by a warning and Stats.ThresholdWarnings, when a new record makes the index
+		// reach it. It is reported once, until the number of records falls below the
+		// threshold again. The index, which is loaded over the threshold, is not reported.
+		// No warning if 0.
+		WarnJournalsThreshold int
+
+		// MaxTagValues limits the number of different values for any tag key in the index.
+		// It prevents the index growth because of high-cardinality tags. No limit if 0.
+		MaxTagValues int
+
+		// AllowedKeys contains the tag keys, which could be used by the new records. A
+		// record with a key, which is not in the list, is not created. The records
+		// created before are available regardless of the setting. All keys are allowed,
+		// if the list is empty.
+		AllowedKeys []string
+
+		// RequiredKeys contains the tag keys, which every new record must have with
+		// non-empty values. A record without any of the keys is not created. The records created before are available
+		// regardless of the setting. No keys are required, if the list is empty.
+		RequiredKeys []string
+
+		// RebuildOnMissing allows to restore the index records for the existing journals,
+		// if the index is empty (the index file is lost, for instance). The journals don't
+		// keep their tags, so every restored record gets the tag line
+		// "lr_rebuilt_src=<journal name>", what keeps the data available for queries.
+		RebuildOnMissing bool
+
+		// ConsistencyMode defines what to do if the index and journals are inconsistent
+		// on Init: ConsistencyStrict (default) fails Init, ConsistencyWarn reports the problem
+		// and continues, ConsistencyRepair drops the orphaned records and rebuilds the
+		// missing ones (see RebuildOnMissing), then continues. The mode also applies to the
+		// index records, which tags lines normalize to the same line: such records are
+		// merged, keeping the first source, in the warn and repair modes.
+		ConsistencyMode string
+
+		// ReadOnly opens the index without changing it. No new sources could be created,
+		// the records could not be deleted, and the index is never saved. Unlike DoNotSave,
+		// the in-memory index is not changed either.
+		ReadOnly bool
+
+		// ShardCount defines how many objects the index is split into. If the value is
+		// greater than 1, the records are distributed between "tindex-<n>.dat" objects by
+		// their tags lines hashes, and the objects are written concurrently. Otherwise,
+		// the index is kept in the single "tindex.dat" object. The index is loaded
+		// regardless of the setting, so it could be changed any time.
+		ShardCount int
+
+		// EncryptionKey contains the hex-encoded AES key (16, 24 or 32 bytes), which is
+		// used to encrypt the index files by AES-GCM. If the value is empty, the files
+		// are not encrypted. The not encrypted files are loaded regardless of the
+		// setting, so the encryption could be turned on any time.
+		EncryptionKey string
+
+		// DeterministicSrc makes the source id of a new record to be the hash of its
+		// normalized tags line, so the same tags get the same source id on all the
+		// nodes. The records created before keep their ids. If the id is taken by
+		// another tags line already, the record is not created.
+		DeterministicSrc bool
+
+		// SrcGenerator returns the source id for the tags of a new record, so the ids could
+		// follow an external naming scheme. The id must be a valid journal name: non-empty,
+		// without the path separators and the white spaces. If the id is taken by another
+		// record already, the record is not created. The default ids are generated, if it
+		// is nil. It could not be used with DeterministicSrc.
+		SrcGenerator func(tags tag.Set) (string, error) `json:"-"`
 	}
 
 	inmemService struct {
 		Config   *InMemConfig       `inject:"tindexInMemCfg"`
 		Journals journal.Controller `inject:""`
-
-		logger log4g.Logger
-		lock   sync.Mutex
-		// tmap contains tags:tagsDesc key-value pairs
-		tmap map[tag.Line]*tagsDesc
+		// Registry is the optional Prometheus registry, the index metrics
+		// collector is registered there, if it is provided
+		Registry prometheus.Registerer `inject:"promRegistry,optional"`
+
+		logger  log4g.Logger
+		storage Storage
+		clock   utils.Clock
+		// lock guards the index. Holding the lock exclusively allows to access all the
+		// index fields. Holding it for read, the records are acquired and released with
+		// their tmap buckets locked, and the new records are added by addConcurrently
+		// (see there). The records are removed with the lock held exclusively only.
+		lock sync.RWMutex
+		// idxLock guards the index-wide fields (kvals, kidx, lcache, dirty and
+		// overThreshold), when the lock is held for read. It is acquired after the
+		// tmap bucket lock, if both are needed, and it is held for short only.
+		idxLock sync.Mutex
+		// tmap contains tags:tagsDesc key-value pairs, its bucket locks guard the
+		// readers and exclusive fields of the records
+		tmap *linesMap
 		// smap contains src:tagsDesc key-value pairs
-		smap map[string]*tagsDesc
-		done bool
+		smap *srcsMap
+		// kvals contains the number of records for every tag key and value. It is
+		// maintained only if MaxTagValues is set.
+		kvals map[string]map[string]int
+		// kidx contains the tags lines of the records for every tag key
+		kidx map[string]map[tag.Line]struct{}
+		// lcache contains the normalized tags lines for the raw ones, which were parsed before
+		lcache map[string]tag.Line
+		done   bool
+		// dirty indicates the index has changes which are not persisted yet
+		dirty bool
+		// stats contains the index statistics counters
+		stats stats
+		// collector exposes the stats to Registry, it is nil if the registry is not provided
+		collector prometheus.Collector
+		// stopCh is closed to stop the flusher
+		stopCh chan struct{}
+		// saveErr contains the error of the last attempt to persist the index
+		saveErr error
+		// subs contains the subscriptions for the records changes (see Subscribe)
+		subs map[*subscription]struct{}
+		// encKey contains the parsed InMemConfig.EncryptionKey
+		encKey []byte
+		// allowedKeys contains the InMemConfig.AllowedKeys, it is nil if all keys are allowed
+		allowedKeys map[string]struct{}
+		// idxShards contains the number of the index objects the index was loaded from,
+		// or saved to the last time. It is 0, if the index was never sharded.
+		idxShards int
+		// walRecs contains the number of the records in the WAL
+		walRecs int
+		// walReset indicates the WAL could not be appended anymore (its tail is
+		// broken), so the whole index must be saved, what resets the WAL
+		walReset bool
+		// overThreshold indicates the number of records reached WarnJournalsThreshold
+		// and it was reported already
+		overThreshold bool
 	}
 )
 
 const (
-	cIdxFileName       = "tindex.dat"
-	cIdxBackupFileName = "tindex.bak"
+	// ConsistencyStrict is the InMemConfig.ConsistencyMode value to fail Init on inconsistency
+	ConsistencyStrict = "strict"
+	// ConsistencyWarn is the InMemConfig.ConsistencyMode value to report inconsistency only
+	ConsistencyWarn = "warn"
+	// ConsistencyRepair is the InMemConfig.ConsistencyMode value to fix inconsistency on Init
+	ConsistencyRepair = "repair"
+)
+
+const (
+	// cRebuiltSrcTag is the tag name for the records restored by rebuild
+	cRebuiltSrcTag = "lr_rebuilt_src"
+
+	// cCtxCheckPeriod defines how many records are scanned between the context checks
+	cCtxCheckPeriod = 1000
+
+	// cForEachBatchSize defines how many records are read under the lock by ForEach
+	cForEachBatchSize = 1000
+
+	// cLineCacheSize defines the maximum number of entries in the lcache
+	cLineCacheSize = 10000
+
+	// cBucketsNum defines the number of the tmap and smap buckets
+	cBucketsNum = 32
+
+	// cWorkingDirMode defines the permissions of the working dir, if it is created
+	cWorkingDirMode = 0750
+)
+
+var (
+	// errReadOnly is returned for the operations changing the index in the ReadOnly mode
+	errReadOnly = errors.New("the index is opened in read-only mode")
+	// errSrcCollision is returned when the deterministic source id is taken by another tags line
+	errSrcCollision = errors.New("the source id is taken by another tags line")
 )
 
+// NewInmemService returns the index, which Config and Journals are expected to be
+// injected. The index could be used without the injection, it is not persisted
+// and has no journals then.
 func NewInmemService() Service {
 	ims := new(inmemService)
+	ims.Config = &InMemConfig{DoNotSave: true}
 	ims.logger = log4g.GetLogger("tindex.inmem")
-	ims.tmap = make(map[tag.Line]*tagsDesc)
-	ims.smap = make(map[string]*tagsDesc)
+	ims.tmap = newLinesMap(cBucketsNum)
+	ims.smap = newSrcsMap(cBucketsNum)
+	ims.lcache = make(map[string]tag.Line)
+	ims.clock = utils.RealClock
 	return ims
 }
 
@@ -84,10 +280,129 @@ func NewInmemServiceWithConfig(cfg InMemConfig) Service {
 	return res
 }
 
+// Check checks the config values
+func (c *InMemConfig) Check() error {
+	if c.FlushIntervalMs < 0 {
+		return errors.Errorf("invalid FlushIntervalMs=%d, must be >= 0", c.FlushIntervalMs)
+	}
+	if c.MaxJournals < 0 {
+		return errors.Errorf("invalid MaxJournals=%d, must be >= 0", c.MaxJournals)
+	}
+	if c.MaxTagValues < 0 {
+		return errors.Errorf("invalid MaxTagValues=%d, must be >= 0", c.MaxTagValues)
+	}
+	if c.WALMaxRecords < 0 {
+		return errors.Errorf("invalid WALMaxRecords=%d, must be >= 0", c.WALMaxRecords)
+	}
+	if c.WarnJournalsThreshold < 0 {
+		return errors.Errorf("invalid WarnJournalsThreshold=%d, must be >= 0", c.WarnJournalsThreshold)
+	}
+	if c.MaxJournals > 0 && c.WarnJournalsThreshold > c.MaxJournals {
+		return errors.Errorf("invalid WarnJournalsThreshold=%d, must be <= MaxJournals=%d", c.WarnJournalsThreshold, c.MaxJournals)
+	}
+	for _, k := range c.AllowedKeys {
+		if strings.TrimSpace(k) == "" {
+			return errors.Errorf("invalid AllowedKeys=%v, the keys must be non-empty", c.AllowedKeys)
+		}
+	}
+	allowed := make(map[string]bool, len(c.AllowedKeys))
+	for _, k := range c.AllowedKeys {
+		allowed[k] = true
+	}
+	for _, k := range c.RequiredKeys {
+		if strings.TrimSpace(k) == "" {
+			return errors.Errorf("invalid RequiredKeys=%v, the keys must be non-empty", c.RequiredKeys)
+		}
+		if len(allowed) > 0 && !allowed[k] {
+			return errors.Errorf("invalid RequiredKeys=%v, the key %q is not in AllowedKeys=%v", c.RequiredKeys, k, c.AllowedKeys)
+		}
+	}
+	if c.ShardCount < 0 {
+		return errors.Errorf("invalid ShardCount=%d, must be >= 0", c.ShardCount)
+	}
+	if c.DeterministicSrc && c.SrcGenerator != nil {
+		return errors.Errorf("DeterministicSrc and SrcGenerator could not be used together")
+	}
+	if _, err := parseEncryptionKey(c.EncryptionKey); err != nil {
+		return errors.Wrapf(err, "invalid EncryptionKey")
+	}
+	switch c.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		return errors.Errorf("unknown Compression=%q, expected %q or %q", c.Compression, CompressionNone, CompressionGzip)
+	}
+	switch c.Format {
+	case "", FormatJSON, FormatBinary:
+	default:
+		return errors.Errorf("unknown Format=%q, expected %q or %q", c.Format, FormatJSON, FormatBinary)
+	}
+	if c.ReadOnly && (c.RebuildOnMissing || c.ConsistencyMode == ConsistencyRepair) {
+		return errors.Errorf("ReadOnly could not be used with RebuildOnMissing or ConsistencyMode=%q", ConsistencyRepair)
+	}
+	switch c.ConsistencyMode {
+	case "", ConsistencyStrict, ConsistencyWarn, ConsistencyRepair:
+	default:
+		return errors.Errorf("unknown ConsistencyMode=%q, expected %q, %q or %q", c.ConsistencyMode,
+			ConsistencyStrict, ConsistencyWarn, ConsistencyRepair)
+	}
+	return nil
+}
+
+// String is fmt.Stringer implementation, the EncryptionKey value is not printed
+func (c *InMemConfig) String() string {
+	type plainConfig InMemConfig
+	pc := plainConfig(*c)
+	if pc.EncryptionKey != "" {
+		pc.EncryptionKey = "<redacted>"
+	}
+	return fmt.Sprintf("%+v", pc)
+}
+
 func (ims *inmemService) Init(ctx context.Context) error {
 	ims.logger.Info("Initializing...")
+	if err := ims.Config.Check(); err != nil {
+		return errors.Wrapf(err, "invalid config %v", ims.Config)
+	}
 	ims.done = false
-	return ims.checkConsistency(ctx)
+	// the key is checked already
+	ims.encKey, _ = parseEncryptionKey(ims.Config.EncryptionKey)
+	ims.allowedKeys = nil
+	if len(ims.Config.AllowedKeys) > 0 {
+		ims.allowedKeys = make(map[string]struct{}, len(ims.Config.AllowedKeys))
+		for _, k := range ims.Config.AllowedKeys {
+			ims.allowedKeys[k] = struct{}{}
+		}
+	}
+	if ims.Config.Clock != nil {
+		ims.clock = ims.Config.Clock
+	}
+	if err := ims.initStorage(); err != nil {
+		return err
+	}
+	if _, ok := ims.storage.(Appender); ims.isWalUsed() && !ok {
+		return errors.Errorf("the storage %v doesn't implement Appender, so WAL could not be used", ims.storage)
+	}
+	if err := ims.checkConsistency(ctx); err != nil {
+		return err
+	}
+	ims.lock.Lock()
+	wt := ims.Config.WarnJournalsThreshold
+	ims.overThreshold = wt > 0 && ims.tmap.len() >= wt
+	ims.lock.Unlock()
+
+	if ims.Registry != nil && ims.collector == nil {
+		c := NewCollector(ims)
+		if err := ims.Registry.Register(c); err != nil {
+			return errors.Wrapf(err, "could not register the index metrics")
+		}
+		ims.collector = c
+	}
+
+	if ims.Config.FlushIntervalMs > 0 {
+		ims.stopCh = make(chan struct{})
+		go ims.runFlusher(ims.stopCh)
+	}
+	return nil
 }
 
 func (ims *inmemService) Shutdown() {
@@ -96,39 +411,174 @@ func (ims *inmemService) Shutdown() {
 	ims.lock.Lock()
 	defer ims.lock.Unlock()
 
+	if ims.stopCh != nil {
+		close(ims.stopCh)
+		ims.stopCh = nil
+	}
+	ims.flushUnsafe()
+	for s := range ims.subs {
+		ims.unsubscribeUnsafe(s)
+	}
 	ims.done = true
+
+	if ims.collector != nil {
+		ims.Registry.Unregister(ims.collector)
+		ims.collector = nil
+	}
 }
 
 func (ims *inmemService) GetOrCreateJournal(tags string) (res string, ts tag.Set, err error) {
-	return ims.getOrCreateJournal(tags, true)
+	ims.stats.onCreate()
+	return ims.getOrCreateJournal(tags, nil, true)
+}
+
+// GetOrCreateJournalByTags is the part of Service interface
+func (ims *inmemService) GetOrCreateJournalByTags(tags tag.Set) (string, error) {
+	ims.stats.onCreate()
+	res, _, err := ims.getOrCreateJournal(string(tags.Line()), &tags, true)
+	return res, err
 }
 
 func (ims *inmemService) GetJournal(tags string) (string, tag.Set, error) {
-	return ims.getOrCreateJournal(tags, false)
+	return ims.getOrCreateJournal(tags, nil, false)
 }
 
-// GetJournalTags acquires the src and returns its Tags, if it is found. If no
-// error, and lock == true, the src must be released after usage. No release is needed if lock == false
-func (ims *inmemService) GetJournalTags(src string, lock bool) (ts tag.Set, err error) {
+// GetOrCreateJournals creates the missing journals for tagsList under one lock, so
+// the index is persisted once. If the index could not be saved, the newly created
+// records are removed.
+func (ims *inmemService) GetOrCreateJournals(tagsList []string) (map[string]string, error) {
+	ims.stats.onCreate()
+	sets := make(map[string]tag.Set, len(tagsList))
+	for _, tags := range tagsList {
+		if _, ok := sets[tags]; ok {
+			continue
+		}
+
+		tgs, err := tag.Parse(tags)
+		if err != nil {
+			return nil, wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", tags, err)
+		}
+
+		if tgs.IsEmpty() {
+			return nil, wrapErr(ErrInvalidTags, "at least one tag value is expected to define the source")
+		}
+		sets[tags] = tgs
+	}
+
 	for {
 		ims.lock.Lock()
 		if ims.done {
 			ims.lock.Unlock()
-			return tag.EmptySet, fmt.Errorf("already shut-down.")
+			return nil, ErrShutDown
 		}
 
-		td, ok := ims.smap[src]
-		if !ok {
+		if ims.hasExclusiveUnsafe(sets) {
 			ims.lock.Unlock()
-			return tag.EmptySet, errors2.NotFound
+			ims.logger.Debug("GetOrCreateJournals(): Oops, raise with an exclusive lock")
+			time.Sleep(time.Millisecond)
+			continue
 		}
 
-		ts = td.tags
-		locked := !td.exclusive
-		if locked && lock {
+		newSets := make(map[tag.Line]tag.Set)
+		for _, tgs := range sets {
+			if ims.tmap.get(tgs.Line()) == nil {
+				newSets[tgs.Line()] = tgs
+			}
+		}
+
+		nss := make([]tag.Set, 0, len(newSets))
+		for _, tgs := range newSets {
+			nss = append(nss, tgs)
+		}
+		if len(nss) > 0 && ims.Config.ReadOnly {
+			ims.lock.Unlock()
+			return nil, errReadOnly
+		}
+		if err := ims.checkKeys(nss); err != nil {
+			ims.lock.Unlock()
+			return nil, err
+		}
+		if err := ims.checkLimitsUnsafe(nss); err != nil {
+			ims.lock.Unlock()
+			return nil, err
+		}
+
+		created := make([]*tagsDesc, 0, len(nss))
+		for _, tgs := range nss {
+			src, err := ims.newSrcUnsafe(tgs)
+			if err != nil {
+				for _, td := range created {
+					ims.removeUnsafe(td)
+				}
+				ims.lock.Unlock()
+				return nil, err
+			}
+			td := &tagsDesc{tags: tgs, Src: src}
+			ims.addUnsafe(td)
+			created = append(created, td)
+		}
+
+		tds := make(map[string]*tagsDesc, len(sets))
+		for tags, tgs := range sets {
+			tds[tags] = ims.tmap.get(tgs.Line())
+		}
+
+		if len(created) > 0 {
+			if err := ims.onChangeUnsafe(created, nil); err != nil {
+				for _, td := range created {
+					ims.removeUnsafe(td)
+				}
+				ims.logger.Error("could not save state for the new sources, count=", len(created), ", err=", err)
+				ims.lock.Unlock()
+				return nil, err
+			}
+			ims.notifyUnsafe(JE_CREATED, created...)
+			ims.checkThresholdUnsafe()
+		}
+
+		res := make(map[string]string, len(tds))
+		for tags, td := range tds {
 			td.readers++
+			res[tags] = td.Src
 		}
 		ims.lock.Unlock()
+		return res, nil
+	}
+}
+
+// hasExclusiveUnsafe returns whether any of the existing sources for sets is locked exclusively
+func (ims *inmemService) hasExclusiveUnsafe(sets map[string]tag.Set) bool {
+	for _, tgs := range sets {
+		if td := ims.tmap.get(tgs.Line()); td != nil && td.exclusive {
+			return true
+		}
+	}
+	return false
+}
+
+// GetJournalTags acquires the src and returns its Tags, if it is found. If no
+// error, and lock == true, the src must be released after usage. No release is needed if lock == false
+func (ims *inmemService) GetJournalTags(src string, lock bool) (ts tag.Set, err error) {
+	if !lock {
+		return ims.peekJournalTags(src)
+	}
+
+	for {
+		ims.lock.RLock()
+		if ims.done {
+			ims.lock.RUnlock()
+			return tag.EmptySet, ErrShutDown
+		}
+
+		td := ims.smap.load(src)
+		if td == nil {
+			ims.lock.RUnlock()
+			return tag.EmptySet, ErrNotFound
+		}
+
+		ts = td.tags
+		locked := ims.acquireShared(td)
+		ims.lock.RUnlock()
 
 		if locked {
 			break
@@ -140,7 +590,39 @@ func (ims *inmemService) GetJournalTags(src string, lock bool) (ts tag.Set, err
 	return ts, err
 }
 
+// peekJournalTags returns the src Tags without acquiring the src. Only the read
+// lock is held, so concurrent peeks don't block each other.
+func (ims *inmemService) peekJournalTags(src string) (tag.Set, error) {
+	for {
+		ims.lock.RLock()
+		if ims.done {
+			ims.lock.RUnlock()
+			return tag.EmptySet, ErrShutDown
+		}
+
+		td := ims.smap.load(src)
+		if td == nil {
+			ims.lock.RUnlock()
+			return tag.EmptySet, ErrNotFound
+		}
+
+		l := ims.lockOf(td)
+		l.Lock()
+		ts, exclusive := td.tags, td.exclusive
+		l.Unlock()
+		ims.lock.RUnlock()
+
+		if !exclusive {
+			return ts, nil
+		}
+
+		ims.logger.Debug("peekJournalTags(): Oops, raise with an exclusive lock")
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func (ims *inmemService) Visit(srcCond *lql.Source, vf VisitorF, visitFlags int) error {
+	ims.stats.onQuery()
 	tef, err := lql.BuildTagsExpFuncBySource(srcCond)
 	if err != nil {
 		return err
@@ -152,148 +634,629 @@ func (ims *inmemService) Visit(srcCond *lql.Source, vf VisitorF, visitFlags int)
 	return ims.visitWaitingIfLocked(tef, vf, visitFlags)
 }
 
-func (ims *inmemService) getOrCreateJournal(tags string, create bool) (res string, ts tag.Set, err error) {
-	for {
-		ims.lock.Lock()
-		if ims.done {
-			ims.lock.Unlock()
-			return "", tag.EmptySet, fmt.Errorf("already shut-down.")
-		}
-
-		td, ok := ims.tmap[tag.Line(tags)]
-		if !ok {
-			tgs, err := tag.Parse(tags)
-			if err != nil {
-				ims.lock.Unlock()
-				return "", tag.EmptySet, fmt.Errorf("the line %s doesn't seem like properly formatted tag line: %s", tags, err)
-			}
+// GetJournalsPage returns the page of matched tags-sources pairs, ordered by the tags line.
+// The cursor is the last tags line of the previous page.
+func (ims *inmemService) GetJournalsPage(ctx context.Context, srcCond *lql.Source, cursor string, limit int) (map[tag.Line]string, string, error) {
+	ims.stats.onQuery()
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("limit=%d must be positive", limit)
+	}
 
-			if tgs.IsEmpty() {
-				ims.lock.Unlock()
-				return "", tag.EmptySet, fmt.Errorf("at least one tag value is expected to define the source")
-			}
+	tef, err := lql.BuildTagsExpFuncBySource(srcCond)
+	if err != nil {
+		return nil, "", err
+	}
 
-			if td2, ok := ims.tmap[tgs.Line()]; !ok {
-				if !create {
-					ims.logger.Debug("getOrCreateJournal(): could not find the journal by tags=", tags, " and cration is not allowed")
-					ims.lock.Unlock()
-					return "", tag.EmptySet, errors2.NotFound
-				}
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return nil, "", ErrShutDown
+	}
 
-				td = new(tagsDesc)
-				td.tags = tgs
-				td.Src = newSrc()
-				ims.tmap[tgs.Line()] = td
-				ims.smap[td.Src] = td
-				err = ims.saveStateUnsafe()
-				if err != nil {
-					delete(ims.tmap, tgs.Line())
-					delete(ims.smap, td.Src)
-					ims.logger.Error("could not save state for the new source ", td.Src, " formed for ", tgs.Line(), ", original Tags=", tags, ", err=", err)
-					ims.lock.Unlock()
-					return "", tag.EmptySet, err
-				}
-			} else {
-				td = td2
-			}
+	// only the limit+1 smallest lines are kept, the extra one tells there is the next page
+	h := make(linesHeap, 0, limit+1)
+	i := 0
+	if !ims.tmap.forEach(func(td *tagsDesc) bool {
+		if i++; i%cCtxCheckPeriod == 0 && ctx.Err() != nil {
+			return false
 		}
 
-		res = td.Src
-		ts = td.tags
-		locked := !td.exclusive
-		if locked {
-			td.readers++
+		ln := string(td.tags.Line())
+		if ln <= cursor || (len(h) > limit && ln >= h[0]) || !tef(td.tags) {
+			return true
 		}
-		ims.lock.Unlock()
-
-		if locked {
-			break
+		heap.Push(&h, ln)
+		if len(h) > limit+1 {
+			heap.Pop(&h)
 		}
-		ims.logger.Debug("getOrCreateJournal(): Oops, raise with an exclusive lock")
-		time.Sleep(time.Millisecond)
+		return true
+	}) {
+		return nil, "", ctx.Err()
 	}
-	return res, ts, err
+	lines := []string(h)
+	sort.Strings(lines)
+
+	next := ""
+	if len(lines) > limit {
+		lines = lines[:limit]
+		next = lines[limit-1]
+	}
+
+	res := make(map[tag.Line]string, len(lines))
+	for _, ln := range lines {
+		tl := tag.Line(ln)
+		res[tl] = ims.tmap.load(tl).Src
+	}
+	return res, next, nil
 }
 
-func (ims *inmemService) visitSkippingIfLocked(tef lql.TagsExpFunc, vf VisitorF, visitFlags int) error {
-	ims.lock.Lock()
+func (h linesHeap) Len() int           { return len(h) }
+func (h linesHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h linesHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *linesHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *linesHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// ForEach is the part of Service interface. The tags lines are copied and sorted
+// once, and the sources are read under the lock by batches of cForEachBatchSize.
+// The records removed during the scan are skipped.
+func (ims *inmemService) ForEach(ctx context.Context, fn func(tag.Line, string) error) error {
+	ims.stats.onQuery()
+	ims.lock.RLock()
 	if ims.done {
-		ims.lock.Unlock()
-		return fmt.Errorf("already shut-down.")
+		ims.lock.RUnlock()
+		return ErrShutDown
 	}
+	lines := make([]string, 0, ims.tmap.len())
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		lines = append(lines, string(td.tags.Line()))
+		return true
+	})
+	ims.lock.RUnlock()
+	sort.Strings(lines)
 
-	vstd := make([]*tagsDesc, 0, 100)
-	for _, td := range ims.tmap {
-		if tef(td.tags) {
-			if !td.exclusive {
-				td.readers++
-				vstd = append(vstd, td)
+	type entry struct {
+		tl  tag.Line
+		src string
+	}
+	batch := make([]entry, 0, cForEachBatchSize)
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > cForEachBatchSize {
+			n = cForEachBatchSize
+		}
+
+		batch = batch[:0]
+		ims.lock.RLock()
+		if ims.done {
+			ims.lock.RUnlock()
+			return ErrShutDown
+		}
+		for _, ln := range lines[:n] {
+			tl := tag.Line(ln)
+			if td := ims.tmap.load(tl); td != nil {
+				batch = append(batch, entry{tl, td.Src})
 			}
 		}
-	}
-	ims.lock.Unlock()
+		ims.lock.RUnlock()
+		lines = lines[n:]
 
-	startIdx := 0
-	for i, v := range vstd {
-		startIdx = i + 1
-		if !vf(v.tags, v.Src) {
-			break
+		for _, e := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(e.tl, e.src); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	if visitFlags&VF_DO_NOT_RELEASE == 0 {
-		startIdx = 0
+// CountJournals returns the number of index records matched to srcCond
+func (ims *inmemService) CountJournals(ctx context.Context, srcCond *lql.Source) (int, error) {
+	ims.stats.onQuery()
+	tef, err := lql.BuildTagsExpFuncBySource(srcCond)
+	if err != nil {
+		return 0, err
 	}
 
-	ims.lock.Lock()
-	for i := startIdx; i < len(vstd); i++ {
-		vstd[i].readers--
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return 0, ErrShutDown
 	}
-	ims.lock.Unlock()
 
-	return nil
+	cnt, i := 0, 0
+	if !ims.tmap.forEach(func(td *tagsDesc) bool {
+		if i++; i%cCtxCheckPeriod == 0 && ctx.Err() != nil {
+			return false
+		}
+
+		if tef(td.tags) {
+			cnt++
+		}
+		return true
+	}) {
+		return 0, ctx.Err()
+	}
+	return cnt, nil
 }
 
-func (ims *inmemService) visitWaitingIfLocked(tef lql.TagsExpFunc, vf VisitorF, visitFlags int) error {
-	ims.lock.Lock()
+// GetJournalsWithTags is the part of Service interface
+func (ims *inmemService) GetJournalsWithTags(ctx context.Context, srcCond *lql.Source) ([]JournalTags, error) {
+	ims.stats.onQuery()
+	tef, err := lql.BuildTagsExpFuncBySource(srcCond)
+	if err != nil {
+		return nil, err
+	}
+
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
 	if ims.done {
-		ims.lock.Unlock()
-		return fmt.Errorf("already shut-down.")
+		return nil, ErrShutDown
 	}
 
-	vstd := make([]*tagsDesc, 0, 100)
-	for _, td := range ims.tmap {
+	var tds []*tagsDesc
+	i := 0
+	if !ims.tmap.forEach(func(td *tagsDesc) bool {
+		if i++; i%cCtxCheckPeriod == 0 && ctx.Err() != nil {
+			return false
+		}
+
 		if tef(td.tags) {
-			if !td.exclusive {
-				vstd = append(vstd, td)
-			}
+			tds = append(tds, td)
 		}
+		return true
+	}) {
+		return nil, ctx.Err()
 	}
-	ims.lock.Unlock()
 
-	maxIdx := -1
-L1:
-	for i, v := range vstd {
-		skip := true
-		for skip {
-			ims.lock.Lock()
-			if ims.done {
-				ims.lock.Unlock()
-				ims.logger.Warn("visitWaitingIfLocked Oops, the component was closed.")
-				return errors2.WrongState
-			}
+	sortTagsDescs(tds)
+	res := make([]JournalTags, len(tds))
+	for i, td := range tds {
+		res[i] = JournalTags{Tags: td.tags, Src: td.Src}
+	}
+	return res, nil
+}
 
-			if _, ok := ims.smap[v.Src]; !ok {
-				ims.logger.Debug("the partition ", v.Src, ", seems to be removed while visiting. SKipping it.")
-				ims.lock.Unlock()
-				vstd[i] = nil
-				continue L1
+// List is the part of Service interface
+func (ims *inmemService) List() ([]JournalInfo, error) {
+	ims.stats.onQuery()
+	ims.lock.RLock()
+	if ims.done {
+		ims.lock.RUnlock()
+		return nil, ErrShutDown
+	}
+	tds := make([]*tagsDesc, 0, ims.tmap.len())
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		tds = append(tds, td)
+		return true
+	})
+	ims.lock.RUnlock()
+
+	// the records are not changed, so they are read without the lock
+	sortTagsDescs(tds)
+	res := make([]JournalInfo, len(tds))
+	for i, td := range tds {
+		vals := make(map[string]string)
+		for _, k := range td.tags.Keys() {
+			vals[k] = td.tags.Tag(k)
+		}
+		res[i] = JournalInfo{Tags: string(td.tags.Line()), Src: td.Src, Values: vals}
+	}
+	return res, nil
+}
+
+// GetJournalsByTagKey returns the tags-source pairs of the records, which have
+// the tag key, regardless of its value. The sources are not acquired.
+func (ims *inmemService) GetJournalsByTagKey(key string) (map[tag.Line]string, error) {
+	ims.stats.onQuery()
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return nil, ErrShutDown
+	}
+
+	// the lines are copied first, the tmap buckets could not be locked holding idxLock
+	ims.idxLock.Lock()
+	lines := make([]tag.Line, 0, len(ims.kidx[key]))
+	for ln := range ims.kidx[key] {
+		lines = append(lines, ln)
+	}
+	ims.idxLock.Unlock()
+
+	res := make(map[tag.Line]string, len(lines))
+	for _, ln := range lines {
+		res[ln] = ims.tmap.load(ln).Src
+	}
+	return res, nil
+}
+
+// ResolveSources is the part of Service interface
+func (ims *inmemService) ResolveSources(lines []tag.Line) (map[tag.Line]string, error) {
+	ims.stats.onQuery()
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return nil, ErrShutDown
+	}
+
+	res := make(map[tag.Line]string, len(lines))
+	var missing []tag.Line
+	for _, ln := range lines {
+		if td := ims.tmap.load(ln); td != nil {
+			res[ln] = td.Src
+		} else {
+			missing = append(missing, ln)
+		}
+	}
+	if len(missing) > 0 {
+		return res, wrapErr(ErrNotFound, "%d of %d tags lines are not in the index: %v", len(missing), len(lines), missing)
+	}
+	return res, nil
+}
+
+// HealthCheck is the part of Service interface
+func (ims *inmemService) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ims.lock.RLock()
+	done, saveErr := ims.done, ims.saveErr
+	ims.lock.RUnlock()
+	if done {
+		return ErrShutDown
+	}
+	if saveErr != nil {
+		return errors.Wrapf(saveErr, "the last attempt to save the index failed")
+	}
+
+	if ims.Config.DoNotSave || ims.Config.ReadOnly || ims.Config.Storage != nil {
+		return nil
+	}
+	return checkWritable(ims.Config.WorkingDir)
+}
+
+// checkWritable returns an error, if the file could not be created in the dir
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, "tindex.health")
+	if err != nil {
+		return errors.Wrapf(err, "the working dir %s is not writable", dir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// GetStats returns the index statistics
+func (ims *inmemService) GetStats() *Stats {
+	ims.lock.RLock()
+	ims.idxLock.Lock()
+	jCnt, dirty := ims.tmap.len(), ims.dirty
+	ims.idxLock.Unlock()
+	ims.lock.RUnlock()
+	return ims.stats.get(jCnt, dirty)
+}
+
+// getOrCreateJournal returns the source for the tags line. If the parsed tags
+// set is not nil, the tags line is not parsed, set is used instead.
+func (ims *inmemService) getOrCreateJournal(tags string, set *tag.Set, create bool) (res string, ts tag.Set, err error) {
+	for {
+		// the existing records are acquired holding the read lock only
+		ims.lock.RLock()
+		if td, ok := ims.lookupUnsafe(tags); ok && !ims.done {
+			res, ts = td.Src, td.tags
+			locked := ims.acquireShared(td)
+			ims.lock.RUnlock()
+			if locked {
+				return res, ts, nil
+			}
+			ims.logger.Debug("getOrCreateJournal(): Oops, raise with an exclusive lock")
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		ims.lock.RUnlock()
+
+		if create && ims.addsConcurrently() {
+			td, locked, err := ims.addConcurrently(tags, set)
+			if err != nil {
+				return "", tag.EmptySet, err
 			}
-			skip = v.exclusive
-			if !skip {
-				v.readers++
+			if locked {
+				return td.Src, td.tags, nil
 			}
+			ims.logger.Debug("getOrCreateJournal(): Oops, raise with an exclusive lock")
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		ims.lock.Lock()
+		if ims.done {
 			ims.lock.Unlock()
+			return "", tag.EmptySet, ErrShutDown
+		}
+
+		td, ok := ims.lookupUnsafe(tags)
+		if !ok {
+			tgs, err := parseTags(tags, set)
+			if err != nil {
+				ims.lock.Unlock()
+				return "", tag.EmptySet, err
+			}
+			ims.cacheLineUnsafe(tags, tgs.Line())
+
+			if td2 := ims.tmap.get(tgs.Line()); td2 == nil {
+				if !create {
+					ims.logger.Debug("getOrCreateJournal(): could not find the journal, and creation is not allowed, tags=", tags)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, ErrNotFound
+				}
+
+				if ims.Config.ReadOnly {
+					ims.logger.Debug("getOrCreateJournal(): could not create new source, the index is read-only, tags=", tags)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, errReadOnly
+				}
+
+				if err = ims.checkKeys([]tag.Set{tgs}); err != nil {
+					ims.logger.Warn("getOrCreateJournal(): could not create new source, tags=", tags, ", err=", err)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, err
+				}
+
+				if err = ims.checkLimitsUnsafe([]tag.Set{tgs}); err != nil {
+					ims.logger.Warn("getOrCreateJournal(): could not create new source, tags=", tags, ", err=", err)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, err
+				}
+
+				src, err := ims.newSrcUnsafe(tgs)
+				if err != nil {
+					ims.logger.Error("getOrCreateJournal(): could not create new source, tags=", tgs.Line(), ", err=", err)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, err
+				}
+
+				td = new(tagsDesc)
+				td.tags = tgs
+				td.Src = src
+				ims.addUnsafe(td)
+				err = ims.onChangeUnsafe([]*tagsDesc{td}, nil)
+				if err != nil {
+					ims.removeUnsafe(td)
+					ims.logger.Error("could not save state for the new source, src=", td.Src, ", tags=", tgs.Line(), ", origTags=", tags, ", err=", err)
+					ims.lock.Unlock()
+					return "", tag.EmptySet, err
+				}
+				ims.notifyUnsafe(JE_CREATED, td)
+				ims.checkThresholdUnsafe()
+			} else {
+				td = td2
+			}
+		}
+
+		res = td.Src
+		ts = td.tags
+		locked := !td.exclusive
+		if locked {
+			td.readers++
+		}
+		ims.lock.Unlock()
+
+		if locked {
+			break
+		}
+		ims.logger.Debug("getOrCreateJournal(): Oops, raise with an exclusive lock")
+		time.Sleep(time.Millisecond)
+	}
+	return res, ts, err
+}
+
+// parseTags returns the tags set for the tags line. If the parsed set is not nil,
+// it is returned instead.
+func parseTags(tags string, set *tag.Set) (tag.Set, error) {
+	var tgs tag.Set
+	if set != nil {
+		tgs = *set
+	} else {
+		var err error
+		if tgs, err = tag.Parse(tags); err != nil {
+			return tag.EmptySet, wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", tags, err)
+		}
+	}
+
+	if tgs.IsEmpty() {
+		return tag.EmptySet, wrapErr(ErrInvalidTags, "at least one tag value is expected to define the source")
+	}
+	return tgs, nil
+}
+
+// addsConcurrently returns whether the new records could be added by addConcurrently.
+// It is so, if the changes are not persisted by the adding call, but they are
+// either saved by the flusher later, or never saved.
+func (ims *inmemService) addsConcurrently() bool {
+	return !ims.Config.ReadOnly && !ims.isWalUsed() && (ims.Config.FlushIntervalMs > 0 || ims.Config.DoNotSave)
+}
+
+// addConcurrently returns the record for the tags line, the record is added, if
+// it doesn't exist. Only the tmap bucket of the line is locked for the call, with
+// the lock held for read, so the records of the other buckets could be added or
+// acquired concurrently. The index-wide limits are checked, and the index-wide
+// fields are changed with idxLock held. The record is acquired, if locked is true.
+func (ims *inmemService) addConcurrently(tags string, set *tag.Set) (td *tagsDesc, locked bool, err error) {
+	tgs, err := parseTags(tags, set)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return nil, false, ErrShutDown
+	}
+
+	ln := tgs.Line()
+	b := ims.tmap.bucket(ln)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ims.idxLock.Lock()
+	defer ims.idxLock.Unlock()
+	ims.cacheLineUnsafe(tags, ln)
+
+	if td = b.recs[ln]; td == nil {
+		if err = ims.checkKeys([]tag.Set{tgs}); err != nil {
+			ims.logger.Warn("addConcurrently(): could not create new source, tags=", tags, ", err=", err)
+			return nil, false, err
+		}
+
+		if err = ims.checkLimitsUnsafe([]tag.Set{tgs}); err != nil {
+			ims.logger.Warn("addConcurrently(): could not create new source, tags=", tags, ", err=", err)
+			return nil, false, err
+		}
+
+		src, err := ims.newSrcUnsafe(tgs)
+		if err != nil {
+			ims.logger.Error("addConcurrently(): could not create new source, tags=", ln, ", err=", err)
+			return nil, false, err
+		}
+
+		td = &tagsDesc{tags: tgs, Src: src}
+		ims.addUnsafe(td)
+		// the same as onChangeUnsafe does, when the changes are saved by the flusher
+		if ims.Config.FlushIntervalMs > 0 {
+			ims.dirty = true
+		}
+		ims.notifyUnsafe(JE_CREATED, td)
+		ims.checkThresholdUnsafe()
+	}
+
+	if td.exclusive {
+		return td, false, nil
+	}
+	td.readers++
+	return td, true, nil
+}
+
+// lookupUnsafe returns the record for the tags line, which could be not normalized.
+// The lock must be held at least for read.
+func (ims *inmemService) lookupUnsafe(tags string) (*tagsDesc, bool) {
+	if td := ims.tmap.load(tag.Line(tags)); td != nil {
+		return td, true
+	}
+
+	ims.idxLock.Lock()
+	ln, ok := ims.lcache[tags]
+	ims.idxLock.Unlock()
+	if ok {
+		td := ims.tmap.load(ln)
+		return td, td != nil
+	}
+	return nil, false
+}
+
+// cacheLineUnsafe stores the normalized line ln for the raw tags line, if they are different
+func (ims *inmemService) cacheLineUnsafe(tags string, ln tag.Line) {
+	if tag.Line(tags) == ln {
+		return
+	}
+
+	if len(ims.lcache) >= cLineCacheSize {
+		ims.lcache = make(map[string]tag.Line)
+	}
+	ims.lcache[tags] = ln
+}
+
+func (ims *inmemService) visitSkippingIfLocked(tef lql.TagsExpFunc, vf VisitorF, visitFlags int) error {
+	ims.lock.Lock()
+	if ims.done {
+		ims.lock.Unlock()
+		return ErrShutDown
+	}
+
+	vstd := make([]*tagsDesc, 0, 100)
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		if tef(td.tags) {
+			if !td.exclusive {
+				td.readers++
+				vstd = append(vstd, td)
+			}
+		}
+		return true
+	})
+	ims.lock.Unlock()
+	sortTagsDescs(vstd)
+
+	startIdx := 0
+	for i, v := range vstd {
+		startIdx = i + 1
+		if !vf(v.tags, v.Src) {
+			break
+		}
+	}
+
+	if visitFlags&VF_DO_NOT_RELEASE == 0 {
+		startIdx = 0
+	}
+
+	ims.lock.Lock()
+	for i := startIdx; i < len(vstd); i++ {
+		vstd[i].readers--
+	}
+	ims.lock.Unlock()
+
+	return nil
+}
+
+func (ims *inmemService) visitWaitingIfLocked(tef lql.TagsExpFunc, vf VisitorF, visitFlags int) error {
+	// the candidates are collected under the read lock, the index is not modified here
+	ims.lock.RLock()
+	if ims.done {
+		ims.lock.RUnlock()
+		return ErrShutDown
+	}
+
+	vstd := make([]*tagsDesc, 0, 100)
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		if tef(td.tags) && !td.exclusive {
+			vstd = append(vstd, td)
+		}
+		return true
+	})
+	ims.lock.RUnlock()
+	sortTagsDescs(vstd)
+
+	maxIdx := -1
+L1:
+	for i, v := range vstd {
+		skip := true
+		for skip {
+			ims.lock.RLock()
+			if ims.done {
+				ims.lock.RUnlock()
+				ims.logger.Warn("visitWaitingIfLocked Oops, the component was closed.")
+				return errors2.WrongState
+			}
+
+			if ims.smap.load(v.Src) != v {
+				ims.logger.Debug("the partition seems to be removed or retagged while visiting, skipping it, src=", v.Src)
+				ims.lock.RUnlock()
+				vstd[i] = nil
+				continue L1
+			}
+			skip = !ims.acquireShared(v)
+			ims.lock.RUnlock()
 
 			if skip {
 				// Crap. We do this stupid thing here, just because it has to happen extremely rear,
@@ -312,22 +1275,29 @@ L1:
 		}
 	}
 
-	ims.lock.Lock()
+	ims.lock.RLock()
 	for i := 0; i <= maxIdx; i++ {
 		v := vstd[i]
 		if v != nil {
+			l := ims.lockOf(v)
+			l.Lock()
 			v.readers--
+			l.Unlock()
 		}
 	}
-	ims.lock.Unlock()
+	ims.lock.RUnlock()
 
 	return nil
 }
 
 // Release allows to release the partition name which could be acquired by GetOrCreateJournal
 func (ims *inmemService) Release(jn string) {
-	ims.lock.Lock()
-	if td, ok := ims.smap[string(jn)]; ok {
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if td := ims.smap.load(jn); td != nil {
+		l := ims.lockOf(td)
+		l.Lock()
+		defer l.Unlock()
 		if td.exclusive {
 			panic("Could not release the lock, which was locked exclusively " + td.String())
 		} else if td.readers <= 0 {
@@ -336,14 +1306,41 @@ func (ims *inmemService) Release(jn string) {
 			td.readers--
 		}
 	}
-	ims.lock.Unlock()
+}
+
+// lockOf returns the lock of the tmap bucket, which contains td
+func (ims *inmemService) lockOf(td *tagsDesc) *sync.Mutex {
+	return &ims.tmap.bucket(td.tags.Line()).lock
+}
+
+// lineHash returns FNV-1a hash of the tags line ln
+func lineHash(ln tag.Line) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(ln); i++ {
+		h ^= uint32(ln[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// acquireShared increases the td readers, if td is not locked exclusively. It
+// returns whether td is acquired. The ims.lock must be held at least for read.
+func (ims *inmemService) acquireShared(td *tagsDesc) bool {
+	l := ims.lockOf(td)
+	l.Lock()
+	res := !td.exclusive
+	if res {
+		td.readers++
+	}
+	l.Unlock()
+	return res
 }
 
 func (ims *inmemService) LockExclusively(jn string) bool {
 	ims.lock.Lock()
-	td, ok := ims.smap[jn]
+	td := ims.smap.load(jn)
 	res := false
-	if ok {
+	if td != nil {
 		if !td.exclusive && td.readers == 1 {
 			td.exclusive = true
 			res = true
@@ -355,7 +1352,7 @@ func (ims *inmemService) LockExclusively(jn string) bool {
 
 func (ims *inmemService) UnlockExclusively(jn string) {
 	ims.lock.Lock()
-	if td, ok := ims.smap[string(jn)]; ok {
+	if td := ims.smap.load(jn); td != nil {
 		if !td.exclusive || td.readers != 1 {
 			panic("Could not UnlockExclusively the lock, which was not locked exclusively " + td.String())
 		} else {
@@ -369,125 +1366,932 @@ func (ims *inmemService) UnlockExclusively(jn string) {
 // is returned, the jn must be released via Release method anyway
 func (ims *inmemService) Delete(jn string) error {
 	ims.lock.Lock()
-	err := errors2.NotFound
-	if td, ok := ims.smap[jn]; ok {
+	err := ErrNotFound
+	if td := ims.smap.load(jn); td != nil && ims.Config.ReadOnly {
+		err = errReadOnly
+	} else if td != nil {
 		err = errors2.WrongState
 		if td.exclusive {
-			delete(ims.tmap, td.tags.Line())
-			delete(ims.smap, td.Src)
+			ims.removeUnsafe(td)
 			err = nil
-			ims.saveStateUnsafe()
+			ims.onChangeUnsafe(nil, []*tagsDesc{td})
+			ims.notifyUnsafe(JE_DELETED, td)
+			ims.checkThresholdUnsafe()
 		}
 	}
 	ims.lock.Unlock()
 	return err
 }
 
-func (ims *inmemService) saveStateUnsafe() error {
-	ims.logger.Debug("saveStateUnsafe()")
-	if ims.Config.DoNotSave {
-		ims.logger.Warn("will not save config, cause DoNotSave flag is set.")
-		return nil
+// DeleteJournal removes the tags record from the index. The source must not be
+// acquired at the moment of the call.
+func (ims *inmemService) DeleteJournal(tags string) error {
+	tgs, err := tag.Parse(tags)
+	if err != nil {
+		return wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", tags, err)
 	}
 
-	fn := path.Join(ims.Config.WorkingDir, cIdxFileName)
-	_, err := os.Stat(fn)
-	var bFn string
-	if !os.IsNotExist(err) {
-		bFn = path.Join(ims.Config.WorkingDir, cIdxBackupFileName)
-		err = os.Rename(fn, bFn)
-	} else {
-		err = nil
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
+
+	if ims.done {
+		return ErrShutDown
 	}
 
-	if err != nil {
-		return errors.Wrapf(err, "could not rename file %s to %s", fn, bFn)
+	if ims.Config.ReadOnly {
+		return errReadOnly
 	}
 
-	data, err := json.Marshal(ims.tmap)
-	if err != nil {
-		return errors.Wrapf(err, "could not marshal tmap ")
+	td := ims.tmap.get(tgs.Line())
+	if td == nil {
+		return ErrNotFound
 	}
 
-	if err = ioutil.WriteFile(fn, data, 0640); err != nil {
-		return errors.Wrapf(err, "could not write file %s ", fn)
+	if td.exclusive || td.readers > 0 {
+		ims.logger.Warn("DeleteJournal(): could not delete the acquired source, src=", td.Src, ", tags=", td.tags.Line())
+		return errors2.WrongState
 	}
 
+	ims.removeUnsafe(td)
+	if err = ims.onChangeUnsafe(nil, []*tagsDesc{td}); err != nil {
+		ims.addUnsafe(td)
+		return err
+	}
+	ims.notifyUnsafe(JE_DELETED, td)
+	ims.checkThresholdUnsafe()
+	ims.logger.Info("DeleteJournal(): the source is removed from the index, src=", td.Src, ", tags=", td.tags.Line())
 	return nil
 }
 
-func (ims *inmemService) checkConsistency(ctx context.Context) error {
-	if !ims.Config.DoNotSave {
-		err := fileutil.EnsureDirExists(ims.Config.WorkingDir)
-		if err != nil {
-			return errors.Wrapf(err, "checkConsistency(): could not be ensure the dir %s exists", ims.Config.WorkingDir)
-		}
+// RetagJournal is the part of Service interface. The AllowedKeys, RequiredKeys and
+// MaxTagValues are checked for the new tags line.
+func (ims *inmemService) RetagJournal(oldTags, newTags string) error {
+	otgs, err := tag.Parse(oldTags)
+	if err != nil {
+		return wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", oldTags, err)
 	}
-
-	err := ims.loadState()
+	ntgs, err := tag.Parse(newTags)
 	if err != nil {
-		return err
+		return wrapErr(ErrInvalidTags, "the line %s doesn't seem like properly formatted tag line: %s", newTags, err)
 	}
-
-	ims.logger.Info("Checking the index and data consistency")
-	fail := false
-	km := make(map[string]string, len(ims.tmap))
-	for _, d := range ims.tmap {
-		km[d.Src] = d.Src
+	if ntgs.IsEmpty() {
+		return wrapErr(ErrInvalidTags, "at least one tag value is expected to define the source")
 	}
 
-	jCnt := 0
-	ims.Journals.Visit(ctx, func(j journal.Journal) bool {
-		jCnt++
-		if _, ok := km[j.Name()]; !ok {
-			ims.logger.Error("found partition ", j.Name(), ", but it is not in the tindex")
-			fail = true
-		} else {
-			delete(km, j.Name())
-		}
-		return true
-	})
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
 
-	if len(km) > 0 {
-		ims.logger.Warn("tindex contains ", len(km), " records, which don't have corresponding journals")
+	if ims.done {
+		return ErrShutDown
 	}
 
-	if fail {
-		ims.logger.Error("Consistency check failed. ", jCnt, " sources found and ", len(ims.tmap), " records in tindex")
-		return errors.Errorf("data is inconsistent. %d journals and %d tindex records found. Some journals don't have records in the tindex", jCnt, len(ims.tmap))
+	if ims.Config.ReadOnly {
+		return errReadOnly
 	}
-	ims.logger.Info("Consistency check passed. ", jCnt, " sources found and all of them have correct tindex record. ",
-		len(ims.tmap), " index records in total.")
-	return ims.saveStateUnsafe()
-}
 
-func (ims *inmemService) loadState() error {
-	fn := path.Join(ims.Config.WorkingDir, cIdxFileName)
-	_, err := os.Stat(fn)
-	if os.IsNotExist(err) {
-		ims.logger.Warn("loadState() file not found ", fn)
+	td := ims.tmap.get(otgs.Line())
+	if td == nil {
+		return ErrNotFound
+	}
+	if otgs.Line() == ntgs.Line() {
 		return nil
 	}
-	ims.logger.Debug("loadState() from ", fn)
+	if td2 := ims.tmap.get(ntgs.Line()); td2 != nil {
+		return wrapErr(ErrAlreadyExists, "could not move the source %s to %s, the line belongs to the source %s", td.Src, ntgs.Line(), td2.Src)
+	}
+	if td.exclusive || td.readers > 0 {
+		ims.logger.Warn("RetagJournal(): could not retag the acquired source, src=", td.Src, ", tags=", td.tags.Line())
+		return errors2.WrongState
+	}
+	if err = ims.checkKeys([]tag.Set{ntgs}); err != nil {
+		return err
+	}
+
+	// the record is replaced by the new one, the tags of the record, which could be
+	// read without the lock, are never changed. The old record is removed before the
+	// limits are checked, so its tags values are not counted
+	ntd := &tagsDesc{tags: ntgs, Src: td.Src}
+	ims.removeUnsafe(td)
+	if err = ims.checkLimitsUnsafe([]tag.Set{ntgs}); err == nil {
+		ims.addUnsafe(ntd)
+		if err = ims.onChangeUnsafe([]*tagsDesc{ntd}, []*tagsDesc{td}); err != nil {
+			ims.removeUnsafe(ntd)
+		}
+	}
+	if err != nil {
+		ims.addUnsafe(td)
+		return err
+	}
+
+	ims.notifyUnsafe(JE_DELETED, td)
+	ims.notifyUnsafe(JE_CREATED, ntd)
+	ims.logger.Info("RetagJournal(): the source is moved, src=", td.Src, ", from=", td.tags.Line(), ", to=", ntgs.Line())
+	return nil
+}
+
+// DropOrphans is the part of Service interface
+func (ims *inmemService) DropOrphans(ctx context.Context) (int, error) {
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
+	if ims.done {
+		return 0, ErrShutDown
+	}
+	if ims.Config.ReadOnly {
+		return 0, errReadOnly
+	}
+	return ims.dropOrphansUnsafe(ctx)
+}
 
-	data, err := ioutil.ReadFile(fn)
+func (ims *inmemService) dropOrphansUnsafe(ctx context.Context) (int, error) {
+	cr, err := ims.checkConsistencyUnsafe(ctx)
 	if err != nil {
-		return errors.Wrapf(err, "cound not load index file %s. Wrong permissions?", fn)
+		return 0, err
+	}
+
+	tds := make([]*tagsDesc, 0, len(cr.Orphans))
+	for _, ln := range cr.Orphans {
+		td := ims.tmap.get(ln)
+		if td.exclusive || td.readers > 0 {
+			ims.logger.Warn("DropOrphans(): skipping the acquired source, src=", td.Src, ", tags=", td.tags.Line())
+			continue
+		}
+		ims.removeUnsafe(td)
+		tds = append(tds, td)
+	}
+
+	if len(tds) == 0 {
+		return 0, nil
+	}
+
+	if err = ims.onChangeUnsafe(nil, tds); err != nil {
+		for _, td := range tds {
+			ims.addUnsafe(td)
+		}
+		return 0, err
+	}
+	ims.notifyUnsafe(JE_DELETED, tds...)
+	ims.checkThresholdUnsafe()
+	ims.logger.Info("DropOrphans(): the records without journals are removed from the index, count=", len(tds))
+	return len(tds), nil
+}
+
+// newSrcUnsafe returns the source id for the new record with the tags. The id is
+// either unique, or the hash of the tags line, if InMemConfig.DeterministicSrc is set,
+// or the one returned by InMemConfig.SrcGenerator. errSrcCollision is returned, if
+// the hash or the generated id is the id of another record already.
+func (ims *inmemService) newSrcUnsafe(tags tag.Set) (string, error) {
+	var src string
+	switch {
+	case ims.Config.SrcGenerator != nil:
+		var err error
+		if src, err = ims.Config.SrcGenerator(tags); err != nil {
+			return "", errors.Wrapf(err, "SrcGenerator could not generate the source id for tags=%s", tags.Line())
+		}
+		if err = checkSrc(src); err != nil {
+			return "", errors.Wrapf(err, "SrcGenerator returned invalid source id for tags=%s", tags.Line())
+		}
+	case ims.Config.DeterministicSrc:
+		src = hashSrc(tags.Line())
+	default:
+		return newSrc(), nil
+	}
+
+	if td := ims.smap.load(src); td != nil {
+		return "", wrapErr(errSrcCollision, "src=%s, tags=%s, taken by tags=%s", src, tags.Line(), td.tags.Line())
+	}
+	return src, nil
+}
+
+// addUnsafe adds td to the index maps. If the lock is held for read only, the
+// td tmap bucket and idxLock must be locked.
+func (ims *inmemService) addUnsafe(td *tagsDesc) {
+	ln := td.tags.Line()
+	ims.tmap.put(td)
+	ims.smap.store(td)
+
+	if ims.kidx == nil {
+		ims.kidx = make(map[string]map[tag.Line]struct{})
+	}
+	for _, k := range td.tags.Keys() {
+		lines, ok := ims.kidx[k]
+		if !ok {
+			lines = make(map[tag.Line]struct{})
+			ims.kidx[k] = lines
+		}
+		lines[ln] = struct{}{}
 	}
 
-	err = json.Unmarshal(data, &ims.tmap)
+	if ims.Config.MaxTagValues > 0 {
+		if ims.kvals == nil {
+			ims.kvals = make(map[string]map[string]int)
+		}
+		for _, k := range td.tags.Keys() {
+			vals, ok := ims.kvals[k]
+			if !ok {
+				vals = make(map[string]int)
+				ims.kvals[k] = vals
+			}
+			vals[td.tags.Tag(k)]++
+		}
+	}
+}
+
+// removeUnsafe removes td from the index maps
+func (ims *inmemService) removeUnsafe(td *tagsDesc) {
+	ln := td.tags.Line()
+	ims.tmap.remove(ln)
+	ims.smap.remove(td.Src)
+
+	for _, k := range td.tags.Keys() {
+		if lines, ok := ims.kidx[k]; ok {
+			delete(lines, ln)
+			if len(lines) == 0 {
+				delete(ims.kidx, k)
+			}
+		}
+
+		vals, ok := ims.kvals[k]
+		if !ok {
+			continue
+		}
+		v := td.tags.Tag(k)
+		if vals[v] <= 1 {
+			delete(vals, v)
+		} else {
+			vals[v]--
+		}
+		if len(vals) == 0 {
+			delete(ims.kvals, k)
+		}
+	}
+}
+
+// checkKeys returns an error if the new records for sets could not be added to
+// the index, because their tag keys are not in the InMemConfig.AllowedKeys, or
+// because they don't have the InMemConfig.RequiredKeys
+func (ims *inmemService) checkKeys(sets []tag.Set) error {
+	for _, ts := range sets {
+		if ims.allowedKeys != nil {
+			for _, k := range ts.Keys() {
+				if _, ok := ims.allowedKeys[k]; !ok {
+					return wrapErr(ErrInvalidTags, "could not add the source for %s, the tag key %q is not in AllowedKeys=%v", ts.Line(), k, ims.Config.AllowedKeys)
+				}
+			}
+		}
+
+		var missing []string
+		for _, k := range ims.Config.RequiredKeys {
+			if ts.Tag(k) == "" {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) > 0 {
+			return wrapErr(ErrInvalidTags, "could not add the source for %s, the required tag keys %v are missing, RequiredKeys=%v", ts.Line(), missing, ims.Config.RequiredKeys)
+		}
+	}
+	return nil
+}
+
+// checkLimitsUnsafe returns an error if the new records for sets could not be added
+// to the index because of MaxJournals or MaxTagValues limits.
+func (ims *inmemService) checkLimitsUnsafe(sets []tag.Set) error {
+	if mj := ims.Config.MaxJournals; mj > 0 && ims.tmap.len()+len(sets) > mj {
+		return wrapErr(ErrCapacityExceeded, "could not add %d new source(s), the index has %d records and the limit is MaxJournals=%d", len(sets), ims.tmap.len(), mj)
+	}
+
+	mv := ims.Config.MaxTagValues
+	if mv <= 0 {
+		return nil
+	}
+
+	nvals := make(map[string]map[string]bool)
+	for _, ts := range sets {
+		for _, k := range ts.Keys() {
+			v := ts.Tag(k)
+			if _, ok := ims.kvals[k][v]; ok {
+				continue
+			}
+
+			nv, ok := nvals[k]
+			if !ok {
+				nv = make(map[string]bool)
+				nvals[k] = nv
+			}
+			nv[v] = true
+			if len(ims.kvals[k])+len(nv) > mv {
+				return wrapErr(ErrCapacityExceeded, "could not add the source for %s, the tag %q would have more than MaxTagValues=%d values", ts.Line(), k, mv)
+			}
+		}
+	}
+	return nil
+}
+
+// checkThresholdUnsafe must be called when the records are added or removed. It
+// reports the number of records, which reached InMemConfig.WarnJournalsThreshold,
+// once per crossing: the threshold is reported again only after the number of
+// records falls below it.
+func (ims *inmemService) checkThresholdUnsafe() {
+	wt := ims.Config.WarnJournalsThreshold
+	if wt <= 0 {
+		return
+	}
+	if ims.tmap.len() < wt {
+		ims.overThreshold = false
+		return
+	}
+	if !ims.overThreshold {
+		ims.overThreshold = true
+		ims.stats.onThresholdWarning()
+		ims.logger.Warn("The index has ", ims.tmap.len(), " records, it reached WarnJournalsThreshold=", wt,
+			", MaxJournals=", ims.Config.MaxJournals)
+	}
+}
+
+// onChangeUnsafe must be called when the index is modified, created and deleted
+// contain the records added and removed. It either appends the changes to the
+// WAL, saves the state immediately or marks it dirty to be saved by the flusher later.
+func (ims *inmemService) onChangeUnsafe(created, deleted []*tagsDesc) error {
+	if ims.isWalUsed() {
+		return ims.appendWalUnsafe(created, deleted)
+	}
+	if ims.Config.FlushIntervalMs > 0 {
+		ims.dirty = true
+		return nil
+	}
+	return ims.saveStateUnsafe()
+}
+
+func (ims *inmemService) runFlusher(stopCh chan struct{}) {
+	ims.logger.Info("Running flusher, intervalMs=", ims.Config.FlushIntervalMs)
+	ticker := ims.clock.NewTicker(time.Duration(ims.Config.FlushIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			ims.logger.Info("Flusher stopped")
+			return
+		case <-ticker.C():
+			ims.lock.Lock()
+			ims.flushUnsafe()
+			ims.lock.Unlock()
+		}
+	}
+}
+
+// flushUnsafe saves the state if it is dirty, or if the WAL is not empty
+func (ims *inmemService) flushUnsafe() {
+	if !ims.dirty && ims.walRecs == 0 && !ims.walReset {
+		return
+	}
+
+	if err := ims.saveStateUnsafe(); err != nil {
+		ims.logger.Error("could not flush the index, will try later, err=", err)
+	}
+}
+
+func (ims *inmemService) saveStateUnsafe() error {
+	ims.logger.Debug("saveStateUnsafe()")
+	if ims.Config.DoNotSave || ims.Config.ReadOnly {
+		ims.logger.Warn("will not save config, cause DoNotSave or ReadOnly flag is set.")
+		ims.dirty = false
+		return nil
+	}
+
+	start := ims.clock.Now()
+	err := ims.writeStateUnsafe()
 	if err == nil {
-		for tln, td := range ims.tmap {
-			td.tags, err = tag.ParseUnsafe(bytes.StringToByteArray(tln.String()))
-			if err != nil {
-				ims.logger.Error("Could not parse tags ", tln, " which read from the index file")
+		err = ims.resetWalUnsafe()
+	}
+	now := ims.clock.Now()
+	ims.stats.onSave(now, now.Sub(start), err)
+	ims.saveErr = err
+	if err == nil {
+		ims.dirty = false
+	}
+	return err
+}
+
+// Compact is the part of Service interface
+func (ims *inmemService) Compact() error {
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
+	if ims.done {
+		return ErrShutDown
+	}
+	if ims.Config.ReadOnly {
+		return errReadOnly
+	}
+	if ims.Config.DoNotSave {
+		return nil
+	}
+
+	if err := ims.saveStateUnsafe(); err != nil {
+		return err
+	}
+	return ims.trimUnsafe()
+}
+
+// trimUnsafe replaces the backups of the index objects by their content, and removes
+// the objects of the index shards, which are not used anymore
+func (ims *inmemService) trimUnsafe() error {
+	var fns []idxFileName
+	if ims.idxShards <= 1 {
+		fns = append(fns, idxFileNames(-1))
+	} else {
+		for i := 0; i < ims.idxShards; i++ {
+			fns = append(fns, idxFileNames(i))
+		}
+	}
+
+	for _, fn := range fns {
+		// the object is checked before it becomes the backup
+		if _, _, err := ims.readState(fn.name); err != nil {
+			return errors.Wrapf(err, "could not read the compacted index %s", fn.name)
+		}
+		data, err := ims.storage.Read(fn.name)
+		if err != nil {
+			return errors.Wrapf(err, "could not read the compacted index %s", fn.name)
+		}
+		if err = ims.writeObject(fn.tmp, fn.bak, data); err != nil {
+			return errors.Wrapf(err, "could not write the backup %s", fn.bak)
+		}
+	}
+
+	rm, ok := ims.storage.(Remover)
+	if !ok {
+		return nil
+	}
+	var stale []idxFileName
+	start := 0
+	if ims.idxShards > 1 {
+		stale = append(stale, idxFileNames(-1))
+		start = ims.idxShards
+	}
+	// the shards are numbered contiguously, so the unused ones follow the used ones
+	for i := start; ; i++ {
+		fn := idxFileNames(i)
+		_, err := ims.storage.Read(fn.name)
+		if os.IsNotExist(err) {
+			if _, err = ims.storage.Read(fn.bak); os.IsNotExist(err) {
 				break
 			}
-			ims.smap[td.Src] = td
 		}
+		stale = append(stale, fn)
 	}
+	for _, fn := range stale {
+		for _, name := range []string{fn.name, fn.bak, fn.tmp} {
+			if err := rm.Remove(name); err != nil {
+				return errors.Wrapf(err, "could not remove the unused index object %s", name)
+			}
+		}
+		ims.logger.Info("Compact(): the unused index object is removed, file=", fn.name)
+	}
+	return nil
+}
 
-	return err
+// writeStateUnsafe writes the index to the storage, the previous index content becomes the backup.
+// If the index is sharded, the shards are written concurrently, and the shards manifest is
+// written the last, when the number of the shards is changed. The lock must be held
+// exclusively, so the records of all tmap buckets are written consistently.
+func (ims *inmemService) writeStateUnsafe() error {
+	sc := ims.Config.ShardCount
+	if sc <= 1 {
+		if err := ims.writeIdx(idxFileNames(-1), ims.tmap.snapshot()); err != nil {
+			return err
+		}
+		if ims.idxShards > 1 {
+			// the index is not sharded anymore
+			return ims.writeShardsManifest(1)
+		}
+		return nil
+	}
+
+	tmaps := make([]map[tag.Line]*tagsDesc, sc)
+	for i := range tmaps {
+		tmaps[i] = make(map[tag.Line]*tagsDesc, ims.tmap.len()/sc+1)
+	}
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		tl := td.tags.Line()
+		tmaps[lineHash(tl)%uint32(sc)][tl] = td
+		return true
+	})
+
+	errs := make([]error, sc)
+	var wg sync.WaitGroup
+	for i := range tmaps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ims.writeIdx(idxFileNames(i), tmaps[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if ims.idxShards != sc {
+		return ims.writeShardsManifest(sc)
+	}
+	return nil
+}
+
+// writeIdx writes tmap to the index object fn.name, the previous object content becomes the backup
+func (ims *inmemService) writeIdx(fn idxFileName, tmap map[tag.Line]*tagsDesc) error {
+	data, err := marshalIdx(tmap, ims.Config.Format, ims.Config.Compression, ims.encKey)
+	if err != nil {
+		return err
+	}
+
+	// the current index content is rotated to the backup only when the new one is in place
+	prev, err := ims.storage.Read(fn.name)
+	if err != nil && !os.IsNotExist(err) {
+		ims.logger.Warn("could not read the current index, the backup will not be updated, file=", fn.name, ", err=", err)
+	}
+
+	if err = ims.writeObject(fn.tmp, fn.name, data); err != nil {
+		return err
+	}
+
+	// the backup is replaced by the rename, so it is either the old or the new one
+	if len(prev) > 0 {
+		if err = ims.writeObject(fn.tmp, fn.bak, prev); err != nil {
+			ims.logger.Warn("could not rotate previous index, file=", fn.bak, ", err=", err)
+		}
+	}
+
+	return nil
+}
+
+// writeShardsManifest writes the shards manifest with the number of the index shards sc
+func (ims *inmemService) writeShardsManifest(sc int) error {
+	data, err := json.Marshal(&shardsManifest{ShardCount: sc})
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal the shards manifest ")
+	}
+	if err = ims.writeObject(cIdxShardsTmpFileName, cIdxShardsFileName, encodeIdxFile(data)); err != nil {
+		return err
+	}
+	ims.idxShards = sc
+	return nil
+}
+
+// writeObject writes data into the tmp object and renames it to name
+func (ims *inmemService) writeObject(tmp, name string, data []byte) error {
+	if err := ims.storage.Write(tmp, data); err != nil {
+		return errors.Wrapf(err, "could not write %s to %s", tmp, ims.storage)
+	}
+
+	if err := ims.storage.Rename(tmp, name); err != nil {
+		return errors.Wrapf(err, "could not rename %s to %s in %s", tmp, name, ims.storage)
+	}
+	return nil
+}
+
+// initStorage sets up the storage the index is persisted to
+func (ims *inmemService) initStorage() error {
+	ims.storage = ims.Config.Storage
+	if ims.storage != nil {
+		return nil
+	}
+
+	if !ims.Config.DoNotSave && !ims.Config.ReadOnly {
+		if err := os.MkdirAll(ims.Config.WorkingDir, cWorkingDirMode); err != nil {
+			return errors.Wrapf(err, "could not create the working dir %s", ims.Config.WorkingDir)
+		}
+		// the index is saved later, so the problem is reported at once
+		if err := checkWritable(ims.Config.WorkingDir); err != nil {
+			return err
+		}
+	}
+	ims.storage = NewFsStorage(ims.Config.WorkingDir)
+	return nil
+}
+
+func (ims *inmemService) checkConsistency(ctx context.Context) error {
+	err := ims.loadState()
+	if err != nil {
+		return err
+	}
+
+	if ims.tmap.len() == 0 && ims.Config.RebuildOnMissing {
+		n, err := ims.rebuild(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "could not rebuild the index")
+		}
+		ims.logger.Warn("The index is empty, the records were rebuilt for the existing journals, count=", n)
+	}
+
+	ims.logger.Info("Checking the index and data consistency")
+	cr, err := ims.checkConsistencyUnsafe(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(cr.Orphans) > 0 {
+		ims.logger.Warn("tindex contains the records, which don't have corresponding journals, count=", len(cr.Orphans))
+		for _, ln := range cr.Orphans {
+			ims.logger.Debug("the tindex record doesn't have the journal, tags=", ln)
+		}
+	}
+
+	if len(cr.Missing) > 0 {
+		for _, jn := range cr.Missing {
+			ims.logger.Error("found partition, which is not in the tindex, src=", jn)
+		}
+		ims.logger.Error("Consistency check failed, journals=", cr.Journals, ", records=", cr.Records)
+		switch ims.Config.ConsistencyMode {
+		case ConsistencyWarn:
+			ims.logger.Warn("Continue with the journals not available, ConsistencyMode=", ConsistencyWarn, ", count=", len(cr.Missing))
+			return ims.saveStateUnsafe()
+		case ConsistencyRepair:
+		default:
+			return errors.Errorf("data is inconsistent. %d journals and %d tindex records found. Some journals don't have records in the tindex", cr.Journals, cr.Records)
+		}
+	}
+
+	if ims.Config.ConsistencyMode == ConsistencyRepair && !cr.IsConsistent() {
+		return ims.repairUnsafe(ctx)
+	}
+	ims.logger.Info("Consistency check passed, journals=", cr.Journals, ", records=", cr.Records)
+	return ims.saveStateUnsafe()
+}
+
+// CheckConsistency is the part of Service interface
+func (ims *inmemService) CheckConsistency(ctx context.Context) (ConsistencyReport, error) {
+	ims.lock.RLock()
+	defer ims.lock.RUnlock()
+	if ims.done {
+		return ConsistencyReport{}, ErrShutDown
+	}
+	return ims.checkConsistencyUnsafe(ctx)
+}
+
+// checkConsistencyUnsafe compares the index records with the journals. The orphaned
+// tag lines in the report are sorted.
+func (ims *inmemService) checkConsistencyUnsafe(ctx context.Context) (ConsistencyReport, error) {
+	cr := ConsistencyReport{Records: ims.tmap.len()}
+	km := make(map[string]tag.Line, ims.tmap.len())
+	ims.tmap.forEach(func(d *tagsDesc) bool {
+		km[d.Src] = d.tags.Line()
+		return true
+	})
+
+	ims.visitJournals(ctx, func(j journal.Journal) bool {
+		cr.Journals++
+		if _, ok := km[j.Name()]; !ok {
+			cr.Missing = append(cr.Missing, j.Name())
+		} else {
+			delete(km, j.Name())
+		}
+		return true
+	})
+
+	if ctx != nil && ctx.Err() != nil {
+		return cr, ctx.Err()
+	}
+
+	for _, ln := range km {
+		cr.Orphans = append(cr.Orphans, ln)
+	}
+	sort.Slice(cr.Orphans, func(i, j int) bool { return cr.Orphans[i] < cr.Orphans[j] })
+	return cr, nil
+}
+
+// visitJournals visits the journals, if the journals controller is set
+func (ims *inmemService) visitJournals(ctx context.Context, v func(j journal.Journal) bool) {
+	if ims.Journals != nil {
+		ims.Journals.Visit(ctx, v)
+	}
+}
+
+// repairUnsafe drops the orphaned records and rebuilds the missing ones
+func (ims *inmemService) repairUnsafe(ctx context.Context) error {
+	dn, err := ims.dropOrphansUnsafe(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "could not drop the orphaned records")
+	}
+
+	rn, err := ims.rebuild(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "could not rebuild the index")
+	}
+	ims.logger.Warn("The index is repaired, dropped=", dn, ", rebuilt=", rn)
+	return ims.saveStateUnsafe()
+}
+
+// rebuild adds the index records for the journals which don't have them. It returns
+// the number of records added.
+func (ims *inmemService) rebuild(ctx context.Context) (int, error) {
+	var tds []*tagsDesc
+	var err error
+	ims.visitJournals(ctx, func(j journal.Journal) bool {
+		if ims.smap.load(j.Name()) != nil {
+			return true
+		}
+
+		var tgs tag.Set
+		tgs, err = tag.Parse(cRebuiltSrcTag + "=" + j.Name())
+		if err != nil {
+			err = errors.Wrapf(err, "could not form tags for the journal %s", j.Name())
+			return false
+		}
+		tds = append(tds, &tagsDesc{tags: tgs, Src: j.Name()})
+		return true
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, td := range tds {
+		ims.logger.Info("rebuild(): the journal is added to the index, src=", td.Src, ", tags=", td.tags.Line())
+		ims.addUnsafe(td)
+	}
+	return len(tds), nil
+}
+
+// loadState loads the index from the storage. If the shards manifest is found,
+// the index is merged from the shards, otherwise it is read from the single index
+// object (the index written before it was sharded, for instance).
+func (ims *inmemService) loadState() error {
+	ims.logger.Debug("loadState(), storage=", ims.storage)
+	sc, err := ims.readShardsManifest()
+	if err != nil {
+		return err
+	}
+	ims.idxShards = sc
+
+	var tmap map[tag.Line]*tagsDesc
+	if sc <= 1 {
+		tmap, err = ims.loadIdx(idxFileNames(-1))
+	} else {
+		tmap = make(map[tag.Line]*tagsDesc)
+		for i := 0; i < sc && err == nil; i++ {
+			var stmap map[tag.Line]*tagsDesc
+			stmap, err = ims.loadIdx(idxFileNames(i))
+			for tl, td := range stmap {
+				tmap[tl] = td
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if tmap == nil {
+		tmap = make(map[tag.Line]*tagsDesc)
+	}
+	ims.walRecs, ims.walReset = 0, false
+	if err = ims.loadWal(tmap); err != nil {
+		return err
+	}
+
+	if err = ims.mergeCollisions(tmap); err != nil {
+		return err
+	}
+
+	ims.tmap = newLinesMap(cBucketsNum)
+	ims.smap = newSrcsMap(cBucketsNum)
+	ims.kvals = nil
+	ims.kidx = nil
+	for _, td := range tmap {
+		ims.addUnsafe(td)
+	}
+	return nil
+}
+
+// mergeCollisions looks for the records of tmap, which stored tags lines are
+// different, but normalize to the same line. Such records could be written by
+// the older versions, which didn't normalize the tags. In ConsistencyStrict mode
+// the error is returned, otherwise only the first record is kept for the line:
+// the one stored in the normalized form, or the one with the smallest stored line.
+// The journals of the dropped records are reported by the consistency check then.
+func (ims *inmemService) mergeCollisions(tmap map[tag.Line]*tagsDesc) error {
+	lines := make(map[tag.Line][]tag.Line)
+	for ln, td := range tmap {
+		nln := td.tags.Line()
+		lines[nln] = append(lines[nln], ln)
+	}
+
+	var dups []tag.Line
+	for nln, lns := range lines {
+		if len(lns) < 2 {
+			continue
+		}
+		sort.Slice(lns, func(i, j int) bool {
+			if lns[i] == nln || lns[j] == nln {
+				return lns[i] == nln
+			}
+			return lns[i] < lns[j]
+		})
+		for _, ln := range lns[1:] {
+			ims.logger.Error("the tags line ", ln, " normalizes to the same line as ", lns[0], ", src=", tmap[ln].Src, ", kept src=", tmap[lns[0]].Src)
+		}
+		dups = append(dups, lns[1:]...)
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+
+	switch ims.Config.ConsistencyMode {
+	case ConsistencyWarn, ConsistencyRepair:
+		ims.logger.Warn("The records with the same normalized tags lines are merged, ConsistencyMode=", ims.Config.ConsistencyMode, ", dropped=", len(dups))
+		for _, ln := range dups {
+			delete(tmap, ln)
+		}
+		return nil
+	default:
+		return errors.Errorf("data is inconsistent. %d tindex records have the tags lines, which normalize to the lines of other records", len(dups))
+	}
+}
+
+// loadIdx reads the index object fn.name, or its backup if the object is not usable.
+// The empty map is returned, if the object is not found.
+func (ims *inmemService) loadIdx(fn idxFileName) (map[tag.Line]*tagsDesc, error) {
+	tmap, format, err := ims.readState(fn.name)
+	if os.IsNotExist(err) {
+		ims.logger.Warn("loadState(): the index is not found, file=", fn.name, ", storage=", ims.storage)
+		return nil, nil
+	}
+
+	if err != nil {
+		ims.logger.Error("loadState(): could not read the index, trying the backup, file=", fn.name, ", backup=", fn.bak, ", err=", err)
+		var err2 error
+		tmap, format, err2 = ims.readState(fn.bak)
+		if err2 != nil {
+			return nil, errors.Wrapf(err, "could not load the index %s, and the backup %s is not usable either (%s)", fn.name, fn.bak, err2)
+		}
+		ims.logger.Warn("loadState(): the index is recovered from the backup, file=", fn.bak)
+	}
+
+	if format != ims.getFormat() {
+		ims.logger.Info("loadState(): the index is in the format ", format, ", it will be written in the format ", ims.getFormat(), ", file=", fn.name)
+		ims.dirty = true
+	}
+	return tmap, nil
+}
+
+// getFormat returns the format the index is written in
+func (ims *inmemService) getFormat() string {
+	if ims.Config.Format == "" {
+		return FormatJSON
+	}
+	return ims.Config.Format
+}
+
+// readShardsManifest returns the number of the index shards from the shards
+// manifest, or 0 if the manifest is not found
+func (ims *inmemService) readShardsManifest() (int, error) {
+	data, err := readIdxFile(ims.storage, cIdxShardsFileName, nil)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not read the shards manifest %s", cIdxShardsFileName)
+	}
+
+	var sm shardsManifest
+	if err = json.Unmarshal(data, &sm); err != nil {
+		return 0, errors.Wrapf(err, "could not unmarshal the shards manifest %s", cIdxShardsFileName)
+	}
+	if sm.ShardCount < 0 {
+		return 0, errors.Errorf("invalid ShardCount=%d in the shards manifest %s", sm.ShardCount, cIdxShardsFileName)
+	}
+	return sm.ShardCount, nil
+}
+
+// readState reads the index object name and returns the tags map built from it,
+// and the format the object is encoded in
+func (ims *inmemService) readState(name string) (map[tag.Line]*tagsDesc, string, error) {
+	data, err := readIdxFile(ims.storage, name, ims.encKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tmap, format, err := decodeIdx(data)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "could not unmarshal the index %s", name)
+	}
+
+	for tln, td := range tmap {
+		td.tags, err = tag.ParseUnsafe(bytes.StringToByteArray(tln.String()))
+		if err != nil {
+			ims.logger.Error("Could not parse tags read from the index, tags=", tln, ", file=", name, ", err=", err)
+			return nil, "", err
+		}
+	}
+	return tmap, format, nil
+}
+
+// sortTagsDescs sorts tds by their tags lines
+func sortTagsDescs(tds []*tagsDesc) {
+	sort.Slice(tds, func(i, j int) bool {
+		return tds[i].tags.Line() < tds[j].tags.Line()
+	})
 }
 
 func (td *tagsDesc) String() string {
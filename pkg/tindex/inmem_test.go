@@ -15,14 +15,28 @@
 package tindex
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
 	"github.com/jrivets/log4g"
 	"github.com/logrange/logrange/pkg/lql"
 	"github.com/logrange/logrange/pkg/model/tag"
+	"github.com/logrange/logrange/pkg/utils"
 	"github.com/logrange/range/pkg/records"
 	"github.com/logrange/range/pkg/records/journal"
+	errors2 "github.com/logrange/range/pkg/utils/errors"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -106,6 +120,66 @@ func BenchmarkFindIndex(b *testing.B) {
 	}
 }
 
+// BenchmarkConcurrentVisit runs the index scans by the concurrent readers, the
+// writers add new records concurrently with the scans in the "writers" case
+func BenchmarkConcurrentVisit(b *testing.B) {
+	for _, writers := range []bool{false, true} {
+		b.Run(fmt.Sprintf("writers=%t", writers), func(b *testing.B) {
+			ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+			ims.Journals = &testJournals{}
+			ims.Init(nil)
+			for i := 0; i < 1000; i++ {
+				src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+				ims.Release(src)
+			}
+
+			var ops int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// every 10th operation is the write in the writers case
+					if i := atomic.AddInt64(&ops, 1); writers && i%10 == 0 {
+						src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("b=%d", i))
+						if err != nil {
+							b.Fatal("err must be nil, but err=", err)
+						}
+						ims.Release(src)
+						continue
+					}
+
+					cnt := 0
+					err := ims.Visit(&lql.Source{}, func(tags tag.Set, jrnl string) bool {
+						cnt++
+						return true
+					}, VF_SKIP_IF_LOCKED)
+					if err != nil || cnt < 1000 {
+						b.Fatal("expected all the records visited, but ", cnt, ", err=", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestNoInjection(t *testing.T) {
+	ims := NewInmemService().(*inmemService)
+	if err := ims.Init(context.Background()); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims.Shutdown()
+
+	src, ts, err := ims.GetOrCreateJournal("a=1")
+	if err != nil || src == "" || ts.Tag("a") != "1" {
+		t.Fatal("the journal must be created, but src=", src, ", ts=", ts, ", err=", err)
+	}
+	if src2, _, err := ims.GetJournal("a=1"); err != nil || src2 != src {
+		t.Fatal("expected src=", src, ", but src2=", src2, ", err=", err)
+	}
+	ims.Release(src)
+	ims.Release(src)
+}
+
 func TestCheckInit(t *testing.T) {
 	dir, err := ioutil.TempDir("", "CheckInit")
 	if err != nil {
@@ -261,8 +335,8 @@ func TestReAcquireExclusively(t *testing.T) {
 	src, _, _ := ims.GetOrCreateJournal("dda=a") //1st
 	ims.GetOrCreateJournal("dda=a")              // 2nd
 
-	if ims.tmap["dda=a"].readers != 2 {
-		t.Fatal("Wrong value for td=", ims.tmap["dda=a"])
+	if ims.tmap.get("dda=a").readers != 2 {
+		t.Fatal("Wrong value for td=", ims.tmap.get("dda=a"))
 	}
 
 	res, _ := getJournals(ims, ps)
@@ -272,18 +346,18 @@ func TestReAcquireExclusively(t *testing.T) {
 		t.Fatal("Visitor must return the partition but res=", res)
 	}
 
-	if ims.smap[src].readers != 2 {
-		t.Fatal("Wrong value for td=", ims.smap[src])
+	if ims.smap.load(src).readers != 2 {
+		t.Fatal("Wrong value for td=", ims.smap.load(src))
 	}
 
 	ok := ims.LockExclusively(src)
-	if ok || ims.smap[src].exclusive {
+	if ok || ims.smap.load(src).exclusive {
 		t.Fatal("Must not be acquired but ok=", ok)
 	}
 	ims.Release(src)
 
 	// Now, we have only one read ackusition, so can re-acquire for exclusive
-	if !ims.LockExclusively(src) || !ims.smap[src].exclusive {
+	if !ims.LockExclusively(src) || !ims.smap.load(src).exclusive {
 		t.Fatal("Must be acquired")
 	}
 
@@ -295,13 +369,13 @@ func TestReAcquireExclusively(t *testing.T) {
 
 	// releasing the exclusive
 	ims.UnlockExclusively(src)
-	if ims.smap[src].exclusive {
+	if ims.smap.load(src).exclusive {
 		t.Fatal("Must not be exclusive")
 	}
 	ims.Release(src)
 
 	// not acquired for read, so must fail
-	if ims.LockExclusively(src) || ims.smap[src].exclusive {
+	if ims.LockExclusively(src) || ims.smap.load(src).exclusive {
 		t.Fatal("Must not be acquired")
 	}
 
@@ -313,7 +387,7 @@ func TestReAcquireExclusively(t *testing.T) {
 
 	// Ok, re-acquire once again now
 	ims.GetOrCreateJournal("dda=a")
-	if !ims.LockExclusively(src) || !ims.smap[src].exclusive {
+	if !ims.LockExclusively(src) || !ims.smap.load(src).exclusive {
 		t.Fatal("Must be acquired")
 	}
 
@@ -417,8 +491,8 @@ func TestDelete(t *testing.T) {
 		t.Fatal("Must not be able to Delete!")
 	}
 
-	if len(ims.smap) != 1 || len(ims.tmap) != 1 {
-		t.Fatal("Must not affect data, but ims.smap=", ims.smap)
+	if ims.smap.len() != 1 || ims.tmap.len() != 1 {
+		t.Fatal("Must not affect data, but tmap=", ims.tmap.snapshot())
 	}
 
 	// ok, no get it exclusively
@@ -429,8 +503,8 @@ func TestDelete(t *testing.T) {
 	}
 
 	ims.Release(src)
-	if len(ims.smap) != 0 || len(ims.tmap) != 0 {
-		t.Fatal("Must not affect data, but ims.smap=", ims.smap)
+	if ims.smap.len() != 0 || ims.tmap.len() != 0 {
+		t.Fatal("Must not affect data, but tmap=", ims.tmap.snapshot())
 	}
 }
 
@@ -448,7 +522,7 @@ func TestVisitSkipping(t *testing.T) {
 
 	src, _, _ := ims.GetOrCreateJournal("dda=a") //1st
 
-	if ims.smap[src].readers != 1 {
+	if ims.smap.load(src).readers != 1 {
 		t.Fatal("Must be 1 reader here")
 	}
 
@@ -456,25 +530,25 @@ func TestVisitSkipping(t *testing.T) {
 
 	// Visit release
 	ims.visitSkippingIfLocked(lql.PositiveTagsExpFunc, func(tags tag.Set, jrnl string) bool {
-		if ims.smap[jrnl].readers != 1 {
+		if ims.smap.load(jrnl).readers != 1 {
 			t.Fatal("Must be 1 reader here")
 		}
 		return true
 	}, 0)
 
-	if ims.smap[src].readers != 0 {
+	if ims.smap.load(src).readers != 0 {
 		t.Fatal("Must be 0 readers here")
 	}
 
 	// Visit non-release
 	ims.visitSkippingIfLocked(lql.PositiveTagsExpFunc, func(tags tag.Set, jrnl string) bool {
-		if ims.smap[jrnl].readers != 1 {
+		if ims.smap.load(jrnl).readers != 1 {
 			t.Fatal("Must be 1 reader here")
 		}
 		return true
 	}, VF_DO_NOT_RELEASE)
 
-	if ims.smap[src].readers != 1 {
+	if ims.smap.load(src).readers != 1 {
 		t.Fatal("Must be 0 readers here")
 	}
 	ims.Release(src)
@@ -485,14 +559,14 @@ func TestVisitSkipping(t *testing.T) {
 	// Visit non-release
 	visited := map[string]string{}
 	ims.visitSkippingIfLocked(lql.PositiveTagsExpFunc, func(tags tag.Set, jrnl string) bool {
-		if ims.smap[jrnl].readers != 1 {
+		if ims.smap.load(jrnl).readers != 1 {
 			t.Fatal("Must be 1 reader here")
 		}
 		visited[jrnl] = jrnl
 		return false
 	}, VF_DO_NOT_RELEASE)
 
-	if len(visited) != 1 || (visited[src] == src && ims.smap[src2].readers != 0) || (visited[src2] == src2 && ims.smap[src].readers != 0) {
+	if len(visited) != 1 || (visited[src] == src && ims.smap.load(src2).readers != 0) || (visited[src2] == src2 && ims.smap.load(src).readers != 0) {
 		t.Fatal("not properly released ", visited)
 	}
 
@@ -505,14 +579,14 @@ func TestVisitSkipping(t *testing.T) {
 	// Visit release
 	visited = map[string]string{}
 	ims.visitSkippingIfLocked(lql.PositiveTagsExpFunc, func(tags tag.Set, jrnl string) bool {
-		if ims.smap[jrnl].readers != 1 {
+		if ims.smap.load(jrnl).readers != 1 {
 			t.Fatal("Must be 1 reader here")
 		}
 		visited[jrnl] = jrnl
 		return false
 	}, 0)
 
-	if len(visited) != 1 || ims.smap[src2].readers != 0 || ims.smap[src].readers != 0 {
+	if len(visited) != 1 || ims.smap.load(src2).readers != 0 || ims.smap.load(src).readers != 0 {
 		t.Fatal("not properly released ", visited)
 	}
 }
@@ -525,3 +599,2909 @@ func getJournals(ims *inmemService, srcCond *lql.Source) (map[tag.Line]string, e
 	}, VF_SKIP_IF_LOCKED)
 	return res, err
 }
+
+func TestSaveStateRotatesBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "SaveState")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemService().(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Config = &InMemConfig{WorkingDir: dir}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	ims.GetOrCreateJournal("a=b")
+	ims.GetOrCreateJournal("a=c")
+
+	for _, fn := range []string{cIdxFileName, cIdxBackupFileName} {
+		if _, err := os.Stat(path.Join(dir, fn)); err != nil {
+			t.Fatal("file ", fn, " must exist, but err=", err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, cIdxTmpFileName)); !os.IsNotExist(err) {
+		t.Fatal("file ", cIdxTmpFileName, " must not exist, but err=", err)
+	}
+
+	ims.Shutdown()
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if ims.tmap.len() != 2 {
+		t.Fatal("expected 2 records, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestLoadCorruptedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "LoadCorrupted")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemService().(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Config = &InMemConfig{WorkingDir: dir}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	ims.GetOrCreateJournal("a=b")
+	ims.GetOrCreateJournal("a=c")
+	ims.Shutdown()
+
+	// flip a byte in the payload
+	fn := path.Join(dir, cIdxFileName)
+	data, _ := ioutil.ReadFile(fn)
+	data[len(data)-2]++
+	ioutil.WriteFile(fn, data, 0640)
+
+	ims2 := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims2.Journals = &testJournals{}
+	if err = ims2.Init(nil); err != nil {
+		t.Fatal("Init() must recover from the backup, but err=", err)
+	}
+	if ims2.tmap.len() != 1 || ims2.tmap.get("a=b") == nil {
+		t.Fatal("expected the backup content, but tmap=", ims2.tmap.snapshot())
+	}
+	ims2.Shutdown()
+
+	// both files are corrupted now
+	ioutil.WriteFile(fn, data, 0640)
+	ioutil.WriteFile(path.Join(dir, cIdxBackupFileName), data, 0640)
+	ims3 := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims3.Journals = &testJournals{}
+	if err = ims3.Init(nil); err == nil {
+		t.Fatal("Init() must fail when both files are corrupted")
+	}
+}
+
+func TestLoadFromBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "LoadFromBackup")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemService().(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Config = &InMemConfig{WorkingDir: dir}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	src, _, _ := ims.GetOrCreateJournal("a=b")
+	ims.Shutdown()
+
+	fn := path.Join(dir, cIdxFileName)
+	os.Rename(fn, path.Join(dir, cIdxBackupFileName))
+	ioutil.WriteFile(fn, []byte("garbage{"), 0640)
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() must recover from the backup, but err=", err)
+	}
+
+	src2, _, err := ims.GetJournal("a=b")
+	if err != nil || src2 != src || ims.tmap.len() != 1 {
+		t.Fatal("expected the backup content, but src2=", src2, ", err=", err, ", tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestGzipCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "GzipCompression")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, Compression: CompressionGzip}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	src, _, _ := ims.GetOrCreateJournal("a=b")
+	ims.Shutdown()
+
+	payload, err := decodeIdxFile(readFile(t, path.Join(dir, cIdxFileName)))
+	if err != nil || payload[0] != cGzipMagic[0] || payload[1] != cGzipMagic[1] {
+		t.Fatal("the payload must be gzipped, err=", err)
+	}
+
+	// must be loaded with no compression set as well
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if src2, _, err := ims.GetJournal("a=b"); err != nil || src2 != src {
+		t.Fatal("expected src=", src, ", but src2=", src2, ", err=", err)
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, Compression: "zip"}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err == nil {
+		t.Fatal("Init() must fail for unknown compression")
+	}
+}
+
+func BenchmarkSaveState(b *testing.B) {
+	for _, cmpr := range []string{CompressionNone, CompressionGzip} {
+		b.Run(cmpr, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "benchmark")
+			if err != nil {
+				b.Fatal("Could not create new dir err=", err)
+			}
+			defer os.RemoveAll(dir) // clean up
+
+			ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, DoNotSave: true, Compression: cmpr}).(*inmemService)
+			ims.Journals = &testJournals{}
+			ims.Init(nil)
+			for i := 0; i < 100000; i++ {
+				ims.GetOrCreateJournal(fmt.Sprintf("app=application%d,pod=pod-%d,ns=default", i%100, i))
+			}
+			ims.Config.DoNotSave = false
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ims.saveStateUnsafe(); err != nil {
+					b.Fatal("could not save state, err=", err)
+				}
+			}
+			b.StopTimer()
+
+			fi, _ := os.Stat(path.Join(dir, cIdxFileName))
+			b.Logf("%d index records, file size is %d bytes", ims.tmap.len(), fi.Size())
+		})
+	}
+}
+
+func TestIndexFormatMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "IndexFormat")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	srcs := make(map[string]string)
+	open := func(format, compression string) *inmemService {
+		ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, Format: format, Compression: compression}).(*inmemService)
+		js := make([]string, 0, len(srcs))
+		for _, src := range srcs {
+			js = append(js, src)
+		}
+		ims.Journals = &testJournals{js}
+		if err := ims.Init(nil); err != nil {
+			t.Fatal("Init() err=", err, " for Format=", format)
+		}
+		for tags, src := range srcs {
+			if src2, _, err := ims.GetJournal(tags); err != nil || src2 != src {
+				t.Fatal("expected src=", src, " for ", tags, ", but src2=", src2, ", err=", err)
+			}
+			ims.Release(src)
+		}
+		return ims
+	}
+	checkFormat := func(format string) {
+		data, err := readIdxFile(NewFsStorage(dir), cIdxFileName, nil)
+		if err != nil {
+			t.Fatal("readIdxFile() err=", err)
+		}
+		if _, f, err := decodeIdx(data); err != nil || f != format {
+			t.Fatal("expected the index in the format ", format, ", but ", f, ", err=", err)
+		}
+	}
+
+	// the index is written in JSON by default
+	ims := open("", "")
+	for _, tags := range []string{"a=1", "a=2,b=\"x y\"", "c=3"} {
+		src, _, _ := ims.GetOrCreateJournal(tags)
+		ims.Release(src)
+		srcs[tags] = src
+	}
+	ims.Shutdown()
+	checkFormat(FormatJSON)
+
+	// it is migrated on Init
+	open(FormatBinary, "").Shutdown()
+	checkFormat(FormatBinary)
+
+	// the binary index is compressed, and loaded back into JSON
+	open(FormatBinary, CompressionGzip).Shutdown()
+	checkFormat(FormatBinary)
+	open(FormatJSON, "").Shutdown()
+	checkFormat(FormatJSON)
+
+	if err = (&InMemConfig{Format: "xml"}).Check(); err == nil {
+		t.Fatal("Check() must fail for the unknown format")
+	}
+}
+
+func TestDecodeBinaryIndex(t *testing.T) {
+	tmap := map[tag.Line]*tagsDesc{"a=1": {Src: "src1"}, "b=2,c=3": {Src: "src2"}, "d=": {Src: ""}}
+	data, err := encodeIdx(tmap, FormatBinary)
+	if err != nil {
+		t.Fatal("encodeIdx() err=", err)
+	}
+	tmap2, format, err := decodeIdx(data)
+	if err != nil || format != FormatBinary || len(tmap2) != len(tmap) {
+		t.Fatal("expected ", tmap, ", but ", tmap2, ", format=", format, ", err=", err)
+	}
+	for ln, td := range tmap {
+		if td2, ok := tmap2[ln]; !ok || td2.Src != td.Src {
+			t.Fatal("expected ", td, " for ", ln, ", but ", td2)
+		}
+	}
+
+	// the truncated and the extended data are rejected
+	for i := 1; i < len(data); i++ {
+		if _, _, err = decodeIdx(data[:i]); err == nil {
+			t.Fatal("decodeIdx() must fail for the data truncated to ", i, " bytes")
+		}
+	}
+	if _, _, err = decodeIdx(append(data, 0)); err == nil {
+		t.Fatal("decodeIdx() must fail for the extra data")
+	}
+}
+
+func BenchmarkDecodeIndex(b *testing.B) {
+	tmap := make(map[tag.Line]*tagsDesc)
+	for i := 0; i < 100000; i++ {
+		tmap[tag.Line(fmt.Sprintf("app=application%d,ns=default,pod=pod-%d", i%100, i))] = &tagsDesc{Src: newSrc()}
+	}
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		data, err := encodeIdx(tmap, format)
+		if err != nil {
+			b.Fatal("encodeIdx() err=", err)
+		}
+		b.Run(format, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := decodeIdx(data); err != nil {
+					b.Fatal("decodeIdx() err=", err)
+				}
+			}
+			b.Logf("%d index records, the encoded index size is %d bytes", len(tmap), len(data))
+		})
+	}
+}
+
+func readFile(t *testing.T, fn string) []byte {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal("could not read file ", fn, ", err=", err)
+	}
+	return data
+}
+
+func TestFlushInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "FlushInterval")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, FlushIntervalMs: 50}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	start := time.Now()
+	saves := int(ims.stats.saves)
+	for i := 0; i < 10000; i++ {
+		src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		if err != nil {
+			t.Fatal("could not create journal, err=", err)
+		}
+		ims.Release(src)
+	}
+	ims.Shutdown()
+
+	maxSaves := int(time.Now().Sub(start)/(50*time.Millisecond)) + 2
+	if int(ims.stats.saves)-saves > maxSaves {
+		t.Fatal("expected at most ", maxSaves, " saves, but ", int(ims.stats.saves)-saves, " happened")
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if ims.tmap.len() != 10000 {
+		t.Fatal("expected 10000 records after shutdown, but ", ims.tmap.len())
+	}
+}
+
+func TestFlushIntervalClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "FlushIntervalClock")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	fc := utils.NewFakeClock(time.Unix(1000, 0))
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, FlushIntervalMs: 1000, Clock: fc}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims.Shutdown()
+
+	// the index could be saved by Init
+	saves := ims.GetStats().Saves
+	waitSaves := func(n int64) {
+		start := time.Now()
+		for atomic.LoadInt64(&ims.stats.saves) != n {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("expected ", n, " saves, but ", atomic.LoadInt64(&ims.stats.saves))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// the flusher ticker is created
+	start := time.Now()
+	for fc.Timers() == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the flusher must start the ticker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		if err != nil {
+			t.Fatal("could not create journal, err=", err)
+		}
+		ims.Release(src)
+	}
+	fc.Advance(999 * time.Millisecond)
+	if st := ims.GetStats(); !st.Dirty || st.Saves != saves {
+		t.Fatal("the changes must not be persisted before the interval, but ", st)
+	}
+
+	// the changes are persisted at once
+	fc.Advance(time.Millisecond)
+	waitSaves(saves + 1)
+	if st := ims.GetStats(); st.Dirty || !st.LastSaveTime.Equal(time.Unix(1001, 0)) {
+		t.Fatal("the changes must be persisted at 1001 sec, but ", st)
+	}
+
+	// the missed ticks are dropped, so several intervals give one save
+	if _, _, err = ims.GetOrCreateJournal("a=10"); err != nil {
+		t.Fatal("could not create journal, err=", err)
+	}
+	fc.Advance(5 * time.Second)
+	waitSaves(saves + 2)
+	if st := ims.GetStats(); st.Dirty || !st.LastSaveTime.Equal(time.Unix(1006, 0)) {
+		t.Fatal("the changes must be persisted at 1006 sec, but ", st)
+	}
+}
+
+func BenchmarkConcurrentGetJournalTags(b *testing.B) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	srcs := make([]string, 1000)
+	for i := range srcs {
+		srcs[i], _, _ = ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := ims.GetJournalTags(srcs[i%len(srcs)], false); err != nil {
+				b.Fatal("err must be nil, but err=", err)
+			}
+			i++
+		}
+	})
+}
+
+func TestDeleteJournal(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	src, _, _ := ims.GetOrCreateJournal("b=2,a=1")
+	if err := ims.DeleteJournal("a=1,b=2"); err != errors2.WrongState {
+		t.Fatal("must not be deleted while acquired, but err=", err)
+	}
+
+	ims.Release(src)
+	if err := ims.DeleteJournal("a=1,b=2"); err != nil {
+		t.Fatal("must be deleted, but err=", err)
+	}
+	if ims.smap.len() != 0 || ims.tmap.len() != 0 {
+		t.Fatal("the index must be empty, but tmap=", ims.tmap.snapshot())
+	}
+
+	if err := ims.DeleteJournal("a=1,b=2"); err != errors2.NotFound {
+		t.Fatal("expected NotFound, but err=", err)
+	}
+	if err := ims.DeleteJournal("c=3"); err != errors2.NotFound {
+		t.Fatal("expected NotFound, but err=", err)
+	}
+}
+
+func TestGetJournalTagsConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "GetJournalTagsConsistency")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	src1, _, _ := ims.GetOrCreateJournal("a=1")
+	src2, _, _ := ims.GetOrCreateJournal("a=2,b=3")
+	ims.Release(src1)
+	ims.Release(src2)
+	ims.DeleteJournal("a=1")
+	ims.Shutdown()
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src2}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	if _, err := ims.GetJournalTags(src1, false); err != errors2.NotFound {
+		t.Fatal("src1 must not be found, but err=", err)
+	}
+	ts, err := ims.GetJournalTags(src2, false)
+	if err != nil || ts.Line() != "a=2,b=3" {
+		t.Fatal("expected a=2,b=3 for src2, but ts=", ts, ", err=", err)
+	}
+	if ims.smap.len() != ims.tmap.len() {
+		t.Fatal("smap and tmap must have same size, smap=", ims.smap.len(), ", tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestGetJournalsPage(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	for i := 0; i < 25; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%02d", i))
+		ims.Release(src)
+	}
+
+	var all []tag.Line
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		res, next, err := ims.GetJournalsPage(context.Background(), nil, cursor, 10)
+		if err != nil {
+			t.Fatal("err must be nil, but err=", err)
+		}
+		page := make([]string, 0, len(res))
+		for tl := range res {
+			page = append(page, string(tl))
+		}
+		sort.Strings(page)
+		for _, ln := range page {
+			all = append(all, tag.Line(ln))
+		}
+		if next == "" {
+			break
+		}
+		if next != page[len(page)-1] {
+			t.Fatal("the cursor must be the last line of the page, but next=", next)
+		}
+		cursor = next
+	}
+
+	if len(all) != 25 {
+		t.Fatal("expected 25 records, but got ", all)
+	}
+	for i, tl := range all {
+		if tl != tag.Line(fmt.Sprintf("a=%02d", i)) {
+			t.Fatal("wrong order ", all)
+		}
+	}
+
+	// the last page is full, no next page
+	if res, next, err := ims.GetJournalsPage(context.Background(), nil, "a=14", 10); err != nil || len(res) != 10 || next != "" {
+		t.Fatal("expected the last 10 records, but res=", res, ", next=", next, ", err=", err)
+	}
+
+	if _, _, err := ims.GetJournalsPage(context.Background(), nil, "", 0); err == nil {
+		t.Fatal("must be an error for limit=0")
+	}
+}
+
+func TestVisitOrder(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	for i := 0; i < 100; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", 99-i))
+		ims.Release(src)
+	}
+
+	for _, flags := range []int{VF_SKIP_IF_LOCKED, 0} {
+		for n := 0; n < 5; n++ {
+			var lines []string
+			vf := func(tags tag.Set, jrnl string) bool {
+				lines = append(lines, tags.Line().String())
+				return len(lines) < 10
+			}
+			if flags&VF_SKIP_IF_LOCKED != 0 {
+				ims.visitSkippingIfLocked(lql.PositiveTagsExpFunc, vf, flags)
+			} else {
+				ims.visitWaitingIfLocked(lql.PositiveTagsExpFunc, vf, flags)
+			}
+
+			if len(lines) != 10 || !sort.StringsAreSorted(lines) || lines[0] != "a=0" || lines[1] != "a=1" || lines[2] != "a=10" {
+				t.Fatal("expected first 10 sorted lines, but got ", lines)
+			}
+		}
+	}
+}
+
+func TestCountJournals(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	for i := 0; i < 10; i++ {
+		ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+	}
+
+	if cnt, err := ims.CountJournals(context.Background(), nil); err != nil || cnt != 10 {
+		t.Fatal("expected 10, but cnt=", cnt, ", err=", err)
+	}
+
+	ims.Shutdown()
+	if _, err := ims.CountJournals(context.Background(), nil); err == nil {
+		t.Fatal("must be an error after shutdown")
+	}
+}
+
+func BenchmarkCountJournals(b *testing.B) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	for i := 0; i < 10000; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		ims.Release(src)
+	}
+
+	b.Run("CountJournals", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ims.CountJournals(context.Background(), nil)
+		}
+	})
+
+	b.Run("Visit", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cnt := 0
+			ims.Visit(nil, func(tags tag.Set, jrnl string) bool {
+				cnt++
+				return true
+			}, VF_SKIP_IF_LOCKED)
+		}
+	})
+}
+
+func TestGetOrCreateJournals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "GetOrCreateJournals")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	src, _, _ := ims.GetOrCreateJournal("a=1")
+	saves := int(ims.stats.saves)
+	res, err := ims.GetOrCreateJournals([]string{"a=1", "a=2", "b=3,a=4", "a=4,b=3"})
+	if err != nil || len(res) != 4 || res["a=1"] != src || res["b=3,a=4"] != res["a=4,b=3"] {
+		t.Fatal("wrong result res=", res, ", err=", err)
+	}
+	if int(ims.stats.saves)-saves != 1 || ims.tmap.len() != 3 {
+		t.Fatal("expected 1 save and 3 records, but saves=", int(ims.stats.saves)-saves, ", tmap=", ims.tmap.snapshot())
+	}
+	if ims.tmap.get("a=1").readers != 2 || ims.tmap.get("a=4,b=3").readers != 2 {
+		t.Fatal("the sources must be acquired, tmap=", ims.tmap.snapshot())
+	}
+
+	if _, err := ims.GetOrCreateJournals([]string{"a=5", "a=5,"}); err == nil {
+		t.Fatal("must fail for wrong tags line")
+	}
+
+	// unable to save, so the new records must be rolled back
+	os.RemoveAll(dir)
+	if _, err := ims.GetOrCreateJournals([]string{"a=1", "a=6"}); err == nil {
+		t.Fatal("must fail when the state could not be saved")
+	}
+	if ims.tmap.len() != 3 || ims.smap.len() != 3 || ims.tmap.get("a=1").readers != 2 {
+		t.Fatal("the index must not be changed, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+type testStorage struct {
+	lock sync.Mutex
+	objs map[string][]byte
+}
+
+func (ts *testStorage) Read(name string) ([]byte, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	data, ok := ts.objs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (ts *testStorage) Write(name string, data []byte) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.objs[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (ts *testStorage) Rename(oldName, newName string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	data, ok := ts.objs[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(ts.objs, oldName)
+	ts.objs[newName] = data
+	return nil
+}
+
+// failingWriteStorage fails the write number failOn (starting from 1), and
+// removes the object written, like the fsStorage does
+type failingWriteStorage struct {
+	*testStorage
+	writes, failOn int
+}
+
+func (fs *failingWriteStorage) Write(name string, data []byte) error {
+	fs.writes++
+	if fs.writes == fs.failOn {
+		delete(fs.objs, name)
+		return fmt.Errorf("no space left on device")
+	}
+	return fs.testStorage.Write(name, data)
+}
+
+func TestSaveStateKeepsBackupOnFailure(t *testing.T) {
+	st := &failingWriteStorage{testStorage: &testStorage{objs: make(map[string][]byte)}}
+	ims := NewInmemServiceWithConfig(InMemConfig{Storage: st}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	ims.GetOrCreateJournal("a=b")
+	ims.GetOrCreateJournal("a=c")
+	bak := st.objs[cIdxBackupFileName]
+	if bak == nil {
+		t.Fatal("the backup must be written")
+	}
+
+	// the backup is not lost, if it could not be rotated
+	st.failOn = st.writes + 2
+	ims.GetOrCreateJournal("a=d")
+	if st.writes < st.failOn {
+		t.Fatal("the backup must be rotated, but writes=", st.writes)
+	}
+	if !bytes.Equal(st.objs[cIdxBackupFileName], bak) {
+		t.Fatal("the backup must be kept, but objs=", st.objs)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "HealthCheck")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	ctx := context.Background()
+	if err := ims.HealthCheck(ctx); err != nil {
+		t.Fatal("HealthCheck() err=", err)
+	}
+	if files, _ := filepath.Glob(path.Join(dir, "tindex.health*")); len(files) != 0 {
+		t.Fatal("HealthCheck() must not leave files in the working dir, but ", files)
+	}
+
+	// the working dir is not writable
+	os.RemoveAll(dir)
+	err = ims.HealthCheck(ctx)
+	if err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Fatal("HealthCheck() must fail, when the working dir is not writable, but err=", err)
+	}
+
+	// the last save failed
+	if _, _, err := ims.GetOrCreateJournal("a=1"); err == nil {
+		t.Fatal("GetOrCreateJournal() must fail, when the index could not be saved")
+	}
+	err = ims.HealthCheck(ctx)
+	if err == nil || !strings.Contains(err.Error(), "save") {
+		t.Fatal("HealthCheck() must fail, when the last save failed, but err=", err)
+	}
+
+	os.MkdirAll(dir, 0740)
+	src, _, err := ims.GetOrCreateJournal("a=1")
+	if err != nil {
+		t.Fatal("GetOrCreateJournal() err=", err)
+	}
+	ims.Release(src)
+	if err := ims.HealthCheck(ctx); err != nil {
+		t.Fatal("HealthCheck() err=", err)
+	}
+
+	// shut down
+	ims.Shutdown()
+	err = ims.HealthCheck(ctx)
+	if err == nil || !strings.Contains(err.Error(), "shut down") {
+		t.Fatal("HealthCheck() must fail after shutdown, but err=", err)
+	}
+
+	// nothing is checked on the disk, if the index is not saved
+	ims = NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, WorkingDir: dir + "/absent"}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	if err := ims.HealthCheck(ctx); err != nil {
+		t.Fatal("HealthCheck() err=", err)
+	}
+	ims.Shutdown()
+}
+
+func TestFsStorageSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "FsStorageSyncDir")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	// the real directory sync must work on the platform
+	st := NewFsStorage(dir)
+	if err := st.Write("a.tmp", []byte("a")); err != nil {
+		t.Fatal("Write() err=", err)
+	}
+	if err := st.Rename("a.tmp", "a"); err != nil {
+		t.Fatal("Rename() err=", err)
+	}
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	var synced []string
+	syncErr := fmt.Errorf("sync error")
+	defer func(sd func(string) error) { syncDir = sd }(syncDir)
+	syncDir = func(d string) error {
+		synced = append(synced, d)
+		return syncErr
+	}
+
+	// the index is saved, the dir is synced after the rename
+	if _, _, err := ims.GetOrCreateJournal("a=1"); err == nil || !strings.Contains(err.Error(), syncErr.Error()) {
+		t.Fatal("the sync error must be returned, but err=", err)
+	}
+	if len(synced) != 1 || synced[0] != dir {
+		t.Fatal("expected the dir ", dir, " synced, but ", synced)
+	}
+	if _, err := os.Stat(path.Join(dir, cIdxFileName)); err != nil {
+		t.Fatal("the index must be renamed before the sync, err=", err)
+	}
+
+	// the dir is synced after the index and the backup renames
+	syncErr = nil
+	src, _, err := ims.GetOrCreateJournal("a=1")
+	if err != nil || len(synced) != 3 {
+		t.Fatal("the dir must be synced, but err=", err, ", synced=", synced)
+	}
+	ims.Release(src)
+	ims.Shutdown()
+}
+
+func TestCustomStorage(t *testing.T) {
+	st := &testStorage{objs: make(map[string][]byte)}
+	ims := NewInmemServiceWithConfig(InMemConfig{Storage: st}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	src, _, _ := ims.GetOrCreateJournal("a=b")
+	ims.GetOrCreateJournal("a=c")
+	ims.Shutdown()
+
+	if len(st.objs) != 2 || st.objs[cIdxFileName] == nil || st.objs[cIdxBackupFileName] == nil {
+		t.Fatal("expected index and backup in the storage, but objs=", st.objs)
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{Storage: st}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if src2, _, err := ims.GetJournal("a=b"); err != nil || src2 != src || ims.tmap.len() != 2 {
+		t.Fatal("expected src=", src, ", but src2=", src2, ", err=", err, ", tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Collector")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	reg := prometheus.NewRegistry()
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Registry = reg
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	gather := func() map[string]float64 {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal("could not gather the metrics, err=", err)
+		}
+		res := make(map[string]float64)
+		for _, mf := range mfs {
+			if !strings.HasPrefix(mf.GetName(), "logrange_tindex_") || len(mf.GetMetric()) != 1 {
+				t.Fatal("unexpected metric family ", mf)
+			}
+			m := mf.GetMetric()[0]
+			switch {
+			case m.GetGauge() != nil:
+				res[mf.GetName()] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				res[mf.GetName()] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				res[mf.GetName()+"_count"] = float64(m.GetHistogram().GetSampleCount())
+				res[mf.GetName()+"_sum"] = m.GetHistogram().GetSampleSum()
+			}
+		}
+		return res
+	}
+
+	src, _, _ := ims.GetOrCreateJournal("a=1")
+	ims.Release(src)
+	ims.GetOrCreateJournals([]string{"a=2", "a=3"})
+	ims.CountJournals(context.Background(), nil)
+	m := gather()
+	exp := map[string]float64{
+		"logrange_tindex_journals":                    3,
+		"logrange_tindex_create_calls_total":          2,
+		"logrange_tindex_query_calls_total":           1,
+		"logrange_tindex_saves_total":                 3,
+		"logrange_tindex_save_failures_total":         0,
+		"logrange_tindex_save_duration_seconds_count": 3,
+		"logrange_tindex_threshold_warnings_total":    0,
+	}
+	for k, v := range exp {
+		if m[k] != v {
+			t.Fatal("expected ", k, "=", v, ", but ", m[k], " in ", m)
+		}
+	}
+	if m["logrange_tindex_save_duration_seconds_sum"] <= 0 {
+		t.Fatal("the save durations must be summed, but ", m)
+	}
+
+	// the journals gauge follows the records deleted
+	if err = ims.DeleteJournal("a=1"); err != nil {
+		t.Fatal("DeleteJournal() err=", err)
+	}
+	if m = gather(); m["logrange_tindex_journals"] != 2 || m["logrange_tindex_save_duration_seconds_count"] != 4 {
+		t.Fatal("the journals gauge must be updated, but ", m)
+	}
+
+	// the collector is unregistered by the shutdown
+	ims.Shutdown()
+	if m = gather(); len(m) != 0 {
+		t.Fatal("the collector must be unregistered, but ", m)
+	}
+}
+
+func TestEncryptedIndex(t *testing.T) {
+	key := "000102030405060708090a0b0c0d0e0f"
+	for _, k := range []string{"", key, key + "1011121314151617", key + key} {
+		if err := (&InMemConfig{EncryptionKey: k}).Check(); err != nil {
+			t.Fatal("Check() err=", err, " for EncryptionKey=", k)
+		}
+	}
+	for _, k := range []string{"zz", key[:30], key + "10"} {
+		if err := (&InMemConfig{EncryptionKey: k}).Check(); err == nil {
+			t.Fatal("Check() must fail for EncryptionKey=", k)
+		}
+	}
+
+	// the key is not reported with the config
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, EncryptionKey: key, MaxJournals: -1}).(*inmemService)
+	if err := ims.Init(nil); err == nil || strings.Contains(err.Error(), key) || strings.Contains(ims.Config.String(), key) {
+		t.Fatal("Init() must fail without the EncryptionKey in the error, err=", err)
+	}
+
+	st := &testStorage{objs: make(map[string][]byte)}
+	ims = NewInmemServiceWithConfig(InMemConfig{Storage: st, EncryptionKey: key, Compression: CompressionGzip}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	src, _, _ := ims.GetOrCreateJournal("secret=value")
+	ims.Shutdown()
+
+	payload, err := decodeIdxFile(st.objs[cIdxFileName])
+	if err != nil || !bytes.HasPrefix(payload, cEncMagic) || bytes.Contains(payload, []byte("secret")) {
+		t.Fatal("the index must be encrypted, err=", err)
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{Storage: st, EncryptionKey: key}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if src2, _, err := ims.GetJournal("secret=value"); err != nil || src2 != src {
+		t.Fatal("expected src=", src, ", but src2=", src2, ", err=", err)
+	}
+	ims.Shutdown()
+
+	// the index could not be read with the wrong key or without the key
+	for _, k := range []string{"", key[:30] + "00"} {
+		ims = NewInmemServiceWithConfig(InMemConfig{Storage: st, EncryptionKey: k, DoNotSave: true}).(*inmemService)
+		ims.Journals = &testJournals{}
+		if err = ims.Init(nil); err == nil {
+			ims.Shutdown()
+			t.Fatal("Init() must fail for EncryptionKey=", k)
+		}
+	}
+
+	// the plaintext index is loaded and encrypted when the key is set
+	st = &testStorage{objs: make(map[string][]byte)}
+	ims = NewInmemServiceWithConfig(InMemConfig{Storage: st}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	src, _, _ = ims.GetOrCreateJournal("a=b")
+	ims.Shutdown()
+
+	ims = NewInmemServiceWithConfig(InMemConfig{Storage: st, EncryptionKey: key}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if src2, _, err := ims.GetJournal("a=b"); err != nil || src2 != src {
+		t.Fatal("expected src=", src, ", but src2=", src2, ", err=", err)
+	}
+	ims.GetOrCreateJournal("a=c")
+	ims.Shutdown()
+	if payload, err = decodeIdxFile(st.objs[cIdxFileName]); err != nil || !bytes.HasPrefix(payload, cEncMagic) {
+		t.Fatal("the index must be encrypted, err=", err)
+	}
+}
+
+func TestShardedIndex(t *testing.T) {
+	st := &testStorage{objs: make(map[string][]byte)}
+	open := func(shards int) *inmemService {
+		ims := NewInmemServiceWithConfig(InMemConfig{Storage: st, ShardCount: shards}).(*inmemService)
+		ims.Journals = &testJournals{}
+		if err := ims.Init(nil); err != nil {
+			t.Fatal("Init() err=", err)
+		}
+		return ims
+	}
+	checkIdx := func(ims *inmemService, srcs map[string]string) {
+		if ims.tmap.len() != len(srcs) {
+			t.Fatal("expected ", len(srcs), " records, but tmap=", ims.tmap.snapshot())
+		}
+		for tags, src := range srcs {
+			if src2, _, err := ims.GetJournal(tags); err != nil || src2 != src {
+				t.Fatal("expected src=", src, " for ", tags, ", but src2=", src2, ", err=", err)
+			}
+			ims.Release(src)
+		}
+	}
+
+	// the legacy single index
+	ims := open(0)
+	srcs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		tags := fmt.Sprintf("a=%d", i)
+		src, _, _ := ims.GetOrCreateJournal(tags)
+		ims.Release(src)
+		srcs[tags] = src
+	}
+	ims.Shutdown()
+
+	// the legacy index is migrated to the shards
+	ims = open(4)
+	checkIdx(ims, srcs)
+	src, _, _ := ims.GetOrCreateJournal("a=20")
+	ims.Release(src)
+	srcs["a=20"] = src
+	ims.Shutdown()
+	total := 0
+	for i := 0; i < 4; i++ {
+		data, err := readIdxFile(st, idxFileNames(i).name, nil)
+		if err != nil {
+			t.Fatal("the shard ", i, " must be written, err=", err)
+		}
+		var tmap map[tag.Line]*tagsDesc
+		json.Unmarshal(data, &tmap)
+		if len(tmap) == len(srcs) {
+			t.Fatal("the records must be distributed between the shards, but shard ", i, " contains all of them")
+		}
+		total += len(tmap)
+	}
+	if total != len(srcs) || st.objs[cIdxShardsFileName] == nil {
+		t.Fatal("expected ", len(srcs), " records in the shards and the manifest, but ", total, " records, objs=", st.objs)
+	}
+
+	// the index is loaded regardless of the ShardCount, the records are re-distributed
+	ims = open(0)
+	checkIdx(ims, srcs)
+	ims.Shutdown()
+	ims = open(2)
+	checkIdx(ims, srcs)
+	ims.DeleteJournal("a=20")
+	delete(srcs, "a=20")
+	ims.Shutdown()
+	ims = open(3)
+	checkIdx(ims, srcs)
+	ims.Shutdown()
+
+	if err := (&InMemConfig{ShardCount: -1}).Check(); err == nil {
+		t.Fatal("Check() must fail for the negative ShardCount")
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "GetStats")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ims.GetOrCreateJournal("a=1")
+	ims.GetOrCreateJournal("a=1")
+	ims.GetOrCreateJournals([]string{"a=2", "a=3"})
+	ims.CountJournals(context.Background(), nil)
+	ims.GetJournalsPage(context.Background(), nil, "", 10)
+
+	st := ims.GetStats()
+	// the first save happens in Init()
+	if st.Journals != 3 || st.CreateCalls != 3 || st.QueryCalls != 2 || st.Saves != 3 || st.SaveFailures != 0 {
+		t.Fatal("wrong stats ", st)
+	}
+	if st.SaveDuration <= 0 || st.LastSaveDuration <= 0 || st.LastSaveDuration > st.SaveDuration {
+		t.Fatal("wrong save durations ", st)
+	}
+
+	os.RemoveAll(dir)
+	ims.GetOrCreateJournal("a=4")
+	if st = ims.GetStats(); st.SaveFailures != 1 || st.Journals != 3 {
+		t.Fatal("wrong stats after failure ", st)
+	}
+}
+
+func TestStatsDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "StatsDirty")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, FlushIntervalMs: 3600000}).(*inmemService)
+	ims.Journals = &testJournals{}
+	start := time.Now()
+	ims.Init(nil)
+	defer ims.Shutdown()
+
+	st := ims.GetStats()
+	if st.Dirty || st.LastSaveTime.Before(start) {
+		t.Fatal("the index must be saved in Init(), but ", st)
+	}
+	saved := st.LastSaveTime
+
+	src, _, _ := ims.GetOrCreateJournal("a=1")
+	ims.Release(src)
+	if st = ims.GetStats(); !st.Dirty || st.LastSaveTime != saved {
+		t.Fatal("the index must be dirty after the change, but ", st)
+	}
+
+	ims.lock.Lock()
+	ims.flushUnsafe()
+	ims.lock.Unlock()
+	if st = ims.GetStats(); st.Dirty || !st.LastSaveTime.After(saved) {
+		t.Fatal("the index must not be dirty after the flush, but ", st)
+	}
+}
+
+func TestMaxJournals(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, MaxJournals: 3}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ims.GetOrCreateJournal("a=1")
+	if _, err := ims.GetOrCreateJournals([]string{"a=2", "a=3", "a=4"}); err == nil {
+		t.Fatal("must fail, the limit is 3")
+	}
+	if ims.tmap.len() != 1 || ims.smap.len() != 1 {
+		t.Fatal("nothing must be added, but tmap=", ims.tmap.snapshot())
+	}
+
+	ims.GetOrCreateJournals([]string{"a=1", "a=2", "a=3"})
+	if _, _, err := ims.GetOrCreateJournal("a=4"); err == nil {
+		t.Fatal("must fail, the limit is 3")
+	}
+	if _, _, err := ims.GetOrCreateJournal("a=3"); err != nil {
+		t.Fatal("existing source must be returned, but err=", err)
+	}
+	if ims.tmap.len() != 3 {
+		t.Fatal("expected 3 records, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestWarnJournalsThreshold(t *testing.T) {
+	if err := (&InMemConfig{MaxJournals: 3, WarnJournalsThreshold: 4}).Check(); err == nil {
+		t.Fatal("Check() must fail, the threshold is greater than MaxJournals")
+	}
+
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, MaxJournals: 5, WarnJournalsThreshold: 3}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ims.GetOrCreateJournals([]string{"a=1", "a=2"})
+	if n := ims.GetStats().ThresholdWarnings; n != 0 {
+		t.Fatal("no warning expected below the threshold, but ", n)
+	}
+	ims.GetOrCreateJournal("a=3")
+	ims.GetOrCreateJournals([]string{"a=3", "a=4"})
+	ims.GetOrCreateJournal("a=5")
+	if n := ims.GetStats().ThresholdWarnings; n != 1 {
+		t.Fatal("a single warning expected for the crossing, but ", n)
+	}
+
+	// falls below the threshold and crosses it again
+	for _, tags := range []string{"a=3", "a=4", "a=5"} {
+		ims.tmap.get(tag.Line(tags)).readers = 0
+		if err := ims.DeleteJournal(tags); err != nil {
+			t.Fatal("DeleteJournal() err=", err)
+		}
+	}
+	ims.GetOrCreateJournal("a=6")
+	if n := ims.GetStats().ThresholdWarnings; n != 2 {
+		t.Fatal("the second crossing must be reported, but warnings=", n)
+	}
+}
+
+func TestMaxTagValues(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, MaxTagValues: 2}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ims.GetOrCreateJournal("app=a,req=1")
+	ims.GetOrCreateJournal("app=a,req=2")
+	if _, _, err := ims.GetOrCreateJournal("app=a,req=3"); err == nil {
+		t.Fatal("must fail, req has too many values")
+	}
+	if _, err := ims.GetOrCreateJournals([]string{"app=b", "app=c"}); err == nil {
+		t.Fatal("must fail, app has too many values")
+	}
+	if ims.tmap.len() != 2 || len(ims.kvals["app"]) != 1 || len(ims.kvals["req"]) != 2 {
+		t.Fatal("nothing must be added, but tmap=", ims.tmap.snapshot(), ", kvals=", ims.kvals)
+	}
+
+	src, _, err := ims.GetOrCreateJournal("app=b")
+	if err != nil {
+		t.Fatal("must be created, but err=", err)
+	}
+
+	// releasing a value allows to add another one
+	ims.LockExclusively(src)
+	ims.Delete(src)
+	if _, _, err := ims.GetOrCreateJournal("app=c"); err != nil {
+		t.Fatal("must be created, but err=", err)
+	}
+}
+
+func TestAllowedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "AllowedKeys")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	src1, _, _ := ims.GetOrCreateJournal("app=a,pod=p1")
+	ims.Release(src1)
+	ims.Shutdown()
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, AllowedKeys: []string{"app", "env"}}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src1}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims.Shutdown()
+	for _, tags := range []string{"app=a", "app=b,env=prod", "env=dev"} {
+		src, _, err := ims.GetOrCreateJournal(tags)
+		if err != nil {
+			t.Fatal("GetOrCreateJournal() err=", err, " for ", tags)
+		}
+		ims.Release(src)
+	}
+
+	_, _, err = ims.GetOrCreateJournal("app=a,pod=p2")
+	if errors.Cause(err) != ErrInvalidTags || !strings.Contains(err.Error(), `"pod"`) {
+		t.Fatal("the unknown key pod must be reported, but err=", err)
+	}
+	if _, err = ims.GetOrCreateJournals([]string{"app=c", "host=h1"}); errors.Cause(err) != ErrInvalidTags || !strings.Contains(err.Error(), `"host"`) {
+		t.Fatal("the unknown key host must be reported, but err=", err)
+	}
+	if ims.tmap.get("app=c") != nil {
+		t.Fatal("no records must be added, but tmap=", ims.tmap.snapshot())
+	}
+
+	// the record created before is available
+	if src, _, err := ims.GetOrCreateJournal("app=a,pod=p1"); err != nil || src != src1 {
+		t.Fatal("expected src=", src1, ", but src=", src, ", err=", err)
+	}
+
+	if err = (&InMemConfig{AllowedKeys: []string{"app", " "}}).Check(); err == nil {
+		t.Fatal("Check() must fail for the empty key")
+	}
+}
+
+func TestRequiredKeys(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, RequiredKeys: []string{"env", "service"}}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims.Shutdown()
+
+	for _, tags := range []string{"env=prod,service=api", "env=dev,pod=p1,service=db"} {
+		src, _, err := ims.GetOrCreateJournal(tags)
+		if err != nil {
+			t.Fatal("GetOrCreateJournal() err=", err, " for ", tags)
+		}
+		ims.Release(src)
+	}
+
+	for tags, missing := range map[string]string{"env=prod": "[service]", "pod=p1": "[env service]", `env="",service=api`: "[env]"} {
+		_, _, err := ims.GetOrCreateJournal(tags)
+		if errors.Cause(err) != ErrInvalidTags || !strings.Contains(err.Error(), missing) {
+			t.Fatal("the missing keys ", missing, " must be reported for ", tags, ", but err=", err)
+		}
+	}
+	if _, err := ims.GetOrCreateJournals([]string{"env=prod,service=web", "service=web"}); errors.Cause(err) != ErrInvalidTags {
+		t.Fatal("GetOrCreateJournals() must fail, but err=", err)
+	}
+	if ims.tmap.len() != 2 {
+		t.Fatal("no records must be added, but tmap=", ims.tmap.snapshot())
+	}
+
+	cfg := InMemConfig{AllowedKeys: []string{"env", "service"}, RequiredKeys: []string{"env"}}
+	if err := cfg.Check(); err != nil {
+		t.Fatal("Check() err=", err)
+	}
+	cfg.RequiredKeys = []string{"env", "pod"}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("Check() must fail for the required key, which is not allowed")
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	for i := 0; i < 2*cCtxCheckPeriod; i++ {
+		ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ims.CountJournals(ctx, nil); err != context.Canceled {
+		t.Fatal("expected context.Canceled, but err=", err)
+	}
+	if _, _, err := ims.GetJournalsPage(ctx, nil, "", 10); err != context.Canceled {
+		t.Fatal("expected context.Canceled, but err=", err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	defer ims.Shutdown()
+
+	n := 2*cForEachBatchSize + cForEachBatchSize/2
+	srcs := make(map[tag.Line]string, n)
+	for i := 0; i < n; i++ {
+		src, ts, err := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		if err != nil {
+			t.Fatal("GetOrCreateJournal() err=", err)
+		}
+		srcs[ts.Line()] = src
+	}
+
+	visited := make(map[tag.Line]string, n)
+	last := tag.Line("")
+	queries := ims.GetStats().QueryCalls
+	err := ims.ForEach(context.Background(), func(tl tag.Line, src string) error {
+		if _, ok := visited[tl]; ok {
+			t.Fatal("the entry ", tl, " is visited twice")
+		}
+		if tl <= last {
+			t.Fatal("the entry ", tl, " is visited after ", last)
+		}
+		visited[tl] = src
+		last = tl
+		return nil
+	})
+	if err != nil || len(visited) != n {
+		t.Fatal("expected ", n, " entries visited, but ", len(visited), ", err=", err)
+	}
+	if q := ims.GetStats().QueryCalls - queries; q != 1 {
+		t.Fatal("the scan must be counted as 1 query, but ", q)
+	}
+	for tl, src := range srcs {
+		if visited[tl] != src {
+			t.Fatal("expected ", src, " for ", tl, ", but ", visited[tl])
+		}
+	}
+
+	// fn error stops the scan
+	cnt := 0
+	testErr := fmt.Errorf("test error")
+	err = ims.ForEach(context.Background(), func(tl tag.Line, src string) error {
+		if cnt++; cnt == 10 {
+			return testErr
+		}
+		return nil
+	})
+	if err != testErr || cnt != 10 {
+		t.Fatal("expected the scan stopped at 10, but cnt=", cnt, ", err=", err)
+	}
+
+	// the closed context stops the scan
+	ctx, cancel := context.WithCancel(context.Background())
+	cnt = 0
+	err = ims.ForEach(ctx, func(tl tag.Line, src string) error {
+		if cnt++; cnt == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || cnt != 10 {
+		t.Fatal("expected the scan cancelled at 10, but cnt=", cnt, ", err=", err)
+	}
+}
+
+func TestRebuildOnMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "RebuildOnMissing")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{"AB01", "AB02"}}
+	if err = ims.Init(nil); err == nil {
+		t.Fatal("Init() must fail, the journals are not in the index")
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, RebuildOnMissing: true}).(*inmemService)
+	ims.Journals = &testJournals{[]string{"AB01", "AB02"}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	src, _, err := ims.GetJournal(cRebuiltSrcTag + "=AB02")
+	if err != nil || src != "AB02" || ims.tmap.len() != 2 {
+		t.Fatal("the journal must be restored, but src=", src, ", err=", err, ", tmap=", ims.tmap.snapshot())
+	}
+	ims.Release(src)
+	ims.Shutdown()
+
+	// must be persisted
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{"AB01", "AB02"}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "CheckConsistency")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	srcs := make(map[string]string)
+	for _, tags := range []string{"a=1", "a=2", "a=3"} {
+		src, _, err := ims.GetOrCreateJournal(tags)
+		if err != nil {
+			t.Fatal("GetOrCreateJournal() err=", err)
+		}
+		ims.Release(src)
+		srcs[tags] = src
+	}
+
+	// seed the mismatch: a=2 has no journal, and there is the journal ZZZ without record
+	ims.Journals = &testJournals{[]string{srcs["a=1"], "ZZZ", srcs["a=3"]}}
+	cr, err := ims.CheckConsistency(context.Background())
+	if err != nil {
+		t.Fatal("CheckConsistency() err=", err)
+	}
+
+	if cr.IsConsistent() || cr.Journals != 3 || cr.Records != 3 {
+		t.Fatal("wrong report ", cr)
+	}
+
+	if !reflect.DeepEqual(cr.Orphans, []tag.Line{"a=2"}) || !reflect.DeepEqual(cr.Missing, []string{"ZZZ"}) {
+		t.Fatal("wrong orphans or missing in the report ", cr)
+	}
+
+	ims.Journals = &testJournals{[]string{srcs["a=1"], srcs["a=2"], srcs["a=3"]}}
+	cr, err = ims.CheckConsistency(context.Background())
+	if err != nil || !cr.IsConsistent() {
+		t.Fatal("must be consistent, but cr=", cr, ", err=", err)
+	}
+}
+
+func TestRetagJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "RetagJournal")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	src1, _, _ := ims.GetOrCreateJournal("app=a,pod=p1")
+	src2, _, _ := ims.GetOrCreateJournal("app=b")
+	ims.Release(src2)
+	ch, unsubscribe, _ := ims.Subscribe(&lql.Source{})
+	defer unsubscribe()
+
+	// the acquired source could not be retagged
+	if err = ims.RetagJournal("pod=p1, app=a", "app=a,pod=p1,zone=z1"); err != errors2.WrongState {
+		t.Fatal("RetagJournal() must fail for the acquired source, but err=", err)
+	}
+	ims.Release(src1)
+	if err = ims.RetagJournal("pod=p1, app=a", "app=a,pod=p1,zone=z1"); err != nil {
+		t.Fatal("RetagJournal() err=", err)
+	}
+	if ev := <-ch; ev.Type != JE_DELETED || ev.Src != src1 || ev.Tags.Line() != "app=a,pod=p1" {
+		t.Fatal("expected the old line deleted, but ", ev)
+	}
+	if ev := <-ch; ev.Type != JE_CREATED || ev.Src != src1 || ev.Tags.Line() != "app=a,pod=p1,zone=z1" {
+		t.Fatal("expected the new line created, but ", ev)
+	}
+	if _, _, err = ims.GetJournal("app=a,pod=p1"); errors.Cause(err) != ErrNotFound {
+		t.Fatal("the old line must be removed, but err=", err)
+	}
+	if ts, err := ims.GetJournalTags(src1, false); err != nil || ts.Line() != "app=a,pod=p1,zone=z1" {
+		t.Fatal("expected the new tags for ", src1, ", but ", ts.Line(), ", err=", err)
+	}
+
+	// the line of another source
+	if err = ims.RetagJournal("app=a,pod=p1,zone=z1", "app=b"); errors.Cause(err) != ErrAlreadyExists {
+		t.Fatal("RetagJournal() must fail for the existing line, but err=", err)
+	}
+	if err = ims.RetagJournal("app=c", "app=d"); errors.Cause(err) != ErrNotFound {
+		t.Fatal("RetagJournal() must fail for the unknown line, but err=", err)
+	}
+	if ims.tmap.len() != 2 || ims.smap.len() != 2 || ims.tmap.get("app=b").Src != src2 {
+		t.Fatal("the index must not be changed, but tmap=", ims.tmap.snapshot())
+	}
+	ims.Shutdown()
+
+	// the change is persisted
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src1, src2}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	if src, _, err := ims.GetJournal("app=a,pod=p1,zone=z1"); err != nil || src != src1 {
+		t.Fatal("expected src=", src1, ", but src=", src, ", err=", err)
+	}
+	ims.Shutdown()
+}
+
+func TestRetagJournalConcurrent(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	defer ims.Shutdown()
+	for i := 0; i < 10; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		ims.Release(src)
+	}
+
+	var wg sync.WaitGroup
+	var stop int32
+	reader := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				f()
+			}
+		}()
+	}
+	reader(func() {
+		if jis, err := ims.List(); err != nil || len(jis) != 10 {
+			t.Error("List() must return 10 records, but ", len(jis), ", err=", err)
+		}
+	})
+	for _, flags := range []int{0, VF_SKIP_IF_LOCKED} {
+		flags := flags
+		reader(func() {
+			ims.Visit(&lql.Source{}, func(tags tag.Set, jrnl string) bool {
+				return tags.Line() != ""
+			}, flags)
+		})
+	}
+
+	for i := 0; i < 1000; i++ {
+		from, to := fmt.Sprintf("a=%d", i%10), fmt.Sprintf("a=%d,b=%d", i%10, i)
+		if i >= 10 {
+			from = fmt.Sprintf("a=%d,b=%d", i%10, i-10)
+		}
+		for {
+			err := ims.RetagJournal(from, to)
+			if err == nil {
+				break
+			}
+			if err != errors2.WrongState {
+				t.Fatal("RetagJournal() err=", err)
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	for _, td := range ims.tmap.snapshot() {
+		if td.readers != 0 || td.exclusive || ims.smap.load(td.Src) != td {
+			t.Fatal("the records must be released and consistent, but ", td)
+		}
+	}
+}
+
+func TestDropOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "DropOrphans")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	srcs := make(map[string]string)
+	for _, tags := range []string{"a=1", "a=2", "a=3", "a=4"} {
+		src, _, err := ims.GetOrCreateJournal(tags)
+		if err != nil {
+			t.Fatal("GetOrCreateJournal() err=", err)
+		}
+		ims.Release(src)
+		srcs[tags] = src
+	}
+
+	ims.Journals = &testJournals{[]string{srcs["a=1"], srcs["a=2"], srcs["a=3"], srcs["a=4"]}}
+	n, err := ims.DropOrphans(context.Background())
+	if n != 0 || err != nil {
+		t.Fatal("nothing to drop in the healthy index, but n=", n, ", err=", err)
+	}
+
+	// a=2 and a=4 are orphans, a=4 is acquired
+	src, _, _ := ims.GetJournal("a=4")
+	ims.Journals = &testJournals{[]string{srcs["a=1"], srcs["a=3"]}}
+	n, err = ims.DropOrphans(context.Background())
+	if n != 1 || err != nil {
+		t.Fatal("expected 1 record removed, but n=", n, ", err=", err)
+	}
+
+	ims.Release(src)
+	n, err = ims.DropOrphans(context.Background())
+	if n != 1 || err != nil {
+		t.Fatal("expected 1 record removed, but n=", n, ", err=", err)
+	}
+
+	if ims.tmap.len() != 2 || ims.smap.len() != 2 {
+		t.Fatal("expected 2 records, but tmap=", ims.tmap.snapshot())
+	}
+	ims.Shutdown()
+
+	// the result must be persisted
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{srcs["a=1"], srcs["a=3"]}}
+	ims.Init(nil)
+	cr, err := ims.CheckConsistency(context.Background())
+	if err != nil || !cr.IsConsistent() || cr.Records != 2 {
+		t.Fatal("must be consistent, but cr=", cr, ", err=", err)
+	}
+}
+
+func TestConsistencyMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ConsistencyMode")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	src1, _, _ := ims.GetOrCreateJournal("a=1")
+	ims.Release(src1)
+	src2, _, _ := ims.GetOrCreateJournal("a=2")
+	ims.Release(src2)
+	ims.Shutdown()
+
+	// a=2 is orphaned, and the journal ZZZ is not in the index
+	jrnls := &testJournals{[]string{src1, "ZZZ"}}
+
+	newIms := func(mode string) *inmemService {
+		ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, ConsistencyMode: mode}).(*inmemService)
+		ims.Journals = jrnls
+		return ims
+	}
+
+	if err = newIms("bad").Init(nil); err == nil {
+		t.Fatal("Init() must fail for the unknown mode")
+	}
+
+	for _, mode := range []string{"", ConsistencyStrict} {
+		if err = newIms(mode).Init(nil); err == nil {
+			t.Fatal("Init() must fail in the mode ", mode)
+		}
+	}
+
+	ims = newIms(ConsistencyWarn)
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() must not fail in the warn mode, err=", err)
+	}
+	cr, _ := ims.CheckConsistency(context.Background())
+	if len(cr.Orphans) != 1 || len(cr.Missing) != 1 {
+		t.Fatal("the index must not be changed in the warn mode, but cr=", cr)
+	}
+	ims.Shutdown()
+
+	ims = newIms(ConsistencyRepair)
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() must not fail in the repair mode, err=", err)
+	}
+	cr, _ = ims.CheckConsistency(context.Background())
+	if !cr.IsConsistent() || cr.Records != 2 {
+		t.Fatal("the index must be repaired, but cr=", cr)
+	}
+	if _, err = ims.GetJournalTags("ZZZ", false); err != nil {
+		t.Fatal("ZZZ must be rebuilt, err=", err)
+	}
+	ims.Shutdown()
+
+	// the repaired index must be persisted
+	if err = newIms(ConsistencyStrict).Init(nil); err != nil {
+		t.Fatal("Init() must succeed after the repair, err=", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ReadOnly")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	src, _, _ := ims.GetOrCreateJournal("a=1")
+	ims.Release(src)
+	ims.Shutdown()
+	data := readFile(t, path.Join(dir, cIdxFileName))
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, ReadOnly: true}).(*inmemService)
+	ims.Journals = &testJournals{[]string{src}}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+
+	src2, _, err := ims.GetOrCreateJournal("a=1")
+	if err != nil || src2 != src {
+		t.Fatal("existing source must be returned, but src2=", src2, ", err=", err)
+	}
+	ims.Release(src2)
+
+	if _, _, err = ims.GetOrCreateJournal("a=2"); err != errReadOnly {
+		t.Fatal("creation must be rejected, but err=", err)
+	}
+
+	if _, err = ims.GetOrCreateJournals([]string{"a=1", "a=3"}); err != errReadOnly {
+		t.Fatal("creation must be rejected, but err=", err)
+	}
+
+	if err = ims.DeleteJournal("a=1"); err != errReadOnly {
+		t.Fatal("deletion must be rejected, but err=", err)
+	}
+
+	cnt, err := ims.CountJournals(context.Background(), nil)
+	if cnt != 1 || err != nil || ims.tmap.len() != 1 {
+		t.Fatal("the index must not be changed, but cnt=", cnt, ", err=", err)
+	}
+	ims.Shutdown()
+
+	if !reflect.DeepEqual(data, readFile(t, path.Join(dir, cIdxFileName))) {
+		t.Fatal("the index file must not be changed")
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, ReadOnly: true, RebuildOnMissing: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err == nil {
+		t.Fatal("ReadOnly with RebuildOnMissing must be rejected")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ExportImport")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	for i := 0; i < 10; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d,b=c", i))
+		ims.Release(src)
+	}
+
+	var buf bytes.Buffer
+	if err = ims.Export(&buf); err != nil {
+		t.Fatal("Export() err=", err)
+	}
+	data := buf.String()
+	if strings.Count(data, "\n") != 10 || !strings.HasPrefix(data, `{"tags":"a=0,b=c","src":"`) {
+		t.Fatal("wrong export ", data)
+	}
+
+	smap := make(map[string]tag.Line)
+	for _, td := range ims.tmap.snapshot() {
+		smap[td.Src] = td.tags.Line()
+	}
+
+	// wipe
+	for _, td := range ims.tmap.snapshot() {
+		ims.removeUnsafe(td)
+	}
+
+	if err = ims.Import(strings.NewReader(data), IMPORT_MERGE); err != nil {
+		t.Fatal("Import() err=", err)
+	}
+
+	smap2 := make(map[string]tag.Line)
+	for _, td := range ims.tmap.snapshot() {
+		smap2[td.Src] = td.tags.Line()
+	}
+	if !reflect.DeepEqual(smap, smap2) || ims.tmap.len() != 10 {
+		t.Fatal("expected ", smap, ", but got ", smap2)
+	}
+
+	// the same again is ok
+	if err = ims.Import(strings.NewReader(data), IMPORT_MERGE); err != nil || ims.tmap.len() != 10 {
+		t.Fatal("Import() err=", err)
+	}
+
+	// conflict
+	if err = ims.Import(strings.NewReader(`{"tags":"a=0,b=c","src":"XXX"}`), IMPORT_MERGE); err == nil {
+		t.Fatal("the conflict must be reported")
+	}
+
+	if err = ims.Import(strings.NewReader(`{"tags":"a=1","src":"XXX"}`+"\n"), IMPORT_REPLACE); err != nil {
+		t.Fatal("Import() err=", err)
+	}
+	if ims.tmap.len() != 1 || ims.smap.len() != 1 || ims.smap.load("XXX") == nil {
+		t.Fatal("the index must be replaced, but tmap=", ims.tmap.snapshot())
+	}
+
+	if err = ims.Import(strings.NewReader(`{"tags":"a=1","src":"XXX"} bad`), IMPORT_REPLACE); err == nil {
+		t.Fatal("the bad input must be reported")
+	}
+	if err = ims.Import(strings.NewReader(""), 5); err == nil {
+		t.Fatal("the bad mode must be reported")
+	}
+	ims.Shutdown()
+
+	// must be persisted
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{[]string{"XXX"}}
+	if err = ims.Init(nil); err != nil || ims.tmap.len() != 1 {
+		t.Fatal("Init() err=", err, ", tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, Compression: CompressionGzip}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	for i := 0; i < 100; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+		ims.Release(src)
+	}
+
+	// the journals are created while the snapshot is taken
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 100; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", i))
+			if err != nil {
+				t.Error("GetOrCreateJournal() err=", err)
+				return
+			}
+			ims.Release(src)
+		}
+	}()
+
+	var buf bytes.Buffer
+	err := ims.Snapshot(&buf)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal("Snapshot() err=", err)
+	}
+
+	// the snapshot is loaded as the index file
+	st := &testStorage{objs: map[string][]byte{cIdxFileName: buf.Bytes()}}
+	ims2 := NewInmemServiceWithConfig(InMemConfig{Storage: st, ConsistencyMode: ConsistencyWarn}).(*inmemService)
+	ims2.Journals = &testJournals{}
+	if err = ims2.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims2.Shutdown()
+	if ims2.tmap.len() < 100 || ims2.tmap.len() > ims.tmap.len() {
+		t.Fatal("expected from 100 to ", ims.tmap.len(), " records, but ", ims2.tmap.len())
+	}
+	for tl, td := range ims2.tmap.snapshot() {
+		if ims.tmap.get(tl) == nil || ims.tmap.get(tl).Src != td.Src || td.readers != 0 {
+			t.Fatal("the record ", td, " doesn't match the index")
+		}
+	}
+
+	ims.Shutdown()
+	if err = ims.Snapshot(&buf); err == nil {
+		t.Fatal("Snapshot() must fail after shutdown")
+	}
+}
+
+func TestLoadNormalizationCollision(t *testing.T) {
+	// the index written by an older version, which didn't normalize the tags
+	legacy := []byte(`{"b=2,a=1":{"Src":"S1"},"a=1,b=2":{"Src":"S2"},"c=3":{"Src":"S3"}}`)
+	jrnls := &testJournals{[]string{"S1", "S2", "S3"}}
+	newIms := func(mode string) *inmemService {
+		st := &testStorage{objs: map[string][]byte{cIdxFileName: legacy}}
+		ims := NewInmemServiceWithConfig(InMemConfig{Storage: st, ConsistencyMode: mode}).(*inmemService)
+		ims.Journals = jrnls
+		return ims
+	}
+
+	for _, mode := range []string{"", ConsistencyStrict} {
+		if err := newIms(mode).Init(nil); err == nil {
+			t.Fatal("Init() must fail for the collision in the mode ", mode)
+		}
+	}
+
+	for _, mode := range []string{ConsistencyWarn, ConsistencyRepair} {
+		ims := newIms(mode)
+		if err := ims.Init(nil); err != nil {
+			t.Fatal("Init() err=", err, " in the mode ", mode)
+		}
+		// the dropped journal is rebuilt in the repair mode
+		td := ims.smap.load("S1")
+		if ims.smap.len() != ims.tmap.len() || (mode == ConsistencyWarn) != (td == nil) ||
+			(td != nil && td.tags.Line() != "lr_rebuilt_src=S1") {
+			t.Fatal("the record of S1 must be dropped, but tmap=", ims.tmap.snapshot(), ", smap=", ims.smap.len())
+		}
+		src, _, err := ims.GetJournal("b=2,a=1")
+		if err != nil || src != "S2" {
+			t.Fatal("the normalized record S2 must be kept, but src=", src, ", err=", err)
+		}
+		ims.Release(src)
+
+		cr, _ := ims.CheckConsistency(context.Background())
+		if mode == ConsistencyWarn && (len(cr.Missing) != 1 || cr.Missing[0] != "S1") {
+			t.Fatal("S1 must be reported as missing in the warn mode, but cr=", cr)
+		}
+		if mode == ConsistencyRepair && !cr.IsConsistent() {
+			t.Fatal("the index must be repaired, but cr=", cr)
+		}
+		ims.Shutdown()
+	}
+}
+
+func TestNormalizedTags(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	src1, ts1, err := ims.GetOrCreateJournal("a=1,b=2")
+	if err != nil {
+		t.Fatal("GetOrCreateJournal() err=", err)
+	}
+	ims.Release(src1)
+
+	for i := 0; i < 2; i++ {
+		src2, ts2, err := ims.GetOrCreateJournal("b=2,a=1")
+		if err != nil || src1 != src2 || ts1.Line() != ts2.Line() {
+			t.Fatal("the same source expected, but src1=", src1, ", src2=", src2, ", err=", err)
+		}
+		ims.Release(src2)
+
+		if ims.lcache["b=2,a=1"] != "a=1,b=2" || len(ims.lcache) != 1 {
+			t.Fatal("the line must be cached, but lcache=", ims.lcache)
+		}
+	}
+
+	src3, _, err := ims.GetJournal("b=2, a=1")
+	if err != nil || src3 != src1 {
+		t.Fatal("the same source expected, but src3=", src3, ", err=", err)
+	}
+	ims.Release(src3)
+
+	if ims.tmap.len() != 1 {
+		t.Fatal("expected exactly one source, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestDuplicateTagKeys(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	if _, _, err := ims.GetOrCreateJournal("a=1,b=2,a=2"); err == nil {
+		t.Fatal("GetOrCreateJournal() must fail for the duplicate tag")
+	}
+	if ims.tmap.len() != 0 || len(ims.lcache) != 0 {
+		t.Fatal("no journals expected, but tmap=", ims.tmap.snapshot(), ", lcache=", ims.lcache)
+	}
+}
+
+func BenchmarkGetOrCreateNotNormalized(b *testing.B) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, _, _ := ims.GetOrCreateJournal("b=2,a=1,c=3")
+		ims.Release(src)
+	}
+}
+
+func TestGetOrCreateJournalByTags(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ts, _ := tag.Parse("b=2,a=1")
+	src, err := ims.GetOrCreateJournalByTags(ts)
+	if err != nil {
+		t.Fatal("GetOrCreateJournalByTags() err=", err)
+	}
+	src2, ts2, err := ims.GetOrCreateJournal("a=1,b=2")
+	if err != nil || src2 != src || !ts2.Equals(ts) {
+		t.Fatal("expected the same source ", src, ", but src2=", src2, ", err=", err)
+	}
+	if src2, err = ims.GetOrCreateJournalByTags(ts); err != nil || src2 != src || ims.tmap.get(ts.Line()).readers != 3 {
+		t.Fatal("expected the source ", src, " acquired 3 times, but src2=", src2, ", err=", err, ", tmap=", ims.tmap.snapshot())
+	}
+
+	if _, err = ims.GetOrCreateJournalByTags(tag.EmptySet); err == nil {
+		t.Fatal("GetOrCreateJournalByTags() must fail for the empty tags")
+	}
+	if ims.tmap.len() != 1 {
+		t.Fatal("expected exactly one source, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestDeterministicSrc(t *testing.T) {
+	newService := func() *inmemService {
+		ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, DeterministicSrc: true}).(*inmemService)
+		ims.Journals = &testJournals{}
+		ims.Init(nil)
+		return ims
+	}
+
+	// the sources are the same on the different instances
+	ims1, ims2 := newService(), newService()
+	defer ims1.Shutdown()
+	defer ims2.Shutdown()
+	src1, _, err := ims1.GetOrCreateJournal("a=1,b=2")
+	if err != nil {
+		t.Fatal("GetOrCreateJournal() err=", err)
+	}
+	ims2.GetOrCreateJournal("c=3")
+	src2, _, err := ims2.GetOrCreateJournal("{b=2, a=1}")
+	if err != nil || src1 != src2 || src1 != hashSrc("a=1,b=2") {
+		t.Fatal("expected the same source ", src1, ", but src2=", src2, ", err=", err)
+	}
+	res, err := ims1.GetOrCreateJournals([]string{"c=3", "d=4"})
+	if err != nil || res["c=3"] != ims2.tmap.get("c=3").Src {
+		t.Fatal("expected the same source for c=3, but res=", res, ", err=", err)
+	}
+	if src3, _, _ := ims1.GetOrCreateJournal("a=2"); src3 == src1 || len(src3) != len(src1) {
+		t.Fatal("expected the different source for the different tags, but ", src3)
+	}
+
+	// the id is taken by another tags line
+	ts, _ := tag.Parse("x=1")
+	ims1.lock.Lock()
+	ims1.addUnsafe(&tagsDesc{tags: ts, Src: hashSrc("y=1")})
+	ims1.lock.Unlock()
+	if _, _, err = ims1.GetOrCreateJournal("y=1"); errors.Cause(err) != errSrcCollision {
+		t.Fatal("expected the collision error, but err=", err)
+	}
+	if _, err = ims1.GetOrCreateJournals([]string{"z=1", "y=1"}); errors.Cause(err) != errSrcCollision {
+		t.Fatal("expected the collision error, but err=", err)
+	}
+	if ims1.tmap.get("y=1") != nil {
+		t.Fatal("the record must not be created")
+	}
+	if ims1.tmap.get("z=1") != nil {
+		t.Fatal("the records of the batch must not be created")
+	}
+}
+
+func BenchmarkGetOrCreateJournalByTags(b *testing.B) {
+	sets := make([]tag.Set, 10000)
+	for i := range sets {
+		sets[i], _ = tag.Parse(fmt.Sprintf("app=app%d,env=prod,host=host%d", i, i%100))
+	}
+	run := func(b *testing.B, getOrCreate func(ims *inmemService, ts tag.Set) string) {
+		ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+		ims.Journals = &testJournals{}
+		ims.Init(nil)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// the first pass over the sets creates the journals
+			ims.Release(getOrCreate(ims, sets[i%len(sets)]))
+		}
+	}
+
+	b.Run("string", func(b *testing.B) {
+		run(b, func(ims *inmemService, ts tag.Set) string {
+			src, _, _ := ims.GetOrCreateJournal(string(ts.Line()))
+			return src
+		})
+	})
+	b.Run("set", func(b *testing.B) {
+		run(b, func(ims *inmemService, ts tag.Set) string {
+			src, _ := ims.GetOrCreateJournalByTags(ts)
+			return src
+		})
+	})
+}
+
+func TestSrcGenerator(t *testing.T) {
+	gen := func(tags tag.Set) (string, error) {
+		switch tags.Tag("app") {
+		case "":
+			return "", errors.New("no app tag")
+		case "bad":
+			return "a/b", nil
+		}
+		return "ext_" + tags.Tag("app") + "_" + tags.Tag("env"), nil
+	}
+	if err := (&InMemConfig{DeterministicSrc: true, SrcGenerator: gen}).Check(); err == nil {
+		t.Fatal("Check() must fail, DeterministicSrc and SrcGenerator are set")
+	}
+
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, SrcGenerator: gen}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	defer ims.Shutdown()
+
+	if src, _, err := ims.GetOrCreateJournal("app=nginx,env=prod"); err != nil || src != "ext_nginx_prod" {
+		t.Fatal("expected the generated id, but src=", src, ", err=", err)
+	}
+	res, err := ims.GetOrCreateJournals([]string{"app=nginx,env=prod", "app=db,env=dev"})
+	if err != nil || res["app=nginx,env=prod"] != "ext_nginx_prod" || res["app=db,env=dev"] != "ext_db_dev" {
+		t.Fatal("expected the generated ids, but res=", res, ", err=", err)
+	}
+
+	// the generator errors and the invalid ids
+	for _, tags := range []string{"env=prod", "app=bad"} {
+		if _, _, err = ims.GetOrCreateJournal(tags); err == nil {
+			t.Fatal("GetOrCreateJournal() must fail for ", tags)
+		}
+	}
+
+	// the id is taken by another tags line
+	if _, _, err = ims.GetOrCreateJournal("app=nginx,env=prod,host=h1"); errors.Cause(err) != errSrcCollision {
+		t.Fatal("expected the collision error, but err=", err)
+	}
+	if _, err = ims.GetOrCreateJournals([]string{"app=web,env=dev", "app=db,env=dev,host=h2"}); errors.Cause(err) != errSrcCollision {
+		t.Fatal("expected the collision error, but err=", err)
+	}
+	if ims.tmap.len() != 2 || ims.smap.len() != 2 {
+		t.Fatal("nothing must be added, but tmap=", ims.tmap.snapshot())
+	}
+}
+
+func TestGetJournalsByTagKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "GetJournalsByTagKey")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	srcs := make(map[string]string)
+	for _, tags := range []string{"pod=a,app=1", "pod=b", "app=2", "app=3,env=prod"} {
+		src, _, _ := ims.GetOrCreateJournal(tags)
+		ims.Release(src)
+		srcs[tags] = src
+	}
+	res, err := ims.GetJournalsByTagKey("pod")
+	if err != nil || len(res) != 2 || res["app=1,pod=a"] != srcs["pod=a,app=1"] || res["pod=b"] != srcs["pod=b"] {
+		t.Fatal("expected 2 records with pod, but res=", res, ", err=", err)
+	}
+	if res, _ = ims.GetJournalsByTagKey("app"); len(res) != 3 {
+		t.Fatal("expected 3 records with app, but res=", res)
+	}
+	if res, _ = ims.GetJournalsByTagKey("po"); len(res) != 0 {
+		t.Fatal("no records expected for unknown key, but res=", res)
+	}
+
+	if err = ims.DeleteJournal("pod=b"); err != nil {
+		t.Fatal("DeleteJournal() err=", err)
+	}
+	if err = ims.DeleteJournal("app=3,env=prod"); err != nil {
+		t.Fatal("DeleteJournal() err=", err)
+	}
+	if res, _ = ims.GetJournalsByTagKey("pod"); len(res) != 1 || res["app=1,pod=a"] == "" {
+		t.Fatal("expected 1 record with pod, but res=", res)
+	}
+	if _, ok := ims.kidx["env"]; ok {
+		t.Fatal("the key with no records must be removed from the index, but ", ims.kidx)
+	}
+	ims.Shutdown()
+
+	// the key index is built when the index is loaded
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	defer ims.Shutdown()
+	if res, _ = ims.GetJournalsByTagKey("pod"); len(res) != 1 || res["app=1,pod=a"] != srcs["pod=a,app=1"] {
+		t.Fatal("expected 1 record with pod after reload, but res=", res)
+	}
+	if res, _ = ims.GetJournalsByTagKey("app"); len(res) != 2 || res["app=2"] != srcs["app=2"] {
+		t.Fatal("expected 2 records with app after reload, but res=", res)
+	}
+	if len(ims.kidx) != 2 {
+		t.Fatal("expected pod and app keys only, but ", ims.kidx)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Compact")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	open := func(cfg InMemConfig) *inmemService {
+		cfg.WorkingDir = dir
+		ims := NewInmemServiceWithConfig(cfg).(*inmemService)
+		ims.Journals = &testJournals{}
+		if err := ims.Init(nil); err != nil {
+			t.Fatal("Init() err=", err)
+		}
+		return ims
+	}
+	size := func(name string) int64 {
+		fi, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+
+	ims := open(InMemConfig{})
+	tags := make([]string, 500)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("app=app%d,env=prod", i)
+		src, _, _ := ims.GetOrCreateJournal(tags[i])
+		ims.Release(src)
+	}
+	ims.Shutdown()
+
+	// the deletes are not flushed
+	ims = open(InMemConfig{FlushIntervalMs: 3600000})
+	for _, tg := range tags[50:] {
+		if err = ims.DeleteJournal(tg); err != nil {
+			t.Fatal("DeleteJournal() err=", err)
+		}
+	}
+	datSize, bakSize := size(cIdxFileName), size(cIdxBackupFileName)
+	if err = ims.Compact(); err != nil {
+		t.Fatal("Compact() err=", err)
+	}
+	if size(cIdxFileName) >= datSize/5 || size(cIdxBackupFileName) >= bakSize/5 {
+		t.Fatal("the index must shrink, but before ", datSize, "/", bakSize, ", after ", size(cIdxFileName), "/", size(cIdxBackupFileName))
+	}
+	dat, _ := ioutil.ReadFile(path.Join(dir, cIdxFileName))
+	bak, _ := ioutil.ReadFile(path.Join(dir, cIdxBackupFileName))
+	if !bytes.Equal(dat, bak) {
+		t.Fatal("the backup must be the same as the compacted index")
+	}
+	ims.Shutdown()
+
+	// the single index objects are removed, when the index is sharded
+	ims = open(InMemConfig{ShardCount: 4})
+	if err = ims.Compact(); err != nil {
+		t.Fatal("Compact() err=", err)
+	}
+	ims.Shutdown()
+	if size(cIdxFileName) >= 0 || size(cIdxBackupFileName) >= 0 || size(idxFileNames(3).bak) <= 0 {
+		t.Fatal("the shards must replace the single index")
+	}
+
+	// and the shards are removed, when it is not sharded anymore
+	ims = open(InMemConfig{})
+	if err = ims.Compact(); err != nil {
+		t.Fatal("Compact() err=", err)
+	}
+	ims.Shutdown()
+	for i := 0; i < 4; i++ {
+		if size(idxFileNames(i).name) >= 0 || size(idxFileNames(i).bak) >= 0 {
+			t.Fatal("the shard ", i, " must be removed")
+		}
+	}
+
+	ims = open(InMemConfig{ReadOnly: true})
+	defer ims.Shutdown()
+	if ims.tmap.len() != 50 {
+		t.Fatal("expected 50 records, but ", ims.tmap.len())
+	}
+	for _, tg := range tags[:50] {
+		if ims.tmap.get(tag.Line(tg)) == nil {
+			t.Fatal("the record ", tg, " must be kept")
+		}
+	}
+	if err = ims.Compact(); err != errReadOnly {
+		t.Fatal("expected errReadOnly, but err=", err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	for _, key := range []string{"", "000102030405060708090a0b0c0d0e0f"} {
+		dir, err := ioutil.TempDir("", "WALReplay")
+		if err != nil {
+			t.Fatal("Could not create new dir err=", err)
+		}
+		defer os.RemoveAll(dir) // clean up
+
+		open := func() *inmemService {
+			ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, WAL: true, EncryptionKey: key}).(*inmemService)
+			ims.Journals = &testJournals{}
+			if err := ims.Init(nil); err != nil {
+				t.Fatal("Init() err=", err)
+			}
+			return ims
+		}
+
+		ims := open()
+		srcs, _ := ims.GetOrCreateJournals([]string{"a=1", "a=2"})
+		ims.GetOrCreateJournal("a=4")
+		ims.Release(srcs["a=1"])
+		ims.Release(srcs["a=2"])
+		if err = ims.DeleteJournal("a=1"); err != nil {
+			t.Fatal("DeleteJournal() err=", err)
+		}
+		if err = ims.RetagJournal("a=2", "a=3"); err != nil {
+			t.Fatal("RetagJournal() err=", err)
+		}
+		if ims.walRecs != 6 {
+			t.Fatal("expected 6 records in the WAL, but ", ims.walRecs)
+		}
+		if tmap, _, err := ims.readState(cIdxFileName); err != nil || len(tmap) != 0 {
+			t.Fatal("the index must not be written on the changes, but tmap=", tmap, ", err=", err)
+		}
+		exp := map[tag.Line]string{"a=3": srcs["a=2"], "a=4": ims.tmap.get("a=4").Src}
+
+		// the index is not shut down, so the WAL is not compacted, and the
+		// interrupted append leaves the incomplete frame
+		frame, _ := encodeWalFrame([]*tagsDesc{{tags: tag.EmptySet, Src: "lost"}}, nil, ims.encKey)
+		if err = ims.storage.(Appender).Append(cWalFileName, frame[:len(frame)-1]); err != nil {
+			t.Fatal("Append() err=", err)
+		}
+
+		ims = open()
+		res := make(map[tag.Line]string)
+		for ln, td := range ims.tmap.snapshot() {
+			res[ln] = td.Src
+		}
+		if !reflect.DeepEqual(res, exp) {
+			t.Fatal("expected ", exp, " after the replay, but ", res)
+		}
+		if _, err = os.Stat(path.Join(dir, cWalFileName)); !os.IsNotExist(err) {
+			t.Fatal("the WAL must be compacted on Init, but err=", err)
+		}
+
+		// the WAL works after the broken tail is removed
+		ims.GetOrCreateJournal("a=5")
+		ims = open()
+		if ims.tmap.get("a=5") == nil || ims.tmap.len() != 3 {
+			t.Fatal("expected a=5 in the index, but tmap=", ims.tmap.snapshot())
+		}
+		ims.Shutdown()
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	if err := (&InMemConfig{WALMaxRecords: -1}).Check(); err == nil {
+		t.Fatal("Check() must fail for negative WALMaxRecords")
+	}
+	ims := NewInmemServiceWithConfig(InMemConfig{WAL: true, Storage: &testStorage{objs: make(map[string][]byte)}}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err := ims.Init(nil); err == nil {
+		t.Fatal("Init() must fail, the storage doesn't implement Appender")
+	}
+
+	dir, err := ioutil.TempDir("", "WALCompaction")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	walSize := func() int64 {
+		fi, err := os.Stat(path.Join(dir, cWalFileName))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+	idxLen := func() int {
+		tmap, _, err := ims.readState(cIdxFileName)
+		if err != nil {
+			t.Fatal("readState() err=", err)
+		}
+		return len(tmap)
+	}
+
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: dir, WAL: true, WALMaxRecords: 3}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	ims.GetOrCreateJournal("a=1")
+	ims.GetOrCreateJournal("a=2")
+	if ws := walSize(); ws <= 0 || idxLen() != 0 {
+		t.Fatal("the changes must be in the WAL only, but WAL size=", ws)
+	}
+
+	// the WAL is collapsed into the index, when it has WALMaxRecords records
+	ims.GetOrCreateJournal("a=3")
+	if ws := walSize(); ws != -1 || ims.walRecs != 0 || idxLen() != 3 {
+		t.Fatal("the WAL must be compacted, but WAL size=", ws, ", records=", ims.walRecs)
+	}
+
+	ims.GetOrCreateJournal("a=4")
+	if ims.walRecs != 1 || idxLen() != 3 {
+		t.Fatal("expected 1 record in the WAL, but ", ims.walRecs)
+	}
+	if err = ims.Compact(); err != nil {
+		t.Fatal("Compact() err=", err)
+	}
+	if ws := walSize(); ws != -1 || idxLen() != 4 {
+		t.Fatal("the WAL must be compacted by Compact(), but WAL size=", ws)
+	}
+
+	// the WAL left is compacted on Shutdown
+	ims.GetOrCreateJournal("a=5")
+	ims.Shutdown()
+	if ws := walSize(); ws != -1 || idxLen() != 5 {
+		t.Fatal("the WAL must be compacted by Shutdown(), but WAL size=", ws)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, MaxJournals: 1}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	for _, tags := range []string{"a=1,b", "{}"} {
+		if _, _, err := ims.GetOrCreateJournal(tags); errors.Cause(err) != ErrInvalidTags {
+			t.Fatal("expected ErrInvalidTags for ", tags, ", but err=", err)
+		}
+		if _, err := ims.GetOrCreateJournals([]string{tags}); errors.Cause(err) != ErrInvalidTags {
+			t.Fatal("expected ErrInvalidTags for ", tags, ", but err=", err)
+		}
+	}
+	if err := ims.DeleteJournal("a=1,b"); errors.Cause(err) != ErrInvalidTags {
+		t.Fatal("expected ErrInvalidTags, but err=", err)
+	}
+	// the wrapped errors are found by the standard library as well
+	if _, _, err := ims.GetOrCreateJournal("a=1,b"); !goerrors.Is(err, ErrInvalidTags) || goerrors.Is(err, ErrNotFound) {
+		t.Fatal("errors.Is() must find ErrInvalidTags, but err=", err)
+	}
+	if _, err := ims.ResolveSources([]tag.Line{"a=3"}); !goerrors.Is(err, ErrNotFound) {
+		t.Fatal("errors.Is() must find ErrNotFound, but err=", err)
+	}
+
+	if _, _, err := ims.GetJournal("a=1"); err != ErrNotFound || err != errors2.NotFound {
+		t.Fatal("expected ErrNotFound, but err=", err)
+	}
+	if _, err := ims.GetJournalTags("unknown", false); err != ErrNotFound {
+		t.Fatal("expected ErrNotFound, but err=", err)
+	}
+
+	src, _, _ := ims.GetOrCreateJournal("a=1")
+	ims.Release(src)
+	if _, _, err := ims.GetOrCreateJournal("a=2"); errors.Cause(err) != ErrCapacityExceeded || !goerrors.Is(err, ErrCapacityExceeded) {
+		t.Fatal("expected ErrCapacityExceeded, but err=", err)
+	}
+
+	ims.Shutdown()
+	if _, _, err := ims.GetOrCreateJournal("a=1"); err != ErrShutDown {
+		t.Fatal("expected ErrShutDown, but err=", err)
+	}
+	if _, err := ims.CountJournals(context.Background(), &lql.Source{}); err != ErrShutDown {
+		t.Fatal("expected ErrShutDown, but err=", err)
+	}
+	if err := ims.HealthCheck(context.Background()); err != ErrShutDown {
+		t.Fatal("expected ErrShutDown, but err=", err)
+	}
+}
+
+func TestGetJournalsWithTags(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	defer ims.Shutdown()
+
+	for _, tags := range []string{"b=2,a=1", "a=2", "c=3"} {
+		src, _, _ := ims.GetOrCreateJournal(tags)
+		ims.Release(src)
+	}
+
+	res, err := ims.GetJournalsWithTags(context.Background(), &lql.Source{})
+	if err != nil || len(res) != 3 {
+		t.Fatal("expected 3 records, but res=", res, ", err=", err)
+	}
+	for i, jt := range res {
+		td := ims.smap.load(jt.Src)
+		if td == nil || !reflect.DeepEqual(jt.Tags, td.tags) || jt.Tags.Line() != td.tags.Line() {
+			t.Fatal("expected the stored tags ", td, ", but ", jt)
+		}
+		if i > 0 && res[i-1].Tags.Line() >= jt.Tags.Line() {
+			t.Fatal("the records must be sorted by the tags lines, but ", res)
+		}
+	}
+	if res[0].Tags.Tag("b") != "2" || res[0].Tags.Line() != "a=1,b=2" {
+		t.Fatal("the tags must be parsed, but ", res[0].Tags)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < cCtxCheckPeriod; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("d=%d", i))
+		ims.Release(src)
+	}
+	if _, err = ims.GetJournalsWithTags(ctx, &lql.Source{}); err != context.Canceled {
+		t.Fatal("expected context.Canceled, but err=", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	ch, unsub, err := ims.Subscribe(&lql.Source{Tags: &lql.TagsVal{Tags: tag.MapToSet(map[string]string{"a": "1"})}})
+	if err != nil {
+		t.Fatal("Subscribe() err=", err)
+	}
+	all, unsubAll, err := ims.Subscribe(nil)
+	if err != nil {
+		t.Fatal("Subscribe() err=", err)
+	}
+
+	// the matching records only
+	src, _, _ := ims.GetOrCreateJournal("a=1,b=2")
+	ims.Release(src)
+	src2, _, _ := ims.GetOrCreateJournal("a=2")
+	ims.Release(src2)
+	srcs, _ := ims.GetOrCreateJournals([]string{"a=1,b=3", "c=1"})
+	for _, s := range srcs {
+		ims.Release(s)
+	}
+	if ev := <-ch; ev.Type != JE_CREATED || ev.Src != src || ev.Tags.Line() != "a=1,b=2" {
+		t.Fatal("expected the created event for ", src, ", but ", ev)
+	}
+	if ev := <-ch; ev.Type != JE_CREATED || ev.Src != srcs["a=1,b=3"] {
+		t.Fatal("expected the created event for ", srcs["a=1,b=3"], ", but ", ev)
+	}
+	if len(ch) != 0 || len(all) != 4 {
+		t.Fatal("expected 0 and 4 events, but ", len(ch), " and ", len(all))
+	}
+
+	if err = ims.DeleteJournal("a=1,b=2"); err != nil {
+		t.Fatal("DeleteJournal() err=", err)
+	}
+	ims.GetJournal("a=2")
+	ims.LockExclusively(src2)
+	if err = ims.Delete(src2); err != nil {
+		t.Fatal("Delete() err=", err)
+	}
+	if ev := <-ch; ev.Type != JE_DELETED || ev.Src != src || len(ch) != 0 {
+		t.Fatal("expected the deleted event for ", src, ", but ", ev)
+	}
+
+	// the existing records are not reported again
+	if _, _, err = ims.GetOrCreateJournal("a=1,b=3"); err != nil || len(ch) != 0 {
+		t.Fatal("no events expected, but ", len(ch), ", err=", err)
+	}
+
+	// the slow subscriber loses the oldest events, 6 events are not read yet
+	for i := 0; i < cSubscrChanSize; i++ {
+		src, _, _ := ims.GetOrCreateJournal(fmt.Sprintf("d=%d", i))
+		ims.Release(src)
+	}
+	if len(all) != cSubscrChanSize {
+		t.Fatal("expected the full channel, but ", len(all))
+	}
+	if ev := <-all; ev.Type != JE_CREATED || ev.Tags.Line() != "d=0" {
+		t.Fatal("expected the created event for d=0, but ", ev)
+	}
+
+	unsub()
+	unsub()
+	if _, ok := <-ch; ok || len(ims.subs) != 1 {
+		t.Fatal("the channel must be closed, and the subscription removed, but ", len(ims.subs))
+	}
+
+	// the channels are closed by Shutdown
+	ims.Shutdown()
+	unsubAll()
+	for range all {
+	}
+	if _, _, err = ims.Subscribe(nil); err != ErrShutDown {
+		t.Fatal("expected ErrShutDown, but err=", err)
+	}
+}
+
+func TestResolveSources(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	defer ims.Shutdown()
+
+	srcs, err := ims.GetOrCreateJournals([]string{"b=2,a=1", "a=2", "c=3"})
+	if err != nil {
+		t.Fatal("GetOrCreateJournals() err=", err)
+	}
+	for _, src := range srcs {
+		ims.Release(src)
+	}
+
+	res, err := ims.ResolveSources([]tag.Line{"a=1,b=2", "c=3"})
+	if err != nil || len(res) != 2 || res["a=1,b=2"] != srcs["b=2,a=1"] || res["c=3"] != srcs["c=3"] {
+		t.Fatal("expected 2 sources, but res=", res, ", err=", err)
+	}
+
+	res, err = ims.ResolveSources([]tag.Line{"a=2", "b=2,a=1", "d=4", "c=3"})
+	if errors.Cause(err) != ErrNotFound || !strings.Contains(err.Error(), "[b=2,a=1 d=4]") {
+		t.Fatal("expected ErrNotFound for the missing lines, but err=", err)
+	}
+	if len(res) != 2 || res["a=2"] != srcs["a=2"] || res["c=3"] != srcs["c=3"] {
+		t.Fatal("expected the found sources, but res=", res)
+	}
+
+	if res, err = ims.ResolveSources(nil); err != nil || len(res) != 0 {
+		t.Fatal("expected empty result, but res=", res, ", err=", err)
+	}
+}
+
+func TestInitWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "InitWorkingDir")
+	if err != nil {
+		t.Fatal("Could not create new dir err=", err)
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	// the missing dirs are created
+	wd := path.Join(dir, "a", "b")
+	ims := NewInmemServiceWithConfig(InMemConfig{WorkingDir: wd}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err != nil {
+		t.Fatal("Init() err=", err)
+	}
+	ims.Shutdown()
+	if fi, err := os.Stat(wd); err != nil || !fi.IsDir() || fi.Mode().Perm()&^cWorkingDirMode != 0 {
+		t.Fatal("the working dir must be created, but fi=", fi, ", err=", err)
+	}
+
+	// the dir could not be created under a file
+	fn := path.Join(dir, "file")
+	ioutil.WriteFile(fn, []byte{}, 0640)
+	ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: path.Join(fn, "idx")}).(*inmemService)
+	ims.Journals = &testJournals{}
+	if err = ims.Init(nil); err == nil || !strings.Contains(err.Error(), "could not create the working dir") {
+		t.Fatal("expected the working dir error, but err=", err)
+	}
+
+	// the permissions are not checked for root
+	if os.Geteuid() == 0 {
+		return
+	}
+	ro := path.Join(dir, "ro")
+	os.Mkdir(ro, 0500)
+	defer os.Chmod(ro, 0700)
+	for _, wd := range []string{ro, path.Join(ro, "idx")} {
+		ims = NewInmemServiceWithConfig(InMemConfig{WorkingDir: wd}).(*inmemService)
+		ims.Journals = &testJournals{}
+		if err = ims.Init(nil); err == nil || !strings.Contains(err.Error(), wd) {
+			t.Fatal("expected the error for the read-only dir, but err=", err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	if res, err := ims.List(); err != nil || len(res) != 0 {
+		t.Fatal("expected empty list, but res=", res, ", err=", err)
+	}
+
+	srcs, err := ims.GetOrCreateJournals([]string{"c=3", "b=2,a=1", "a=2"})
+	if err != nil {
+		t.Fatal("GetOrCreateJournals() err=", err)
+	}
+	for _, src := range srcs {
+		ims.Release(src)
+	}
+
+	res, err := ims.List()
+	exp := []JournalInfo{
+		{Tags: "a=1,b=2", Src: srcs["b=2,a=1"], Values: map[string]string{"a": "1", "b": "2"}},
+		{Tags: "a=2", Src: srcs["a=2"], Values: map[string]string{"a": "2"}},
+		{Tags: "c=3", Src: srcs["c=3"], Values: map[string]string{"c": "3"}},
+	}
+	if err != nil || !reflect.DeepEqual(res, exp) {
+		t.Fatal("expected ", exp, ", but res=", res, ", err=", err)
+	}
+
+	ims.Shutdown()
+	if _, err = ims.List(); err != ErrShutDown {
+		t.Fatal("expected ErrShutDown, but err=", err)
+	}
+}
+
+func TestConcurrentAcquireRelease(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("a=%d", (g+i)%50))
+				if err != nil {
+					t.Error("GetOrCreateJournal() err=", err)
+					return
+				}
+				if _, err = ims.GetJournalTags(src, true); err != nil {
+					t.Error("GetJournalTags() err=", err)
+					return
+				}
+				ims.Release(src)
+				ims.Release(src)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if ims.tmap.len() != 50 {
+		t.Fatal("expected 50 records, but got ", ims.tmap.len())
+	}
+	for _, td := range ims.tmap.snapshot() {
+		if td.readers != 0 || td.exclusive {
+			t.Fatal("all records must be released, but td=", td)
+		}
+	}
+}
+
+func TestConcurrentCreateLimits(t *testing.T) {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true, MaxJournals: 100, WarnJournalsThreshold: 50}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+
+	var created, rejected int32
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				src, _, err := ims.GetOrCreateJournal(fmt.Sprintf("g=%d,i=%d", g, i))
+				if goerrors.Is(err, ErrCapacityExceeded) {
+					atomic.AddInt32(&rejected, 1)
+					continue
+				}
+				if err != nil {
+					t.Error("GetOrCreateJournal() err=", err)
+					return
+				}
+				atomic.AddInt32(&created, 1)
+				ims.Release(src)
+			}
+		}(g)
+	}
+	// the records are scanned, while they are added
+	for i := 0; i < 10; i++ {
+		if _, err := ims.CountJournals(context.Background(), nil); err != nil {
+			t.Fatal("CountJournals() err=", err)
+		}
+	}
+	wg.Wait()
+
+	if created != 100 || rejected != 220 || ims.tmap.len() != 100 || ims.smap.len() != 100 {
+		t.Fatal("expected 100 records, but created=", created, ", rejected=", rejected, ", tmap=", ims.tmap.len(), ", smap=", ims.smap.len())
+	}
+	if len(ims.kidx["g"]) != 100 || len(ims.kidx["i"]) != 100 {
+		t.Fatal("all records must be in the keys index, but ", len(ims.kidx["g"]), " and ", len(ims.kidx["i"]))
+	}
+	if st := ims.GetStats(); st.ThresholdWarnings != 1 {
+		t.Fatal("the threshold must be reported once, but ", st.ThresholdWarnings)
+	}
+}
+
+// newBucketsIndex returns the not persisted index, which maps are split into the
+// buckets number of buckets. The single bucket is the same as the single lock for
+// all the records.
+func newBucketsIndex(buckets int) *inmemService {
+	ims := NewInmemServiceWithConfig(InMemConfig{DoNotSave: true}).(*inmemService)
+	ims.Journals = &testJournals{}
+	ims.Init(nil)
+	ims.tmap = newLinesMap(buckets)
+	ims.smap = newSrcsMap(buckets)
+	return ims
+}
+
+func BenchmarkGetOrCreateJournalParallel(b *testing.B) {
+	for _, buckets := range []int{1, cBucketsNum} {
+		b.Run(fmt.Sprintf("buckets=%d", buckets), func(b *testing.B) {
+			ims := newBucketsIndex(buckets)
+			tags := make([]string, 1000)
+			for i := range tags {
+				tags[i] = fmt.Sprintf("a=%d", i)
+				src, _, _ := ims.GetOrCreateJournal(tags[i])
+				ims.Release(src)
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					src, _, err := ims.GetOrCreateJournal(tags[i%len(tags)])
+					if err != nil {
+						b.Fatal("err must be nil, but err=", err)
+					}
+					ims.Release(src)
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkGetOrCreateJournalNew measures the records creation by 16 writers, every
+// call adds the new tags line to the index.
+func BenchmarkGetOrCreateJournalNew(b *testing.B) {
+	const writers = 16
+	for _, buckets := range []int{1, cBucketsNum} {
+		b.Run(fmt.Sprintf("buckets=%d", buckets), func(b *testing.B) {
+			ims := newBucketsIndex(buckets)
+			tags := make([]string, b.N)
+			for i := range tags {
+				tags[i] = fmt.Sprintf("app=application%d,pod=pod-%d", i%writers, i)
+			}
+
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < len(tags); i += writers {
+						src, _, err := ims.GetOrCreateJournal(tags[i])
+						if err != nil {
+							b.Error("err must be nil, but err=", err)
+							return
+						}
+						ims.Release(src)
+					}
+				}(w)
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			if ims.tmap.len() != len(tags) {
+				b.Fatal("expected ", len(tags), " records, but ", ims.tmap.len())
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/logrange/logrange/pkg/model/tag"
+)
+
+type (
+	// linesMap is the tags line to record map, which is split into the buckets
+	// by the tags lines hashes. Every bucket has its own lock, so the records
+	// of different buckets could be added and acquired concurrently.
+	linesMap struct {
+		// size is the number of records in all buckets, it is accessed atomically
+		size    int64
+		buckets []linesBucket
+	}
+
+	// linesBucket contains the records, which tags lines hashes fall into the
+	// bucket. The lock guards recs and the readers and exclusive fields of the records.
+	linesBucket struct {
+		lock sync.Mutex
+		recs map[tag.Line]*tagsDesc
+	}
+
+	// srcsMap is the source id to record map, which is split into the buckets
+	// by the source ids hashes
+	srcsMap struct {
+		size    int64
+		buckets []srcsBucket
+	}
+
+	srcsBucket struct {
+		lock sync.Mutex
+		recs map[string]*tagsDesc
+	}
+)
+
+func newLinesMap(buckets int) *linesMap {
+	m := &linesMap{buckets: make([]linesBucket, buckets)}
+	for i := range m.buckets {
+		m.buckets[i].recs = make(map[tag.Line]*tagsDesc)
+	}
+	return m
+}
+
+// bucket returns the bucket for the tags line ln
+func (m *linesMap) bucket(ln tag.Line) *linesBucket {
+	return &m.buckets[lineHash(ln)%uint32(len(m.buckets))]
+}
+
+// get returns the record for ln or nil, if there is no such one. The ln bucket
+// must be locked, or the map must not be modified concurrently.
+func (m *linesMap) get(ln tag.Line) *tagsDesc {
+	return m.bucket(ln).recs[ln]
+}
+
+// load returns the record for ln or nil, if there is no such one. The ln bucket
+// is locked by the call.
+func (m *linesMap) load(ln tag.Line) *tagsDesc {
+	b := m.bucket(ln)
+	b.lock.Lock()
+	td := b.recs[ln]
+	b.lock.Unlock()
+	return td
+}
+
+// put adds td to the map. The same requirements as for get are applied.
+func (m *linesMap) put(td *tagsDesc) {
+	ln := td.tags.Line()
+	b := m.bucket(ln)
+	if _, ok := b.recs[ln]; !ok {
+		atomic.AddInt64(&m.size, 1)
+	}
+	b.recs[ln] = td
+}
+
+// remove deletes the record for ln from the map. The same requirements as for
+// get are applied.
+func (m *linesMap) remove(ln tag.Line) {
+	b := m.bucket(ln)
+	if _, ok := b.recs[ln]; ok {
+		atomic.AddInt64(&m.size, -1)
+		delete(b.recs, ln)
+	}
+}
+
+// len returns the number of records in the map
+func (m *linesMap) len() int {
+	return int(atomic.LoadInt64(&m.size))
+}
+
+// forEach calls f for the records of the map, until f returns false. The
+// buckets are locked one by one, so f must not acquire the bucket locks. It
+// returns false, if the iteration was stopped by f.
+func (m *linesMap) forEach(f func(td *tagsDesc) bool) bool {
+	for i := range m.buckets {
+		b := &m.buckets[i]
+		b.lock.Lock()
+		for _, td := range b.recs {
+			if !f(td) {
+				b.lock.Unlock()
+				return false
+			}
+		}
+		b.lock.Unlock()
+	}
+	return true
+}
+
+// snapshot returns all the records of the map. The snapshot is consistent,
+// only if the map is not modified concurrently.
+func (m *linesMap) snapshot() map[tag.Line]*tagsDesc {
+	res := make(map[tag.Line]*tagsDesc, m.len())
+	m.forEach(func(td *tagsDesc) bool {
+		res[td.tags.Line()] = td
+		return true
+	})
+	return res
+}
+
+func newSrcsMap(buckets int) *srcsMap {
+	m := &srcsMap{buckets: make([]srcsBucket, buckets)}
+	for i := range m.buckets {
+		m.buckets[i].recs = make(map[string]*tagsDesc)
+	}
+	return m
+}
+
+func (m *srcsMap) bucket(src string) *srcsBucket {
+	return &m.buckets[lineHash(tag.Line(src))%uint32(len(m.buckets))]
+}
+
+// load returns the record for the source id src or nil, if there is no such one
+func (m *srcsMap) load(src string) *tagsDesc {
+	b := m.bucket(src)
+	b.lock.Lock()
+	td := b.recs[src]
+	b.lock.Unlock()
+	return td
+}
+
+func (m *srcsMap) store(td *tagsDesc) {
+	b := m.bucket(td.Src)
+	b.lock.Lock()
+	if _, ok := b.recs[td.Src]; !ok {
+		atomic.AddInt64(&m.size, 1)
+	}
+	b.recs[td.Src] = td
+	b.lock.Unlock()
+}
+
+func (m *srcsMap) remove(src string) {
+	b := m.bucket(src)
+	b.lock.Lock()
+	if _, ok := b.recs[src]; ok {
+		atomic.AddInt64(&m.size, -1)
+		delete(b.recs, src)
+	}
+	b.lock.Unlock()
+}
+
+func (m *srcsMap) len() int {
+	return int(atomic.LoadInt64(&m.size))
+}
@@ -0,0 +1,88 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// collector is prometheus.Collector implementation, it exposes the index
+	// statistics (see Service.GetStats) as the logrange_tindex_* metrics. The
+	// statistics are read on every scrape, so the journals gauge reflects the
+	// records created and deleted by the moment.
+	collector struct {
+		svc           Service
+		journals      *prometheus.Desc
+		createCalls   *prometheus.Desc
+		queryCalls    *prometheus.Desc
+		saves         *prometheus.Desc
+		saveFailures  *prometheus.Desc
+		saveDurations *prometheus.Desc
+		thrWarnings   *prometheus.Desc
+	}
+)
+
+const cMetricsNamespace = "logrange_tindex"
+
+// NewCollector returns the prometheus.Collector for the index service svc
+func NewCollector(svc Service) prometheus.Collector {
+	return &collector{
+		svc:           svc,
+		journals:      newMetricDesc("journals", "The number of records in the index."),
+		createCalls:   newMetricDesc("create_calls_total", "The number of GetOrCreateJournal(s) calls."),
+		queryCalls:    newMetricDesc("query_calls_total", "The number of the index queries."),
+		saves:         newMetricDesc("saves_total", "The number of times the index was persisted."),
+		saveFailures:  newMetricDesc("save_failures_total", "The number of failed attempts to persist the index."),
+		saveDurations: newMetricDesc("save_duration_seconds", "The durations of the attempts to persist the index."),
+		thrWarnings:   newMetricDesc("threshold_warnings_total", "The number of times the records number reached WarnJournalsThreshold."),
+	}
+}
+
+func newMetricDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(cMetricsNamespace, "", name), help, nil, nil)
+}
+
+// Describe is prometheus.Collector implementation
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.journals
+	ch <- c.createCalls
+	ch <- c.queryCalls
+	ch <- c.saves
+	ch <- c.saveFailures
+	ch <- c.saveDurations
+	ch <- c.thrWarnings
+}
+
+// Collect is prometheus.Collector implementation
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	st := c.svc.GetStats()
+	ch <- prometheus.MustNewConstMetric(c.journals, prometheus.GaugeValue, float64(st.Journals))
+	ch <- prometheus.MustNewConstMetric(c.createCalls, prometheus.CounterValue, float64(st.CreateCalls))
+	ch <- prometheus.MustNewConstMetric(c.queryCalls, prometheus.CounterValue, float64(st.QueryCalls))
+	ch <- prometheus.MustNewConstMetric(c.saves, prometheus.CounterValue, float64(st.Saves))
+	ch <- prometheus.MustNewConstMetric(c.saveFailures, prometheus.CounterValue, float64(st.SaveFailures))
+	ch <- prometheus.MustNewConstMetric(c.thrWarnings, prometheus.CounterValue, float64(st.ThresholdWarnings))
+
+	// the histogram buckets are cumulative
+	var cnt uint64
+	buckets := make(map[float64]uint64, len(SaveDurationBounds))
+	for i, b := range SaveDurationBounds {
+		cnt += uint64(st.SaveDurations[i])
+		buckets[b.Seconds()] = cnt
+	}
+	cnt += uint64(st.SaveDurations[len(SaveDurationBounds)])
+	ch <- prometheus.MustNewConstHistogram(c.saveDurations, cnt, st.SaveDuration.Seconds(), buckets)
+}
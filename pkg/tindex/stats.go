@@ -0,0 +1,143 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"github.com/logrange/logrange/pkg/utils"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Stats struct contains the index statistics. The counters are collected
+	// since the service instance was created.
+	Stats struct {
+		// Journals contains the number of records in the index
+		Journals int
+		// CreateCalls contains the number of GetOrCreateJournal(s) calls
+		CreateCalls int64
+		// QueryCalls contains the number of Visit, GetJournalsPage, CountJournals and ForEach calls
+		QueryCalls int64
+		// Saves contains the number of times the index was persisted
+		Saves int64
+		// SaveFailures contains the number of failed attempts to persist the index
+		SaveFailures int64
+		// SaveDuration contains the total time spent on persisting the index
+		SaveDuration time.Duration
+		// SaveDurations contains the number of the persisting attempts by their
+		// durations. The i-th value counts the attempts, which took more than
+		// SaveDurationBounds[i-1] and not more than SaveDurationBounds[i], the
+		// last value counts the attempts longer than all the bounds.
+		SaveDurations []int64
+		// LastSaveDuration contains the time spent on the last persisting attempt
+		LastSaveDuration time.Duration
+		// LastSaveTime contains the time the index was persisted successfully the last
+		// time, it is zero if the index was not persisted yet
+		LastSaveTime time.Time
+		// Dirty indicates the index has changes, which are not persisted yet (see
+		// InMemConfig.FlushIntervalMs)
+		Dirty bool
+		// ThresholdWarnings contains the number of times the number of records
+		// reached InMemConfig.WarnJournalsThreshold
+		ThresholdWarnings int64
+	}
+
+	// stats struct holds the counters, which are updated atomically
+	stats struct {
+		createCalls   int64
+		queryCalls    int64
+		saves         int64
+		saveFailures  int64
+		saveDurNs     int64
+		lastSaveDurNs int64
+		saveDurs      [len(SaveDurationBounds) + 1]int64
+		lastSaveNs    int64
+		thrWarnings   int64
+	}
+)
+
+// SaveDurationBounds contains the upper bounds of the Stats.SaveDurations buckets
+var SaveDurationBounds = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+func (s *stats) onCreate() {
+	atomic.AddInt64(&s.createCalls, 1)
+}
+
+func (s *stats) onQuery() {
+	atomic.AddInt64(&s.queryCalls, 1)
+}
+
+func (s *stats) onThresholdWarning() {
+	atomic.AddInt64(&s.thrWarnings, 1)
+}
+
+// onSave counts the attempt to persist the index, which took dur and was over at now
+func (s *stats) onSave(now time.Time, dur time.Duration, err error) {
+	if err != nil {
+		atomic.AddInt64(&s.saveFailures, 1)
+	} else {
+		atomic.AddInt64(&s.saves, 1)
+		atomic.StoreInt64(&s.lastSaveNs, now.UnixNano())
+	}
+	atomic.AddInt64(&s.saveDurNs, int64(dur))
+	atomic.AddInt64(&s.saveDurs[saveDurationBucket(dur)], 1)
+	atomic.StoreInt64(&s.lastSaveDurNs, int64(dur))
+}
+
+func (s *stats) get(journals int, dirty bool) *Stats {
+	res := &Stats{
+		Journals:          journals,
+		CreateCalls:       atomic.LoadInt64(&s.createCalls),
+		QueryCalls:        atomic.LoadInt64(&s.queryCalls),
+		Saves:             atomic.LoadInt64(&s.saves),
+		SaveFailures:      atomic.LoadInt64(&s.saveFailures),
+		SaveDuration:      time.Duration(atomic.LoadInt64(&s.saveDurNs)),
+		LastSaveDuration:  time.Duration(atomic.LoadInt64(&s.lastSaveDurNs)),
+		SaveDurations:     make([]int64, len(s.saveDurs)),
+		Dirty:             dirty,
+		ThresholdWarnings: atomic.LoadInt64(&s.thrWarnings),
+	}
+	for i := range s.saveDurs {
+		res.SaveDurations[i] = atomic.LoadInt64(&s.saveDurs[i])
+	}
+	if ns := atomic.LoadInt64(&s.lastSaveNs); ns != 0 {
+		res.LastSaveTime = time.Unix(0, ns)
+	}
+	return res
+}
+
+// saveDurationBucket returns the index of the Stats.SaveDurations bucket for dur
+func saveDurationBucket(dur time.Duration) int {
+	for i, b := range SaveDurationBounds {
+		if dur <= b {
+			return i
+		}
+	}
+	return len(SaveDurationBounds)
+}
+
+// String is fmt.Stringer implementation
+func (s *Stats) String() string {
+	return utils.ToJsonStr(s)
+}
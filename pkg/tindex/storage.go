@@ -0,0 +1,155 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+)
+
+type (
+	// Storage interface allows to persist the index data somewhere else than the
+	// local file system. The objects are addressed by names like "tindex.dat".
+	// The methods could be called concurrently for different objects, when the
+	// index is sharded (see InMemConfig.ShardCount).
+	Storage interface {
+		// Read returns the content of the object name. The error returned must
+		// satisfy os.IsNotExist() if the object is not found
+		Read(name string) ([]byte, error)
+
+		// Write stores data into the object name, replacing its content if the object exists.
+		// The data must be durable when the function returns with no error.
+		Write(name string, data []byte) error
+
+		// Rename atomically renames the object oldName to newName, replacing newName
+		// if it exists. The new name must be durable when the function returns with
+		// no error.
+		Rename(oldName, newName string) error
+	}
+
+	// Remover is implemented by the Storage, which allows to remove the objects. The
+	// index uses it to remove the objects, which are not used anymore (see Service.Compact)
+	Remover interface {
+		// Remove removes the object name. No error is returned if the object doesn't exist.
+		Remove(name string) error
+	}
+
+	// Appender is implemented by the Storage, which allows to append the data to the
+	// objects. The index needs it to write the changes to the WAL (see InMemConfig.WAL)
+	Appender interface {
+		// Append appends data to the object name, the object is created if it doesn't
+		// exist. The data must be durable when the function returns with no error.
+		Append(name string, data []byte) error
+	}
+
+	// fsStorage implements Storage on top of the local file system directory
+	fsStorage struct {
+		dir string
+	}
+)
+
+// NewFsStorage returns the Storage which keeps the objects as files in the dir
+func NewFsStorage(dir string) Storage {
+	return &fsStorage{dir: dir}
+}
+
+func (fs *fsStorage) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(fs.dir, name))
+}
+
+func (fs *fsStorage) Write(name string, data []byte) error {
+	fn := path.Join(fs.dir, name)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+
+	if err != nil {
+		os.Remove(fn)
+	}
+	return err
+}
+
+// Rename renames the file and syncs the directory, because the rename is not
+// durable on many file systems until the directory is synced. So the index file
+// is either the previous or the new one after a crash.
+func (fs *fsStorage) Rename(oldName, newName string) error {
+	if err := os.Rename(path.Join(fs.dir, oldName), path.Join(fs.dir, newName)); err != nil {
+		return err
+	}
+	return syncDir(fs.dir)
+}
+
+func (fs *fsStorage) Append(name string, data []byte) error {
+	f, err := os.OpenFile(path.Join(fs.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (fs *fsStorage) Remove(name string) error {
+	err := os.Remove(path.Join(fs.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *fsStorage) String() string {
+	return "[fs: dir=" + fs.dir + "]"
+}
+
+// syncDir flushes the directory dir entries to the disk. The platforms and file
+// systems, which don't support the directories sync (like Windows), are ignored.
+// It is a variable to be replaced in tests.
+var syncDir = func(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+
+	if pe, ok := err.(*os.PathError); ok && (pe.Err == syscall.EINVAL || pe.Err == syscall.ENOTSUP) {
+		return nil
+	}
+	return err
+}
@@ -15,8 +15,13 @@
 package tindex
 
 import (
+	"context"
+	"fmt"
 	"github.com/logrange/logrange/pkg/lql"
 	"github.com/logrange/logrange/pkg/model/tag"
+	errors2 "github.com/logrange/range/pkg/utils/errors"
+	"github.com/pkg/errors"
+	"io"
 )
 
 type (
@@ -28,10 +33,21 @@ type (
 		// is returned with no error, the JournalName MUST be released using the Release method later
 		GetOrCreateJournal(tags string) (string, tag.Set, error)
 
+		// GetOrCreateJournalByTags does the same as GetOrCreateJournal, but it uses the
+		// parsed tags, so the tags line is not parsed again. If the result is returned
+		// with no error, the JournalName MUST be released using the Release method later
+		GetOrCreateJournalByTags(tags tag.Set) (string, error)
+
 		// GetJournal returns the journal name for the unique Tags combination. If the result
 		// is returned with no error, the JournalName MUST be released using the Release method later
 		GetJournal(tags string) (string, tag.Set, error)
 
+		// GetOrCreateJournals returns the journal names for the list of tags lines provided. The result
+		// maps every tags line to the journal name. The missing journals are created at once. If the
+		// result is returned with no error, every journal name from the map MUST be released using
+		// the Release method later
+		GetOrCreateJournals(tagsList []string) (map[string]string, error)
+
 		// GetJournalTags returns the journal Tags combination by its name. If the result
 		// is returned with no error, and the lock == true, the journal src MUST be released
 		// using the Release method later. If lock == false either an error happens or not
@@ -42,7 +58,7 @@ type (
 		// Visit walks over the tags-sources that corresponds to the srcCond. VF_SKIP_IF_LOCKED allows to skip the source if it
 		// is locked. If VF_SKIP_IF_LOCKED is not set, the Visit will wait until the source become available or removed.
 		// VF_DO_NOT_RELEASE will not release the partition automatically, but it is the client responsibility to release
-		// the partition later
+		// the partition later. The sources are visited in the lexicographical order of their tags lines.
 		Visit(srcCond *lql.Source, v VisitorF, visitFlags int) error
 
 		// LockExclusively changes the acquired source jn (via GetOrCreateJournal or Visit) to exclusive lock.
@@ -60,6 +76,136 @@ type (
 		// was deleted, the consequireve Release() call will not have any effect. If the Delete returns any
 		// error, the partition must be unlocked and released if it was acquired before
 		Delete(jn string) error
+
+		// RetagJournal moves the record of oldTags to the newTags line, the record keeps
+		// its source. The index is persisted with both changes at once. ErrNotFound is
+		// returned if there is no record for oldTags, and ErrAlreadyExists, if newTags
+		// belongs to another source. The source must not be acquired, errors.WrongState
+		// is returned otherwise.
+		RetagJournal(oldTags, newTags string) error
+
+		// DeleteJournal removes the record for the tags line from the index. It is intended for
+		// removing the records which don't have the journals anymore. The function returns
+		// NotFound if the tags are not in the index, and WrongState if the source is acquired.
+		DeleteJournal(tags string) error
+
+		// GetJournalsPage returns up to limit tags-sources pairs which correspond to srcCond. The
+		// results are sorted by the tags line, and the cursor returned (if not empty) should be
+		// provided to the next call to get the next page. The empty cursor is returned for the last
+		// page. The sources are not acquired. The scan is interrupted with ctx.Err() if ctx is closed.
+		GetJournalsPage(ctx context.Context, srcCond *lql.Source, cursor string, limit int) (map[tag.Line]string, string, error)
+
+		// CountJournals returns the number of sources which correspond to srcCond. The scan is
+		// interrupted with ctx.Err() if ctx is closed.
+		CountJournals(ctx context.Context, srcCond *lql.Source) (int, error)
+
+		// GetJournalsWithTags returns the records, which correspond to srcCond, with the
+		// parsed tags, so the tags lines don't need to be parsed again. The records are
+		// sorted by the tags lines. The sources are not acquired. The scan is interrupted
+		// with ctx.Err() if ctx is closed.
+		GetJournalsWithTags(ctx context.Context, srcCond *lql.Source) ([]JournalTags, error)
+
+		// List returns all the index records as plain structs sorted by the tags lines. It
+		// is intended for the tools, which inspect the index content. The sources are not
+		// acquired.
+		List() ([]JournalInfo, error)
+
+		// GetJournalsByTagKey returns the tags-source pairs of the records, which have the
+		// tag key regardless of its value. The records are found by the key index, so
+		// the index is not scanned. The sources are not acquired.
+		GetJournalsByTagKey(key string) (map[tag.Line]string, error)
+
+		// ResolveSources returns the sources for the tags lines provided. The lines are
+		// looked up directly, so the index is not scanned. The lines must be normalized
+		// (see tag.Set.Line). If some lines are not found, the result contains the lines
+		// found, and the error is ErrNotFound wrapped with the missing lines. The sources
+		// are not acquired.
+		ResolveSources(lines []tag.Line) (map[tag.Line]string, error)
+
+		// ForEach calls fn for every tags-source pair of the index in the lexicographical
+		// order of the tags lines. The pairs are read by batches, and fn is called with
+		// no index lock held, so the records added or removed during the scan could be
+		// missed. The scan stops at the first error returned by fn or if ctx is closed.
+		// The sources are not acquired.
+		ForEach(ctx context.Context, fn func(tag.Line, string) error) error
+
+		// HealthCheck returns an error describing the problem, if the index is not able
+		// to serve the requests: it is shut down, its working directory is not writable,
+		// or the last attempt to persist the index failed. It returns nil otherwise.
+		HealthCheck(ctx context.Context) error
+
+		// GetStats returns the index statistics
+		GetStats() *Stats
+
+		// CheckConsistency compares the index records with the existing journals and returns
+		// the report about the differences found. The index is not changed.
+		CheckConsistency(ctx context.Context) (ConsistencyReport, error)
+
+		// DropOrphans removes the index records, which don't have the journals. The acquired
+		// records are skipped. It returns the number of records removed.
+		DropOrphans(ctx context.Context) (int, error)
+
+		// Compact rewrites the persisted index from the current records, and replaces the
+		// backups by the same content, so the deleted records don't take the space. The
+		// objects left from the previous InMemConfig.ShardCount are removed, if the
+		// Storage implements Remover. It could be called any time, the index is not
+		// changed.
+		Compact() error
+
+		// Export writes the index records to w as JSON lines like {"tags": "a=1", "src": "1234"}.
+		// The records are written in the lexicographical order of their tags lines.
+		Export(w io.Writer) error
+
+		// Snapshot writes the consistent copy of the index to w in the index file format,
+		// so it could be used as the index file (see InMemConfig.WorkingDir) to restore
+		// the index. The index is not blocked while the snapshot is written.
+		Snapshot(w io.Writer) error
+
+		// Subscribe returns the channel, which receives the events about the records,
+		// which correspond to srcCond, when they are created or deleted, and the
+		// function to unsubscribe, which closes the channel. The events are buffered,
+		// if the channel is full because of a slow reader, the oldest event is dropped.
+		// The channel is closed when the index is shut down.
+		Subscribe(srcCond *lql.Source) (<-chan JournalEvent, func(), error)
+
+		// Import reads the records written by Export from r and adds them to the index. The mode
+		// could be IMPORT_MERGE to add the records to the existing ones, or IMPORT_REPLACE to
+		// replace the whole index content. The index is not changed if an error is returned.
+		Import(r io.Reader, mode int) error
+	}
+
+	// JournalTags contains the source and its parsed tags (see Service.GetJournalsWithTags)
+	JournalTags struct {
+		Tags tag.Set
+		Src  string
+	}
+
+	// JournalInfo contains the index record returned by Service.List. Tags contains
+	// the tags line, and Values contains the tags values by their keys.
+	JournalInfo struct {
+		Tags   string
+		Src    string
+		Values map[string]string
+	}
+
+	// JournalEvent contains the record change sent to the subscribers (see
+	// Service.Subscribe). Type is either JE_CREATED or JE_DELETED.
+	JournalEvent struct {
+		Type int
+		Tags tag.Set
+		Src  string
+	}
+
+	// ConsistencyReport contains the result of the index and journals comparison
+	ConsistencyReport struct {
+		// Journals contains the number of journals found
+		Journals int
+		// Records contains the number of the index records
+		Records int
+		// Orphans contains the tag lines of the index records, which don't have journals
+		Orphans []tag.Line
+		// Missing contains the names of the journals, which don't have records in the index
+		Missing []string
 	}
 
 	// VisitorF is the callback function which si called by Service.Visit for all matches found. It will iterate
@@ -68,7 +214,68 @@ type (
 	VisitorF func(tags tag.Set, jrnl string) bool
 )
 
+// IsConsistent returns whether every journal has the index record and vice versa
+func (cr *ConsistencyReport) IsConsistent() bool {
+	return len(cr.Orphans) == 0 && len(cr.Missing) == 0
+}
+
+// The errors returned by the Service. The errors could be wrapped to provide the
+// details, so errors.Cause(err) should be compared with them, or errors.Is of the
+// standard library could be used.
+var (
+	// ErrShutDown is returned when the Service is called after Shutdown
+	ErrShutDown = errors.New("the index is shut down")
+	// ErrInvalidTags is returned when the tags line could not be parsed, or it has no tags
+	ErrInvalidTags = errors.New("invalid tags")
+	// ErrNotFound is returned when the record is not found. It is the same error as
+	// errors.NotFound of the range package, which was returned before.
+	ErrNotFound = errors2.NotFound
+	// ErrCapacityExceeded is returned when the new record could not be added, because
+	// of the InMemConfig.MaxJournals or MaxTagValues limits
+	ErrCapacityExceeded = errors.New("the index capacity is exceeded")
+	// ErrAlreadyExists is returned when the record could not be moved to the tags
+	// line, because the line belongs to another source
+	ErrAlreadyExists = errors.New("the tags line already exists")
+)
+
+// wrappedError contains the details for the cause error. Unlike the errors
+// wrapped by errors.Wrapf, it could be unwrapped by the standard library
+// errors.Is and errors.As, as well as by errors.Cause
+type wrappedError struct {
+	cause error
+	msg   string
+}
+
+// wrapErr returns the cause error with the details formatted
+func wrapErr(cause error, format string, args ...interface{}) error {
+	return &wrappedError{cause: cause, msg: fmt.Sprintf(format, args...)}
+}
+
+func (we *wrappedError) Error() string {
+	return we.msg + ": " + we.cause.Error()
+}
+
+// Cause returns the wrapped error (see errors.Cause)
+func (we *wrappedError) Cause() error {
+	return we.cause
+}
+
+// Unwrap returns the wrapped error (see errors.Unwrap of the standard library)
+func (we *wrappedError) Unwrap() error {
+	return we.cause
+}
+
 const (
 	VF_SKIP_IF_LOCKED = 1
 	VF_DO_NOT_RELEASE = 2
 )
+
+const (
+	IMPORT_MERGE   = 0
+	IMPORT_REPLACE = 1
+)
+
+const (
+	JE_CREATED = 1
+	JE_DELETED = 2
+)
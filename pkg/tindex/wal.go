@@ -0,0 +1,245 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"encoding/binary"
+	"github.com/logrange/logrange/pkg/model/tag"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"os"
+)
+
+// The WAL (see InMemConfig.WAL) is the sequence of frames, every frame contains
+// the changes made by one index operation:
+//
+//	| CRC32 of the body (4 bytes) | body length (4 bytes) | body |
+//
+// The body is the payload, which is AES-GCM encrypted, if the index is encrypted
+// (see encryptIdx). The payload is the number of the records (uvarint) followed
+// by the records, every record is the operation (1 byte), the tags line and the
+// source id, both are written as the length (uvarint) followed by the string bytes.
+//
+// The frames are applied in the order they were written, every record sets or
+// removes the tags line, so the WAL could be replayed on top of the index,
+// which contains the WAL changes already, with the same result.
+const (
+	cWalFileName = "tindex.wal"
+
+	cWalFrameHdrSize = 8
+
+	cDefaultWALMaxRecords = 1000
+)
+
+const (
+	walOpCreate = byte('c')
+	walOpDelete = byte('d')
+)
+
+// encodeWalFrame returns the frame, which contains the records deleted and created
+func encodeWalFrame(created, deleted []*tagsDesc, key []byte) ([]byte, error) {
+	n := binary.MaxVarintLen64
+	for _, tds := range [][]*tagsDesc{created, deleted} {
+		for _, td := range tds {
+			n += 1 + len(td.tags.Line()) + len(td.Src) + 2*binary.MaxVarintLen64
+		}
+	}
+	payload := make([]byte, 0, n)
+	payload = appendUvarint(payload, uint64(len(created)+len(deleted)))
+	// the deleted records go first, so the line, which is deleted and created
+	// by the same operation, is in the index after the replay
+	payload = appendWalRecords(payload, walOpDelete, deleted)
+	payload = appendWalRecords(payload, walOpCreate, created)
+
+	body, err := encryptIdx(payload, key)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, cWalFrameHdrSize, cWalFrameHdrSize+len(body))
+	binary.BigEndian.PutUint32(res, crc32.ChecksumIEEE(body))
+	binary.BigEndian.PutUint32(res[4:], uint32(len(body)))
+	return append(res, body...), nil
+}
+
+func appendWalRecords(buf []byte, op byte, tds []*tagsDesc) []byte {
+	for _, td := range tds {
+		ln := td.tags.Line()
+		buf = append(buf, op)
+		buf = appendUvarint(buf, uint64(len(ln)))
+		buf = append(buf, ln...)
+		buf = appendUvarint(buf, uint64(len(td.Src)))
+		buf = append(buf, td.Src...)
+	}
+	return buf
+}
+
+// replayWal applies the WAL frames of data to tmap. It returns the number of
+// the records applied, and the number of the bytes at the end of data, which
+// don't make the complete frame. Such tail is left by the append, which was
+// interrupted, the changes of it were not acknowledged, so they are ignored.
+func replayWal(data []byte, tmap map[tag.Line]*tagsDesc, key []byte) (int, int, error) {
+	recs := 0
+	for len(data) > 0 {
+		if len(data) < cWalFrameHdrSize {
+			return recs, len(data), nil
+		}
+		n := binary.BigEndian.Uint32(data[4:])
+		if uint64(n) > uint64(len(data)-cWalFrameHdrSize) {
+			return recs, len(data), nil
+		}
+		body := data[cWalFrameHdrSize : cWalFrameHdrSize+int(n)]
+		if binary.BigEndian.Uint32(data) != crc32.ChecksumIEEE(body) {
+			return recs, len(data), nil
+		}
+
+		payload, err := decryptIdx(body, key)
+		if err != nil {
+			return recs, 0, err
+		}
+		cnt, err := replayWalFrame(payload, tmap)
+		if err != nil {
+			return recs, 0, err
+		}
+		recs += cnt
+		data = data[cWalFrameHdrSize+int(n):]
+	}
+	return recs, 0, nil
+}
+
+func replayWalFrame(payload []byte, tmap map[tag.Line]*tagsDesc) (int, error) {
+	n, ok := readUvarint(&payload)
+	if !ok || n > uint64(len(payload)) {
+		return 0, errCorruptedIdx
+	}
+	for i := uint64(0); i < n; i++ {
+		if len(payload) == 0 {
+			return 0, errCorruptedIdx
+		}
+		op := payload[0]
+		payload = payload[1:]
+		ln, ok1 := readString(&payload)
+		src, ok2 := readString(&payload)
+		if !ok1 || !ok2 {
+			return 0, errCorruptedIdx
+		}
+
+		switch op {
+		case walOpCreate:
+			tags, err := tag.Parse(ln)
+			if err != nil {
+				return 0, errors.Wrapf(err, "could not parse the tags %s of the WAL record", ln)
+			}
+			tmap[tag.Line(ln)] = &tagsDesc{tags: tags, Src: src}
+		case walOpDelete:
+			delete(tmap, tag.Line(ln))
+		default:
+			return 0, errors.Errorf("unknown WAL record operation %q", op)
+		}
+	}
+	if len(payload) > 0 {
+		return 0, errCorruptedIdx
+	}
+	return int(n), nil
+}
+
+// loadWal replays the WAL on top of the index tmap
+func (ims *inmemService) loadWal(tmap map[tag.Line]*tagsDesc) error {
+	data, err := ims.storage.Read(cWalFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not read the WAL %s", cWalFileName)
+	}
+
+	recs, tail, err := replayWal(data, tmap, ims.encKey)
+	if err != nil {
+		return errors.Wrapf(err, "could not replay the WAL %s", cWalFileName)
+	}
+	ims.walRecs = recs
+	if tail > 0 {
+		// the next frames could not be appended after the broken one
+		ims.logger.Warn("loadState(): the WAL tail is incomplete, it is ignored, file=", cWalFileName, ", bytes=", tail)
+		ims.walReset = true
+	}
+	if recs > 0 {
+		ims.logger.Info("loadState(): the WAL is replayed, file=", cWalFileName, ", records=", recs)
+	}
+	return nil
+}
+
+// appendWalUnsafe appends the changes to the WAL. The WAL is compacted into the
+// index, when it has InMemConfig.WALMaxRecords records, unless the flusher does it.
+func (ims *inmemService) appendWalUnsafe(created, deleted []*tagsDesc) error {
+	if ims.walReset {
+		// the WAL could not be appended, the whole index is saved instead
+		return ims.saveStateUnsafe()
+	}
+
+	frame, err := encodeWalFrame(created, deleted, ims.encKey)
+	if err != nil {
+		return err
+	}
+	if err = ims.storage.(Appender).Append(cWalFileName, frame); err != nil {
+		// the frame could be written partially
+		ims.walReset = true
+		ims.saveErr = err
+		return errors.Wrapf(err, "could not append to the WAL %s", cWalFileName)
+	}
+	ims.walRecs += len(created) + len(deleted)
+	ims.saveErr = nil
+
+	if ims.Config.FlushIntervalMs > 0 || ims.walRecs < ims.getWALMaxRecords() {
+		return nil
+	}
+	// the changes are persisted already, so the compaction failure is not
+	// reported to the caller, it is tried again on the next change
+	if err = ims.saveStateUnsafe(); err != nil {
+		ims.logger.Error("could not compact the WAL into the index, will try later, err=", err)
+	}
+	return nil
+}
+
+// resetWalUnsafe removes the WAL, it must be called when the index is saved
+func (ims *inmemService) resetWalUnsafe() error {
+	if ims.walRecs == 0 && !ims.walReset {
+		return nil
+	}
+
+	var err error
+	if rm, ok := ims.storage.(Remover); ok {
+		err = rm.Remove(cWalFileName)
+	} else {
+		err = ims.storage.Write(cWalFileName, nil)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not reset the WAL %s", cWalFileName)
+	}
+	ims.logger.Debug("the WAL is compacted into the index, records=", ims.walRecs)
+	ims.walRecs = 0
+	ims.walReset = false
+	return nil
+}
+
+func (ims *inmemService) isWalUsed() bool {
+	return ims.Config.WAL && !ims.Config.DoNotSave && !ims.Config.ReadOnly
+}
+
+func (ims *inmemService) getWALMaxRecords() int {
+	if ims.Config.WALMaxRecords == 0 {
+		return cDefaultWALMaxRecords
+	}
+	return ims.Config.WALMaxRecords
+}
@@ -0,0 +1,112 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tindex
+
+import (
+	"github.com/logrange/logrange/pkg/lql"
+)
+
+// subscription is the Subscribe call state, tef selects the records, which
+// changes are sent to ch
+type subscription struct {
+	tef lql.TagsExpFunc
+	ch  chan JournalEvent
+}
+
+// cSubscrChanSize defines how many events could be buffered for a subscriber
+const cSubscrChanSize = 1024
+
+// Subscribe is the part of Service interface
+func (ims *inmemService) Subscribe(srcCond *lql.Source) (<-chan JournalEvent, func(), error) {
+	tef, err := lql.BuildTagsExpFuncBySource(srcCond)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ims.lock.Lock()
+	defer ims.lock.Unlock()
+	if ims.done {
+		return nil, nil, ErrShutDown
+	}
+
+	s := &subscription{tef: tef, ch: make(chan JournalEvent, cSubscrChanSize)}
+	if ims.subs == nil {
+		ims.subs = make(map[*subscription]struct{})
+	}
+	ims.subs[s] = struct{}{}
+	return s.ch, func() {
+		ims.lock.Lock()
+		ims.unsubscribeUnsafe(s)
+		ims.lock.Unlock()
+	}, nil
+}
+
+// unsubscribeUnsafe removes the subscription s and closes its channel, if it
+// is not removed yet
+func (ims *inmemService) unsubscribeUnsafe(s *subscription) {
+	if _, ok := ims.subs[s]; ok {
+		delete(ims.subs, s)
+		close(s.ch)
+	}
+}
+
+// notifyUnsafe sends the event of type typ for every record of tds to the
+// subscribers, which conditions match the record tags. The sending never blocks,
+// if the subscriber channel is full, the oldest event is dropped.
+func (ims *inmemService) notifyUnsafe(typ int, tds ...*tagsDesc) {
+	for s := range ims.subs {
+		for _, td := range tds {
+			if s.tef(td.tags) {
+				ims.sendUnsafe(s, JournalEvent{Type: typ, Tags: td.tags, Src: td.Src})
+			}
+		}
+	}
+}
+
+func (ims *inmemService) sendUnsafe(s *subscription, ev JournalEvent) {
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+
+		select {
+		case old := <-s.ch:
+			ims.logger.Warn("the subscriber is slow, the oldest event is dropped, event=", old)
+		default:
+		}
+	}
+}
+
+// notifyReplaceUnsafe sends the events for the records, which were removed or
+// added, when the records of tmap were replaced by the current ones
+func (ims *inmemService) notifyReplaceUnsafe(tmap *linesMap) {
+	if len(ims.subs) == 0 {
+		return
+	}
+	tmap.forEach(func(td *tagsDesc) bool {
+		if td2 := ims.tmap.get(td.tags.Line()); td2 == nil || td2.Src != td.Src {
+			ims.notifyUnsafe(JE_DELETED, td)
+		}
+		return true
+	})
+	ims.tmap.forEach(func(td *tagsDesc) bool {
+		if td2 := tmap.get(td.tags.Line()); td2 == nil || td2.Src != td.Src {
+			ims.notifyUnsafe(JE_CREATED, td)
+		}
+		return true
+	})
+}
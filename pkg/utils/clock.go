@@ -0,0 +1,234 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Clock is the source of the current time, the timers and the tickers. The
+	// code, which logic depends on the time, uses the Clock, so the time could
+	// be controlled in tests (see FakeClock)
+	Clock interface {
+		// Now returns the current time
+		Now() time.Time
+		// NewTimer returns the timer, which fires once after d
+		NewTimer(d time.Duration) Timer
+		// NewTicker returns the ticker, which fires every d
+		NewTicker(d time.Duration) Ticker
+	}
+
+	// Timer is the time.Timer provided by a Clock
+	Timer interface {
+		C() <-chan time.Time
+		Stop() bool
+		Reset(d time.Duration) bool
+	}
+
+	// Ticker is the time.Ticker provided by a Clock
+	Ticker interface {
+		C() <-chan time.Time
+		Stop()
+	}
+
+	realClock  struct{}
+	realTimer  struct{ t *time.Timer }
+	realTicker struct{ t *time.Ticker }
+
+	// FakeClock is the Clock, which time is changed by Advance only. The timers
+	// and the tickers fire, when the time is advanced past their deadlines. It
+	// is intended for tests.
+	FakeClock struct {
+		lock   sync.Mutex
+		now    time.Time
+		timers map[*fakeTimer]struct{}
+	}
+
+	// fakeTimer is the Timer and the Ticker of FakeClock, period is 0 for the timers
+	fakeTimer struct {
+		fc     *FakeClock
+		c      chan time.Time
+		when   time.Time
+		period time.Duration
+	}
+
+	fakeTicker struct {
+		*fakeTimer
+	}
+)
+
+// RealClock is the Clock, which uses the system time
+var RealClock Clock = realClock{}
+
+// SleepClock waits for the duration d of the clock c. It returns false if
+// ctx is closed earlier.
+func SleepClock(ctx context.Context, c Clock, d time.Duration) bool {
+	t := c.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C():
+		return true
+	}
+}
+
+// WaitTick waits for the next tick of t. It returns false if ctx is closed.
+func WaitTick(ctx context.Context, t Ticker) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C():
+		return true
+	}
+}
+
+//=== realClock ===
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+func (rt realTimer) Reset(d time.Duration) bool {
+	return rt.t.Reset(d)
+}
+
+func (rt realTicker) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTicker) Stop() {
+	rt.t.Stop()
+}
+
+//=== FakeClock ===
+
+// NewFakeClock returns the FakeClock, which time is now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, timers: make(map[*fakeTimer]struct{})}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) Timer {
+	return fc.newTimer(d, 0)
+}
+
+// NewTicker returns the ticker, it panics if d <= 0 like time.NewTicker does
+func (fc *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{fc.newTimer(d, d)}
+}
+
+// Advance moves the time forward by d, and fires the timers and the tickers,
+// which deadlines are passed. Like time.Ticker does, a ticker sends one tick
+// only, if several periods are passed, or the previous tick is not received.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.now = fc.now.Add(d)
+	fc.fireUnsafe()
+}
+
+// Timers returns the number of the active timers and tickers. It allows to
+// wait until the code under test starts waiting for the time.
+func (fc *FakeClock) Timers() int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return len(fc.timers)
+}
+
+func (fc *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	ft := &fakeTimer{fc: fc, c: make(chan time.Time, 1), period: period}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	ft.when = fc.now.Add(d)
+	fc.timers[ft] = struct{}{}
+	fc.fireUnsafe()
+	return ft
+}
+
+func (fc *FakeClock) fireUnsafe() {
+	for ft := range fc.timers {
+		if ft.when.After(fc.now) {
+			continue
+		}
+		select {
+		case ft.c <- ft.when:
+		default:
+		}
+		if ft.period == 0 {
+			delete(fc.timers, ft)
+			continue
+		}
+		for !ft.when.After(fc.now) {
+			ft.when = ft.when.Add(ft.period)
+		}
+	}
+}
+
+func (ft *fakeTimer) C() <-chan time.Time {
+	return ft.c
+}
+
+// Stop is the part of Timer interface
+func (ft *fakeTimer) Stop() bool {
+	ft.fc.lock.Lock()
+	defer ft.fc.lock.Unlock()
+	_, ok := ft.fc.timers[ft]
+	delete(ft.fc.timers, ft)
+	return ok
+}
+
+// Stop is the part of Ticker interface
+func (ft fakeTicker) Stop() {
+	ft.fakeTimer.Stop()
+}
+
+// Reset is the part of Timer interface
+func (ft *fakeTimer) Reset(d time.Duration) bool {
+	ft.fc.lock.Lock()
+	defer ft.fc.lock.Unlock()
+	_, ok := ft.fc.timers[ft]
+	ft.when = ft.fc.now.Add(d)
+	ft.fc.timers[ft] = struct{}{}
+	ft.fc.fireUnsafe()
+	return ok
+}
@@ -110,8 +110,19 @@ func SplitString(str string, kvSep, fldSep byte, buf []string) ([]string, error)
 }
 
 // ToMap turns a key-value string into map. For example the string `{ name=app, ccc="ddd" }` will be turned into
-// a map, which equals to map[string]string{"name":"app", "ccc", "ddd"}
+// a map, which equals to map[string]string{"name":"app", "ccc", "ddd"}. If a key is met several times, the last
+// value is kept.
 func ToMap(kvs string) (map[string]string, error) {
+	return toMap(kvs, false)
+}
+
+// ToMapStrict works the same way like ToMap does, but it returns an error if a key is met more than once,
+// e.g. for the string `a=1,a=2`
+func ToMapStrict(kvs string) (map[string]string, error) {
+	return toMap(kvs, true)
+}
+
+func toMap(kvs string, strict bool) (map[string]string, error) {
 	fine, err := RemoveCurlyBraces(kvs)
 	if err != nil {
 		return nil, err
@@ -137,6 +148,9 @@ func ToMap(kvs string) (map[string]string, error) {
 		if len(k) == 0 {
 			return nil, errors.Errorf("tag name (for value=%s) could not be empty: %s", kvs, v)
 		}
+		if _, ok := mp[k]; ok && strict {
+			return nil, errors.Errorf("duplicate tag name \"%s\" in %s", k, kvs)
+		}
 
 		if len(v) > 0 && (v[0] == '"' || v[0] == '`') {
 			v1 := v
@@ -62,6 +62,18 @@ func TestToMap(t *testing.T) {
 	testParseTags(t, "name=-\"app\"", map[string]string{"name": "-\"app\""}, false)
 	testParseTags(t, "name-app", map[string]string{}, true)
 	testParseTags(t, "name=-a\"pp", map[string]string{}, true)
+	testParseTags(t, "a=1,a=2", map[string]string{"a": "2"}, false)
+}
+
+func TestToMapStrict(t *testing.T) {
+	if m, err := ToMapStrict("{a=1, b=2}"); err != nil || !MapsEquals(m, map[string]string{"a": "1", "b": "2"}) {
+		t.Fatal("unexpected m=", m, ", err=", err)
+	}
+	for _, kvs := range []string{"a=1,a=2", "a=1, b=2, a=1", `{a="1,b=2", b = 3, b=3}`} {
+		if _, err := ToMapStrict(kvs); err == nil {
+			t.Fatal("the duplicate key must be reported for ", kvs)
+		}
+	}
 }
 
 func testRemoveCurlyBraces(t *testing.T, in, out string, errOk bool) {
@@ -14,6 +14,12 @@
 
 package utils
 
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
 // RemoveDups returns a slice where every element from ss meets only once
 func RemoveDups(ss []string) []string {
 	j := 0
@@ -28,3 +34,43 @@ func RemoveDups(ss []string) []string {
 	return ss[:j]
 }
 
+// ExpandEnv replaces the ${VAR} placeholders in s by the environment variables values.
+// An error is returned if a variable is not set. The $${ sequence is replaced by ${,
+// what allows to keep the placeholder-like text as is. Other $ symbols are not changed.
+func ExpandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for {
+		idx := strings.Index(s, "${")
+		if idx < 0 {
+			sb.WriteString(s)
+			break
+		}
+
+		if idx > 0 && s[idx-1] == '$' {
+			// escaped, the preceding $ is written as the placeholder one
+			sb.WriteString(s[:idx])
+			sb.WriteString("{")
+			s = s[idx+2:]
+			continue
+		}
+
+		end := strings.IndexByte(s[idx:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("no closing } for the placeholder in %q", s)
+		}
+
+		name := s[idx+2 : idx+end]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("the environment variable %q is not set", name)
+		}
+		sb.WriteString(s[:idx])
+		sb.WriteString(val)
+		s = s[idx+end+1:]
+	}
+	return sb.String(), nil
+}
@@ -16,6 +16,7 @@ package utils
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
@@ -27,3 +28,28 @@ func TestRemoveDups(t *testing.T) {
 	assert.ElementsMatch(t, a, e)
 }
 
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("LR_TEST_EXPAND_ENV", "secret")
+	defer os.Unsetenv("LR_TEST_EXPAND_ENV")
+	os.Unsetenv("LR_TEST_EXPAND_ENV_MISSING")
+
+	for in, exp := range map[string]string{
+		"":                                "",
+		"abc":                             "abc",
+		"$abc":                            "$abc",
+		"${LR_TEST_EXPAND_ENV}":           "secret",
+		"a=${LR_TEST_EXPAND_ENV}, b=$c":   "a=secret, b=$c",
+		"$${LR_TEST_EXPAND_ENV_MISSING}":  "${LR_TEST_EXPAND_ENV_MISSING}",
+		"$${A}${LR_TEST_EXPAND_ENV}$${B}": "${A}secret${B}",
+		"${LR_TEST_EXPAND_ENV}${LR_TEST_EXPAND_ENV}": "secretsecret",
+	} {
+		res, err := ExpandEnv(in)
+		assert.Nil(t, err)
+		assert.Equal(t, exp, res)
+	}
+
+	for _, in := range []string{"${LR_TEST_EXPAND_ENV_MISSING}", "a${LR_TEST_EXPAND_ENV", "${}"} {
+		_, err := ExpandEnv(in)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2018-2019 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// UnmarshalCfg decodes the config data read from the file name to v. The data
+// is YAML if the file has .yaml or .yml extension, and JSON if it has .json
+// extension. Otherwise, the data is JSON if it starts with '{'. The YAML is
+// converted to JSON before it is decoded, so the json struct tags and the
+// json.Unmarshaler implementations are used for both formats.
+func UnmarshalCfg(name string, data []byte, v interface{}) error {
+	if IsYamlCfg(name, data) {
+		return yaml.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// IsYamlCfg returns whether the config data read from the file name is YAML
+// (see UnmarshalCfg)
+func IsYamlCfg(name string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	return !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// ToYamlStr encodes v to a YAML string, the json struct tags are used for the
+// fields names
+func ToYamlStr(v interface{}) string {
+	res, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(res)
+}